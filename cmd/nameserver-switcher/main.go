@@ -7,11 +7,15 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/steigr/nameserver-switcher/internal/acl"
+	"github.com/steigr/nameserver-switcher/internal/cache"
 	"github.com/steigr/nameserver-switcher/internal/config"
 	dnsserver "github.com/steigr/nameserver-switcher/internal/dns"
 	grpcserver "github.com/steigr/nameserver-switcher/internal/grpc"
@@ -19,7 +23,9 @@ import (
 	"github.com/steigr/nameserver-switcher/internal/logging"
 	"github.com/steigr/nameserver-switcher/internal/matcher"
 	"github.com/steigr/nameserver-switcher/internal/metrics"
+	"github.com/steigr/nameserver-switcher/internal/proxyproto"
 	"github.com/steigr/nameserver-switcher/internal/resolver"
+	"github.com/steigr/nameserver-switcher/internal/rrl"
 )
 
 // App holds all the application components.
@@ -31,6 +37,10 @@ type App struct {
 	DNSServer     *dnsserver.Server
 	GRPCServer    *grpcserver.Server
 	HTTPServer    *http.Server
+	Pools         []*resolver.Pool
+
+	snapshotStop chan struct{}
+	snapshotDone chan struct{}
 }
 
 // NewApp creates a new application instance with the given configuration.
@@ -64,16 +74,50 @@ func NewApp(cfg *config.Config) (*App, error) {
 	}
 
 	// Create resolvers
+	upstreamOpts := upstreamOptions(cfg, m)
+	strategy, err := resolver.ParseStrategy(cfg.UpstreamStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every pool reports its upstream circuit states on /healthz
+	var pools []*resolver.Pool
+	newPool := func(addresses, name string, recursive bool) (*resolver.Pool, error) {
+		pool, err := resolver.NewUpstreamPool(addresses, recursive, name, strategy, upstreamOpts)
+		if err != nil {
+			return nil, err
+		}
+		healthChecker.AddCheck("upstream:"+name, pool.HealthCheck)
+		pools = append(pools, pool)
+		return pool, nil
+	}
+
 	var explicitResolver resolver.Resolver
 	if cfg.ExplicitResolver != "" {
-		explicitResolver = resolver.NewDNSResolver(cfg.ExplicitResolver, true, "explicit")
+		explicitResolver, err = newPool(cfg.ExplicitResolver, "explicit", true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create explicit resolver: %w", err)
+		}
 		logging.Infof("Using explicit resolver: %s", cfg.ExplicitResolver)
 	}
 
+	// Probe resolver: queried non-recursively for matched requests
+	var probeResolver resolver.Resolver
+	if cfg.ProbeResolver != "" {
+		probeResolver, err = newPool(cfg.ProbeResolver, "probe", false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create probe resolver: %w", err)
+		}
+		logging.Infof("Using probe resolver: %s", cfg.ProbeResolver)
+	}
+
 	// System resolver: use REQUEST_RESOLVER if configured, otherwise use system /etc/resolv.conf
 	var systemResolver resolver.Resolver
 	if cfg.RequestResolver != "" {
-		systemResolver = resolver.NewDNSResolver(cfg.RequestResolver, true, "system")
+		systemResolver, err = newPool(cfg.RequestResolver, "system", true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create system resolver: %w", err)
+		}
 		logging.Infof("Using configured system resolver: %s", cfg.RequestResolver)
 	} else {
 		sysRes, err := resolver.NewSystemResolver()
@@ -81,14 +125,20 @@ func NewApp(cfg *config.Config) (*App, error) {
 			logging.Warnf("Failed to create system resolver, using fallback: %v", err)
 			sysRes = resolver.NewSystemResolverWithServers([]string{"8.8.8.8:53", "8.8.4.4:53"})
 		}
-		systemResolver = sysRes
+		systemResolver, err = newPool(strings.Join(sysRes.Servers(), ","), "system", true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create system resolver: %w", err)
+		}
 		logging.Infof("Using system resolvers: %v", sysRes.Servers())
 	}
 
 	// Create specialized fallback resolvers, defaulting to systemResolver if not configured
 	var passthroughResolver resolver.Resolver
 	if cfg.PassthroughResolver != "" {
-		passthroughResolver = resolver.NewDNSResolver(cfg.PassthroughResolver, true, "passthrough")
+		passthroughResolver, err = newPool(cfg.PassthroughResolver, "passthrough", true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create passthrough resolver: %w", err)
+		}
 		logging.Infof("Using passthrough resolver: %s", cfg.PassthroughResolver)
 	} else {
 		passthroughResolver = systemResolver
@@ -97,7 +147,10 @@ func NewApp(cfg *config.Config) (*App, error) {
 
 	var noCnameResponseResolver resolver.Resolver
 	if cfg.NoCnameResponseResolver != "" {
-		noCnameResponseResolver = resolver.NewDNSResolver(cfg.NoCnameResponseResolver, true, "no-cname-response")
+		noCnameResponseResolver, err = newPool(cfg.NoCnameResponseResolver, "no-cname-response", true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create no-cname-response resolver: %w", err)
+		}
 		logging.Infof("Using no-cname-response resolver: %s", cfg.NoCnameResponseResolver)
 	} else {
 		noCnameResponseResolver = systemResolver
@@ -106,30 +159,172 @@ func NewApp(cfg *config.Config) (*App, error) {
 
 	var noCnameMatchResolver resolver.Resolver
 	if cfg.NoCnameMatchResolver != "" {
-		noCnameMatchResolver = resolver.NewDNSResolver(cfg.NoCnameMatchResolver, true, "no-cname-match")
+		noCnameMatchResolver, err = newPool(cfg.NoCnameMatchResolver, "no-cname-match", true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create no-cname-match resolver: %w", err)
+		}
 		logging.Infof("Using no-cname-match resolver: %s", cfg.NoCnameMatchResolver)
 	} else {
 		noCnameMatchResolver = systemResolver
 		logging.Info("No-cname-match resolver not configured, using system resolver")
 	}
 
+	// Failure policies and rules may refer to any configured resolver by name
+	namedResolvers := map[string]resolver.Resolver{
+		"explicit":          explicitResolver,
+		"probe":             probeResolver,
+		"system":            systemResolver,
+		"passthrough":       passthroughResolver,
+		"no-cname-response": noCnameResponseResolver,
+		"no-cname-match":    noCnameMatchResolver,
+	}
+
+	// Build per-route failure policies
+	failurePolicies, err := failurePolicies(cfg, namedResolvers)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load custom rules, evaluated before the default rules built from the settings above
+	var rules []resolver.Rule
+	if cfg.RulesFile != "" {
+		rules, err = loadRules(cfg, namedResolvers, newPool)
+		if err != nil {
+			return nil, err
+		}
+		logging.Infof("Loaded %d routing rules from %s", len(rules), cfg.RulesFile)
+	}
+
+	// Create response cache (nil when disabled)
+	responseCache := cache.New(cache.Config{
+		MaxEntries:         cfg.CacheSize,
+		MinTTL:             cfg.CacheMinTTL,
+		MaxTTL:             cfg.CacheMaxTTL,
+		PrefetchHits:       cfg.PrefetchHits,
+		PrefetchPercentage: cfg.PrefetchPercentage,
+		Metrics:            m,
+	})
+
 	// Create router
 	router := resolver.NewRouter(resolver.RouterConfig{
+		Rules:                   rules,
 		RequestMatcher:          requestMatcher,
 		CNAMEMatcher:            cnameMatcher,
 		ExplicitResolver:        explicitResolver,
+		ProbeResolver:           probeResolver,
 		PassthroughResolver:     passthroughResolver,
 		NoCnameResponseResolver: noCnameResponseResolver,
 		NoCnameMatchResolver:    noCnameMatchResolver,
+		FailurePolicies:         failurePolicies,
+		CNAMEMaxDepth:           cfg.CNAMEMaxDepth,
+		Cache:                   responseCache,
+		ServeStale:              cfg.ServeStale,
+		StaleMaxAge:             cfg.StaleMaxAge,
+		StaleAnswerTimeout:      cfg.StaleAnswerTimeout,
+		PrefetchWorkers:         cfg.PrefetchWorkers,
+		DecisionCacheSize:       cfg.RouteCacheSize,
+		Metrics:                 m,
+	})
+
+	// Create client access control lists (nil for listeners without allow or deny lists)
+	aclAction, err := acl.ParseAction(cfg.ACLAction)
+	if err != nil {
+		return nil, err
+	}
+	newACL := func(listener, allow, deny string) (*acl.List, error) {
+		return acl.New(acl.Config{
+			Listener: listener,
+			Allow:    allow,
+			Deny:     deny,
+			Action:   aclAction,
+			LogEvery: cfg.ACLLogEvery,
+			Metrics:  m,
+		})
+	}
+	dnsACL, err := newACL("dns", cfg.DNSAllow, cfg.DNSDeny)
+	if err != nil {
+		return nil, err
+	}
+	dotACL, err := newACL("dot", cfg.DoTAllow, cfg.DoTDeny)
+	if err != nil {
+		return nil, err
+	}
+	dohACL, err := newACL("doh", cfg.DoHAllow, cfg.DoHDeny)
+	if err != nil {
+		return nil, err
+	}
+	grpcACL, err := newACL("grpc", cfg.GRPCAllow, cfg.GRPCDeny)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create PROXY protocol policies for the TCP listeners (nil when disabled)
+	dnsProxyProtocol, err := proxyproto.New(proxyproto.Config{
+		Listener: "dns",
+		Trusted:  cfg.DNSProxyProtocol,
+		Metrics:  m,
+	})
+	if err != nil {
+		return nil, err
+	}
+	grpcProxyProtocol, err := proxyproto.New(proxyproto.Config{
+		Listener: "grpc",
+		Trusted:  cfg.GRPCProxyProtocol,
+		Metrics:  m,
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Create UDP response rate limiter (nil when disabled)
+	rateLimiter, err := rrl.New(rrl.Config{
+		ResponsesPerSecond: cfg.RRLResponsesPerSecond,
+		NoDataPerSecond:    cfg.RRLNoDataPerSecond,
+		NXDomainsPerSecond: cfg.RRLNXDomainsPerSecond,
+		ErrorsPerSecond:    cfg.RRLErrorsPerSecond,
+		IPv4PrefixLen:      cfg.RRLIPv4PrefixLen,
+		IPv6PrefixLen:      cfg.RRLIPv6PrefixLen,
+		Slip:               cfg.RRLSlip,
+		Exempt:             cfg.RRLExempt,
+		Metrics:            m,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the DNS endpoints (DNSListenAddr and DNSPort when none are set)
+	endpoints, err := dnsserver.ParseEndpoints(cfg.DNSListen)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create DNS server
 	dnsServer := dnsserver.NewServer(dnsserver.ServerConfig{
-		Addr:    cfg.DNSListenAddr,
-		Port:    cfg.DNSPort,
-		Router:  router,
-		Metrics: m,
-		Config:  cfg,
+		Addr:            cfg.DNSListenAddr,
+		Port:            cfg.DNSPort,
+		Endpoints:       endpoints,
+		Router:          router,
+		Metrics:         m,
+		Config:          cfg,
+		MaxUDPSize:      cfg.DNSMaxUDPSize,
+		Listeners:       cfg.DNSListeners,
+		MaxInFlight:     cfg.DNSMaxInFlight,
+		MaxQueued:       cfg.DNSMaxQueued,
+		QueueTimeout:    cfg.DNSQueueTimeout,
+		ShedRcode:       dns.StringToRcode[strings.ToUpper(strings.TrimSpace(cfg.DNSShedRcode))],
+		RequestTimeout:  cfg.DNSRequestTimeout,
+		TLSPort:         cfg.DoTPort,
+		TLSCertFile:     cfg.DoTCertFile,
+		TLSKeyFile:      cfg.DoTKeyFile,
+		TLSClientCAFile: cfg.DoTClientCAFile,
+		DoHPort:         cfg.DoHPort,
+		DoHCertFile:     cfg.DoHCertFile,
+		DoHKeyFile:      cfg.DoHKeyFile,
+		ACL:             dnsACL,
+		TLSACL:          dotACL,
+		DoHACL:          dohACL,
+		RateLimiter:     rateLimiter,
+		ProxyProtocol:   dnsProxyProtocol,
 	})
 
 	// Create gRPC server
@@ -143,6 +338,8 @@ func NewApp(cfg *config.Config) (*App, error) {
 		CNAMEMatcher:     cnameMatcher,
 		RequestResolver:  cfg.RequestResolver,
 		ExplicitResolver: cfg.ExplicitResolver,
+		QueryACL:         grpcACL,
+		ProxyProtocol:    grpcProxyProtocol,
 	})
 
 	// Create HTTP server for health and metrics
@@ -151,6 +348,9 @@ func NewApp(cfg *config.Config) (*App, error) {
 	httpMux.HandleFunc("/readyz", healthChecker.ReadyHandler())
 	httpMux.HandleFunc("/livez", healthChecker.LiveHandler())
 	httpMux.Handle("/metrics", promhttp.Handler())
+	if cfg.DoH {
+		httpMux.Handle(dnsserver.DoHPath, dnsServer.DoHHandler())
+	}
 
 	httpServer := &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", cfg.HTTPListenAddr, cfg.HTTPPort),
@@ -165,13 +365,155 @@ func NewApp(cfg *config.Config) (*App, error) {
 		DNSServer:     dnsServer,
 		GRPCServer:    grpcServer,
 		HTTPServer:    httpServer,
+		Pools:         pools,
 	}, nil
 }
 
+// upstreamOptions builds the transport options shared by all upstream resolvers.
+func upstreamOptions(cfg *config.Config, m *metrics.Metrics) resolver.UpstreamOptions {
+	return resolver.UpstreamOptions{
+		TLS: resolver.TLSOptions{
+			ServerName: cfg.UpstreamTLSServerName,
+			CAFile:     cfg.UpstreamTLSCAFile,
+			CertFile:   cfg.UpstreamTLSCertFile,
+			KeyFile:    cfg.UpstreamTLSKeyFile,
+		},
+		Timeout:   cfg.UpstreamTimeout,
+		DoHMethod: cfg.UpstreamDoHMethod,
+		UDPSize:   uint16(cfg.UpstreamUDPSize),
+		Metrics:   m,
+		Breaker: resolver.BreakerConfig{
+			FailureThreshold: cfg.UpstreamFailureThreshold,
+			OpenDuration:     cfg.UpstreamOpenDuration,
+		},
+		ProbeInterval: cfg.UpstreamProbeInterval,
+	}
+}
+
+// failurePolicies parses the per-route failure policies from the configuration.
+func failurePolicies(cfg *config.Config, resolvers map[string]resolver.Resolver) (map[string]resolver.FailurePolicy, error) {
+	failureRcodes, err := resolver.ParseRcodes(cfg.FailureRcodes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid failure rcodes: %w", err)
+	}
+
+	specs := map[string]string{
+		resolver.RouteExplicit:        cfg.ExplicitFailurePolicy,
+		resolver.RoutePassthrough:     cfg.PassthroughFailurePolicy,
+		resolver.RouteNoCnameResponse: cfg.NoCnameResponseFailurePolicy,
+		resolver.RouteNoCnameMatch:    cfg.NoCnameMatchFailurePolicy,
+	}
+
+	policies := make(map[string]resolver.FailurePolicy, len(specs))
+	for route, spec := range specs {
+		policy, err := resolver.ParseFailurePolicy(spec, resolvers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s failure policy: %w", route, err)
+		}
+		policies[route] = withFailureRcodes(policy, failureRcodes)
+	}
+	return policies, nil
+}
+
+// withFailureRcodes makes policy handle upstream answers with one of rcodes like
+// errors. The error policy keeps them: they reach the client unchanged instead of
+// turning into SERVFAIL.
+func withFailureRcodes(policy resolver.FailurePolicy, rcodes []int) resolver.FailurePolicy {
+	if policy.Action != resolver.FailureActionError {
+		policy.FailureRcodes = rcodes
+	}
+	return policy
+}
+
+// loadRules builds the routing rules from the rules file. Resolver fields name a
+// configured resolver or list upstream addresses, which get a pool of their own;
+// probe pools query non-recursively.
+func loadRules(cfg *config.Config, resolvers map[string]resolver.Resolver, newPool func(addresses, name string, recursive bool) (*resolver.Pool, error)) ([]resolver.Rule, error) {
+	ruleConfigs, err := config.LoadRules(cfg.RulesFile)
+	if err != nil {
+		return nil, err
+	}
+	failureRcodes, err := resolver.ParseRcodes(cfg.FailureRcodes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid failure rcodes: %w", err)
+	}
+
+	rules := make([]resolver.Rule, 0, len(ruleConfigs))
+	for _, rc := range ruleConfigs {
+		rule := resolver.Rule{Name: rc.Name}
+
+		if len(rc.RequestPatterns) > 0 {
+			if rule.RequestMatcher, err = matcher.NewRegexMatcher(rc.RequestPatterns); err != nil {
+				return nil, fmt.Errorf("failed to create request matcher for rule %s: %w", rc.Name, err)
+			}
+		}
+		if len(rc.CNAMEPatterns) > 0 {
+			if rule.CNAMEMatcher, err = matcher.NewRegexMatcher(rc.CNAMEPatterns); err != nil {
+				return nil, fmt.Errorf("failed to create CNAME matcher for rule %s: %w", rc.Name, err)
+			}
+		}
+
+		ruleResolver := func(spec, slot string) (resolver.Resolver, error) {
+			if spec == "" {
+				return nil, nil
+			}
+			if named, ok := resolvers[spec]; ok {
+				if named == nil {
+					return nil, fmt.Errorf("rule %s: %s resolver %q is not configured", rc.Name, slot, spec)
+				}
+				return named, nil
+			}
+			pool, err := newPool(spec, rc.Name+"/"+slot, slot != "probe")
+			if err != nil {
+				return nil, fmt.Errorf("failed to create %s resolver for rule %s: %w", slot, rc.Name, err)
+			}
+			return pool, nil
+		}
+		if rule.ProbeResolver, err = ruleResolver(rc.ProbeResolver, "probe"); err != nil {
+			return nil, err
+		}
+		if rule.TargetResolver, err = ruleResolver(rc.TargetResolver, "target"); err != nil {
+			return nil, err
+		}
+		if rule.NoCnameResponseResolver, err = ruleResolver(rc.NoCnameResponseResolver, "no-cname-response"); err != nil {
+			return nil, err
+		}
+		if rule.NoCnameMatchResolver, err = ruleResolver(rc.NoCnameMatchResolver, "no-cname-match"); err != nil {
+			return nil, err
+		}
+
+		policy, err := resolver.ParseFailurePolicy(rc.FailurePolicy, resolvers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid failure policy for rule %s: %w", rc.Name, err)
+		}
+		policy = withFailureRcodes(policy, failureRcodes)
+		rule.FailurePolicies = map[string]resolver.FailurePolicy{
+			resolver.RouteExplicit:        policy,
+			resolver.RoutePassthrough:     policy,
+			resolver.RouteNoCnameResponse: policy,
+			resolver.RouteNoCnameMatch:    policy,
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
 // Start starts all the application servers.
 func (a *App) Start() error {
 	logging.Info("Starting nameserver-switcher...")
 
+	// Start upstream health probes
+	for _, pool := range a.Pools {
+		pool.StartProbing()
+	}
+
+	// Warm the caches from the last snapshot
+	a.startSnapshots()
+
+	// Start refreshing popular cached answers
+	a.Router.StartPrefetching()
+
 	// Start DNS server
 	if err := a.DNSServer.Start(); err != nil {
 		return fmt.Errorf("failed to start DNS server: %w", err)
@@ -227,6 +569,13 @@ func (a *App) Shutdown(ctx context.Context) error {
 		shutdownErr = err
 	}
 
+	a.Router.StopPrefetching()
+	a.stopSnapshots()
+
+	for _, pool := range a.Pools {
+		pool.StopProbing()
+	}
+
 	if shutdownErr != nil {
 		return fmt.Errorf("shutdown completed with errors: %w", shutdownErr)
 	}
@@ -235,6 +584,61 @@ func (a *App) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// startSnapshots restores cached answers from the snapshot file and saves them
+// every SnapshotInterval. Unusable snapshots are ignored.
+func (a *App) startSnapshots() {
+	path := a.Config.SnapshotFile
+	if path == "" {
+		return
+	}
+
+	n, err := a.Router.LoadSnapshot(path)
+	if err != nil {
+		logging.Warnf("Ignoring snapshot %s: %v", path, err)
+	} else if n > 0 {
+		logging.Infof("Restored %d cached answers from %s", n, path)
+	}
+
+	if a.Config.SnapshotInterval <= 0 || a.snapshotStop != nil {
+		return
+	}
+	a.snapshotStop = make(chan struct{})
+	a.snapshotDone = make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(a.Config.SnapshotInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := a.Router.SaveSnapshot(path); err != nil {
+					logging.Errorf("Snapshot failed: %v", err)
+				}
+			}
+		}
+	}(a.snapshotStop, a.snapshotDone)
+}
+
+// stopSnapshots stops periodic snapshots and saves a final one.
+func (a *App) stopSnapshots() {
+	if a.snapshotStop != nil {
+		close(a.snapshotStop)
+		<-a.snapshotDone
+		a.snapshotStop = nil
+		a.snapshotDone = nil
+	}
+
+	if path := a.Config.SnapshotFile; path != "" {
+		if err := a.Router.SaveSnapshot(path); err != nil {
+			logging.Errorf("Snapshot failed: %v", err)
+		}
+	}
+}
+
 // Run starts the application and waits for a shutdown signal.
 func (a *App) Run() error {
 	if err := a.Start(); err != nil {
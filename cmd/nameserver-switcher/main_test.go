@@ -5,12 +5,16 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/steigr/nameserver-switcher/internal/config"
+	"github.com/steigr/nameserver-switcher/internal/resolver"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -125,6 +129,280 @@ func TestNewApp(t *testing.T) {
 		assert.NotNil(t, app)
 	})
 
+	t.Run("TLSResolvers", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.RequestPatterns = []string{`.*\.example\.com$`}
+		cfg.ExplicitResolver = "tls://1.1.1.1:853?servername=cloudflare-dns.com"
+		cfg.PassthroughResolver = "tls://9.9.9.9"
+
+		app, err := NewApp(cfg)
+		require.NoError(t, err)
+		assert.NotNil(t, app)
+	})
+
+	t.Run("DoHResolvers", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.RequestPatterns = []string{`.*\.example\.com$`}
+		cfg.ExplicitResolver = "https://cloudflare-dns.com/dns-query"
+		cfg.PassthroughResolver = "https://dns.google"
+		cfg.UpstreamDoHMethod = "GET"
+
+		app, err := NewApp(cfg)
+		require.NoError(t, err)
+		assert.NotNil(t, app)
+	})
+
+	t.Run("TCPResolvers", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.ExplicitResolver = "tcp://1.1.1.1"
+		cfg.PassthroughResolver = "8.8.8.8"
+		cfg.UpstreamUDPSize = 4096
+
+		app, err := NewApp(cfg)
+		require.NoError(t, err)
+		assert.NotNil(t, app)
+	})
+
+	t.Run("ResolverPools", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.RequestPatterns = []string{`.*\.example\.com$`}
+		cfg.ExplicitResolver = "tls://1.1.1.1,tls://9.9.9.9"
+		cfg.PassthroughResolver = "8.8.8.8, 8.8.4.4"
+		cfg.UpstreamStrategy = "lowest_latency"
+
+		app, err := NewApp(cfg)
+		require.NoError(t, err)
+		assert.NotNil(t, app)
+	})
+
+	t.Run("UpstreamHealthChecks", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.RequestResolver = testGoogleDNS
+		cfg.ExplicitResolver = "tls://1.1.1.1,tls://9.9.9.9"
+		cfg.UpstreamFailureThreshold = 3
+		cfg.UpstreamOpenDuration = 10 * time.Second
+
+		app, err := NewApp(cfg)
+		require.NoError(t, err)
+		assert.Len(t, app.Pools, 2)
+
+		checks := app.HealthChecker.RunChecks()
+		assert.Contains(t, checks, "upstream:explicit")
+		assert.Contains(t, checks, "upstream:system")
+		assert.NoError(t, checks["upstream:explicit"])
+	})
+
+	t.Run("FailurePolicies", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.RequestPatterns = []string{`.*\.example\.com$`}
+		cfg.RequestResolver = testGoogleDNS
+		cfg.ExplicitResolver = testCloudflareDNS
+		cfg.ExplicitFailurePolicy = "fallback:system"
+		cfg.PassthroughFailurePolicy = "stale"
+		cfg.NoCnameResponseFailurePolicy = "rcode:REFUSED"
+		cfg.NoCnameMatchFailurePolicy = "retry:2:50ms"
+		cfg.FailureRcodes = "SERVFAIL,REFUSED"
+
+		app, err := NewApp(cfg)
+		require.NoError(t, err)
+		assert.NotNil(t, app)
+
+		// Routes returning errors pass upstream answers with failure rcodes through
+		cfg.ExplicitFailurePolicy = "error"
+		policies, err := failurePolicies(cfg, nil)
+		require.NoError(t, err)
+		assert.Empty(t, policies[resolver.RouteExplicit].FailureRcodes)
+		assert.Equal(t, []int{dns.RcodeServerFailure, dns.RcodeRefused}, policies[resolver.RouteNoCnameMatch].FailureRcodes)
+	})
+
+	t.Run("RulesFile", func(t *testing.T) {
+		rulesFile := filepath.Join(t.TempDir(), "rules.json")
+		require.NoError(t, os.WriteFile(rulesFile, []byte(`{"rules": [
+			{"name": "corp", "request_patterns": [".*\\.corp\\.example$"], "target_resolver": "10.0.0.53:53", "failure_policy": "fallback:system"},
+			{"name": "partner", "request_patterns": [".*\\.partner\\.example$"], "probe_resolver": "system", "target_resolver": "10.1.0.53:53", "no_cname_response_resolver": "system"}
+		]}`), 0o600))
+
+		cfg := getTestConfig(t)
+		cfg.RequestResolver = testGoogleDNS
+		cfg.RulesFile = rulesFile
+		cfg.FailureRcodes = "SERVFAIL,REFUSED"
+
+		app, err := NewApp(cfg)
+		require.NoError(t, err)
+
+		rules := app.Router.Rules()
+		require.Len(t, rules, 4)
+		assert.Equal(t, "corp", rules[0].Name)
+		assert.Equal(t, "corp/target", rules[0].TargetResolver.Name())
+		assert.Equal(t, []int{dns.RcodeServerFailure, dns.RcodeRefused}, rules[0].FailurePolicies[resolver.RouteExplicit].FailureRcodes)
+		assert.Equal(t, "partner", rules[1].Name)
+		assert.Equal(t, "system", rules[1].ProbeResolver.Name())
+		assert.Empty(t, rules[1].FailurePolicies[resolver.RouteExplicit].FailureRcodes, "the error policy keeps failure rcodes")
+		assert.Equal(t, resolver.RuleDefault, rules[2].Name)
+		assert.Equal(t, resolver.RulePassthrough, rules[3].Name)
+	})
+
+	t.Run("ProbeResolver", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.RequestPatterns = []string{`.*\.example\.com$`}
+		cfg.ExplicitResolver = testCloudflareDNS
+		cfg.ProbeResolver = testGoogleDNS
+
+		app, err := NewApp(cfg)
+		require.NoError(t, err)
+
+		rules := app.Router.Rules()
+		require.NotEmpty(t, rules)
+		assert.Equal(t, resolver.RuleDefault, rules[0].Name)
+		assert.Equal(t, "probe", rules[0].ProbeResolver.Name())
+		assert.Equal(t, "explicit", rules[0].TargetResolver.Name())
+	})
+
+	t.Run("InvalidRulesFile", func(t *testing.T) {
+		rulesFile := filepath.Join(t.TempDir(), "rules.json")
+		require.NoError(t, os.WriteFile(rulesFile, []byte(`{"rules": [{"name": "corp", "target_resolver": "explicit"}]}`), 0o600))
+
+		cfg := getTestConfig(t)
+		cfg.RulesFile = rulesFile
+
+		app, err := NewApp(cfg)
+		assert.Error(t, err)
+		assert.Nil(t, app)
+		assert.Contains(t, err.Error(), `target resolver "explicit" is not configured`)
+	})
+
+	t.Run("InvalidFailurePolicy", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.ExplicitFailurePolicy = "fallback:explicit"
+
+		app, err := NewApp(cfg)
+		assert.Error(t, err)
+		assert.Nil(t, app)
+		assert.Contains(t, err.Error(), "invalid explicit failure policy")
+	})
+
+	t.Run("InvalidFailureRcodes", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.FailureRcodes = "SERVFAIL,SOMETIMES"
+
+		app, err := NewApp(cfg)
+		assert.Error(t, err)
+		assert.Nil(t, app)
+		assert.Contains(t, err.Error(), "invalid failure rcodes")
+	})
+
+	t.Run("InvalidUpstreamStrategy", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.UpstreamStrategy = "fastest"
+
+		app, err := NewApp(cfg)
+		assert.Error(t, err)
+		assert.Nil(t, app)
+		assert.Contains(t, err.Error(), "unknown upstream strategy")
+	})
+
+	t.Run("AccessControlLists", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.DNSAllow = "10.0.0.0/8"
+		cfg.GRPCDeny = "192.0.2.0/24"
+		cfg.ACLAction = "drop"
+
+		app, err := NewApp(cfg)
+		require.NoError(t, err)
+		assert.NotNil(t, app)
+	})
+
+	t.Run("InvalidAccessControlList", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.DoTDeny = "10.0.0.0/40"
+
+		app, err := NewApp(cfg)
+		assert.Error(t, err)
+		assert.Nil(t, app)
+		assert.Contains(t, err.Error(), "invalid dot deny list")
+	})
+
+	t.Run("RateLimiting", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.RRLResponsesPerSecond = 20
+		cfg.RRLExempt = "10.0.0.0/8"
+
+		app, err := NewApp(cfg)
+		require.NoError(t, err)
+		assert.NotNil(t, app)
+	})
+
+	t.Run("InvalidRateLimitExemptions", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.RRLResponsesPerSecond = 20
+		cfg.RRLExempt = "10.0.0.0/8,somewhere"
+
+		app, err := NewApp(cfg)
+		assert.Error(t, err)
+		assert.Nil(t, app)
+		assert.Contains(t, err.Error(), "invalid RRL exempt list")
+	})
+
+	t.Run("DNSEndpoints", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.DNSListen = "127.0.0.1:15353, local=[::1]:15353/udp"
+
+		app, err := NewApp(cfg)
+		require.NoError(t, err)
+		assert.Equal(t, "127.0.0.1:15353, [::1]:15353", app.DNSServer.Addr())
+	})
+
+	t.Run("InvalidDNSEndpoints", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.DNSListen = "127.0.0.1:15353/quic"
+
+		app, err := NewApp(cfg)
+		assert.Error(t, err)
+		assert.Nil(t, app)
+		assert.Contains(t, err.Error(), "invalid DNS listener")
+	})
+
+	t.Run("ProxyProtocol", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.DNSProxyProtocol = "10.0.0.0/8"
+		cfg.GRPCProxyProtocol = "10.0.0.1"
+
+		app, err := NewApp(cfg)
+		require.NoError(t, err)
+		assert.NotNil(t, app)
+	})
+
+	t.Run("InvalidProxyProtocol", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.GRPCProxyProtocol = "load-balancer"
+
+		app, err := NewApp(cfg)
+		assert.Error(t, err)
+		assert.Nil(t, app)
+		assert.Contains(t, err.Error(), "invalid grpc PROXY protocol trusted list")
+	})
+
+	t.Run("InvalidResolverAddress", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.ExplicitResolver = "quic://1.1.1.1"
+
+		app, err := NewApp(cfg)
+		assert.Error(t, err)
+		assert.Nil(t, app)
+		assert.Contains(t, err.Error(), "explicit resolver")
+	})
+
+	t.Run("InvalidUpstreamTLSSettings", func(t *testing.T) {
+		cfg := getTestConfig(t)
+		cfg.NoCnameMatchResolver = "tls://1.1.1.1"
+		cfg.UpstreamTLSCAFile = "/nonexistent/ca.pem"
+
+		app, err := NewApp(cfg)
+		assert.Error(t, err)
+		assert.Nil(t, app)
+		assert.Contains(t, err.Error(), "no-cname-match resolver")
+	})
+
 	t.Run("MultiplePatterns", func(t *testing.T) {
 		cfg := getTestConfig(t)
 		cfg.RequestPatterns = []string{
@@ -155,6 +433,8 @@ func TestApp_StartAndShutdown(t *testing.T) {
 	cfg.CNAMEPatterns = []string{`.*\.cdn\.com$`}
 	cfg.RequestResolver = testGoogleDNS
 	cfg.ExplicitResolver = testCloudflareDNS
+	cfg.UpstreamFailureThreshold = 3
+	cfg.UpstreamProbeInterval = 50 * time.Millisecond
 
 	app, err := NewApp(cfg)
 	require.NoError(t, err)
@@ -182,6 +462,38 @@ func TestApp_StartAndShutdown(t *testing.T) {
 	assert.False(t, app.HealthChecker.IsReady())
 }
 
+// TestApp_Snapshot tests that cached answers are saved on shutdown and restored on start.
+func TestApp_Snapshot(t *testing.T) {
+	testMutex.Lock()
+	defer testMutex.Unlock()
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	cfg := getTestConfig(t)
+	cfg.PassthroughResolver = testGoogleDNS
+	cfg.CacheSize = 100
+	cfg.SnapshotFile = path
+	cfg.SnapshotInterval = time.Hour
+
+	app, err := NewApp(cfg)
+	require.NoError(t, err)
+	require.NoError(t, app.Start())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, app.Shutdown(ctx))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"version":1`)
+
+	// A corrupt snapshot does not prevent the start
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+	app, err = NewApp(cfg)
+	require.NoError(t, err)
+	require.NoError(t, app.Start())
+	require.NoError(t, app.Shutdown(ctx))
+}
+
 // TestApp_HTTPEndpoints tests the HTTP endpoints.
 func TestApp_HTTPEndpoints(t *testing.T) {
 	testMutex.Lock()
@@ -190,6 +502,7 @@ func TestApp_HTTPEndpoints(t *testing.T) {
 	cfg := getTestConfig(t)
 	cfg.RequestPatterns = []string{`.*\.example\.com$`}
 	cfg.CNAMEPatterns = []string{`.*\.cdn\.com$`}
+	cfg.DoH = true
 
 	app, err := NewApp(cfg)
 	require.NoError(t, err)
@@ -238,6 +551,13 @@ func TestApp_HTTPEndpoints(t *testing.T) {
 		require.NoError(t, err)
 		assert.Contains(t, string(body), "go_")
 	})
+
+	t.Run("dns-query", func(t *testing.T) {
+		resp, err := http.Get(baseURL + "/dns-query")
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
 }
 
 // TestApp_StartWithPortConflict tests that starting with conflicting ports fails.
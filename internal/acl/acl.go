@@ -0,0 +1,192 @@
+// Package acl provides client access control lists for the query frontends.
+package acl
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"github.com/steigr/nameserver-switcher/internal/logging"
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+)
+
+// Action is what a frontend does with a query from a denied client.
+type Action int
+
+const (
+	// Refuse answers denied queries with REFUSED.
+	Refuse Action = iota
+	// Drop does not answer denied queries.
+	Drop
+)
+
+// String returns the name of the action.
+func (a Action) String() string {
+	if a == Drop {
+		return "drop"
+	}
+	return "refuse"
+}
+
+// ParseAction parses an action name: refuse (the default when empty) or drop.
+func ParseAction(s string) (Action, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "refuse":
+		return Refuse, nil
+	case "drop":
+		return Drop, nil
+	default:
+		return Refuse, fmt.Errorf("invalid ACL action %q: must be refuse or drop", s)
+	}
+}
+
+// Config holds configuration for an access control list.
+type Config struct {
+	// Listener names the frontend in metrics and logs (e.g. dns, dot, doh, grpc).
+	Listener string
+	// Allow is a comma-separated list of client CIDRs or addresses. When set, only
+	// matching clients may query.
+	Allow string
+	// Deny is a comma-separated list of client CIDRs or addresses that may not query,
+	// even when they are allowed.
+	Deny string
+	// Action is what happens to denied queries.
+	Action Action
+	// LogEvery logs one in every LogEvery denied queries (0 disables logging).
+	LogEvery int
+	Metrics  *metrics.Metrics
+}
+
+// List allows or denies clients by address.
+type List struct {
+	listener string
+	allow    []netip.Prefix
+	deny     []netip.Prefix
+	action   Action
+	logEvery uint64
+	metrics  *metrics.Metrics
+	denied   atomic.Uint64
+}
+
+// New creates an access control list. It returns nil, which allows every client,
+// when neither Allow nor Deny is set.
+func New(cfg Config) (*List, error) {
+	allow, err := ParsePrefixes(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s allow list: %w", cfg.Listener, err)
+	}
+	deny, err := ParsePrefixes(cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s deny list: %w", cfg.Listener, err)
+	}
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	l := &List{
+		listener: cfg.Listener,
+		allow:    allow,
+		deny:     deny,
+		action:   cfg.Action,
+		metrics:  cfg.Metrics,
+	}
+	if cfg.LogEvery > 0 {
+		l.logEvery = uint64(cfg.LogEvery)
+	}
+	return l, nil
+}
+
+// ParsePrefixes parses a comma-separated list of CIDRs or addresses. Addresses are
+// single-host prefixes.
+func ParsePrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if strings.Contains(s, "/") {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", s)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// Action returns what happens to denied queries.
+func (l *List) Action() Action {
+	if l == nil {
+		return Refuse
+	}
+	return l.action
+}
+
+// Allowed reports whether the client at addr may query: it must not match the deny
+// list and, when an allow list is set, must match it. Denied queries are counted and
+// logged at the configured sample rate. A nil List allows every client.
+func (l *List) Allowed(addr net.Addr) bool {
+	if l == nil {
+		return true
+	}
+
+	client, ok := ClientAddr(addr)
+	if ok && !contains(l.deny, client) && (len(l.allow) == 0 || contains(l.allow, client)) {
+		return true
+	}
+	// Clients without a usable address are only let through when no allow list is set
+	if !ok && len(l.allow) == 0 {
+		return true
+	}
+
+	if l.metrics != nil {
+		l.metrics.RecordACLDenied(l.listener, l.action.String())
+	}
+	n := l.denied.Add(1)
+	if l.logEvery > 0 && (n-1)%l.logEvery == 0 {
+		logging.Warnf("Denied %s query from %s (action: %s, %d denied so far)", l.listener, addr, l.action, n)
+	}
+	return false
+}
+
+// ClientAddr returns the IP address of a client, with IPv4-mapped IPv6 addresses
+// unmapped.
+func ClientAddr(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	case nil:
+		return netip.Addr{}, false
+	default:
+		addrPort, err := netip.ParseAddrPort(a.String())
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		return addrPort.Addr().Unmap(), true
+	}
+	client, ok := netip.AddrFromSlice(ip)
+	return client.Unmap(), ok
+}
+
+// contains reports whether any of prefixes contains addr.
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package acl
+
+import (
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+)
+
+func udpAddr(ip string) net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: 12345}
+}
+
+func TestParseAction(t *testing.T) {
+	tests := []struct {
+		input       string
+		expected    Action
+		expectError bool
+	}{
+		{input: "", expected: Refuse},
+		{input: "refuse", expected: Refuse},
+		{input: " DROP ", expected: Drop},
+		{input: "reject", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			action, err := ParseAction(tt.input)
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, action)
+		})
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := ParsePrefixes("10.0.0.0/8, 192.0.2.7,,2001:db8::/32, 172.16.5.1/12")
+	require.NoError(t, err)
+	require.Len(t, prefixes, 4)
+	assert.Equal(t, "10.0.0.0/8", prefixes[0].String())
+	assert.Equal(t, "192.0.2.7/32", prefixes[1].String())
+	assert.Equal(t, "2001:db8::/32", prefixes[2].String())
+	assert.Equal(t, "172.16.0.0/12", prefixes[3].String(), "host bits are masked")
+
+	_, err = ParsePrefixes("10.0.0.0/33")
+	assert.Error(t, err)
+	_, err = ParsePrefixes("example.com")
+	assert.Error(t, err)
+}
+
+func TestNew(t *testing.T) {
+	l, err := New(Config{Listener: "dns"})
+	require.NoError(t, err)
+	assert.Nil(t, l, "no lists allow every client")
+	assert.True(t, l.Allowed(udpAddr("192.0.2.1")))
+	assert.Equal(t, Refuse, l.Action())
+
+	_, err = New(Config{Listener: "dns", Allow: "not-an-address"})
+	assert.ErrorContains(t, err, "dns allow list")
+	_, err = New(Config{Listener: "grpc", Deny: "10.0.0.0/99"})
+	assert.ErrorContains(t, err, "grpc deny list")
+}
+
+func TestList_Allowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   string
+		deny    string
+		addr    net.Addr
+		allowed bool
+	}{
+		{name: "allow list match", allow: "10.0.0.0/8", addr: udpAddr("10.1.2.3"), allowed: true},
+		{name: "allow list miss", allow: "10.0.0.0/8", addr: udpAddr("192.0.2.1"), allowed: false},
+		{name: "deny list match", deny: "192.0.2.0/24", addr: udpAddr("192.0.2.1"), allowed: false},
+		{name: "deny list miss", deny: "192.0.2.0/24", addr: udpAddr("198.51.100.1"), allowed: true},
+		{name: "deny wins over allow", allow: "10.0.0.0/8", deny: "10.0.0.1", addr: udpAddr("10.0.0.1"), allowed: false},
+		{name: "tcp client", allow: "2001:db8::/32", addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 853}, allowed: true},
+		{name: "ipv4-mapped client", allow: "10.0.0.0/8", addr: udpAddr("::ffff:10.0.0.1"), allowed: true},
+		{name: "other address type", allow: "127.0.0.0/8", addr: &net.UnixAddr{Name: "127.0.0.1:53"}, allowed: true},
+		{name: "unknown client with allow list", allow: "10.0.0.0/8", addr: nil, allowed: false},
+		{name: "unknown client with deny list", deny: "10.0.0.0/8", addr: nil, allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := New(Config{Listener: "dns", Allow: tt.allow, Deny: tt.deny})
+			require.NoError(t, err)
+			assert.Equal(t, tt.allowed, l.Allowed(tt.addr))
+		})
+	}
+}
+
+func TestList_DeniedMetrics(t *testing.T) {
+	m := metrics.NewMetrics("test_acl")
+	l, err := New(Config{Listener: "doh", Deny: "192.0.2.0/24", Action: Drop, LogEvery: 2, Metrics: m})
+	require.NoError(t, err)
+	assert.Equal(t, Drop, l.Action())
+
+	for i := 0; i < 3; i++ {
+		assert.False(t, l.Allowed(udpAddr("192.0.2.1")))
+	}
+	assert.True(t, l.Allowed(udpAddr("198.51.100.1")))
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.ACLDenied.WithLabelValues("doh", "drop")))
+	assert.Equal(t, uint64(3), l.denied.Load())
+}
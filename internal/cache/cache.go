@@ -0,0 +1,470 @@
+// Package cache provides a sharded, size-bounded DNS response cache.
+package cache
+
+import (
+	"container/list"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+)
+
+const (
+	// defaultShards is the number of shards when none is configured.
+	defaultShards = 16
+	// defaultPrefetchPercentage is the share of the TTL left when popular entries are refreshed.
+	defaultPrefetchPercentage = 10
+	// metricsLabel identifies the response cache in cache metrics.
+	metricsLabel = "response"
+)
+
+// Config holds configuration for a Cache.
+type Config struct {
+	// MaxEntries bounds the number of cached responses (0 disables caching).
+	MaxEntries int
+	// Shards is the number of independently locked LRU shards (default 16).
+	Shards int
+	// MinTTL and MaxTTL clamp the TTLs of cached responses (0 leaves them unclamped).
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// PrefetchHits is how often an entry must be hit during its lifetime to be
+	// refreshed ahead of expiry (0 disables refresh-ahead).
+	PrefetchHits int
+	// PrefetchPercentage is the share of the TTL left when entries are refreshed (default 10).
+	PrefetchPercentage int
+	// Metrics records hits, misses and evictions.
+	Metrics *metrics.Metrics
+}
+
+// Key identifies a cached response: the question, the DO bit and the routing outcome.
+type Key struct {
+	Name   string
+	Qtype  uint16
+	Qclass uint16
+	DO     bool
+	Route  string
+}
+
+// KeyFor returns the cache key for a request routed by route.
+func KeyFor(req *dns.Msg, route string) (Key, bool) {
+	if len(req.Question) == 0 {
+		return Key{}, false
+	}
+	q := req.Question[0]
+	key := Key{Name: strings.ToLower(q.Name), Qtype: q.Qtype, Qclass: q.Qclass, Route: route}
+	if opt := req.IsEdns0(); opt != nil {
+		key.DO = opt.Do()
+	}
+	return key, true
+}
+
+// Cache is a sharded LRU cache of DNS responses that honours record TTLs and
+// caches negative answers for the SOA minimum (RFC 2308).
+type Cache struct {
+	shards             []*shard
+	maxEntries         int
+	minTTL             uint32
+	maxTTL             uint32
+	prefetchHits       int
+	prefetchPercentage int
+	metrics            *metrics.Metrics
+	now                func() time.Time
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// shard is an LRU list of entries guarded by its own lock.
+type shard struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[Key]*list.Element
+	lru        *list.List
+}
+
+// entry is a cached response with its routing metadata and popularity.
+type entry struct {
+	key         Key
+	msg         *dns.Msg
+	meta        any
+	stored      time.Time
+	expires     time.Time
+	hits        int
+	prefetching bool
+}
+
+// New creates a Cache with the given configuration. It returns nil, a valid
+// disabled cache, when MaxEntries is not positive.
+func New(cfg Config) *Cache {
+	if cfg.MaxEntries <= 0 {
+		return nil
+	}
+
+	shards := cfg.Shards
+	if shards <= 0 {
+		shards = defaultShards
+	}
+	if shards > cfg.MaxEntries {
+		shards = cfg.MaxEntries
+	}
+	perShard := (cfg.MaxEntries + shards - 1) / shards
+
+	prefetchPercentage := cfg.PrefetchPercentage
+	if prefetchPercentage <= 0 {
+		prefetchPercentage = defaultPrefetchPercentage
+	}
+
+	c := &Cache{
+		shards:             make([]*shard, shards),
+		maxEntries:         cfg.MaxEntries,
+		minTTL:             uint32(cfg.MinTTL / time.Second),
+		maxTTL:             uint32(cfg.MaxTTL / time.Second),
+		prefetchHits:       cfg.PrefetchHits,
+		prefetchPercentage: prefetchPercentage,
+		metrics:            cfg.Metrics,
+		now:                time.Now,
+	}
+	for i := range c.shards {
+		c.shards[i] = &shard{
+			maxEntries: perShard,
+			entries:    make(map[Key]*list.Element),
+			lru:        list.New(),
+		}
+	}
+	return c
+}
+
+// Get returns a copy of the cached response for key, answering req, with TTLs
+// decremented by the time spent in the cache, and the metadata stored with it.
+func (c *Cache) Get(key Key, req *dns.Msg) (*dns.Msg, any, bool) {
+	if c == nil {
+		return nil, nil, false
+	}
+
+	now := c.now()
+	s := c.shard(key)
+	s.mu.Lock()
+	el, ok := s.entries[key]
+	if ok && !now.Before(el.Value.(*entry).expires) {
+		s.remove(el)
+		ok = false
+	}
+	if !ok {
+		s.mu.Unlock()
+		c.misses.Add(1)
+		if c.metrics != nil {
+			c.metrics.RecordCacheMiss(metricsLabel)
+		}
+		return nil, nil, false
+	}
+	s.lru.MoveToFront(el)
+	e := el.Value.(*entry)
+	e.hits++
+	msg := e.msg.Copy()
+	meta := e.meta
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	s.mu.Unlock()
+
+	c.hits.Add(1)
+	if c.metrics != nil {
+		c.metrics.RecordCacheHit(metricsLabel)
+	}
+
+	msg.Id = req.Id
+	msg.Question = append([]dns.Question(nil), req.Question...)
+	age(msg, elapsed)
+	return msg, meta, true
+}
+
+// Set caches resp for key along with meta. Only complete NOERROR and NXDOMAIN
+// answers with a positive TTL are cached; negative answers need an SOA record.
+func (c *Cache) Set(key Key, resp *dns.Msg, meta any) {
+	if c == nil || resp == nil || resp.Truncated {
+		return
+	}
+	ttl, ok := c.ttl(resp)
+	if !ok {
+		return
+	}
+
+	msg := resp.Copy()
+	forEachTTL(msg, c.clamp)
+
+	now := c.now()
+	c.insert(&entry{
+		key:     key,
+		msg:     msg,
+		meta:    meta,
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	})
+}
+
+// Entry is a cached response as exported for snapshots.
+type Entry struct {
+	Key  Key
+	Msg  *dns.Msg
+	Meta any
+	// Stored is when the response was cached; its TTLs are relative to Stored.
+	Stored  time.Time
+	Expires time.Time
+}
+
+// Answer returns a copy of the response with TTLs decremented by the time spent in
+// the cache until now.
+func (e Entry) Answer(now time.Time) *dns.Msg {
+	msg := e.Msg.Copy()
+	if now.After(e.Stored) {
+		age(msg, uint32(now.Sub(e.Stored)/time.Second))
+	}
+	return msg
+}
+
+// Entries returns copies of all unexpired entries, most recently used first within each shard.
+func (c *Cache) Entries() []Entry {
+	if c == nil {
+		return nil
+	}
+
+	now := c.now()
+	var entries []Entry
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for el := s.lru.Front(); el != nil; el = el.Next() {
+			e := el.Value.(*entry)
+			if now.Before(e.expires) {
+				entries = append(entries, Entry{Key: e.key, Msg: e.msg.Copy(), Meta: e.meta, Stored: e.stored, Expires: e.expires})
+			}
+		}
+		s.mu.Unlock()
+	}
+	return entries
+}
+
+// Restore caches an entry returned by Entries, possibly by another process, keeping
+// its lifetime so that served TTLs account for the time since it was stored.
+// Expired entries are ignored.
+func (c *Cache) Restore(e Entry) {
+	if c == nil || e.Msg == nil || !c.now().Before(e.Expires) {
+		return
+	}
+	c.insert(&entry{
+		key:     e.Key,
+		msg:     e.Msg.Copy(),
+		meta:    e.Meta,
+		stored:  e.Stored,
+		expires: e.Expires,
+	})
+}
+
+// insert adds or replaces an entry and evicts the least recently used beyond the limit.
+func (c *Cache) insert(e *entry) {
+	s := c.shard(e.key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.entries[e.key]; ok {
+		el.Value = e
+		s.lru.MoveToFront(el)
+		return
+	}
+
+	s.entries[e.key] = s.lru.PushFront(e)
+	for s.lru.Len() > s.maxEntries {
+		s.remove(s.lru.Back())
+		c.evictions.Add(1)
+		if c.metrics != nil {
+			c.metrics.RecordCacheEviction(metricsLabel)
+		}
+	}
+}
+
+// Delete removes the entries for which match reports true and returns how many were
+// removed. match must not modify the entry's message.
+func (c *Cache) Delete(match func(Entry) bool) int {
+	if c == nil {
+		return 0
+	}
+
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for el := s.lru.Front(); el != nil; {
+			next := el.Next()
+			e := el.Value.(*entry)
+			if match(Entry{Key: e.key, Msg: e.msg, Meta: e.meta, Stored: e.stored, Expires: e.expires}) {
+				s.remove(el)
+				n++
+			}
+			el = next
+		}
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Due reports whether the entry for key is popular, having been hit at least
+// PrefetchHits times, and has no more than PrefetchPercentage of its TTL left. It
+// reports true once per entry so that the caller refreshes it only once.
+func (c *Cache) Due(key Key) bool {
+	if c == nil || c.prefetchHits <= 0 {
+		return false
+	}
+
+	now := c.now()
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[key]
+	if !ok {
+		return false
+	}
+	e := el.Value.(*entry)
+	if e.prefetching || e.hits < c.prefetchHits {
+		return false
+	}
+	lifetime := e.expires.Sub(e.stored)
+	if e.expires.Sub(now)*100 > lifetime*time.Duration(c.prefetchPercentage) {
+		return false
+	}
+	e.prefetching = true
+	return true
+}
+
+// Len returns the number of cached responses, including expired ones not yet removed.
+func (c *Cache) Len() int {
+	if c == nil {
+		return 0
+	}
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += s.lru.Len()
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Stats summarizes the cache size and its activity since it was created.
+type Stats struct {
+	// Entries is the number of cached responses, including expired ones not yet removed.
+	Entries  int
+	Capacity int
+	Hits     uint64
+	Misses   uint64
+	// Evictions counts entries evicted to stay within the capacity.
+	Evictions uint64
+}
+
+// Stats returns the cache statistics. A nil cache reports zero capacity.
+func (c *Cache) Stats() Stats {
+	if c == nil {
+		return Stats{}
+	}
+	return Stats{
+		Entries:   c.Len(),
+		Capacity:  c.maxEntries,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+// ttl returns the clamped lifetime of resp in the cache.
+func (c *Cache) ttl(resp *dns.Msg) (uint32, bool) {
+	negative := resp.Rcode == dns.RcodeNameError || (resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0)
+	if resp.Rcode != dns.RcodeSuccess && !negative {
+		return 0, false
+	}
+
+	var ttl uint32
+	found := false
+	lower := func(v uint32) {
+		if !found || v < ttl {
+			ttl = v
+			found = true
+		}
+	}
+
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				lower(rr.Header().Ttl)
+			}
+		}
+	}
+
+	if negative {
+		// RFC 2308 section 5: the negative TTL is the minimum of the SOA TTL and its MINIMUM field
+		var soa *dns.SOA
+		for _, rr := range resp.Ns {
+			if s, ok := rr.(*dns.SOA); ok {
+				soa = s
+				break
+			}
+		}
+		if soa == nil {
+			return 0, false
+		}
+		lower(soa.Minttl)
+	}
+
+	if !found {
+		return 0, false
+	}
+	ttl = c.clamp(ttl)
+	return ttl, ttl > 0
+}
+
+// clamp applies the configured TTL bounds.
+func (c *Cache) clamp(ttl uint32) uint32 {
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	return ttl
+}
+
+// shard returns the shard holding key.
+func (c *Cache) shard(key Key) *shard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key.Name))
+	_, _ = h.Write([]byte{byte(key.Qtype >> 8), byte(key.Qtype)})
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+// remove deletes an element. The shard lock must be held.
+func (s *shard) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.entries, el.Value.(*entry).key)
+}
+
+// age decrements the TTLs in msg by elapsed seconds, stopping at zero.
+func age(msg *dns.Msg, elapsed uint32) {
+	forEachTTL(msg, func(ttl uint32) uint32 {
+		if ttl <= elapsed {
+			return 0
+		}
+		return ttl - elapsed
+	})
+}
+
+// forEachTTL replaces the TTL of every record except OPT with fn(ttl).
+func forEachTTL(msg *dns.Msg, fn func(uint32) uint32) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = fn(rr.Header().Ttl)
+			}
+		}
+	}
+}
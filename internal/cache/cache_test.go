@@ -0,0 +1,394 @@
+package cache
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+	"github.com/steigr/nameserver-switcher/internal/testhelper"
+)
+
+func newTestCache(t *testing.T, cfg Config) (*Cache, *testhelper.Clock) {
+	t.Helper()
+	c := New(cfg)
+	require.NotNil(t, c)
+	clock := testhelper.NewClock()
+	c.now = clock.Now
+	return c, clock
+}
+
+func newRequest(name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	return req
+}
+
+func newAnswer(req *dns.Msg, ttl uint32) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP("192.0.2.1").To4(),
+	}}
+	return resp
+}
+
+func newNegative(req *dns.Msg, rcode int, soaTTL, minTTL uint32) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetRcode(req, rcode)
+	resp.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soaTTL},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: minTTL,
+	}}
+	return resp
+}
+
+func mustKey(t *testing.T, req *dns.Msg, route string) Key {
+	t.Helper()
+	key, ok := KeyFor(req, route)
+	require.True(t, ok)
+	return key
+}
+
+func TestKeyFor(t *testing.T) {
+	req := newRequest("WWW.Example.COM.", dns.TypeAAAA)
+	key := mustKey(t, req, "default")
+	assert.Equal(t, Key{Name: "www.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET, Route: "default"}, key)
+
+	req.SetEdns0(1232, true)
+	assert.True(t, mustKey(t, req, "default").DO)
+
+	_, ok := KeyFor(new(dns.Msg), "default")
+	assert.False(t, ok)
+}
+
+func TestNew_Disabled(t *testing.T) {
+	c := New(Config{})
+	assert.Nil(t, c)
+
+	// A nil cache is a valid disabled cache
+	req := newRequest("example.com.", dns.TypeA)
+	key := mustKey(t, req, "default")
+	c.Set(key, newAnswer(req, 300), nil)
+	_, _, ok := c.Get(key, req)
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestCache_GetDecrementsTTL(t *testing.T) {
+	c, clock := newTestCache(t, Config{MaxEntries: 10})
+
+	req := newRequest("example.com.", dns.TypeA)
+	key := mustKey(t, req, "default")
+	c.Set(key, newAnswer(req, 300), "meta")
+
+	clock.Advance(100 * time.Second)
+
+	query := newRequest("Example.com.", dns.TypeA)
+	resp, meta, ok := c.Get(key, query)
+	require.True(t, ok)
+	assert.Equal(t, "meta", meta)
+	assert.Equal(t, query.Id, resp.Id)
+	assert.Equal(t, "Example.com.", resp.Question[0].Name)
+	assert.Equal(t, uint32(200), resp.Answer[0].Header().Ttl)
+
+	// Served copies do not change the cached entry
+	resp.Answer[0].Header().Ttl = 1
+	resp, _, ok = c.Get(key, query)
+	require.True(t, ok)
+	assert.Equal(t, uint32(200), resp.Answer[0].Header().Ttl)
+}
+
+func TestCache_Expiry(t *testing.T) {
+	c, clock := newTestCache(t, Config{MaxEntries: 10})
+
+	req := newRequest("example.com.", dns.TypeA)
+	key := mustKey(t, req, "default")
+	c.Set(key, newAnswer(req, 60), nil)
+
+	clock.Advance(59 * time.Second)
+	_, _, ok := c.Get(key, req)
+	assert.True(t, ok)
+
+	clock.Advance(time.Second)
+	_, _, ok = c.Get(key, req)
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestCache_NegativeCaching(t *testing.T) {
+	c, clock := newTestCache(t, Config{MaxEntries: 10})
+	req := newRequest("missing.example.com.", dns.TypeA)
+
+	t.Run("NXDOMAIN uses SOA minimum", func(t *testing.T) {
+		key := mustKey(t, req, "nxdomain")
+		c.Set(key, newNegative(req, dns.RcodeNameError, 3600, 120), nil)
+
+		clock.Advance(119 * time.Second)
+		resp, _, ok := c.Get(key, req)
+		require.True(t, ok)
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+		clock.Advance(time.Second)
+		_, _, ok = c.Get(key, req)
+		assert.False(t, ok)
+	})
+
+	t.Run("NODATA uses SOA TTL when lower", func(t *testing.T) {
+		key := mustKey(t, req, "nodata")
+		c.Set(key, newNegative(req, dns.RcodeSuccess, 30, 600), nil)
+
+		clock.Advance(30 * time.Second)
+		_, _, ok := c.Get(key, req)
+		assert.False(t, ok)
+	})
+
+	t.Run("Without SOA", func(t *testing.T) {
+		key := mustKey(t, req, "no-soa")
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeNameError)
+		c.Set(key, resp, nil)
+
+		_, _, ok := c.Get(key, req)
+		assert.False(t, ok)
+	})
+}
+
+func TestCache_Uncacheable(t *testing.T) {
+	c, _ := newTestCache(t, Config{MaxEntries: 10})
+	req := newRequest("example.com.", dns.TypeA)
+
+	servfail := new(dns.Msg)
+	servfail.SetRcode(req, dns.RcodeServerFailure)
+
+	truncated := newAnswer(req, 300)
+	truncated.Truncated = true
+
+	for name, resp := range map[string]*dns.Msg{
+		"SERVFAIL":  servfail,
+		"Truncated": truncated,
+		"ZeroTTL":   newAnswer(req, 0),
+		"Nil":       nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			key := mustKey(t, req, name)
+			c.Set(key, resp, nil)
+			_, _, ok := c.Get(key, req)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestCache_TTLClamps(t *testing.T) {
+	c, clock := newTestCache(t, Config{MaxEntries: 10, MinTTL: time.Minute, MaxTTL: time.Hour})
+	req := newRequest("example.com.", dns.TypeA)
+
+	short := mustKey(t, req, "short")
+	c.Set(short, newAnswer(req, 5), nil)
+	resp, _, ok := c.Get(short, req)
+	require.True(t, ok)
+	assert.Equal(t, uint32(60), resp.Answer[0].Header().Ttl)
+
+	long := mustKey(t, req, "long")
+	c.Set(long, newAnswer(req, 86400), nil)
+	resp, _, ok = c.Get(long, req)
+	require.True(t, ok)
+	assert.Equal(t, uint32(3600), resp.Answer[0].Header().Ttl)
+
+	clock.Advance(time.Hour)
+	_, _, ok = c.Get(long, req)
+	assert.False(t, ok)
+}
+
+func TestCache_PreservesOPT(t *testing.T) {
+	c, clock := newTestCache(t, Config{MaxEntries: 10})
+	req := newRequest("example.com.", dns.TypeA)
+	resp := newAnswer(req, 300)
+	resp.SetEdns0(1232, true)
+	optTTL := resp.IsEdns0().Hdr.Ttl
+
+	key := mustKey(t, req, "default")
+	c.Set(key, resp, nil)
+	clock.Advance(10 * time.Second)
+
+	cached, _, ok := c.Get(key, req)
+	require.True(t, ok)
+	require.NotNil(t, cached.IsEdns0())
+	assert.Equal(t, optTTL, cached.IsEdns0().Hdr.Ttl)
+}
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	m := metrics.NewMetrics("test_cache_eviction")
+	c, _ := newTestCache(t, Config{MaxEntries: 2, Shards: 1, Metrics: m})
+
+	reqs := []*dns.Msg{
+		newRequest("a.example.com.", dns.TypeA),
+		newRequest("b.example.com.", dns.TypeA),
+		newRequest("c.example.com.", dns.TypeA),
+	}
+	keys := make([]Key, len(reqs))
+	for i, req := range reqs {
+		keys[i] = mustKey(t, req, "default")
+	}
+
+	c.Set(keys[0], newAnswer(reqs[0], 300), nil)
+	c.Set(keys[1], newAnswer(reqs[1], 300), nil)
+	_, _, ok := c.Get(keys[0], reqs[0])
+	require.True(t, ok)
+	c.Set(keys[2], newAnswer(reqs[2], 300), nil)
+
+	assert.Equal(t, 2, c.Len())
+	_, _, ok = c.Get(keys[1], reqs[1])
+	assert.False(t, ok)
+	_, _, ok = c.Get(keys[0], reqs[0])
+	assert.True(t, ok)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.CacheEvictions.WithLabelValues("response")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.CacheHits.WithLabelValues("response")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.CacheMisses.WithLabelValues("response")))
+}
+
+func TestCache_KeyIncludesDOAndRoute(t *testing.T) {
+	c, _ := newTestCache(t, Config{MaxEntries: 10})
+
+	req := newRequest("example.com.", dns.TypeA)
+	c.Set(mustKey(t, req, "default"), newAnswer(req, 300), nil)
+
+	_, _, ok := c.Get(mustKey(t, req, "passthrough"), req)
+	assert.False(t, ok)
+
+	do := newRequest("example.com.", dns.TypeA)
+	do.SetEdns0(1232, true)
+	_, _, ok = c.Get(mustKey(t, do, "default"), do)
+	assert.False(t, ok)
+}
+
+func TestNew_Shards(t *testing.T) {
+	assert.Len(t, New(Config{MaxEntries: 100}).shards, defaultShards)
+	assert.Len(t, New(Config{MaxEntries: 4}).shards, 4)
+	assert.Len(t, New(Config{MaxEntries: 100, Shards: 3}).shards, 3)
+}
+
+func TestCache_Due(t *testing.T) {
+	c, clock := newTestCache(t, Config{MaxEntries: 10, PrefetchHits: 2})
+
+	req := newRequest("example.com.", dns.TypeA)
+	key := mustKey(t, req, "default")
+	c.Set(key, newAnswer(req, 100), nil)
+
+	// Unpopular entries are not refreshed
+	_, _, _ = c.Get(key, req)
+	clock.Advance(95 * time.Second)
+	assert.False(t, c.Due(key))
+
+	_, _, _ = c.Get(key, req)
+	assert.True(t, c.Due(key))
+	assert.False(t, c.Due(key), "an entry is due only once")
+
+	// A refreshed entry starts over
+	c.Set(key, newAnswer(req, 100), nil)
+	_, _, _ = c.Get(key, req)
+	_, _, _ = c.Get(key, req)
+	assert.False(t, c.Due(key), "more than 10% of the TTL left")
+	clock.Advance(90 * time.Second)
+	assert.True(t, c.Due(key))
+}
+
+func TestCache_DueDisabled(t *testing.T) {
+	c, clock := newTestCache(t, Config{MaxEntries: 10})
+
+	req := newRequest("example.com.", dns.TypeA)
+	key := mustKey(t, req, "default")
+	c.Set(key, newAnswer(req, 100), nil)
+	_, _, _ = c.Get(key, req)
+	clock.Advance(99 * time.Second)
+	assert.False(t, c.Due(key))
+
+	var disabled *Cache
+	assert.False(t, disabled.Due(key))
+}
+
+func TestCache_EntriesRestore(t *testing.T) {
+	c, clock := newTestCache(t, Config{MaxEntries: 10})
+
+	req := newRequest("example.com.", dns.TypeA)
+	key := mustKey(t, req, "default")
+	c.Set(key, newAnswer(req, 60), "meta")
+	expired := newRequest("expired.example.com.", dns.TypeA)
+	c.Set(mustKey(t, expired, "default"), newAnswer(expired, 5), nil)
+
+	clock.Advance(10 * time.Second)
+	entries := c.Entries()
+	require.Len(t, entries, 1)
+	assert.Equal(t, key, entries[0].Key)
+	assert.Equal(t, "meta", entries[0].Meta)
+
+	// The restoring cache serves the remaining TTL
+	restored, restoredClock := newTestCache(t, Config{MaxEntries: 10})
+	restoredClock.Set(clock.Now().Add(20 * time.Second))
+	restored.Restore(entries[0])
+
+	msg, meta, ok := restored.Get(key, req)
+	require.True(t, ok)
+	assert.Equal(t, "meta", meta)
+	assert.Equal(t, uint32(30), msg.Answer[0].Header().Ttl)
+
+	// Entries that expired in the meantime are not restored
+	late, lateClock := newTestCache(t, Config{MaxEntries: 10})
+	lateClock.Set(clock.Now().Add(time.Minute))
+	late.Restore(entries[0])
+	assert.Equal(t, 0, late.Len())
+}
+
+func TestCache_Delete(t *testing.T) {
+	c, clock := newTestCache(t, Config{MaxEntries: 10})
+
+	for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.org."} {
+		req := newRequest(name, dns.TypeA)
+		c.Set(mustKey(t, req, "default"), newAnswer(req, 60), name)
+	}
+
+	n := c.Delete(func(e Entry) bool { return e.Key.Name == "b.example.com." })
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 2, c.Len())
+
+	clock.Advance(15 * time.Second)
+	entries := c.Entries()
+	require.Len(t, entries, 2)
+	assert.Equal(t, uint32(45), entries[0].Answer(clock.Now()).Answer[0].Header().Ttl)
+	assert.Equal(t, uint32(60), entries[0].Msg.Answer[0].Header().Ttl, "Answer must not modify the entry")
+
+	n = c.Delete(func(e Entry) bool { return e.Meta == "c.example.org." })
+	assert.Equal(t, 1, n)
+	_, _, ok := c.Get(mustKey(t, newRequest("c.example.org.", dns.TypeA), "default"), newRequest("c.example.org.", dns.TypeA))
+	assert.False(t, ok)
+
+	var disabled *Cache
+	assert.Equal(t, 0, disabled.Delete(func(Entry) bool { return true }))
+}
+
+func TestCache_Stats(t *testing.T) {
+	c, _ := newTestCache(t, Config{MaxEntries: 2, Shards: 1})
+
+	for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		req := newRequest(name, dns.TypeA)
+		c.Set(mustKey(t, req, "default"), newAnswer(req, 60), nil)
+	}
+	req := newRequest("c.example.com.", dns.TypeA)
+	_, _, _ = c.Get(mustKey(t, req, "default"), req)
+	req = newRequest("a.example.com.", dns.TypeA)
+	_, _, _ = c.Get(mustKey(t, req, "default"), req)
+
+	assert.Equal(t, Stats{Entries: 2, Capacity: 2, Hits: 1, Misses: 1, Evictions: 1}, c.Stats())
+
+	var disabled *Cache
+	assert.Equal(t, Stats{}, disabled.Stats())
+}
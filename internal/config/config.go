@@ -2,9 +2,12 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
 )
@@ -23,6 +26,10 @@ type Config struct {
 	// ExplicitResolver is the DNS server for recursive lookups when CNAME matches.
 	ExplicitResolver string
 
+	// ProbeResolver is the DNS server for the non-recursive probe lookup of matched requests.
+	// Falls back to ExplicitResolver (queried recursively) if not set.
+	ProbeResolver string
+
 	// PassthroughResolver is the DNS server for requests that don't match any request pattern.
 	// Falls back to RequestResolver if not set.
 	PassthroughResolver string
@@ -35,6 +42,100 @@ type Config struct {
 	// Falls back to RequestResolver if not set.
 	NoCnameMatchResolver string
 
+	// CNAMEMaxDepth bounds the CNAME/DNAME hops followed when matching CNAME patterns.
+	CNAMEMaxDepth int
+
+	// RulesFile is a JSON file with routing rules evaluated before the rules built from
+	// the settings above.
+	RulesFile string
+
+	// UpstreamTLSServerName overrides the TLS server name for tls:// and https:// resolvers
+	// given by IP address.
+	UpstreamTLSServerName string
+
+	// UpstreamTLSCAFile is a PEM CA bundle used to verify tls:// resolvers.
+	UpstreamTLSCAFile string
+
+	// UpstreamTLSCertFile is an optional client certificate for tls:// resolvers.
+	UpstreamTLSCertFile string
+
+	// UpstreamTLSKeyFile is the private key for UpstreamTLSCertFile.
+	UpstreamTLSKeyFile string
+
+	// ExplicitFailurePolicy is the failure policy for the explicit resolver route
+	// (error, fallback:<resolver>, stale, rcode:<RCODE> or retry[:<count>[:<backoff>]]).
+	ExplicitFailurePolicy string
+
+	// PassthroughFailurePolicy is the failure policy for the passthrough resolver route.
+	PassthroughFailurePolicy string
+
+	// NoCnameResponseFailurePolicy is the failure policy for the no-cname-response resolver route.
+	NoCnameResponseFailurePolicy string
+
+	// NoCnameMatchFailurePolicy is the failure policy for the no-cname-match resolver route.
+	NoCnameMatchFailurePolicy string
+
+	// FailureRcodes is a comma-separated list of upstream rcodes treated as failures (e.g. SERVFAIL,REFUSED).
+	FailureRcodes string
+
+	// UpstreamStrategy selects how queries are spread over a resolver's upstream list:
+	// sequential, round_robin, random or lowest_latency.
+	UpstreamStrategy string
+
+	// UpstreamFailureThreshold is the number of consecutive failures that opens an upstream's circuit (0 disables).
+	UpstreamFailureThreshold int
+
+	// UpstreamOpenDuration is how long an open circuit skips an upstream before retesting it.
+	UpstreamOpenDuration time.Duration
+
+	// UpstreamProbeInterval is how often upstreams are health-probed in the background (0 disables).
+	UpstreamProbeInterval time.Duration
+
+	// UpstreamTimeout bounds a single exchange with an upstream resolver.
+	UpstreamTimeout time.Duration
+
+	// UpstreamDoHMethod is the HTTP method for https:// resolvers: "POST" or "GET".
+	UpstreamDoHMethod string
+
+	// UpstreamUDPSize is the EDNS0 UDP buffer size advertised to plain DNS upstreams (0 disables EDNS0).
+	UpstreamUDPSize int
+
+	// CacheSize is the maximum number of cached responses (0 disables the response cache).
+	CacheSize int
+
+	// CacheMinTTL raises shorter TTLs of cached responses.
+	CacheMinTTL time.Duration
+
+	// CacheMaxTTL lowers longer TTLs of cached responses (0 disables the limit).
+	CacheMaxTTL time.Duration
+
+	// SnapshotFile is where cached answers are saved across restarts (empty disables snapshots).
+	SnapshotFile string
+
+	// SnapshotInterval is the interval between periodic snapshots (0 saves only on shutdown).
+	SnapshotInterval time.Duration
+
+	// PrefetchHits is how often a cached answer must be hit during its TTL to be refreshed ahead of expiry (0 disables refresh-ahead).
+	PrefetchHits int
+
+	// PrefetchPercentage is the share of the TTL left when popular answers are refreshed.
+	PrefetchPercentage int
+
+	// PrefetchWorkers is the number of background workers refreshing popular answers.
+	PrefetchWorkers int
+
+	// ServeStale answers with the last good answer past its TTL when upstreams fail (RFC 8767).
+	ServeStale bool
+
+	// StaleMaxAge is how long past its TTL an answer may be served stale (0 disables the limit).
+	StaleMaxAge time.Duration
+
+	// StaleAnswerTimeout is how long to wait for upstreams before answering stale (0 waits until they fail).
+	StaleAnswerTimeout time.Duration
+
+	// RouteCacheSize is the maximum number of names whose routing decision is cached (0 disables the route cache).
+	RouteCacheSize int
+
 	// DNSListenAddr is the address to listen for DNS requests.
 	DNSListenAddr string
 
@@ -47,6 +148,121 @@ type Config struct {
 	// DNSPort is the DNS server port (for UDP and TCP).
 	DNSPort int
 
+	// DNSListen is a comma-separated list of [name=]host:port[/udp|/tcp|/udp+tcp]
+	// endpoints serving plain DNS. When set, it replaces DNSListenAddr and DNSPort.
+	DNSListen string
+
+	// DNSMaxUDPSize caps the size of UDP responses regardless of the EDNS buffer size
+	// clients advertise (0 leaves it to the client).
+	DNSMaxUDPSize int
+
+	// DNSListeners is the number of UDP and of TCP sockets bound to the DNS port with
+	// SO_REUSEPORT (Linux only), each served by its own goroutine.
+	DNSListeners int
+
+	// DNSMaxInFlight bounds the number of DNS requests handled concurrently (0 disables the limit).
+	DNSMaxInFlight int
+
+	// DNSMaxQueued is the number of requests that may wait for an in-flight slot.
+	DNSMaxQueued int
+
+	// DNSQueueTimeout is how long a queued request waits for an in-flight slot (0 disables queueing).
+	DNSQueueTimeout time.Duration
+
+	// DNSShedRcode answers requests shed while saturated: "REFUSED" or "SERVFAIL".
+	DNSShedRcode string
+
+	// DNSRequestTimeout bounds the handling of a single DNS request.
+	DNSRequestTimeout time.Duration
+
+	// DoTPort is the DNS-over-TLS server port.
+	DoTPort int
+
+	// DoTCertFile is the certificate of the DNS-over-TLS server (empty disables it).
+	DoTCertFile string
+
+	// DoTKeyFile is the private key for DoTCertFile.
+	DoTKeyFile string
+
+	// DoTClientCAFile is a PEM CA bundle DNS-over-TLS client certificates must be signed by
+	// (empty does not request client certificates).
+	DoTClientCAFile string
+
+	// DoH serves DNS-over-HTTPS queries at /dns-query on the plaintext HTTP server, for
+	// deployments where an ingress terminates TLS.
+	DoH bool
+
+	// DoHPort is the port of the separate DNS-over-HTTPS TLS listener.
+	DoHPort int
+
+	// DoHCertFile is the certificate of the DNS-over-HTTPS TLS listener (empty disables it).
+	DoHCertFile string
+
+	// DoHKeyFile is the private key for DoHCertFile.
+	DoHKeyFile string
+
+	// DNSAllow is a comma-separated list of client CIDRs allowed to query over UDP and TCP (empty allows all).
+	DNSAllow string
+
+	// DNSDeny is a comma-separated list of client CIDRs denied over UDP and TCP.
+	DNSDeny string
+
+	// DoTAllow is a comma-separated list of client CIDRs allowed to query over DNS-over-TLS (empty allows all).
+	DoTAllow string
+
+	// DoTDeny is a comma-separated list of client CIDRs denied over DNS-over-TLS.
+	DoTDeny string
+
+	// DoHAllow is a comma-separated list of client CIDRs allowed to query over DNS-over-HTTPS (empty allows all).
+	DoHAllow string
+
+	// DoHDeny is a comma-separated list of client CIDRs denied over DNS-over-HTTPS.
+	DoHDeny string
+
+	// GRPCAllow is a comma-separated list of client CIDRs allowed to use the CoreDNS Query RPC (empty allows all).
+	GRPCAllow string
+
+	// GRPCDeny is a comma-separated list of client CIDRs denied the CoreDNS Query RPC.
+	GRPCDeny string
+
+	// ACLAction is what happens to queries from denied clients: "refuse" or "drop".
+	ACLAction string
+
+	// ACLLogEvery logs one in every ACLLogEvery denied queries (0 disables logging).
+	ACLLogEvery int
+
+	// DNSProxyProtocol is a comma-separated list of load balancer CIDRs trusted to send
+	// PROXY protocol headers on DNS TCP connections (empty disables the PROXY protocol).
+	DNSProxyProtocol string
+
+	// GRPCProxyProtocol is a comma-separated list of load balancer CIDRs trusted to send
+	// PROXY protocol headers on gRPC connections (empty disables the PROXY protocol).
+	GRPCProxyProtocol string
+
+	// RRLResponsesPerSecond is the rate of UDP responses with answers per client prefix (0 disables rate limiting).
+	RRLResponsesPerSecond int
+
+	// RRLNoDataPerSecond is the rate of empty UDP responses per client prefix (0 uses RRLResponsesPerSecond).
+	RRLNoDataPerSecond int
+
+	// RRLNXDomainsPerSecond is the rate of NXDOMAIN UDP responses per client prefix (0 uses RRLResponsesPerSecond).
+	RRLNXDomainsPerSecond int
+
+	// RRLErrorsPerSecond is the rate of other error UDP responses per client prefix (0 uses RRLResponsesPerSecond).
+	RRLErrorsPerSecond int
+
+	// RRLIPv4PrefixLen is the prefix length grouping IPv4 clients for rate limiting.
+	RRLIPv4PrefixLen int
+
+	// RRLIPv6PrefixLen is the prefix length grouping IPv6 clients for rate limiting.
+	RRLIPv6PrefixLen int
+
+	// RRLSlip sends every RRLSlip-th limited response truncated instead of dropping it (0 drops all).
+	RRLSlip int
+
+	// RRLExempt is a comma-separated list of client CIDRs that are never rate limited.
+	RRLExempt string
+
 	// GRPCPort is the gRPC server port.
 	GRPCPort int
 
@@ -69,23 +285,56 @@ type Config struct {
 // DefaultConfig returns a Config with default values.
 func DefaultConfig() *Config {
 	return &Config{
-		RequestPatterns:         []string{},
-		CNAMEPatterns:           []string{},
-		RequestResolver:         "",
-		ExplicitResolver:        "",
-		PassthroughResolver:     "",
-		NoCnameResponseResolver: "",
-		NoCnameMatchResolver:    "",
-		DNSListenAddr:           "0.0.0.0",
-		GRPCListenAddr:          "0.0.0.0",
-		HTTPListenAddr:          "0.0.0.0",
-		DNSPort:                 5353,
-		GRPCPort:                5354,
-		HTTPPort:                8080,
-		Debug:                   false,
-		LogRequests:             true,
-		LogResponses:            true,
-		LogFormat:               "text",
+		RequestPatterns:          []string{},
+		CNAMEPatterns:            []string{},
+		CNAMEMaxDepth:            8,
+		RequestResolver:          "",
+		ExplicitResolver:         "",
+		PassthroughResolver:      "",
+		NoCnameResponseResolver:  "",
+		NoCnameMatchResolver:     "",
+		UpstreamStrategy:         "sequential",
+		UpstreamFailureThreshold: 3,
+		UpstreamOpenDuration:     10 * time.Second,
+		UpstreamProbeInterval:    10 * time.Second,
+		UpstreamTimeout:          5 * time.Second,
+		UpstreamDoHMethod:        "POST",
+		UpstreamUDPSize:          1232,
+		CacheSize:                10000,
+		CacheMaxTTL:              24 * time.Hour,
+		SnapshotInterval:         5 * time.Minute,
+		PrefetchHits:             5,
+		PrefetchPercentage:       10,
+		PrefetchWorkers:          4,
+		ServeStale:               true,
+		StaleMaxAge:              24 * time.Hour,
+		StaleAnswerTimeout:       1800 * time.Millisecond,
+		RouteCacheSize:           10000,
+		DNSListenAddr:            "0.0.0.0",
+		GRPCListenAddr:           "0.0.0.0",
+		HTTPListenAddr:           "0.0.0.0",
+		DNSPort:                  5353,
+		DNSMaxUDPSize:            1232,
+		DNSListeners:             runtime.GOMAXPROCS(0),
+		DNSMaxInFlight:           1000,
+		DNSMaxQueued:             1000,
+		DNSQueueTimeout:          500 * time.Millisecond,
+		DNSShedRcode:             "REFUSED",
+		DNSRequestTimeout:        10 * time.Second,
+		DoTPort:                  853,
+		DoH:                      false,
+		DoHPort:                  443,
+		ACLAction:                "refuse",
+		ACLLogEvery:              100,
+		RRLIPv4PrefixLen:         24,
+		RRLIPv6PrefixLen:         56,
+		RRLSlip:                  2,
+		GRPCPort:                 5354,
+		HTTPPort:                 8080,
+		Debug:                    false,
+		LogRequests:              true,
+		LogResponses:             true,
+		LogFormat:                "text",
 	}
 }
 
@@ -101,15 +350,82 @@ func (c *Config) ParseFlags() {
 
 	pflag.StringVar(&requestPatternsStr, "request-patterns", "", "Newline-delimited regex patterns for matching incoming requests")
 	pflag.StringVar(&cnamePatternsStr, "cname-patterns", "", "Newline-delimited regex patterns for matching CNAME responses")
-	pflag.StringVar(&requestResolver, "request-resolver", "", "DNS server for initial non-recursive lookups (e.g., 8.8.8.8:53)")
-	pflag.StringVar(&explicitResolver, "explicit-resolver", "", "DNS server for recursive lookups when CNAME matches (e.g., 1.1.1.1:53)")
+	pflag.StringVar(&requestResolver, "request-resolver", "", "Comma-separated DNS servers for initial non-recursive lookups (e.g., 8.8.8.8:53, tls://1.1.1.1 or https://1.1.1.1/dns-query)")
+	pflag.StringVar(&explicitResolver, "explicit-resolver", "", "Comma-separated DNS servers for recursive lookups when CNAME matches (e.g., 1.1.1.1:53, tls://1.1.1.1 or https://1.1.1.1/dns-query)")
 	pflag.StringVar(&passthroughResolver, "passthrough-resolver", "", "DNS server for requests not matching any pattern (falls back to request-resolver)")
 	pflag.StringVar(&noCnameResponseResolver, "no-cname-response-resolver", "", "DNS server for responses without CNAME (falls back to request-resolver)")
 	pflag.StringVar(&noCnameMatchResolver, "no-cname-match-resolver", "", "DNS server for CNAME responses not matching patterns (falls back to request-resolver)")
+	pflag.StringVar(&c.ProbeResolver, "probe-resolver", c.ProbeResolver, "Comma-separated DNS servers for non-recursive probe lookups of matched requests (falls back to explicit-resolver)")
+	pflag.IntVar(&c.CNAMEMaxDepth, "cname-max-depth", c.CNAMEMaxDepth, "Maximum CNAME/DNAME hops followed when matching CNAME patterns")
+	pflag.StringVar(&c.RulesFile, "rules-file", c.RulesFile, "JSON file with routing rules evaluated before the pattern and resolver settings")
+	pflag.StringVar(&c.UpstreamTLSServerName, "upstream-tls-server-name", c.UpstreamTLSServerName, "TLS server name for tls:// and https:// resolvers given by IP address (defaults to the resolver host)")
+	pflag.StringVar(&c.UpstreamTLSCAFile, "upstream-tls-ca-file", c.UpstreamTLSCAFile, "PEM CA bundle for verifying tls:// resolvers")
+	pflag.StringVar(&c.UpstreamTLSCertFile, "upstream-tls-cert-file", c.UpstreamTLSCertFile, "Client certificate for tls:// resolvers")
+	pflag.StringVar(&c.UpstreamTLSKeyFile, "upstream-tls-key-file", c.UpstreamTLSKeyFile, "Client certificate key for tls:// resolvers")
+	pflag.StringVar(&c.ExplicitFailurePolicy, "explicit-failure-policy", c.ExplicitFailurePolicy, "Failure policy for the explicit resolver: error, fallback:<resolver>, stale, rcode:<RCODE> or retry[:<count>[:<backoff>]]")
+	pflag.StringVar(&c.PassthroughFailurePolicy, "passthrough-failure-policy", c.PassthroughFailurePolicy, "Failure policy for the passthrough resolver")
+	pflag.StringVar(&c.NoCnameResponseFailurePolicy, "no-cname-response-failure-policy", c.NoCnameResponseFailurePolicy, "Failure policy for the no-cname-response resolver")
+	pflag.StringVar(&c.NoCnameMatchFailurePolicy, "no-cname-match-failure-policy", c.NoCnameMatchFailurePolicy, "Failure policy for the no-cname-match resolver")
+	pflag.StringVar(&c.FailureRcodes, "failure-rcodes", c.FailureRcodes, "Comma-separated upstream rcodes treated as failures (e.g. SERVFAIL,REFUSED)")
+	pflag.StringVar(&c.UpstreamStrategy, "upstream-strategy", c.UpstreamStrategy, "Upstream selection strategy for resolver lists: sequential, round_robin, random or lowest_latency")
+	pflag.IntVar(&c.UpstreamFailureThreshold, "upstream-failure-threshold", c.UpstreamFailureThreshold, "Consecutive failures before an upstream is skipped (0 disables circuit breaking)")
+	pflag.DurationVar(&c.UpstreamOpenDuration, "upstream-open-duration", c.UpstreamOpenDuration, "How long an unhealthy upstream is skipped before it is retested")
+	pflag.DurationVar(&c.UpstreamProbeInterval, "upstream-probe-interval", c.UpstreamProbeInterval, "Interval between background upstream health probes (0 disables probing)")
+	pflag.DurationVar(&c.UpstreamTimeout, "upstream-timeout", c.UpstreamTimeout, "Timeout for a single upstream resolver exchange")
+	pflag.StringVar(&c.UpstreamDoHMethod, "upstream-doh-method", c.UpstreamDoHMethod, "HTTP method for https:// resolvers: POST or GET")
+	pflag.IntVar(&c.UpstreamUDPSize, "upstream-udp-size", c.UpstreamUDPSize, "EDNS0 UDP buffer size advertised to upstream resolvers (0 disables EDNS0)")
+	pflag.IntVar(&c.CacheSize, "cache-size", c.CacheSize, "Maximum number of cached responses (0 disables the cache)")
+	pflag.DurationVar(&c.CacheMinTTL, "cache-min-ttl", c.CacheMinTTL, "Minimum TTL of cached responses")
+	pflag.DurationVar(&c.CacheMaxTTL, "cache-max-ttl", c.CacheMaxTTL, "Maximum TTL of cached responses (0 disables the limit)")
+	pflag.StringVar(&c.SnapshotFile, "snapshot-file", c.SnapshotFile, "File where cached answers are saved across restarts (empty disables snapshots)")
+	pflag.DurationVar(&c.SnapshotInterval, "snapshot-interval", c.SnapshotInterval, "Interval between periodic snapshots (0 saves only on shutdown)")
+	pflag.IntVar(&c.PrefetchHits, "prefetch-hits", c.PrefetchHits, "Hits during its TTL that make a cached answer refreshed ahead of expiry (0 disables refresh-ahead)")
+	pflag.IntVar(&c.PrefetchPercentage, "prefetch-percentage", c.PrefetchPercentage, "Percentage of the TTL left when popular answers are refreshed")
+	pflag.IntVar(&c.PrefetchWorkers, "prefetch-workers", c.PrefetchWorkers, "Number of background workers refreshing popular answers")
+	pflag.BoolVar(&c.ServeStale, "serve-stale", c.ServeStale, "Answer with the last good answer when upstreams fail")
+	pflag.DurationVar(&c.StaleMaxAge, "stale-max-age", c.StaleMaxAge, "How long past its TTL an answer may be served stale (0 disables the limit)")
+	pflag.DurationVar(&c.StaleAnswerTimeout, "stale-answer-timeout", c.StaleAnswerTimeout, "How long to wait for upstreams before answering stale (0 waits until they fail)")
+	pflag.IntVar(&c.RouteCacheSize, "route-cache-size", c.RouteCacheSize, "Maximum number of names whose routing decision is cached (0 disables the route cache)")
 	pflag.StringVar(&c.DNSListenAddr, "dns-listen-addr", c.DNSListenAddr, "Address to listen for DNS requests")
 	pflag.StringVar(&c.GRPCListenAddr, "grpc-listen-addr", c.GRPCListenAddr, "Address to listen for gRPC requests")
 	pflag.StringVar(&c.HTTPListenAddr, "http-listen-addr", c.HTTPListenAddr, "Address to listen for HTTP health/metrics requests")
 	pflag.IntVar(&c.DNSPort, "dns-port", c.DNSPort, "Port for DNS server")
+	pflag.StringVar(&c.DNSListen, "dns-listen", c.DNSListen, "Comma-separated DNS endpoints as [name=]host:port[/udp|/tcp|/udp+tcp] (replaces --dns-listen-addr and --dns-port)")
+	pflag.IntVar(&c.DNSMaxUDPSize, "dns-max-udp-size", c.DNSMaxUDPSize, "Maximum size of UDP responses (0 leaves it to the client's EDNS buffer size)")
+	pflag.IntVar(&c.DNSListeners, "dns-listeners", c.DNSListeners, "Number of UDP and TCP sockets bound with SO_REUSEPORT (Linux only; defaults to GOMAXPROCS)")
+	pflag.IntVar(&c.DNSMaxInFlight, "dns-max-in-flight", c.DNSMaxInFlight, "Maximum number of DNS requests handled concurrently (0 disables the limit)")
+	pflag.IntVar(&c.DNSMaxQueued, "dns-max-queued", c.DNSMaxQueued, "Maximum number of DNS requests waiting for an in-flight slot")
+	pflag.DurationVar(&c.DNSQueueTimeout, "dns-queue-timeout", c.DNSQueueTimeout, "How long a queued DNS request waits for an in-flight slot (0 disables queueing)")
+	pflag.StringVar(&c.DNSShedRcode, "dns-shed-rcode", c.DNSShedRcode, "Response code for DNS requests shed while saturated: REFUSED or SERVFAIL")
+	pflag.DurationVar(&c.DNSRequestTimeout, "dns-request-timeout", c.DNSRequestTimeout, "Timeout for handling a single DNS request")
+	pflag.IntVar(&c.DoTPort, "dot-port", c.DoTPort, "Port for DNS-over-TLS server")
+	pflag.StringVar(&c.DoTCertFile, "dot-cert-file", c.DoTCertFile, "Certificate for the DNS-over-TLS server (empty disables DNS-over-TLS)")
+	pflag.StringVar(&c.DoTKeyFile, "dot-key-file", c.DoTKeyFile, "Certificate key for the DNS-over-TLS server")
+	pflag.StringVar(&c.DoTClientCAFile, "dot-client-ca-file", c.DoTClientCAFile, "PEM CA bundle for verifying DNS-over-TLS client certificates (empty disables client authentication)")
+	pflag.BoolVar(&c.DoH, "doh", c.DoH, "Serve DNS-over-HTTPS at /dns-query on the plaintext HTTP server, behind a TLS-terminating ingress")
+	pflag.IntVar(&c.DoHPort, "doh-port", c.DoHPort, "Port for the DNS-over-HTTPS TLS listener")
+	pflag.StringVar(&c.DoHCertFile, "doh-cert-file", c.DoHCertFile, "Certificate for the DNS-over-HTTPS TLS listener (empty disables the listener)")
+	pflag.StringVar(&c.DoHKeyFile, "doh-key-file", c.DoHKeyFile, "Certificate key for the DNS-over-HTTPS TLS listener")
+	pflag.StringVar(&c.DNSAllow, "dns-allow", c.DNSAllow, "Comma-separated client CIDRs allowed to query over UDP and TCP (empty allows all)")
+	pflag.StringVar(&c.DNSDeny, "dns-deny", c.DNSDeny, "Comma-separated client CIDRs denied over UDP and TCP")
+	pflag.StringVar(&c.DoTAllow, "dot-allow", c.DoTAllow, "Comma-separated client CIDRs allowed to query over DNS-over-TLS (empty allows all)")
+	pflag.StringVar(&c.DoTDeny, "dot-deny", c.DoTDeny, "Comma-separated client CIDRs denied over DNS-over-TLS")
+	pflag.StringVar(&c.DoHAllow, "doh-allow", c.DoHAllow, "Comma-separated client CIDRs allowed to query over DNS-over-HTTPS (empty allows all)")
+	pflag.StringVar(&c.DoHDeny, "doh-deny", c.DoHDeny, "Comma-separated client CIDRs denied over DNS-over-HTTPS")
+	pflag.StringVar(&c.GRPCAllow, "grpc-allow", c.GRPCAllow, "Comma-separated client CIDRs allowed to use the CoreDNS Query RPC (empty allows all)")
+	pflag.StringVar(&c.GRPCDeny, "grpc-deny", c.GRPCDeny, "Comma-separated client CIDRs denied the CoreDNS Query RPC")
+	pflag.StringVar(&c.ACLAction, "acl-action", c.ACLAction, "Action for queries from denied clients: refuse or drop")
+	pflag.IntVar(&c.ACLLogEvery, "acl-log-every", c.ACLLogEvery, "Log one in every N denied queries (0 disables logging)")
+	pflag.StringVar(&c.DNSProxyProtocol, "dns-proxy-protocol", c.DNSProxyProtocol, "Comma-separated load balancer CIDRs trusted to send PROXY protocol headers on DNS TCP connections (empty disables)")
+	pflag.StringVar(&c.GRPCProxyProtocol, "grpc-proxy-protocol", c.GRPCProxyProtocol, "Comma-separated load balancer CIDRs trusted to send PROXY protocol headers on gRPC connections (empty disables)")
+	pflag.IntVar(&c.RRLResponsesPerSecond, "rrl-responses-per-second", c.RRLResponsesPerSecond, "UDP responses with answers per second and client prefix (0 disables rate limiting)")
+	pflag.IntVar(&c.RRLNoDataPerSecond, "rrl-nodata-per-second", c.RRLNoDataPerSecond, "Empty UDP responses per second and client prefix (0 uses rrl-responses-per-second)")
+	pflag.IntVar(&c.RRLNXDomainsPerSecond, "rrl-nxdomains-per-second", c.RRLNXDomainsPerSecond, "NXDOMAIN UDP responses per second and client prefix (0 uses rrl-responses-per-second)")
+	pflag.IntVar(&c.RRLErrorsPerSecond, "rrl-errors-per-second", c.RRLErrorsPerSecond, "Other error UDP responses per second and client prefix (0 uses rrl-responses-per-second)")
+	pflag.IntVar(&c.RRLIPv4PrefixLen, "rrl-ipv4-prefix-length", c.RRLIPv4PrefixLen, "Prefix length grouping IPv4 clients for rate limiting (1-32)")
+	pflag.IntVar(&c.RRLIPv6PrefixLen, "rrl-ipv6-prefix-length", c.RRLIPv6PrefixLen, "Prefix length grouping IPv6 clients for rate limiting (1-128)")
+	pflag.IntVar(&c.RRLSlip, "rrl-slip", c.RRLSlip, "Send every Nth rate limited response truncated instead of dropping it (0 drops all)")
+	pflag.StringVar(&c.RRLExempt, "rrl-exempt", c.RRLExempt, "Comma-separated client CIDRs that are never rate limited")
 	pflag.IntVar(&c.GRPCPort, "grpc-port", c.GRPCPort, "Port for gRPC server")
 	pflag.IntVar(&c.HTTPPort, "http-port", c.HTTPPort, "Port for HTTP health/metrics server")
 	pflag.BoolVar(&c.Debug, "debug", c.Debug, "Enable debug logging")
@@ -160,6 +476,17 @@ func (c *Config) LoadFromEnv() {
 	if resolver := os.Getenv("EXPLICIT_RESOLVER"); resolver != "" {
 		c.ExplicitResolver = resolver
 	}
+	if resolver := os.Getenv("PROBE_RESOLVER"); resolver != "" {
+		c.ProbeResolver = resolver
+	}
+	if depth := os.Getenv("CNAME_MAX_DEPTH"); depth != "" {
+		if n, err := strconv.Atoi(depth); err == nil {
+			c.CNAMEMaxDepth = n
+		}
+	}
+	if rulesFile := os.Getenv("RULES_FILE"); rulesFile != "" {
+		c.RulesFile = rulesFile
+	}
 	if resolver := os.Getenv("PASSTHROUGH_RESOLVER"); resolver != "" {
 		c.PassthroughResolver = resolver
 	}
@@ -169,6 +496,120 @@ func (c *Config) LoadFromEnv() {
 	if resolver := os.Getenv("NO_CNAME_MATCH_RESOLVER"); resolver != "" {
 		c.NoCnameMatchResolver = resolver
 	}
+	if serverName := os.Getenv("UPSTREAM_TLS_SERVER_NAME"); serverName != "" {
+		c.UpstreamTLSServerName = serverName
+	}
+	if file := os.Getenv("UPSTREAM_TLS_CA_FILE"); file != "" {
+		c.UpstreamTLSCAFile = file
+	}
+	if file := os.Getenv("UPSTREAM_TLS_CERT_FILE"); file != "" {
+		c.UpstreamTLSCertFile = file
+	}
+	if file := os.Getenv("UPSTREAM_TLS_KEY_FILE"); file != "" {
+		c.UpstreamTLSKeyFile = file
+	}
+	if policy := os.Getenv("EXPLICIT_FAILURE_POLICY"); policy != "" {
+		c.ExplicitFailurePolicy = policy
+	}
+	if policy := os.Getenv("PASSTHROUGH_FAILURE_POLICY"); policy != "" {
+		c.PassthroughFailurePolicy = policy
+	}
+	if policy := os.Getenv("NO_CNAME_RESPONSE_FAILURE_POLICY"); policy != "" {
+		c.NoCnameResponseFailurePolicy = policy
+	}
+	if policy := os.Getenv("NO_CNAME_MATCH_FAILURE_POLICY"); policy != "" {
+		c.NoCnameMatchFailurePolicy = policy
+	}
+	if rcodes := os.Getenv("FAILURE_RCODES"); rcodes != "" {
+		c.FailureRcodes = rcodes
+	}
+	if strategy := os.Getenv("UPSTREAM_STRATEGY"); strategy != "" {
+		c.UpstreamStrategy = strategy
+	}
+	if threshold := os.Getenv("UPSTREAM_FAILURE_THRESHOLD"); threshold != "" {
+		if n, err := strconv.Atoi(threshold); err == nil {
+			c.UpstreamFailureThreshold = n
+		}
+	}
+	if duration := os.Getenv("UPSTREAM_OPEN_DURATION"); duration != "" {
+		if d, err := time.ParseDuration(duration); err == nil {
+			c.UpstreamOpenDuration = d
+		}
+	}
+	if interval := os.Getenv("UPSTREAM_PROBE_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			c.UpstreamProbeInterval = d
+		}
+	}
+	if size := os.Getenv("CACHE_SIZE"); size != "" {
+		if n, err := strconv.Atoi(size); err == nil {
+			c.CacheSize = n
+		}
+	}
+	if ttl := os.Getenv("CACHE_MIN_TTL"); ttl != "" {
+		if d, err := time.ParseDuration(ttl); err == nil {
+			c.CacheMinTTL = d
+		}
+	}
+	if ttl := os.Getenv("CACHE_MAX_TTL"); ttl != "" {
+		if d, err := time.ParseDuration(ttl); err == nil {
+			c.CacheMaxTTL = d
+		}
+	}
+	if file := os.Getenv("SNAPSHOT_FILE"); file != "" {
+		c.SnapshotFile = file
+	}
+	if interval := os.Getenv("SNAPSHOT_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			c.SnapshotInterval = d
+		}
+	}
+	if hits := os.Getenv("PREFETCH_HITS"); hits != "" {
+		if n, err := strconv.Atoi(hits); err == nil {
+			c.PrefetchHits = n
+		}
+	}
+	if percentage := os.Getenv("PREFETCH_PERCENTAGE"); percentage != "" {
+		if n, err := strconv.Atoi(percentage); err == nil {
+			c.PrefetchPercentage = n
+		}
+	}
+	if workers := os.Getenv("PREFETCH_WORKERS"); workers != "" {
+		if n, err := strconv.Atoi(workers); err == nil {
+			c.PrefetchWorkers = n
+		}
+	}
+	if serveStale := os.Getenv("SERVE_STALE"); serveStale != "" {
+		c.ServeStale = serveStale == isTrue || serveStale == "1"
+	}
+	if age := os.Getenv("STALE_MAX_AGE"); age != "" {
+		if d, err := time.ParseDuration(age); err == nil {
+			c.StaleMaxAge = d
+		}
+	}
+	if timeout := os.Getenv("STALE_ANSWER_TIMEOUT"); timeout != "" {
+		if d, err := time.ParseDuration(timeout); err == nil {
+			c.StaleAnswerTimeout = d
+		}
+	}
+	if size := os.Getenv("ROUTE_CACHE_SIZE"); size != "" {
+		if n, err := strconv.Atoi(size); err == nil {
+			c.RouteCacheSize = n
+		}
+	}
+	if timeout := os.Getenv("UPSTREAM_TIMEOUT"); timeout != "" {
+		if d, err := time.ParseDuration(timeout); err == nil {
+			c.UpstreamTimeout = d
+		}
+	}
+	if method := os.Getenv("UPSTREAM_DOH_METHOD"); method != "" {
+		c.UpstreamDoHMethod = method
+	}
+	if size := os.Getenv("UPSTREAM_UDP_SIZE"); size != "" {
+		if n, err := strconv.Atoi(size); err == nil {
+			c.UpstreamUDPSize = n
+		}
+	}
 	if addr := os.Getenv("DNS_LISTEN_ADDR"); addr != "" {
 		c.DNSListenAddr = addr
 	}
@@ -183,6 +624,146 @@ func (c *Config) LoadFromEnv() {
 			c.DNSPort = p
 		}
 	}
+	if listen := os.Getenv("DNS_LISTEN"); listen != "" {
+		c.DNSListen = listen
+	}
+	if size := os.Getenv("DNS_MAX_UDP_SIZE"); size != "" {
+		if n, err := strconv.Atoi(size); err == nil {
+			c.DNSMaxUDPSize = n
+		}
+	}
+	if listeners := os.Getenv("DNS_LISTENERS"); listeners != "" {
+		if n, err := strconv.Atoi(listeners); err == nil {
+			c.DNSListeners = n
+		}
+	}
+	if limit := os.Getenv("DNS_MAX_IN_FLIGHT"); limit != "" {
+		if n, err := strconv.Atoi(limit); err == nil {
+			c.DNSMaxInFlight = n
+		}
+	}
+	if limit := os.Getenv("DNS_MAX_QUEUED"); limit != "" {
+		if n, err := strconv.Atoi(limit); err == nil {
+			c.DNSMaxQueued = n
+		}
+	}
+	if timeout := os.Getenv("DNS_QUEUE_TIMEOUT"); timeout != "" {
+		if d, err := time.ParseDuration(timeout); err == nil {
+			c.DNSQueueTimeout = d
+		}
+	}
+	if rcode := os.Getenv("DNS_SHED_RCODE"); rcode != "" {
+		c.DNSShedRcode = rcode
+	}
+	if timeout := os.Getenv("DNS_REQUEST_TIMEOUT"); timeout != "" {
+		if d, err := time.ParseDuration(timeout); err == nil {
+			c.DNSRequestTimeout = d
+		}
+	}
+	if port := os.Getenv("DOT_PORT"); port != "" {
+		if p, err := strconv.Atoi(port); err == nil {
+			c.DoTPort = p
+		}
+	}
+	if file := os.Getenv("DOT_CERT_FILE"); file != "" {
+		c.DoTCertFile = file
+	}
+	if file := os.Getenv("DOT_KEY_FILE"); file != "" {
+		c.DoTKeyFile = file
+	}
+	if file := os.Getenv("DOT_CLIENT_CA_FILE"); file != "" {
+		c.DoTClientCAFile = file
+	}
+	if doh := os.Getenv("DOH"); doh != "" {
+		c.DoH = doh == isTrue || doh == "1"
+	}
+	if port := os.Getenv("DOH_PORT"); port != "" {
+		if p, err := strconv.Atoi(port); err == nil {
+			c.DoHPort = p
+		}
+	}
+	if file := os.Getenv("DOH_CERT_FILE"); file != "" {
+		c.DoHCertFile = file
+	}
+	if file := os.Getenv("DOH_KEY_FILE"); file != "" {
+		c.DoHKeyFile = file
+	}
+	if cidrs := os.Getenv("DNS_ALLOW"); cidrs != "" {
+		c.DNSAllow = cidrs
+	}
+	if cidrs := os.Getenv("DNS_DENY"); cidrs != "" {
+		c.DNSDeny = cidrs
+	}
+	if cidrs := os.Getenv("DOT_ALLOW"); cidrs != "" {
+		c.DoTAllow = cidrs
+	}
+	if cidrs := os.Getenv("DOT_DENY"); cidrs != "" {
+		c.DoTDeny = cidrs
+	}
+	if cidrs := os.Getenv("DOH_ALLOW"); cidrs != "" {
+		c.DoHAllow = cidrs
+	}
+	if cidrs := os.Getenv("DOH_DENY"); cidrs != "" {
+		c.DoHDeny = cidrs
+	}
+	if cidrs := os.Getenv("GRPC_ALLOW"); cidrs != "" {
+		c.GRPCAllow = cidrs
+	}
+	if cidrs := os.Getenv("GRPC_DENY"); cidrs != "" {
+		c.GRPCDeny = cidrs
+	}
+	if action := os.Getenv("ACL_ACTION"); action != "" {
+		c.ACLAction = action
+	}
+	if every := os.Getenv("ACL_LOG_EVERY"); every != "" {
+		if n, err := strconv.Atoi(every); err == nil {
+			c.ACLLogEvery = n
+		}
+	}
+	if cidrs := os.Getenv("DNS_PROXY_PROTOCOL"); cidrs != "" {
+		c.DNSProxyProtocol = cidrs
+	}
+	if cidrs := os.Getenv("GRPC_PROXY_PROTOCOL"); cidrs != "" {
+		c.GRPCProxyProtocol = cidrs
+	}
+	if rate := os.Getenv("RRL_RESPONSES_PER_SECOND"); rate != "" {
+		if n, err := strconv.Atoi(rate); err == nil {
+			c.RRLResponsesPerSecond = n
+		}
+	}
+	if rate := os.Getenv("RRL_NODATA_PER_SECOND"); rate != "" {
+		if n, err := strconv.Atoi(rate); err == nil {
+			c.RRLNoDataPerSecond = n
+		}
+	}
+	if rate := os.Getenv("RRL_NXDOMAINS_PER_SECOND"); rate != "" {
+		if n, err := strconv.Atoi(rate); err == nil {
+			c.RRLNXDomainsPerSecond = n
+		}
+	}
+	if rate := os.Getenv("RRL_ERRORS_PER_SECOND"); rate != "" {
+		if n, err := strconv.Atoi(rate); err == nil {
+			c.RRLErrorsPerSecond = n
+		}
+	}
+	if length := os.Getenv("RRL_IPV4_PREFIX_LENGTH"); length != "" {
+		if n, err := strconv.Atoi(length); err == nil {
+			c.RRLIPv4PrefixLen = n
+		}
+	}
+	if length := os.Getenv("RRL_IPV6_PREFIX_LENGTH"); length != "" {
+		if n, err := strconv.Atoi(length); err == nil {
+			c.RRLIPv6PrefixLen = n
+		}
+	}
+	if slip := os.Getenv("RRL_SLIP"); slip != "" {
+		if n, err := strconv.Atoi(slip); err == nil {
+			c.RRLSlip = n
+		}
+	}
+	if cidrs := os.Getenv("RRL_EXEMPT"); cidrs != "" {
+		c.RRLExempt = cidrs
+	}
 	if port := os.Getenv("GRPC_PORT"); port != "" {
 		if p, err := strconv.Atoi(port); err == nil {
 			c.GRPCPort = p
@@ -223,5 +804,94 @@ func splitPatterns(s string) []string {
 // Validate checks if the configuration is valid.
 func (c *Config) Validate() error {
 	// No strict validation required - empty patterns means nothing matches
+	if (c.UpstreamTLSCertFile == "") != (c.UpstreamTLSKeyFile == "") {
+		return fmt.Errorf("upstream TLS client certificate and key must be set together")
+	}
+	if c.DNSMaxUDPSize != 0 && (c.DNSMaxUDPSize < 512 || c.DNSMaxUDPSize > 65535) {
+		return fmt.Errorf("invalid DNS max UDP size %d: must be 0 or between 512 and 65535", c.DNSMaxUDPSize)
+	}
+	if c.DNSListeners < 0 {
+		return fmt.Errorf("invalid DNS listener count %d: must not be negative", c.DNSListeners)
+	}
+	if c.DNSMaxInFlight < 0 || c.DNSMaxQueued < 0 || c.DNSQueueTimeout < 0 || c.DNSRequestTimeout < 0 {
+		return fmt.Errorf("DNS concurrency limits and timeouts must not be negative")
+	}
+	switch strings.ToUpper(strings.TrimSpace(c.DNSShedRcode)) {
+	case "", "REFUSED", "SERVFAIL":
+	default:
+		return fmt.Errorf("invalid DNS shed rcode %q: must be REFUSED or SERVFAIL", c.DNSShedRcode)
+	}
+	if (c.DoTCertFile == "") != (c.DoTKeyFile == "") {
+		return fmt.Errorf("DNS-over-TLS certificate and key must be set together")
+	}
+	if c.DoTClientCAFile != "" && c.DoTCertFile == "" {
+		return fmt.Errorf("DNS-over-TLS client CA requires a DNS-over-TLS certificate")
+	}
+	if (c.DoHCertFile == "") != (c.DoHKeyFile == "") {
+		return fmt.Errorf("DNS-over-HTTPS certificate and key must be set together")
+	}
+	switch strings.ToLower(strings.TrimSpace(c.ACLAction)) {
+	case "", "refuse", "drop":
+	default:
+		return fmt.Errorf("invalid ACL action %q: must be refuse or drop", c.ACLAction)
+	}
+	if c.ACLLogEvery < 0 {
+		return fmt.Errorf("ACL log sample rate must not be negative")
+	}
+	if c.RRLResponsesPerSecond < 0 || c.RRLNoDataPerSecond < 0 || c.RRLNXDomainsPerSecond < 0 || c.RRLErrorsPerSecond < 0 {
+		return fmt.Errorf("RRL rates must not be negative")
+	}
+	if c.RRLIPv4PrefixLen < 1 || c.RRLIPv4PrefixLen > 32 {
+		return fmt.Errorf("invalid RRL IPv4 prefix length %d: must be between 1 and 32", c.RRLIPv4PrefixLen)
+	}
+	if c.RRLIPv6PrefixLen < 1 || c.RRLIPv6PrefixLen > 128 {
+		return fmt.Errorf("invalid RRL IPv6 prefix length %d: must be between 1 and 128", c.RRLIPv6PrefixLen)
+	}
+	if c.RRLSlip < 0 {
+		return fmt.Errorf("RRL slip must not be negative")
+	}
+	switch strings.ToLower(strings.TrimSpace(c.UpstreamStrategy)) {
+	case "", "sequential", "round_robin", "random", "lowest_latency":
+	default:
+		return fmt.Errorf("invalid upstream strategy %q: must be sequential, round_robin, random or lowest_latency", c.UpstreamStrategy)
+	}
+	if c.CacheSize < 0 || c.CacheMinTTL < 0 || c.CacheMaxTTL < 0 {
+		return fmt.Errorf("cache size and TTLs must not be negative")
+	}
+	if c.CacheMaxTTL > 0 && c.CacheMinTTL > c.CacheMaxTTL {
+		return fmt.Errorf("cache min TTL %s exceeds max TTL %s", c.CacheMinTTL, c.CacheMaxTTL)
+	}
+	if c.SnapshotInterval < 0 {
+		return fmt.Errorf("snapshot interval must not be negative")
+	}
+	if c.PrefetchHits < 0 || c.PrefetchWorkers < 0 {
+		return fmt.Errorf("prefetch hits and workers must not be negative")
+	}
+	if c.PrefetchPercentage < 0 || c.PrefetchPercentage > 100 {
+		return fmt.Errorf("prefetch percentage must be between 0 and 100")
+	}
+	if c.StaleMaxAge < 0 || c.StaleAnswerTimeout < 0 {
+		return fmt.Errorf("stale max age and answer timeout must not be negative")
+	}
+	if c.RouteCacheSize < 0 {
+		return fmt.Errorf("route cache size must not be negative")
+	}
+	if c.CNAMEMaxDepth < 0 {
+		return fmt.Errorf("CNAME max depth must not be negative")
+	}
+	if c.UpstreamFailureThreshold < 0 {
+		return fmt.Errorf("upstream failure threshold must not be negative")
+	}
+	if c.UpstreamOpenDuration < 0 || c.UpstreamProbeInterval < 0 {
+		return fmt.Errorf("upstream open duration and probe interval must not be negative")
+	}
+	switch strings.ToUpper(c.UpstreamDoHMethod) {
+	case "", "POST", "GET":
+	default:
+		return fmt.Errorf("invalid upstream DoH method %q: must be POST or GET", c.UpstreamDoHMethod)
+	}
+	if c.UpstreamUDPSize != 0 && (c.UpstreamUDPSize < 512 || c.UpstreamUDPSize > 65535) {
+		return fmt.Errorf("invalid upstream UDP size %d: must be 0 or between 512 and 65535", c.UpstreamUDPSize)
+	}
 	return nil
 }
@@ -2,7 +2,9 @@ package config
 
 import (
 	"os"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/spf13/pflag"
 	"github.com/stretchr/testify/assert"
@@ -24,6 +26,25 @@ func TestDefaultConfig(t *testing.T) {
 	assert.Equal(t, "0.0.0.0", cfg.GRPCListenAddr)
 	assert.Equal(t, "0.0.0.0", cfg.HTTPListenAddr)
 	assert.Equal(t, 5353, cfg.DNSPort)
+	assert.Equal(t, 1232, cfg.DNSMaxUDPSize)
+	assert.Equal(t, runtime.GOMAXPROCS(0), cfg.DNSListeners)
+	assert.Equal(t, 1000, cfg.DNSMaxInFlight)
+	assert.Equal(t, 1000, cfg.DNSMaxQueued)
+	assert.Equal(t, 500*time.Millisecond, cfg.DNSQueueTimeout)
+	assert.Equal(t, "REFUSED", cfg.DNSShedRcode)
+	assert.Equal(t, 10*time.Second, cfg.DNSRequestTimeout)
+	assert.Equal(t, 853, cfg.DoTPort)
+	assert.Empty(t, cfg.DoTCertFile)
+	assert.False(t, cfg.DoH)
+	assert.Equal(t, 443, cfg.DoHPort)
+	assert.Empty(t, cfg.DoHCertFile)
+	assert.Empty(t, cfg.DNSAllow)
+	assert.Equal(t, "refuse", cfg.ACLAction)
+	assert.Equal(t, 100, cfg.ACLLogEvery)
+	assert.Equal(t, 0, cfg.RRLResponsesPerSecond)
+	assert.Equal(t, 24, cfg.RRLIPv4PrefixLen)
+	assert.Equal(t, 56, cfg.RRLIPv6PrefixLen)
+	assert.Equal(t, 2, cfg.RRLSlip)
 	assert.Equal(t, 5354, cfg.GRPCPort)
 	assert.Equal(t, 8080, cfg.HTTPPort)
 }
@@ -443,6 +464,1062 @@ func TestValidate(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestValidate_UpstreamTLSClientCertificate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.UpstreamTLSCertFile = "/etc/ssl/client.pem"
+	assert.Error(t, cfg.Validate())
+
+	cfg.UpstreamTLSKeyFile = "/etc/ssl/client-key.pem"
+	assert.NoError(t, cfg.Validate())
+
+	cfg.UpstreamTLSCertFile = ""
+	assert.Error(t, cfg.Validate())
+}
+
+func TestLoadFromEnv_UpstreamTLS(t *testing.T) {
+	origServerName := os.Getenv("UPSTREAM_TLS_SERVER_NAME")
+	origCAFile := os.Getenv("UPSTREAM_TLS_CA_FILE")
+	origCertFile := os.Getenv("UPSTREAM_TLS_CERT_FILE")
+	origKeyFile := os.Getenv("UPSTREAM_TLS_KEY_FILE")
+
+	defer func() {
+		_ = os.Setenv("UPSTREAM_TLS_SERVER_NAME", origServerName)
+		_ = os.Setenv("UPSTREAM_TLS_CA_FILE", origCAFile)
+		_ = os.Setenv("UPSTREAM_TLS_CERT_FILE", origCertFile)
+		_ = os.Setenv("UPSTREAM_TLS_KEY_FILE", origKeyFile)
+	}()
+
+	_ = os.Setenv("UPSTREAM_TLS_SERVER_NAME", "dns.corp.example")
+	_ = os.Setenv("UPSTREAM_TLS_CA_FILE", "/etc/ssl/corp-ca.pem")
+	_ = os.Setenv("UPSTREAM_TLS_CERT_FILE", "/etc/ssl/client.pem")
+	_ = os.Setenv("UPSTREAM_TLS_KEY_FILE", "/etc/ssl/client-key.pem")
+
+	cfg := DefaultConfig()
+	cfg.LoadFromEnv()
+
+	assert.Equal(t, "dns.corp.example", cfg.UpstreamTLSServerName)
+	assert.Equal(t, "/etc/ssl/corp-ca.pem", cfg.UpstreamTLSCAFile)
+	assert.Equal(t, "/etc/ssl/client.pem", cfg.UpstreamTLSCertFile)
+	assert.Equal(t, "/etc/ssl/client-key.pem", cfg.UpstreamTLSKeyFile)
+}
+
+func TestParseFlags_UpstreamTLS(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+
+	os.Args = []string{
+		"test",
+		"--explicit-resolver=tls://10.0.0.53:853",
+		"--upstream-tls-server-name=dns.corp.example",
+		"--upstream-tls-ca-file=/etc/ssl/corp-ca.pem",
+		"--upstream-tls-cert-file=/etc/ssl/client.pem",
+		"--upstream-tls-key-file=/etc/ssl/client-key.pem",
+	}
+
+	cfg := DefaultConfig()
+	cfg.ParseFlags()
+
+	assert.Equal(t, "tls://10.0.0.53:853", cfg.ExplicitResolver)
+	assert.Equal(t, "dns.corp.example", cfg.UpstreamTLSServerName)
+	assert.Equal(t, "/etc/ssl/corp-ca.pem", cfg.UpstreamTLSCAFile)
+	assert.Equal(t, "/etc/ssl/client.pem", cfg.UpstreamTLSCertFile)
+	assert.Equal(t, "/etc/ssl/client-key.pem", cfg.UpstreamTLSKeyFile)
+}
+
+func TestValidate_DoT(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DoTCertFile = "/etc/ssl/dot.pem"
+	assert.Error(t, cfg.Validate())
+
+	cfg.DoTKeyFile = "/etc/ssl/dot-key.pem"
+	assert.NoError(t, cfg.Validate())
+
+	cfg.DoTClientCAFile = "/etc/ssl/clients.pem"
+	assert.NoError(t, cfg.Validate())
+
+	cfg.DoTCertFile = ""
+	cfg.DoTKeyFile = ""
+	assert.Error(t, cfg.Validate())
+}
+
+func TestLoadFromEnv_DoT(t *testing.T) {
+	envVars := map[string]string{
+		"DOT_PORT":           "8853",
+		"DOT_CERT_FILE":      "/etc/ssl/dot.pem",
+		"DOT_KEY_FILE":       "/etc/ssl/dot-key.pem",
+		"DOT_CLIENT_CA_FILE": "/etc/ssl/clients.pem",
+	}
+	orig := make(map[string]string)
+	for k := range envVars {
+		orig[k] = os.Getenv(k)
+	}
+	defer func() {
+		for k, v := range orig {
+			_ = os.Setenv(k, v)
+		}
+	}()
+	for k, v := range envVars {
+		_ = os.Setenv(k, v)
+	}
+
+	cfg := DefaultConfig()
+	cfg.LoadFromEnv()
+
+	assert.Equal(t, 8853, cfg.DoTPort)
+	assert.Equal(t, "/etc/ssl/dot.pem", cfg.DoTCertFile)
+	assert.Equal(t, "/etc/ssl/dot-key.pem", cfg.DoTKeyFile)
+	assert.Equal(t, "/etc/ssl/clients.pem", cfg.DoTClientCAFile)
+}
+
+func TestParseFlags_DoT(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+
+	os.Args = []string{
+		"test",
+		"--dot-port=8853",
+		"--dot-cert-file=/etc/ssl/dot.pem",
+		"--dot-key-file=/etc/ssl/dot-key.pem",
+		"--dot-client-ca-file=/etc/ssl/clients.pem",
+	}
+
+	cfg := DefaultConfig()
+	cfg.ParseFlags()
+
+	assert.Equal(t, 8853, cfg.DoTPort)
+	assert.Equal(t, "/etc/ssl/dot.pem", cfg.DoTCertFile)
+	assert.Equal(t, "/etc/ssl/dot-key.pem", cfg.DoTKeyFile)
+	assert.Equal(t, "/etc/ssl/clients.pem", cfg.DoTClientCAFile)
+}
+
+func TestValidate_DoH(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DoHCertFile = "/etc/ssl/doh.pem"
+	assert.Error(t, cfg.Validate())
+
+	cfg.DoHKeyFile = "/etc/ssl/doh-key.pem"
+	assert.NoError(t, cfg.Validate())
+
+	cfg.DoHCertFile = ""
+	assert.Error(t, cfg.Validate())
+}
+
+func TestLoadFromEnv_DoH(t *testing.T) {
+	envVars := map[string]string{
+		"DOH":           "true",
+		"DOH_PORT":      "8443",
+		"DOH_CERT_FILE": "/etc/ssl/doh.pem",
+		"DOH_KEY_FILE":  "/etc/ssl/doh-key.pem",
+	}
+	orig := make(map[string]string)
+	for k := range envVars {
+		orig[k] = os.Getenv(k)
+	}
+	defer func() {
+		for k, v := range orig {
+			_ = os.Setenv(k, v)
+		}
+	}()
+	for k, v := range envVars {
+		_ = os.Setenv(k, v)
+	}
+
+	cfg := DefaultConfig()
+	cfg.LoadFromEnv()
+
+	assert.True(t, cfg.DoH)
+	assert.Equal(t, 8443, cfg.DoHPort)
+	assert.Equal(t, "/etc/ssl/doh.pem", cfg.DoHCertFile)
+	assert.Equal(t, "/etc/ssl/doh-key.pem", cfg.DoHKeyFile)
+}
+
+func TestParseFlags_DoH(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+
+	os.Args = []string{
+		"test",
+		"--doh",
+		"--doh-port=8443",
+		"--doh-cert-file=/etc/ssl/doh.pem",
+		"--doh-key-file=/etc/ssl/doh-key.pem",
+	}
+
+	cfg := DefaultConfig()
+	cfg.ParseFlags()
+
+	assert.True(t, cfg.DoH)
+	assert.Equal(t, 8443, cfg.DoHPort)
+	assert.Equal(t, "/etc/ssl/doh.pem", cfg.DoHCertFile)
+	assert.Equal(t, "/etc/ssl/doh-key.pem", cfg.DoHKeyFile)
+}
+
+func TestValidate_ACLAction(t *testing.T) {
+	cfg := DefaultConfig()
+	for _, action := range []string{"", "refuse", "DROP"} {
+		cfg.ACLAction = action
+		assert.NoError(t, cfg.Validate(), action)
+	}
+
+	cfg.ACLAction = "reject"
+	assert.Error(t, cfg.Validate())
+
+	cfg.ACLAction = "drop"
+	cfg.ACLLogEvery = -1
+	assert.Error(t, cfg.Validate())
+}
+
+func TestLoadFromEnv_ACL(t *testing.T) {
+	envVars := map[string]string{
+		"DNS_ALLOW":     "10.0.0.0/8,192.168.0.0/16",
+		"DNS_DENY":      "10.0.0.1",
+		"DOT_ALLOW":     "10.1.0.0/16",
+		"DOT_DENY":      "10.1.0.1",
+		"DOH_ALLOW":     "10.2.0.0/16",
+		"DOH_DENY":      "10.2.0.1",
+		"GRPC_ALLOW":    "10.3.0.0/16",
+		"GRPC_DENY":     "10.3.0.1",
+		"ACL_ACTION":    "drop",
+		"ACL_LOG_EVERY": "10",
+	}
+	orig := make(map[string]string)
+	for k := range envVars {
+		orig[k] = os.Getenv(k)
+	}
+	defer func() {
+		for k, v := range orig {
+			_ = os.Setenv(k, v)
+		}
+	}()
+	for k, v := range envVars {
+		_ = os.Setenv(k, v)
+	}
+
+	cfg := DefaultConfig()
+	cfg.LoadFromEnv()
+
+	assert.Equal(t, "10.0.0.0/8,192.168.0.0/16", cfg.DNSAllow)
+	assert.Equal(t, "10.0.0.1", cfg.DNSDeny)
+	assert.Equal(t, "10.1.0.0/16", cfg.DoTAllow)
+	assert.Equal(t, "10.1.0.1", cfg.DoTDeny)
+	assert.Equal(t, "10.2.0.0/16", cfg.DoHAllow)
+	assert.Equal(t, "10.2.0.1", cfg.DoHDeny)
+	assert.Equal(t, "10.3.0.0/16", cfg.GRPCAllow)
+	assert.Equal(t, "10.3.0.1", cfg.GRPCDeny)
+	assert.Equal(t, "drop", cfg.ACLAction)
+	assert.Equal(t, 10, cfg.ACLLogEvery)
+
+	// Invalid numbers are ignored
+	_ = os.Setenv("ACL_LOG_EVERY", "often")
+	cfg = DefaultConfig()
+	cfg.LoadFromEnv()
+	assert.Equal(t, 100, cfg.ACLLogEvery)
+}
+
+func TestParseFlags_ACL(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+
+	os.Args = []string{
+		"test",
+		"--dns-allow=10.0.0.0/8",
+		"--dns-deny=10.0.0.1",
+		"--dot-allow=10.1.0.0/16",
+		"--dot-deny=10.1.0.1",
+		"--doh-allow=10.2.0.0/16",
+		"--doh-deny=10.2.0.1",
+		"--grpc-allow=10.3.0.0/16",
+		"--grpc-deny=10.3.0.1",
+		"--acl-action=drop",
+		"--acl-log-every=1",
+	}
+
+	cfg := DefaultConfig()
+	cfg.ParseFlags()
+
+	assert.Equal(t, "10.0.0.0/8", cfg.DNSAllow)
+	assert.Equal(t, "10.0.0.1", cfg.DNSDeny)
+	assert.Equal(t, "10.1.0.0/16", cfg.DoTAllow)
+	assert.Equal(t, "10.1.0.1", cfg.DoTDeny)
+	assert.Equal(t, "10.2.0.0/16", cfg.DoHAllow)
+	assert.Equal(t, "10.2.0.1", cfg.DoHDeny)
+	assert.Equal(t, "10.3.0.0/16", cfg.GRPCAllow)
+	assert.Equal(t, "10.3.0.1", cfg.GRPCDeny)
+	assert.Equal(t, "drop", cfg.ACLAction)
+	assert.Equal(t, 1, cfg.ACLLogEvery)
+}
+
+func TestValidate_RRL(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RRLResponsesPerSecond = 20
+	assert.NoError(t, cfg.Validate())
+
+	cfg.RRLNXDomainsPerSecond = -1
+	assert.Error(t, cfg.Validate())
+
+	cfg = DefaultConfig()
+	cfg.RRLIPv4PrefixLen = 33
+	assert.Error(t, cfg.Validate())
+
+	cfg = DefaultConfig()
+	cfg.RRLIPv6PrefixLen = 129
+	assert.Error(t, cfg.Validate())
+
+	cfg = DefaultConfig()
+	cfg.RRLIPv4PrefixLen = 0
+	assert.ErrorContains(t, cfg.Validate(), "must be between 1 and 32")
+
+	cfg = DefaultConfig()
+	cfg.RRLIPv6PrefixLen = 0
+	assert.ErrorContains(t, cfg.Validate(), "must be between 1 and 128")
+
+	cfg = DefaultConfig()
+	cfg.RRLSlip = -1
+	assert.Error(t, cfg.Validate())
+}
+
+func TestLoadFromEnv_RRL(t *testing.T) {
+	envVars := map[string]string{
+		"RRL_RESPONSES_PER_SECOND": "20",
+		"RRL_NODATA_PER_SECOND":    "10",
+		"RRL_NXDOMAINS_PER_SECOND": "5",
+		"RRL_ERRORS_PER_SECOND":    "2",
+		"RRL_IPV4_PREFIX_LENGTH":   "32",
+		"RRL_IPV6_PREFIX_LENGTH":   "64",
+		"RRL_SLIP":                 "0",
+		"RRL_EXEMPT":               "10.0.0.0/8",
+	}
+	orig := make(map[string]string)
+	for k := range envVars {
+		orig[k] = os.Getenv(k)
+	}
+	defer func() {
+		for k, v := range orig {
+			_ = os.Setenv(k, v)
+		}
+	}()
+	for k, v := range envVars {
+		_ = os.Setenv(k, v)
+	}
+
+	cfg := DefaultConfig()
+	cfg.LoadFromEnv()
+
+	assert.Equal(t, 20, cfg.RRLResponsesPerSecond)
+	assert.Equal(t, 10, cfg.RRLNoDataPerSecond)
+	assert.Equal(t, 5, cfg.RRLNXDomainsPerSecond)
+	assert.Equal(t, 2, cfg.RRLErrorsPerSecond)
+	assert.Equal(t, 32, cfg.RRLIPv4PrefixLen)
+	assert.Equal(t, 64, cfg.RRLIPv6PrefixLen)
+	assert.Equal(t, 0, cfg.RRLSlip)
+	assert.Equal(t, "10.0.0.0/8", cfg.RRLExempt)
+
+	// Invalid numbers are ignored
+	_ = os.Setenv("RRL_RESPONSES_PER_SECOND", "lots")
+	cfg = DefaultConfig()
+	cfg.LoadFromEnv()
+	assert.Equal(t, 0, cfg.RRLResponsesPerSecond)
+}
+
+func TestParseFlags_RRL(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+
+	os.Args = []string{
+		"test",
+		"--rrl-responses-per-second=20",
+		"--rrl-nodata-per-second=10",
+		"--rrl-nxdomains-per-second=5",
+		"--rrl-errors-per-second=2",
+		"--rrl-ipv4-prefix-length=32",
+		"--rrl-ipv6-prefix-length=64",
+		"--rrl-slip=1",
+		"--rrl-exempt=10.0.0.0/8,fd00::/8",
+	}
+
+	cfg := DefaultConfig()
+	cfg.ParseFlags()
+
+	assert.Equal(t, 20, cfg.RRLResponsesPerSecond)
+	assert.Equal(t, 10, cfg.RRLNoDataPerSecond)
+	assert.Equal(t, 5, cfg.RRLNXDomainsPerSecond)
+	assert.Equal(t, 2, cfg.RRLErrorsPerSecond)
+	assert.Equal(t, 32, cfg.RRLIPv4PrefixLen)
+	assert.Equal(t, 64, cfg.RRLIPv6PrefixLen)
+	assert.Equal(t, 1, cfg.RRLSlip)
+	assert.Equal(t, "10.0.0.0/8,fd00::/8", cfg.RRLExempt)
+}
+
+func TestValidate_DNSConcurrency(t *testing.T) {
+	cfg := DefaultConfig()
+	for _, rcode := range []string{"", "refused", "SERVFAIL"} {
+		cfg.DNSShedRcode = rcode
+		assert.NoError(t, cfg.Validate(), rcode)
+	}
+
+	cfg.DNSShedRcode = "NXDOMAIN"
+	assert.Error(t, cfg.Validate())
+
+	cfg = DefaultConfig()
+	cfg.DNSMaxInFlight = -1
+	assert.Error(t, cfg.Validate())
+
+	cfg = DefaultConfig()
+	cfg.DNSQueueTimeout = -time.Second
+	assert.Error(t, cfg.Validate())
+
+	cfg = DefaultConfig()
+	cfg.DNSRequestTimeout = -time.Second
+	assert.Error(t, cfg.Validate())
+}
+
+func TestValidate_DNSListeners(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DNSListeners = 0
+	assert.NoError(t, cfg.Validate())
+
+	cfg.DNSListeners = -1
+	assert.Error(t, cfg.Validate())
+}
+
+func TestLoadFromEnv_DNSListeners(t *testing.T) {
+	orig := os.Getenv("DNS_LISTENERS")
+	defer func() { _ = os.Setenv("DNS_LISTENERS", orig) }()
+
+	_ = os.Setenv("DNS_LISTENERS", "8")
+	cfg := DefaultConfig()
+	cfg.LoadFromEnv()
+	assert.Equal(t, 8, cfg.DNSListeners)
+
+	// Invalid values are ignored
+	_ = os.Setenv("DNS_LISTENERS", "all")
+	cfg = DefaultConfig()
+	cfg.LoadFromEnv()
+	assert.Equal(t, runtime.GOMAXPROCS(0), cfg.DNSListeners)
+}
+
+func TestParseFlags_DNSListeners(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+
+	os.Args = []string{"test", "--dns-listeners=4"}
+
+	cfg := DefaultConfig()
+	cfg.ParseFlags()
+
+	assert.Equal(t, 4, cfg.DNSListeners)
+}
+
+func TestLoadFromEnv_DNSListen(t *testing.T) {
+	orig := os.Getenv("DNS_LISTEN")
+	defer func() { _ = os.Setenv("DNS_LISTEN", orig) }()
+
+	_ = os.Setenv("DNS_LISTEN", "169.254.20.10:53,[fd00::53]:53/udp")
+	cfg := DefaultConfig()
+	cfg.LoadFromEnv()
+	assert.Equal(t, "169.254.20.10:53,[fd00::53]:53/udp", cfg.DNSListen)
+}
+
+func TestParseFlags_DNSListen(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+
+	os.Args = []string{"test", "--dns-listen=0.0.0.0:53,0.0.0.0:5353/tcp"}
+
+	cfg := DefaultConfig()
+	cfg.ParseFlags()
+
+	assert.Equal(t, "0.0.0.0:53,0.0.0.0:5353/tcp", cfg.DNSListen)
+}
+
+func TestLoadFromEnv_ProxyProtocol(t *testing.T) {
+	envVars := map[string]string{
+		"DNS_PROXY_PROTOCOL":  "10.0.0.0/8",
+		"GRPC_PROXY_PROTOCOL": "10.1.0.0/16, 10.2.0.1",
+	}
+	orig := make(map[string]string)
+	for k := range envVars {
+		orig[k] = os.Getenv(k)
+	}
+	defer func() {
+		for k, v := range orig {
+			_ = os.Setenv(k, v)
+		}
+	}()
+	for k, v := range envVars {
+		_ = os.Setenv(k, v)
+	}
+
+	cfg := DefaultConfig()
+	cfg.LoadFromEnv()
+
+	assert.Equal(t, "10.0.0.0/8", cfg.DNSProxyProtocol)
+	assert.Equal(t, "10.1.0.0/16, 10.2.0.1", cfg.GRPCProxyProtocol)
+}
+
+func TestParseFlags_ProxyProtocol(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+
+	os.Args = []string{
+		"test",
+		"--dns-proxy-protocol=10.0.0.0/8",
+		"--grpc-proxy-protocol=10.1.0.0/16",
+	}
+
+	cfg := DefaultConfig()
+	cfg.ParseFlags()
+
+	assert.Equal(t, "10.0.0.0/8", cfg.DNSProxyProtocol)
+	assert.Equal(t, "10.1.0.0/16", cfg.GRPCProxyProtocol)
+}
+
+func TestLoadFromEnv_DNSConcurrency(t *testing.T) {
+	envVars := map[string]string{
+		"DNS_MAX_IN_FLIGHT":   "200",
+		"DNS_MAX_QUEUED":      "50",
+		"DNS_QUEUE_TIMEOUT":   "100ms",
+		"DNS_SHED_RCODE":      "SERVFAIL",
+		"DNS_REQUEST_TIMEOUT": "3s",
+	}
+	orig := make(map[string]string)
+	for k := range envVars {
+		orig[k] = os.Getenv(k)
+	}
+	defer func() {
+		for k, v := range orig {
+			_ = os.Setenv(k, v)
+		}
+	}()
+	for k, v := range envVars {
+		_ = os.Setenv(k, v)
+	}
+
+	cfg := DefaultConfig()
+	cfg.LoadFromEnv()
+
+	assert.Equal(t, 200, cfg.DNSMaxInFlight)
+	assert.Equal(t, 50, cfg.DNSMaxQueued)
+	assert.Equal(t, 100*time.Millisecond, cfg.DNSQueueTimeout)
+	assert.Equal(t, "SERVFAIL", cfg.DNSShedRcode)
+	assert.Equal(t, 3*time.Second, cfg.DNSRequestTimeout)
+
+	// Invalid values are ignored
+	_ = os.Setenv("DNS_MAX_IN_FLIGHT", "many")
+	_ = os.Setenv("DNS_REQUEST_TIMEOUT", "soon")
+	cfg = DefaultConfig()
+	cfg.LoadFromEnv()
+	assert.Equal(t, 1000, cfg.DNSMaxInFlight)
+	assert.Equal(t, 10*time.Second, cfg.DNSRequestTimeout)
+}
+
+func TestParseFlags_DNSConcurrency(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+
+	os.Args = []string{
+		"test",
+		"--dns-max-in-flight=200",
+		"--dns-max-queued=0",
+		"--dns-queue-timeout=1s",
+		"--dns-shed-rcode=SERVFAIL",
+		"--dns-request-timeout=5s",
+	}
+
+	cfg := DefaultConfig()
+	cfg.ParseFlags()
+
+	assert.Equal(t, 200, cfg.DNSMaxInFlight)
+	assert.Equal(t, 0, cfg.DNSMaxQueued)
+	assert.Equal(t, time.Second, cfg.DNSQueueTimeout)
+	assert.Equal(t, "SERVFAIL", cfg.DNSShedRcode)
+	assert.Equal(t, 5*time.Second, cfg.DNSRequestTimeout)
+}
+
+func TestValidate_UpstreamDoHMethod(t *testing.T) {
+	cfg := DefaultConfig()
+	for _, method := range []string{"POST", "GET", "get", ""} {
+		cfg.UpstreamDoHMethod = method
+		assert.NoError(t, cfg.Validate(), method)
+	}
+
+	cfg.UpstreamDoHMethod = "PUT"
+	assert.Error(t, cfg.Validate())
+}
+
+func TestValidate_UpstreamStrategy(t *testing.T) {
+	cfg := DefaultConfig()
+	for _, strategy := range []string{"", "sequential", "round_robin", "random", "lowest_latency", "Round_Robin"} {
+		cfg.UpstreamStrategy = strategy
+		assert.NoError(t, cfg.Validate(), strategy)
+	}
+
+	cfg.UpstreamStrategy = "fastest"
+	assert.Error(t, cfg.Validate())
+}
+
+func TestLoadFromEnv_RulesFile(t *testing.T) {
+	orig := os.Getenv("RULES_FILE")
+	defer func() { _ = os.Setenv("RULES_FILE", orig) }()
+	_ = os.Setenv("RULES_FILE", "/etc/nameserver-switcher/rules.json")
+
+	cfg := DefaultConfig()
+	cfg.LoadFromEnv()
+
+	assert.Equal(t, "/etc/nameserver-switcher/rules.json", cfg.RulesFile)
+}
+
+func TestLoadFromEnv_ProbeResolver(t *testing.T) {
+	orig := os.Getenv("PROBE_RESOLVER")
+	defer func() { _ = os.Setenv("PROBE_RESOLVER", orig) }()
+	_ = os.Setenv("PROBE_RESOLVER", "10.0.0.53:53,10.0.0.54:53")
+
+	cfg := DefaultConfig()
+	cfg.LoadFromEnv()
+
+	assert.Equal(t, "10.0.0.53:53,10.0.0.54:53", cfg.ProbeResolver)
+}
+
+func TestLoadFromEnv_CNAMEMaxDepth(t *testing.T) {
+	orig := os.Getenv("CNAME_MAX_DEPTH")
+	defer func() { _ = os.Setenv("CNAME_MAX_DEPTH", orig) }()
+
+	_ = os.Setenv("CNAME_MAX_DEPTH", "4")
+	cfg := DefaultConfig()
+	assert.Equal(t, 8, cfg.CNAMEMaxDepth)
+	cfg.LoadFromEnv()
+	assert.Equal(t, 4, cfg.CNAMEMaxDepth)
+
+	_ = os.Setenv("CNAME_MAX_DEPTH", "deep")
+	cfg = DefaultConfig()
+	cfg.LoadFromEnv()
+	assert.Equal(t, 8, cfg.CNAMEMaxDepth)
+}
+
+func TestParseFlags_RulesFile(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+	os.Args = []string{"test", "--rules-file=rules.json", "--cname-max-depth=3", "--probe-resolver=10.0.0.53:53"}
+
+	cfg := DefaultConfig()
+	cfg.ParseFlags()
+
+	assert.Equal(t, "10.0.0.53:53", cfg.ProbeResolver)
+	assert.Equal(t, "rules.json", cfg.RulesFile)
+	assert.Equal(t, 3, cfg.CNAMEMaxDepth)
+}
+
+func TestLoadFromEnv_FailurePolicies(t *testing.T) {
+	envVars := map[string]string{
+		"EXPLICIT_FAILURE_POLICY":          "fallback:system",
+		"PASSTHROUGH_FAILURE_POLICY":       "stale",
+		"NO_CNAME_RESPONSE_FAILURE_POLICY": "rcode:REFUSED",
+		"NO_CNAME_MATCH_FAILURE_POLICY":    "retry:3:50ms",
+		"FAILURE_RCODES":                   "SERVFAIL,REFUSED",
+	}
+	for key, value := range envVars {
+		orig := os.Getenv(key)
+		defer func(key, orig string) { _ = os.Setenv(key, orig) }(key, orig)
+		_ = os.Setenv(key, value)
+	}
+
+	cfg := DefaultConfig()
+	cfg.LoadFromEnv()
+
+	assert.Equal(t, "fallback:system", cfg.ExplicitFailurePolicy)
+	assert.Equal(t, "stale", cfg.PassthroughFailurePolicy)
+	assert.Equal(t, "rcode:REFUSED", cfg.NoCnameResponseFailurePolicy)
+	assert.Equal(t, "retry:3:50ms", cfg.NoCnameMatchFailurePolicy)
+	assert.Equal(t, "SERVFAIL,REFUSED", cfg.FailureRcodes)
+}
+
+func TestParseFlags_FailurePolicies(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+
+	os.Args = []string{
+		"test",
+		"--explicit-failure-policy=fallback:passthrough",
+		"--passthrough-failure-policy=retry",
+		"--no-cname-response-failure-policy=stale",
+		"--no-cname-match-failure-policy=rcode:NXDOMAIN",
+		"--failure-rcodes=SERVFAIL",
+	}
+
+	cfg := DefaultConfig()
+	cfg.ParseFlags()
+
+	assert.Equal(t, "fallback:passthrough", cfg.ExplicitFailurePolicy)
+	assert.Equal(t, "retry", cfg.PassthroughFailurePolicy)
+	assert.Equal(t, "stale", cfg.NoCnameResponseFailurePolicy)
+	assert.Equal(t, "rcode:NXDOMAIN", cfg.NoCnameMatchFailurePolicy)
+	assert.Equal(t, "SERVFAIL", cfg.FailureRcodes)
+}
+
+func TestValidate_UpstreamHealth(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.UpstreamFailureThreshold = 0
+	cfg.UpstreamProbeInterval = 0
+	assert.NoError(t, cfg.Validate())
+
+	cfg.UpstreamFailureThreshold = -1
+	assert.Error(t, cfg.Validate())
+
+	cfg.UpstreamFailureThreshold = 3
+	cfg.UpstreamOpenDuration = -time.Second
+	assert.Error(t, cfg.Validate())
+}
+
+func TestLoadFromEnv_Cache(t *testing.T) {
+	envVars := map[string]string{
+		"CACHE_SIZE":       "500",
+		"CACHE_MIN_TTL":    "30s",
+		"CACHE_MAX_TTL":    "1h",
+		"ROUTE_CACHE_SIZE": "50",
+	}
+	for key, value := range envVars {
+		orig := os.Getenv(key)
+		defer func(key, orig string) { _ = os.Setenv(key, orig) }(key, orig)
+		_ = os.Setenv(key, value)
+	}
+
+	cfg := DefaultConfig()
+	assert.Equal(t, 10000, cfg.CacheSize)
+	assert.Equal(t, 24*time.Hour, cfg.CacheMaxTTL)
+	assert.Equal(t, 10000, cfg.RouteCacheSize)
+
+	cfg.LoadFromEnv()
+	assert.Equal(t, 500, cfg.CacheSize)
+	assert.Equal(t, 30*time.Second, cfg.CacheMinTTL)
+	assert.Equal(t, time.Hour, cfg.CacheMaxTTL)
+	assert.Equal(t, 50, cfg.RouteCacheSize)
+}
+
+func TestParseFlags_Cache(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+	os.Args = []string{"test", "--cache-size=0", "--cache-min-ttl=5s", "--cache-max-ttl=10m", "--route-cache-size=0"}
+
+	cfg := DefaultConfig()
+	cfg.ParseFlags()
+
+	assert.Equal(t, 0, cfg.CacheSize)
+	assert.Equal(t, 5*time.Second, cfg.CacheMinTTL)
+	assert.Equal(t, 10*time.Minute, cfg.CacheMaxTTL)
+	assert.Equal(t, 0, cfg.RouteCacheSize)
+}
+
+func TestValidate_Cache(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CacheSize = -1
+	assert.Error(t, cfg.Validate())
+
+	cfg = DefaultConfig()
+	cfg.CacheMinTTL = 2 * time.Hour
+	cfg.CacheMaxTTL = time.Hour
+	err := cfg.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "exceeds max TTL")
+
+	cfg.CacheMaxTTL = 0
+	assert.NoError(t, cfg.Validate())
+
+	cfg.RouteCacheSize = -1
+	assert.Error(t, cfg.Validate())
+}
+
+func TestLoadFromEnv_Snapshot(t *testing.T) {
+	envVars := map[string]string{
+		"SNAPSHOT_FILE":     "/var/lib/nameserver-switcher/snapshot.json",
+		"SNAPSHOT_INTERVAL": "1m",
+	}
+	for key, value := range envVars {
+		orig := os.Getenv(key)
+		defer func(key, orig string) { _ = os.Setenv(key, orig) }(key, orig)
+		_ = os.Setenv(key, value)
+	}
+
+	cfg := DefaultConfig()
+	assert.Empty(t, cfg.SnapshotFile)
+	assert.Equal(t, 5*time.Minute, cfg.SnapshotInterval)
+
+	cfg.LoadFromEnv()
+	assert.Equal(t, "/var/lib/nameserver-switcher/snapshot.json", cfg.SnapshotFile)
+	assert.Equal(t, time.Minute, cfg.SnapshotInterval)
+}
+
+func TestParseFlags_Snapshot(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+	os.Args = []string{"test", "--snapshot-file=/tmp/snapshot.json", "--snapshot-interval=0"}
+
+	cfg := DefaultConfig()
+	cfg.ParseFlags()
+
+	assert.Equal(t, "/tmp/snapshot.json", cfg.SnapshotFile)
+	assert.Equal(t, time.Duration(0), cfg.SnapshotInterval)
+
+	cfg.SnapshotInterval = -time.Second
+	assert.Error(t, cfg.Validate())
+}
+
+func TestLoadFromEnv_Prefetch(t *testing.T) {
+	envVars := map[string]string{
+		"PREFETCH_HITS":       "20",
+		"PREFETCH_PERCENTAGE": "25",
+		"PREFETCH_WORKERS":    "8",
+	}
+	for key, value := range envVars {
+		orig := os.Getenv(key)
+		defer func(key, orig string) { _ = os.Setenv(key, orig) }(key, orig)
+		_ = os.Setenv(key, value)
+	}
+
+	cfg := DefaultConfig()
+	assert.Equal(t, 5, cfg.PrefetchHits)
+	assert.Equal(t, 10, cfg.PrefetchPercentage)
+	assert.Equal(t, 4, cfg.PrefetchWorkers)
+
+	cfg.LoadFromEnv()
+	assert.Equal(t, 20, cfg.PrefetchHits)
+	assert.Equal(t, 25, cfg.PrefetchPercentage)
+	assert.Equal(t, 8, cfg.PrefetchWorkers)
+}
+
+func TestParseFlags_Prefetch(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+	os.Args = []string{"test", "--prefetch-hits=0", "--prefetch-percentage=50", "--prefetch-workers=2"}
+
+	cfg := DefaultConfig()
+	cfg.ParseFlags()
+
+	assert.Equal(t, 0, cfg.PrefetchHits)
+	assert.Equal(t, 50, cfg.PrefetchPercentage)
+	assert.Equal(t, 2, cfg.PrefetchWorkers)
+}
+
+func TestValidate_Prefetch(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PrefetchHits = -1
+	assert.Error(t, cfg.Validate())
+
+	cfg = DefaultConfig()
+	cfg.PrefetchWorkers = -1
+	assert.Error(t, cfg.Validate())
+
+	cfg = DefaultConfig()
+	cfg.PrefetchPercentage = 101
+	assert.Error(t, cfg.Validate())
+}
+
+func TestLoadFromEnv_ServeStale(t *testing.T) {
+	envVars := map[string]string{
+		"SERVE_STALE":          "false",
+		"STALE_MAX_AGE":        "1h",
+		"STALE_ANSWER_TIMEOUT": "500ms",
+	}
+	for key, value := range envVars {
+		orig := os.Getenv(key)
+		defer func(key, orig string) { _ = os.Setenv(key, orig) }(key, orig)
+		_ = os.Setenv(key, value)
+	}
+
+	cfg := DefaultConfig()
+	assert.True(t, cfg.ServeStale)
+	assert.Equal(t, 24*time.Hour, cfg.StaleMaxAge)
+	assert.Equal(t, 1800*time.Millisecond, cfg.StaleAnswerTimeout)
+
+	cfg.LoadFromEnv()
+	assert.False(t, cfg.ServeStale)
+	assert.Equal(t, time.Hour, cfg.StaleMaxAge)
+	assert.Equal(t, 500*time.Millisecond, cfg.StaleAnswerTimeout)
+}
+
+func TestParseFlags_ServeStale(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+	os.Args = []string{"test", "--serve-stale=false", "--stale-max-age=72h", "--stale-answer-timeout=0"}
+
+	cfg := DefaultConfig()
+	cfg.ParseFlags()
+
+	assert.False(t, cfg.ServeStale)
+	assert.Equal(t, 72*time.Hour, cfg.StaleMaxAge)
+	assert.Equal(t, time.Duration(0), cfg.StaleAnswerTimeout)
+}
+
+func TestValidate_ServeStale(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.StaleMaxAge = -time.Second
+	assert.Error(t, cfg.Validate())
+
+	cfg = DefaultConfig()
+	cfg.StaleAnswerTimeout = -time.Second
+	assert.Error(t, cfg.Validate())
+}
+
+func TestValidate_CNAMEMaxDepth(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CNAMEMaxDepth = -1
+	err := cfg.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "CNAME max depth")
+
+	cfg.CNAMEMaxDepth = 0
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestValidate_UpstreamUDPSize(t *testing.T) {
+	cfg := DefaultConfig()
+	for _, size := range []int{0, 512, 1232, 4096, 65535} {
+		cfg.UpstreamUDPSize = size
+		assert.NoError(t, cfg.Validate(), size)
+	}
+	for _, size := range []int{-1, 511, 65536} {
+		cfg.UpstreamUDPSize = size
+		assert.Error(t, cfg.Validate(), size)
+	}
+}
+
+func TestValidate_DNSMaxUDPSize(t *testing.T) {
+	cfg := DefaultConfig()
+	for _, size := range []int{0, 512, 1232, 4096, 65535} {
+		cfg.DNSMaxUDPSize = size
+		assert.NoError(t, cfg.Validate(), size)
+	}
+	for _, size := range []int{-1, 511, 65536} {
+		cfg.DNSMaxUDPSize = size
+		assert.Error(t, cfg.Validate(), size)
+	}
+}
+
+func TestLoadFromEnv_DNSMaxUDPSize(t *testing.T) {
+	orig := os.Getenv("DNS_MAX_UDP_SIZE")
+	defer func() { _ = os.Setenv("DNS_MAX_UDP_SIZE", orig) }()
+
+	_ = os.Setenv("DNS_MAX_UDP_SIZE", "4096")
+	cfg := DefaultConfig()
+	cfg.LoadFromEnv()
+	assert.Equal(t, 4096, cfg.DNSMaxUDPSize)
+
+	// Invalid values are ignored
+	_ = os.Setenv("DNS_MAX_UDP_SIZE", "large")
+	cfg = DefaultConfig()
+	cfg.LoadFromEnv()
+	assert.Equal(t, 1232, cfg.DNSMaxUDPSize)
+}
+
+func TestLoadFromEnv_UpstreamTransport(t *testing.T) {
+	origTimeout := os.Getenv("UPSTREAM_TIMEOUT")
+	origMethod := os.Getenv("UPSTREAM_DOH_METHOD")
+	origUDPSize := os.Getenv("UPSTREAM_UDP_SIZE")
+	origStrategy := os.Getenv("UPSTREAM_STRATEGY")
+	origThreshold := os.Getenv("UPSTREAM_FAILURE_THRESHOLD")
+	origOpenDuration := os.Getenv("UPSTREAM_OPEN_DURATION")
+	origProbeInterval := os.Getenv("UPSTREAM_PROBE_INTERVAL")
+
+	defer func() {
+		_ = os.Setenv("UPSTREAM_FAILURE_THRESHOLD", origThreshold)
+		_ = os.Setenv("UPSTREAM_OPEN_DURATION", origOpenDuration)
+		_ = os.Setenv("UPSTREAM_PROBE_INTERVAL", origProbeInterval)
+		_ = os.Setenv("UPSTREAM_STRATEGY", origStrategy)
+		_ = os.Setenv("UPSTREAM_TIMEOUT", origTimeout)
+		_ = os.Setenv("UPSTREAM_DOH_METHOD", origMethod)
+		_ = os.Setenv("UPSTREAM_UDP_SIZE", origUDPSize)
+	}()
+
+	_ = os.Setenv("UPSTREAM_TIMEOUT", "2s")
+	_ = os.Setenv("UPSTREAM_DOH_METHOD", "GET")
+	_ = os.Setenv("UPSTREAM_UDP_SIZE", "4096")
+	_ = os.Setenv("UPSTREAM_STRATEGY", "lowest_latency")
+	_ = os.Setenv("UPSTREAM_FAILURE_THRESHOLD", "5")
+	_ = os.Setenv("UPSTREAM_OPEN_DURATION", "30s")
+	_ = os.Setenv("UPSTREAM_PROBE_INTERVAL", "0s")
+
+	cfg := DefaultConfig()
+	cfg.LoadFromEnv()
+
+	assert.Equal(t, 2*time.Second, cfg.UpstreamTimeout)
+	assert.Equal(t, "GET", cfg.UpstreamDoHMethod)
+	assert.Equal(t, 4096, cfg.UpstreamUDPSize)
+	assert.Equal(t, "lowest_latency", cfg.UpstreamStrategy)
+	assert.Equal(t, 5, cfg.UpstreamFailureThreshold)
+	assert.Equal(t, 30*time.Second, cfg.UpstreamOpenDuration)
+	assert.Equal(t, time.Duration(0), cfg.UpstreamProbeInterval)
+
+	// Invalid values are ignored
+	_ = os.Setenv("UPSTREAM_TIMEOUT", "soon")
+	_ = os.Setenv("UPSTREAM_UDP_SIZE", "large")
+	cfg = DefaultConfig()
+	cfg.LoadFromEnv()
+	assert.Equal(t, 5*time.Second, cfg.UpstreamTimeout)
+	assert.Equal(t, 1232, cfg.UpstreamUDPSize)
+}
+
+func TestParseFlags_UpstreamTransport(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+
+	os.Args = []string{
+		"test",
+		"--explicit-resolver=https://dns.corp.example/dns-query,tls://10.0.0.53",
+		"--upstream-strategy=round_robin",
+		"--upstream-failure-threshold=0",
+		"--upstream-open-duration=1m",
+		"--upstream-probe-interval=2s",
+		"--upstream-timeout=1500ms",
+		"--upstream-doh-method=GET",
+		"--upstream-udp-size=0",
+		"--dns-max-udp-size=4096",
+	}
+
+	cfg := DefaultConfig()
+	cfg.ParseFlags()
+
+	assert.Equal(t, "https://dns.corp.example/dns-query,tls://10.0.0.53", cfg.ExplicitResolver)
+	assert.Equal(t, "round_robin", cfg.UpstreamStrategy)
+	assert.Equal(t, 0, cfg.UpstreamFailureThreshold)
+	assert.Equal(t, time.Minute, cfg.UpstreamOpenDuration)
+	assert.Equal(t, 2*time.Second, cfg.UpstreamProbeInterval)
+	assert.Equal(t, 1500*time.Millisecond, cfg.UpstreamTimeout)
+	assert.Equal(t, "GET", cfg.UpstreamDoHMethod)
+	assert.Equal(t, 0, cfg.UpstreamUDPSize)
+	assert.Equal(t, 4096, cfg.DNSMaxUDPSize)
+}
+
 // TestConfigPriority_FlagOverridesEnvAndDefault tests that CLI flags take precedence
 // over environment variables and defaults.
 // Priority order: flag (highest) > environment variable > default (lowest)
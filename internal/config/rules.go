@@ -0,0 +1,72 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// RuleConfig describes a routing rule in a rules file.
+//
+// Resolver fields take either a comma-separated list of upstream addresses or the
+// name of a configured resolver (explicit, probe, system, passthrough, no-cname-response,
+// no-cname-match). Empty fields are unused.
+type RuleConfig struct {
+	// Name identifies the rule in logs and resolver names.
+	Name string `json:"name"`
+	// RequestPatterns select the requests handled by the rule; empty matches every request.
+	RequestPatterns []string `json:"request_patterns"`
+	// CNAMEPatterns select the probed CNAMEs answered by TargetResolver.
+	CNAMEPatterns []string `json:"cname_patterns"`
+	// ProbeResolver is queried first to discover CNAMEs; empty answers from TargetResolver directly.
+	ProbeResolver string `json:"probe_resolver"`
+	// TargetResolver answers requests without probe and requests whose CNAME matched.
+	TargetResolver string `json:"target_resolver"`
+	// NoCnameResponseResolver answers probed requests without CNAME.
+	NoCnameResponseResolver string `json:"no_cname_response_resolver"`
+	// NoCnameMatchResolver answers probed requests whose CNAME did not match.
+	NoCnameMatchResolver string `json:"no_cname_match_resolver"`
+	// FailurePolicy applies to all resolvers of the rule (see ExplicitFailurePolicy).
+	FailurePolicy string `json:"failure_policy"`
+}
+
+// rulesFile is the layout of a rules file.
+type rulesFile struct {
+	Rules []RuleConfig `json:"rules"`
+}
+
+// LoadRules reads the routing rules from a JSON rules file. Rules that could not
+// answer every request they match are rejected.
+func LoadRules(path string) ([]RuleConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %w", err)
+	}
+
+	var file rulesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file %s: %w", path, err)
+	}
+
+	names := make(map[string]bool, len(file.Rules))
+	for i, rule := range file.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d in %s has no name", i+1, path)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate rule name %q in %s", rule.Name, path)
+		}
+		names[rule.Name] = true
+		if rule.TargetResolver == "" && rule.ProbeResolver == "" && rule.NoCnameResponseResolver == "" {
+			return nil, fmt.Errorf("rule %q needs a probe, target or no-cname-response resolver", rule.Name)
+		}
+		// Probed requests are answered by the no-cname resolvers, which the rule must name
+		if rule.ProbeResolver != "" && rule.NoCnameResponseResolver == "" {
+			return nil, fmt.Errorf("rule %q has a probe resolver but no no-cname-response resolver", rule.Name)
+		}
+		if rule.ProbeResolver != "" && len(rule.CNAMEPatterns) > 0 && rule.NoCnameMatchResolver == "" {
+			return nil, fmt.Errorf("rule %q has CNAME patterns but no no-cname-match resolver", rule.Name)
+		}
+	}
+	return file.Rules, nil
+}
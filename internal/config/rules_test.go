@@ -0,0 +1,85 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeRulesFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadRules(t *testing.T) {
+	path := writeRulesFile(t, `{
+  "rules": [
+    {
+      "name": "corp",
+      "request_patterns": [".*\\.corp\\.example$"],
+      "cname_patterns": [".*\\.cdn\\.corp$"],
+      "probe_resolver": "10.0.0.53:53",
+      "target_resolver": "tls://10.0.0.53",
+      "no_cname_response_resolver": "system",
+      "no_cname_match_resolver": "passthrough",
+      "failure_policy": "fallback:system"
+    },
+    {
+      "name": "partner",
+      "request_patterns": [".*\\.partner\\.example$"],
+      "target_resolver": "10.1.0.53:53"
+    }
+  ]
+}`)
+
+	rules, err := LoadRules(path)
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+
+	assert.Equal(t, RuleConfig{
+		Name:                    "corp",
+		RequestPatterns:         []string{`.*\.corp\.example$`},
+		CNAMEPatterns:           []string{`.*\.cdn\.corp$`},
+		ProbeResolver:           "10.0.0.53:53",
+		TargetResolver:          "tls://10.0.0.53",
+		NoCnameResponseResolver: "system",
+		NoCnameMatchResolver:    "passthrough",
+		FailurePolicy:           "fallback:system",
+	}, rules[0])
+	assert.Equal(t, "partner", rules[1].Name)
+	assert.Equal(t, "10.1.0.53:53", rules[1].TargetResolver)
+}
+
+func TestLoadRules_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		errMsg  string
+	}{
+		{"InvalidJSON", `{"rules": [`, "failed to parse rules file"},
+		{"MissingName", `{"rules": [{"target_resolver": "system"}]}`, "has no name"},
+		{"DuplicateName", `{"rules": [{"name": "a", "target_resolver": "system"}, {"name": "a", "target_resolver": "system"}]}`, "duplicate rule name"},
+		{"NoResolver", `{"rules": [{"name": "a", "no_cname_match_resolver": "system"}]}`, "needs a probe, target or no-cname-response resolver"},
+		{"ProbeOnly", `{"rules": [{"name": "a", "probe_resolver": "system"}]}`, "no no-cname-response resolver"},
+		{"ProbeWithoutNoCnameMatch", `{"rules": [{"name": "a", "cname_patterns": ["cdn$"], "probe_resolver": "system", "no_cname_response_resolver": "system"}]}`, "no no-cname-match resolver"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadRules(writeRulesFile(t, tt.content))
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+
+	t.Run("MissingFile", func(t *testing.T) {
+		_, err := LoadRules(filepath.Join(t.TempDir(), "missing.json"))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to read rules file")
+	})
+}
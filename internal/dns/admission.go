@@ -0,0 +1,88 @@
+package dns
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+)
+
+const (
+	// shedQueueFull labels requests shed because the queue was full.
+	shedQueueFull = "queue_full"
+	// shedQueueTimeout labels requests shed because no slot freed up in time.
+	shedQueueTimeout = "queue_timeout"
+)
+
+// admission bounds the number of requests handled concurrently. Requests beyond the
+// limit wait in a bounded queue for at most a deadline and are shed otherwise.
+type admission struct {
+	slots     chan struct{}
+	maxQueued int64
+	timeout   time.Duration
+	queued    atomic.Int64
+	metrics   *metrics.Metrics
+}
+
+// newAdmission creates an admission control allowing maxInFlight concurrent requests
+// and queueing up to maxQueued more for at most timeout. It returns nil, which admits
+// every request, when maxInFlight is not positive.
+func newAdmission(maxInFlight, maxQueued int, timeout time.Duration, m *metrics.Metrics) *admission {
+	if maxInFlight <= 0 {
+		return nil
+	}
+	return &admission{
+		slots:     make(chan struct{}, maxInFlight),
+		maxQueued: int64(maxQueued),
+		timeout:   timeout,
+		metrics:   m,
+	}
+}
+
+// acquire takes a slot, queueing for one if none is free. It returns the reason the
+// request is shed, or an empty string once the request holds a slot that must be
+// given back with release.
+func (a *admission) acquire() string {
+	if a == nil {
+		return ""
+	}
+
+	select {
+	case a.slots <- struct{}{}:
+		return ""
+	default:
+	}
+
+	if a.timeout <= 0 {
+		return shedQueueFull
+	}
+	if a.queued.Add(1) > a.maxQueued {
+		a.queued.Add(-1)
+		return shedQueueFull
+	}
+	if a.metrics != nil {
+		a.metrics.IncQueuedRequests()
+	}
+	defer func() {
+		a.queued.Add(-1)
+		if a.metrics != nil {
+			a.metrics.DecQueuedRequests()
+		}
+	}()
+
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+	select {
+	case a.slots <- struct{}{}:
+		return ""
+	case <-timer.C:
+		return shedQueueTimeout
+	}
+}
+
+// release gives back a slot taken by acquire.
+func (a *admission) release() {
+	if a != nil {
+		<-a.slots
+	}
+}
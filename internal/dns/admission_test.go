@@ -0,0 +1,162 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+	"github.com/steigr/nameserver-switcher/internal/resolver"
+)
+
+// blockingResolver answers once release is closed, or fails when the request times out.
+type blockingResolver struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingResolver() *blockingResolver {
+	return &blockingResolver{started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (b *blockingResolver) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	b.started <- struct{}{}
+	select {
+	case <-b.release:
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (b *blockingResolver) Name() string {
+	return "system"
+}
+
+func TestAdmission_Disabled(t *testing.T) {
+	a := newAdmission(0, 10, time.Second, nil)
+	assert.Nil(t, a)
+	for i := 0; i < 3; i++ {
+		assert.Empty(t, a.acquire())
+	}
+	a.release()
+}
+
+func TestAdmission_QueueFull(t *testing.T) {
+	a := newAdmission(1, 0, time.Second, nil)
+
+	require.Empty(t, a.acquire())
+	assert.Equal(t, shedQueueFull, a.acquire(), "no queue sheds at once")
+
+	a.release()
+	assert.Empty(t, a.acquire())
+}
+
+func TestAdmission_Queue(t *testing.T) {
+	m := metrics.NewMetrics("test_dns_admission_queue")
+	a := newAdmission(1, 1, 5*time.Second, m)
+	require.Empty(t, a.acquire())
+
+	queued := make(chan string)
+	go func() { queued <- a.acquire() }()
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(m.QueuedRequests) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// The queue holds one request
+	assert.Equal(t, shedQueueFull, a.acquire())
+
+	// A freed slot goes to the queued request
+	a.release()
+	assert.Empty(t, <-queued)
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.QueuedRequests))
+	a.release()
+}
+
+func TestAdmission_QueueTimeout(t *testing.T) {
+	a := newAdmission(1, 1, 20*time.Millisecond, nil)
+	require.Empty(t, a.acquire())
+
+	start := time.Now()
+	assert.Equal(t, shedQueueTimeout, a.acquire())
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	assert.Equal(t, int64(0), a.queued.Load())
+}
+
+func TestServer_HandleRequest_LoadShedding(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		shedRcode int
+		expected  int
+	}{
+		{name: "default", expected: dns.RcodeRefused},
+		{name: "servfail", shedRcode: dns.RcodeServerFailure, expected: dns.RcodeServerFailure},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			blocking := newBlockingResolver()
+			m := metrics.NewMetrics("test_dns_shed_" + tt.name)
+			server := NewServer(ServerConfig{
+				Addr:        "127.0.0.1",
+				Router:      resolver.NewRouter(resolver.RouterConfig{SystemResolver: blocking}),
+				Metrics:     m,
+				MaxInFlight: 1,
+				ShedRcode:   tt.shedRcode,
+			})
+
+			req := &dns.Msg{}
+			req.SetQuestion("test.com.", dns.TypeA)
+			remote := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+			// The first request holds the only slot
+			first := &mockResponseWriter{remoteAddr: remote}
+			done := make(chan struct{})
+			go func() {
+				server.handleRequest(first, req, "test")
+				close(done)
+			}()
+			<-blocking.started
+			assert.Equal(t, 1.0, testutil.ToFloat64(m.ActiveConnections))
+
+			// so the next one is shed
+			w := &mockResponseWriter{remoteAddr: remote}
+			server.handleRequest(w, req, "test")
+			require.NotNil(t, w.written)
+			assert.Equal(t, tt.expected, w.written.Rcode)
+			assert.Equal(t, 1.0, testutil.ToFloat64(m.ShedRequests.WithLabelValues("udp", shedQueueFull)))
+
+			close(blocking.release)
+			<-done
+			require.NotNil(t, first.written)
+			assert.Equal(t, dns.RcodeSuccess, first.written.Rcode)
+			assert.Equal(t, 0.0, testutil.ToFloat64(m.ActiveConnections))
+		})
+	}
+}
+
+func TestServer_HandleRequest_RequestTimeout(t *testing.T) {
+	server := NewServer(ServerConfig{
+		Addr:           "127.0.0.1",
+		Router:         resolver.NewRouter(resolver.RouterConfig{SystemResolver: newBlockingResolver()}),
+		RequestTimeout: 50 * time.Millisecond,
+	})
+	assert.Equal(t, 50*time.Millisecond, server.requestTimeout)
+	assert.Equal(t, defaultRequestTimeout, NewServer(ServerConfig{}).requestTimeout)
+
+	req := &dns.Msg{}
+	req.SetQuestion("test.com.", dns.TypeA)
+	w := &mockResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}}
+
+	start := time.Now()
+	server.handleRequest(w, req, "test")
+	assert.Less(t, time.Since(start), 5*time.Second)
+	require.NotNil(t, w.written)
+	assert.Equal(t, dns.RcodeServerFailure, w.written.Rcode)
+}
@@ -0,0 +1,156 @@
+package dns
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/steigr/nameserver-switcher/internal/logging"
+	"github.com/steigr/nameserver-switcher/internal/resolver"
+)
+
+const (
+	// DoHPath is the path of the DNS-over-HTTPS endpoint (RFC 8484).
+	DoHPath = "/dns-query"
+	// dohContentType is the media type of DNS messages in DNS-over-HTTPS.
+	dohContentType = "application/dns-message"
+)
+
+// DoHHandler returns an RFC 8484 DNS-over-HTTPS handler. Queries are read from the
+// dns parameter of GET requests or the body of POST requests and answered through the
+// same path as UDP and TCP queries, labelled with protocol doh.
+func (s *Server) DoHHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, status, err := readDoHRequest(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		rw := &dohResponseWriter{remoteAddr: &net.TCPAddr{}}
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			rw.remoteAddr = addr
+		}
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			rw.localAddr = addr
+		}
+
+		s.handleRequest(rw, req, "doh")
+		if rw.closed {
+			// Queries dropped by the access control list get no DNS answer
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if rw.msg == nil {
+			http.Error(w, "no response", http.StatusInternalServerError)
+			return
+		}
+
+		packed, err := rw.msg.Pack()
+		if err != nil {
+			logging.Errorf("Error packing DoH response: %v", err)
+			http.Error(w, "failed to pack response", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", dohContentType)
+		// RFC 8484 section 5.1: the freshness lifetime is the lowest TTL of the answer
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", resolver.RecordTTL(rw.msg)))
+		if _, err := w.Write(packed); err != nil {
+			logging.Errorf("Error writing DoH response: %v", err)
+			if s.metrics != nil {
+				s.metrics.RecordError("write")
+			}
+		}
+	}
+}
+
+// readDoHRequest decodes the query of a DNS-over-HTTPS request. On failure it returns
+// the HTTP status to answer with.
+func readDoHRequest(w http.ResponseWriter, r *http.Request) (*dns.Msg, int, error) {
+	var packed []byte
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, http.StatusBadRequest, errors.New("missing dns parameter")
+		}
+		// RFC 8484 omits the padding, but tolerate clients that send it
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("invalid dns parameter")
+		}
+		packed = b
+	case http.MethodPost:
+		ct := r.Header.Get("Content-Type")
+		if mediaType, _, err := mime.ParseMediaType(ct); err != nil || mediaType != dohContentType {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q", ct)
+		}
+		b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize))
+		if err != nil {
+			return nil, http.StatusRequestEntityTooLarge, errors.New("message too large")
+		}
+		packed = b
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		return nil, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method)
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(packed); err != nil {
+		return nil, http.StatusBadRequest, errors.New("invalid DNS message")
+	}
+	return req, http.StatusOK, nil
+}
+
+// dohResponseWriter captures the response handleRequest writes for a DNS-over-HTTPS query.
+type dohResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	msg        *dns.Msg
+	closed     bool
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	return w.localAddr
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+func (w *dohResponseWriter) WriteMsg(msg *dns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = msg
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func (w *dohResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigTimersOnly(bool) {
+}
+
+func (w *dohResponseWriter) Hijack() {
+}
@@ -0,0 +1,236 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/acl"
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+	"github.com/steigr/nameserver-switcher/internal/resolver"
+	"github.com/steigr/nameserver-switcher/internal/testhelper"
+)
+
+func newDoHTestServer(resp *dns.Msg, m *metrics.Metrics) *Server {
+	return NewServer(ServerConfig{
+		Addr:    "127.0.0.1",
+		Router:  resolver.NewRouter(resolver.RouterConfig{SystemResolver: &mockResolver{name: "system", response: resp}}),
+		Metrics: m,
+	})
+}
+
+func packedQuery(t *testing.T, name string) []byte {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	msg.Id = 0
+	packed, err := msg.Pack()
+	require.NoError(t, err)
+	return packed
+}
+
+func readDoHResponse(t *testing.T, rec *httptest.ResponseRecorder) *dns.Msg {
+	t.Helper()
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "application/dns-message", rec.Header().Get("Content-Type"))
+	reply := new(dns.Msg)
+	require.NoError(t, reply.Unpack(rec.Body.Bytes()))
+	return reply
+}
+
+func TestServer_DoHHandler(t *testing.T) {
+	resp := &dns.Msg{
+		Answer: []dns.RR{
+			&dns.A{
+				Hdr: dns.RR_Header{Name: "test.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("1.2.3.4").To4(),
+			},
+			&dns.A{
+				Hdr: dns.RR_Header{Name: "test.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+				A:   net.ParseIP("1.2.3.5").To4(),
+			},
+		},
+	}
+	m := metrics.NewMetrics("test_dns_doh")
+	handler := newDoHTestServer(resp, m).DoHHandler()
+
+	t.Run("get", func(t *testing.T) {
+		query := base64.RawURLEncoding.EncodeToString(packedQuery(t, "test.com."))
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, DoHPath+"?dns="+query, nil))
+
+		reply := readDoHResponse(t, rec)
+		assert.Equal(t, uint16(0), reply.Id)
+		assert.Len(t, reply.Answer, 2)
+		assert.Equal(t, "max-age=120", rec.Header().Get("Cache-Control"))
+	})
+
+	t.Run("post", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, DoHPath, bytes.NewReader(packedQuery(t, "test.com.")))
+		req.Header.Set("Content-Type", "application/dns-message")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+
+		reply := readDoHResponse(t, rec)
+		assert.Len(t, reply.Answer, 2)
+	})
+
+	t.Run("post with media type parameters", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, DoHPath, bytes.NewReader(packedQuery(t, "test.com.")))
+		req.Header.Set("Content-Type", "Application/DNS-Message; charset=binary")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+
+		reply := readDoHResponse(t, rec)
+		assert.Len(t, reply.Answer, 2)
+	})
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.RequestsTotal.WithLabelValues("doh", "A")))
+}
+
+func TestServer_DoHHandler_NegativeAnswer(t *testing.T) {
+	resp := &dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError},
+		Ns: []dns.RR{&dns.SOA{
+			Hdr:    dns.RR_Header{Name: "test.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:     "ns.test.com.",
+			Mbox:   "hostmaster.test.com.",
+			Minttl: 60,
+		}},
+	}
+	handler := newDoHTestServer(resp, nil).DoHHandler()
+
+	query := base64.RawURLEncoding.EncodeToString(packedQuery(t, "missing.test.com."))
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, DoHPath+"?dns="+query, nil))
+
+	reply := readDoHResponse(t, rec)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	assert.Equal(t, "max-age=60", rec.Header().Get("Cache-Control"))
+}
+
+func TestServer_DoHHandler_InvalidRequests(t *testing.T) {
+	handler := newDoHTestServer(new(dns.Msg), nil).DoHHandler()
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		status      int
+	}{
+		{name: "missing parameter", method: http.MethodGet, target: DoHPath, status: http.StatusBadRequest},
+		{name: "invalid base64", method: http.MethodGet, target: DoHPath + "?dns=!!!", status: http.StatusBadRequest},
+		{name: "invalid message", method: http.MethodGet, target: DoHPath + "?dns=AAAA", status: http.StatusBadRequest},
+		{name: "wrong content type", method: http.MethodPost, target: DoHPath, contentType: "text/plain", body: "x", status: http.StatusUnsupportedMediaType},
+		{name: "invalid content type", method: http.MethodPost, target: DoHPath, contentType: "application/dns-message; =binary", body: "x", status: http.StatusUnsupportedMediaType},
+		{name: "unsupported method", method: http.MethodPut, target: DoHPath, status: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			assert.Equal(t, tt.status, rec.Code)
+		})
+	}
+}
+
+func TestServer_DoHHandler_ACL(t *testing.T) {
+	resp := &dns.Msg{
+		Answer: []dns.RR{
+			&dns.A{
+				Hdr: dns.RR_Header{Name: "test.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("1.2.3.4").To4(),
+			},
+		},
+	}
+	query := DoHPath + "?dns=" + base64.RawURLEncoding.EncodeToString(packedQuery(t, "test.com."))
+
+	for _, action := range []acl.Action{acl.Refuse, acl.Drop} {
+		t.Run(action.String(), func(t *testing.T) {
+			list, err := acl.New(acl.Config{Listener: "doh", Deny: "192.0.2.0/24", Action: action})
+			require.NoError(t, err)
+			server := newDoHTestServer(resp, nil)
+			server.dohACL = list
+			handler := server.DoHHandler()
+
+			// httptest requests come from 192.0.2.1
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, query, nil))
+			if action == acl.Drop {
+				assert.Equal(t, http.StatusForbidden, rec.Code)
+			} else {
+				assert.Equal(t, dns.RcodeRefused, readDoHResponse(t, rec).Rcode)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, query, nil)
+			req.RemoteAddr = "198.51.100.1:1234"
+			rec = httptest.NewRecorder()
+			handler(rec, req)
+			assert.Len(t, readDoHResponse(t, rec).Answer, 1)
+		})
+	}
+}
+
+func TestServer_DoHListener(t *testing.T) {
+	pki := testhelper.NewPKI(t)
+	resp := &dns.Msg{
+		Answer: []dns.RR{
+			&dns.A{
+				Hdr: dns.RR_Header{Name: "test.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("1.2.3.4").To4(),
+			},
+		},
+	}
+
+	server := NewServer(ServerConfig{
+		Addr:        "127.0.0.1",
+		Router:      resolver.NewRouter(resolver.RouterConfig{SystemResolver: &mockResolver{name: "system", response: resp}}),
+		DoHCertFile: pki.ServerCertFile,
+		DoHKeyFile:  pki.ServerKeyFile,
+	})
+	require.NoError(t, server.Start())
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pki.CAPool, ServerName: "dns.test"},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	httpResp, err := client.Post("https://"+server.dohServer.Addr+DoHPath, "application/dns-message", bytes.NewReader(packedQuery(t, "test.com.")))
+	require.NoError(t, err)
+	defer func() { _ = httpResp.Body.Close() }()
+
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	assert.Equal(t, 2, httpResp.ProtoMajor)
+	body, err := io.ReadAll(httpResp.Body)
+	require.NoError(t, err)
+	reply := new(dns.Msg)
+	require.NoError(t, reply.Unpack(body))
+	assert.Len(t, reply.Answer, 1)
+}
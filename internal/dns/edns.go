@@ -0,0 +1,58 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// fitResponse returns a copy of resp adapted to the client of req. The response carries
+// an OPT record only when req has one, advertising maxUDPSize (4096 bytes when 0) and
+// echoing the DO bit; upstream EDNS options other than Extended DNS Errors are dropped.
+// Responses sent over UDP are truncated, setting the TC bit, to the buffer size the
+// client advertised, or 512 bytes without EDNS, capped at maxUDPSize.
+func fitResponse(req, resp *dns.Msg, udp bool, maxUDPSize int) *dns.Msg {
+	out := resp.Copy()
+	out.Id = req.Id
+
+	var upstreamOpt *dns.OPT
+	extra := out.Extra[:0]
+	for _, rr := range out.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			upstreamOpt = opt
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	out.Extra = extra
+
+	size := dns.MinMsgSize
+	if reqOpt := req.IsEdns0(); reqOpt != nil {
+		size = int(reqOpt.UDPSize())
+
+		advertised := maxUDPSize
+		if advertised <= 0 {
+			advertised = dns.DefaultMsgSize
+		}
+		opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetUDPSize(uint16(advertised))
+		opt.SetDo(reqOpt.Do())
+		if upstreamOpt != nil {
+			for _, o := range upstreamOpt.Option {
+				if o.Option() == dns.EDNS0EDE {
+					opt.Option = append(opt.Option, o)
+				}
+			}
+		}
+		out.Extra = append(out.Extra, opt)
+	} else if out.Rcode > 0xF {
+		// Extended response codes cannot be expressed without an OPT record
+		out.Rcode = dns.RcodeServerFailure
+	}
+
+	if udp {
+		if maxUDPSize > 0 && size > maxUDPSize {
+			size = maxUDPSize
+		}
+		out.Truncate(size)
+	}
+	return out
+}
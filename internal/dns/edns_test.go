@@ -0,0 +1,167 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/resolver"
+)
+
+// largeResponse returns an answer of n A records with an upstream OPT record.
+func largeResponse(n int) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.Response = true
+	for i := 0; i < n; i++ {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "big.test.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP(fmt.Sprintf("10.0.%d.%d", i/256, i%256)).To4(),
+		})
+	}
+	resp.SetEdns0(4096, false)
+	return resp
+}
+
+// newQuery returns an A query for big.test.com, with an OPT record when edns is set.
+func newQuery(edns bool, size uint16, do bool) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("big.test.com.", dns.TypeA)
+	if edns {
+		req.SetEdns0(size, do)
+	}
+	return req
+}
+
+// packedLen returns the size of msg on the wire, with name compression.
+func packedLen(t *testing.T, msg *dns.Msg) int {
+	t.Helper()
+	msg = msg.Copy()
+	msg.Compress = true
+	packed, err := msg.Pack()
+	require.NoError(t, err)
+	return len(packed)
+}
+
+func TestFitResponse_WithoutEDNS(t *testing.T) {
+	req := newQuery(false, 0, false)
+	resp := largeResponse(100)
+
+	out := fitResponse(req, resp, true, 1232)
+	assert.Equal(t, req.Id, out.Id)
+	assert.True(t, out.Truncated)
+	assert.Nil(t, out.IsEdns0(), "no OPT record without EDNS in the query")
+	assert.LessOrEqual(t, packedLen(t, out), dns.MinMsgSize)
+	assert.Len(t, resp.Answer, 100, "the routed response is not modified")
+	assert.NotNil(t, resp.IsEdns0())
+
+	// TCP responses are not truncated
+	out = fitResponse(req, resp, false, 1232)
+	assert.False(t, out.Truncated)
+	assert.Len(t, out.Answer, 100)
+	assert.Nil(t, out.IsEdns0())
+}
+
+func TestFitResponse_WithEDNS(t *testing.T) {
+	resp := largeResponse(100)
+
+	// The client buffer size is honoured
+	out := fitResponse(newQuery(true, 1024, true), resp, true, 0)
+	assert.True(t, out.Truncated)
+	assert.LessOrEqual(t, packedLen(t, out), 1024)
+	opt := out.IsEdns0()
+	require.NotNil(t, opt)
+	assert.Equal(t, uint16(dns.DefaultMsgSize), opt.UDPSize())
+	assert.True(t, opt.Do())
+
+	// The server maximum caps larger client buffers
+	out = fitResponse(newQuery(true, 4096, false), resp, true, 1232)
+	assert.True(t, out.Truncated)
+	assert.LessOrEqual(t, packedLen(t, out), 1232)
+	require.NotNil(t, out.IsEdns0())
+	assert.Equal(t, uint16(1232), out.IsEdns0().UDPSize())
+	assert.False(t, out.IsEdns0().Do())
+
+	// Responses that fit are sent whole
+	out = fitResponse(newQuery(true, 4096, false), largeResponse(10), true, 1232)
+	assert.False(t, out.Truncated)
+	assert.Len(t, out.Answer, 10)
+
+	// Buffer sizes below 512 bytes are treated as 512
+	out = fitResponse(newQuery(true, 100, false), resp, true, 1232)
+	assert.True(t, out.Truncated)
+	assert.Greater(t, len(out.Answer), 0)
+}
+
+func TestFitResponse_EDNSOptions(t *testing.T) {
+	resp := largeResponse(1)
+	resp.IsEdns0().Option = []dns.EDNS0{
+		&dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer},
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"},
+	}
+
+	out := fitResponse(newQuery(true, 1232, false), resp, true, 1232)
+	opt := out.IsEdns0()
+	require.NotNil(t, opt)
+	require.Len(t, opt.Option, 1)
+	assert.Equal(t, uint16(dns.EDNS0EDE), opt.Option[0].Option())
+}
+
+func TestFitResponse_ExtendedRcodeWithoutEDNS(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.Rcode = dns.RcodeBadVers
+
+	out := fitResponse(newQuery(false, 0, false), resp, true, 1232)
+	assert.Equal(t, dns.RcodeServerFailure, out.Rcode)
+	_, err := out.Pack()
+	assert.NoError(t, err)
+}
+
+func TestServer_HandleRequest_UDPTruncation(t *testing.T) {
+	router := resolver.NewRouter(resolver.RouterConfig{
+		SystemResolver: &mockResolver{name: "system", response: largeResponse(100)},
+	})
+	server := NewServer(ServerConfig{
+		Addr:       "127.0.0.1",
+		Router:     router,
+		MaxUDPSize: 1232,
+	})
+	require.NoError(t, server.Start())
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+
+	t.Run("without EDNS", func(t *testing.T) {
+		client := &dns.Client{Net: "udp", UDPSize: dns.MaxMsgSize}
+		reply, _, err := client.Exchange(newQuery(false, 0, false), server.Addr())
+		require.NoError(t, err)
+		assert.True(t, reply.Truncated)
+		assert.Nil(t, reply.IsEdns0())
+		assert.LessOrEqual(t, packedLen(t, reply), dns.MinMsgSize)
+	})
+
+	t.Run("with EDNS", func(t *testing.T) {
+		client := &dns.Client{Net: "udp", UDPSize: dns.MaxMsgSize}
+		reply, _, err := client.Exchange(newQuery(true, 4096, false), server.Addr())
+		require.NoError(t, err)
+		assert.True(t, reply.Truncated)
+		require.NotNil(t, reply.IsEdns0())
+		assert.LessOrEqual(t, packedLen(t, reply), 1232)
+	})
+
+	t.Run("TCP retry", func(t *testing.T) {
+		client := &dns.Client{Net: "tcp"}
+		reply, _, err := client.Exchange(newQuery(true, 4096, false), server.Addr())
+		require.NoError(t, err)
+		assert.False(t, reply.Truncated)
+		assert.Len(t, reply.Answer, 100)
+		assert.NotNil(t, reply.IsEdns0())
+	})
+}
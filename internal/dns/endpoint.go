@@ -0,0 +1,172 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Endpoint is an address and port serving plain DNS over UDP, TCP or both.
+type Endpoint struct {
+	// Name labels the endpoint in logs and metrics (host:port when empty).
+	Name string
+	Addr string
+	Port int
+	UDP  bool
+	TCP  bool
+}
+
+// String returns the host:port of the endpoint.
+func (e Endpoint) String() string {
+	return net.JoinHostPort(e.Addr, strconv.Itoa(e.Port))
+}
+
+// protocols returns the protocols of the endpoint for logs, e.g. UDP/TCP.
+func (e Endpoint) protocols() string {
+	var protocols []string
+	if e.UDP {
+		protocols = append(protocols, "UDP")
+	}
+	if e.TCP {
+		protocols = append(protocols, "TCP")
+	}
+	return strings.Join(protocols, "/")
+}
+
+// ParseEndpoints parses a comma-separated list of endpoints of the form
+// [name=]host:port[/protocols], where protocols is udp, tcp or udp+tcp (the default).
+// IPv6 hosts are written in brackets, e.g. [fd00::53]:53/udp.
+func ParseEndpoints(list string) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	names := make(map[string]bool)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		endpoint, err := parseEndpoint(s)
+		if err != nil {
+			return nil, err
+		}
+		if names[endpoint.Name] {
+			return nil, fmt.Errorf("duplicate DNS listener %q", endpoint.Name)
+		}
+		names[endpoint.Name] = true
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// parseEndpoint parses a single [name=]host:port[/protocols] endpoint.
+func parseEndpoint(s string) (Endpoint, error) {
+	var endpoint Endpoint
+	hostPort := s
+	if name, rest, ok := strings.Cut(s, "="); ok {
+		endpoint.Name = strings.TrimSpace(name)
+		hostPort = strings.TrimSpace(rest)
+		if endpoint.Name == "" {
+			return endpoint, fmt.Errorf("invalid DNS listener %q: empty name", s)
+		}
+	}
+
+	protocols := "udp+tcp"
+	if i := strings.LastIndex(hostPort, "/"); i >= 0 {
+		hostPort, protocols = hostPort[:i], strings.ToLower(hostPort[i+1:])
+	}
+	for _, protocol := range strings.Split(protocols, "+") {
+		switch protocol {
+		case "udp":
+			endpoint.UDP = true
+		case "tcp":
+			endpoint.TCP = true
+		default:
+			return endpoint, fmt.Errorf("invalid DNS listener %q: unknown protocol %q", s, protocol)
+		}
+	}
+
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return endpoint, fmt.Errorf("invalid DNS listener %q: %w", s, err)
+	}
+	if host != "" {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return endpoint, fmt.Errorf("invalid DNS listener %q: host must be an IP address", s)
+		}
+	}
+	endpoint.Addr = host
+	endpoint.Port, err = strconv.Atoi(port)
+	if err != nil || endpoint.Port < 1 || endpoint.Port > 65535 {
+		return endpoint, fmt.Errorf("invalid DNS listener %q: invalid port %q", s, port)
+	}
+
+	if endpoint.Name == "" {
+		endpoint.Name = endpoint.String()
+	}
+	return endpoint, nil
+}
+
+// listener holds the UDP and TCP servers of an endpoint.
+type listener struct {
+	endpoint Endpoint
+	udp      []*dns.Server
+	tcp      []*dns.Server
+}
+
+// newListener creates the servers of endpoint, with sockets servers per protocol
+// sharing the port with SO_REUSEPORT when more than one. With the PROXY protocol
+// enabled, TCP has a single server on a listener wrapped in Start.
+func (s *Server) newListener(endpoint Endpoint, sockets int) *listener {
+	if endpoint.Name == "" {
+		endpoint.Name = endpoint.String()
+	}
+	l := &listener{endpoint: endpoint}
+	handler := s.handler(endpoint.Name)
+	for i := 0; i < sockets; i++ {
+		if endpoint.UDP {
+			l.udp = append(l.udp, &dns.Server{
+				Addr:      endpoint.String(),
+				Net:       "udp",
+				Handler:   handler,
+				ReusePort: sockets > 1,
+			})
+		}
+		if endpoint.TCP && (i == 0 || s.proxyProtocol == nil) {
+			l.tcp = append(l.tcp, &dns.Server{
+				Addr:      endpoint.String(),
+				Net:       "tcp",
+				Handler:   handler,
+				ReusePort: sockets > 1,
+			})
+		}
+	}
+	return l
+}
+
+// bound pins an endpoint with port 0 to the port the system picked for its first
+// started server, so the other servers of the endpoint share it and Addr reports it.
+func (l *listener) bound(server *dns.Server) {
+	if l.endpoint.Port != 0 {
+		return
+	}
+	var addr net.Addr
+	if server.PacketConn != nil {
+		addr = server.PacketConn.LocalAddr()
+	} else {
+		addr = server.Listener.Addr()
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return
+	}
+	l.endpoint.Port, _ = strconv.Atoi(port)
+	for _, server := range l.udp {
+		server.Addr = l.endpoint.String()
+	}
+	for _, server := range l.tcp {
+		server.Addr = l.endpoint.String()
+	}
+}
@@ -0,0 +1,188 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/acl"
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+	"github.com/steigr/nameserver-switcher/internal/proxyproto"
+	"github.com/steigr/nameserver-switcher/internal/resolver"
+)
+
+func TestParseEndpoints(t *testing.T) {
+	endpoints, err := ParseEndpoints("")
+	require.NoError(t, err)
+	assert.Empty(t, endpoints)
+
+	endpoints, err = ParseEndpoints("0.0.0.0:53, node-local=169.254.20.10:53/udp, [fd00::53]:5353/tcp, :5300/UDP+TCP")
+	require.NoError(t, err)
+	assert.Equal(t, []Endpoint{
+		{Name: "0.0.0.0:53", Addr: "0.0.0.0", Port: 53, UDP: true, TCP: true},
+		{Name: "node-local", Addr: "169.254.20.10", Port: 53, UDP: true},
+		{Name: "[fd00::53]:5353", Addr: "fd00::53", Port: 5353, TCP: true},
+		{Name: ":5300", Addr: "", Port: 5300, UDP: true, TCP: true},
+	}, endpoints)
+
+	for _, invalid := range []string{
+		"127.0.0.1",
+		"localhost:53",
+		"127.0.0.1:0",
+		"127.0.0.1:dns",
+		"127.0.0.1:53/tls",
+		"fd00::53:53",
+		"=127.0.0.1:53",
+		"127.0.0.1:53, 127.0.0.1:53/udp",
+	} {
+		_, err := ParseEndpoints(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestServer_Endpoints(t *testing.T) {
+	resp := &dns.Msg{
+		Answer: []dns.RR{
+			&dns.A{
+				Hdr: dns.RR_Header{Name: "test.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("1.2.3.4").To4(),
+			},
+		},
+	}
+	m := metrics.NewMetrics("test_dns_endpoints")
+	server := NewServer(ServerConfig{
+		Endpoints: []Endpoint{
+			{Name: "primary", Addr: "127.0.0.1", UDP: true, TCP: true},
+			{Name: "secondary", Addr: "127.0.0.1", UDP: true},
+		},
+		Router:  resolver.NewRouter(resolver.RouterConfig{SystemResolver: &mockResolver{name: "system", response: resp}}),
+		Metrics: m,
+	})
+	require.NoError(t, server.Start())
+	defer shutdownServer(server)
+
+	// Port 0 binds a port picked by the system, shared by the sockets of an endpoint
+	primary, secondary := server.listeners[0].endpoint.String(), server.listeners[1].endpoint.String()
+	assert.NotEqual(t, 0, server.listeners[0].endpoint.Port)
+	assert.Equal(t, primary+", "+secondary, server.Addr())
+
+	req := &dns.Msg{}
+	req.SetQuestion("test.com.", dns.TypeA)
+
+	for _, query := range []struct{ network, addr string }{
+		{"udp", primary},
+		{"tcp", primary},
+		{"udp", secondary},
+	} {
+		client := &dns.Client{Net: query.network}
+		reply, _, err := client.Exchange(req, query.addr)
+		require.NoError(t, err, query)
+		assert.Len(t, reply.Answer, 1)
+	}
+
+	// The second endpoint serves UDP only
+	client := &dns.Client{Net: "tcp", Timeout: time.Second}
+	_, _, err := client.Exchange(req, secondary)
+	assert.Error(t, err)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.ListenerRequests.WithLabelValues("primary", "udp")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.ListenerRequests.WithLabelValues("primary", "tcp")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.ListenerRequests.WithLabelValues("secondary", "udp")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.RequestsTotal.WithLabelValues("udp", "A")))
+}
+
+func TestServer_Start_EndpointBindError(t *testing.T) {
+	router := resolver.NewRouter(resolver.RouterConfig{SystemResolver: &mockResolver{name: "system", response: &dns.Msg{}}})
+
+	// Hold the port of the second endpoint
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	busy := conn.LocalAddr().(*net.UDPAddr).Port
+
+	server := NewServer(ServerConfig{
+		Endpoints: []Endpoint{
+			{Addr: "127.0.0.1", UDP: true, TCP: true},
+			{Name: "busy", Addr: "127.0.0.1", Port: busy, UDP: true},
+		},
+		Router: router,
+	})
+	err = server.Start()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "DNS listener busy (UDP) failed")
+
+	// The listeners started before the failure are stopped again
+	require.Eventually(t, func() bool {
+		conn, err := net.ListenPacket("udp", server.listeners[0].endpoint.String())
+		if err != nil {
+			return false
+		}
+		_ = conn.Close()
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = server.Shutdown(ctx)
+}
+
+func TestServer_ProxyProtocol(t *testing.T) {
+	list, err := acl.New(acl.Config{Listener: "dns", Deny: "192.0.2.0/24"})
+	require.NoError(t, err)
+	policy, err := proxyproto.New(proxyproto.Config{Listener: "dns", Trusted: "127.0.0.0/8"})
+	require.NoError(t, err)
+
+	server := NewServer(ServerConfig{
+		Addr:          "127.0.0.1",
+		Router:        resolver.NewRouter(resolver.RouterConfig{SystemResolver: &mockResolver{name: "system", response: &dns.Msg{}}}),
+		Listeners:     4,
+		ACL:           list,
+		ProxyProtocol: policy,
+	})
+	// TCP has a single socket on the wrapped listener
+	assert.Len(t, server.listeners[0].tcp, 1)
+
+	require.NoError(t, server.Start())
+	defer shutdownServer(server)
+
+	req := &dns.Msg{}
+	req.SetQuestion("test.com.", dns.TypeA)
+
+	// query sends req as if through a load balancer forwarding the client at source
+	query := func(source string) *dns.Msg {
+		conn, err := net.Dial("tcp", server.Addr())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = fmt.Fprintf(conn, "PROXY TCP4 %s 127.0.0.1 40000 53\r\n", source)
+		require.NoError(t, err)
+
+		dnsConn := &dns.Conn{Conn: conn}
+		require.NoError(t, dnsConn.SetDeadline(time.Now().Add(5*time.Second)))
+		require.NoError(t, dnsConn.WriteMsg(req))
+		reply, err := dnsConn.ReadMsg()
+		require.NoError(t, err)
+		return reply
+	}
+
+	// The access control list sees the client, not the load balancer
+	assert.Equal(t, dns.RcodeRefused, query("192.0.2.1").Rcode)
+	assert.Equal(t, dns.RcodeSuccess, query("198.51.100.1").Rcode)
+
+	// Connections without a header from a trusted load balancer are rejected
+	client := &dns.Client{Net: "tcp", Timeout: time.Second}
+	_, _, err = client.Exchange(req, server.Addr())
+	assert.Error(t, err)
+
+	// UDP is not affected
+	client = &dns.Client{Net: "udp"}
+	reply, _, err := client.Exchange(req, server.Addr())
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+}
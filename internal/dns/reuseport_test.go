@@ -0,0 +1,144 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/resolver"
+)
+
+func newListenersTestServer(listeners int) *Server {
+	resp := &dns.Msg{
+		Answer: []dns.RR{
+			&dns.A{
+				Hdr: dns.RR_Header{Name: "test.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("1.2.3.4").To4(),
+			},
+		},
+	}
+	return NewServer(ServerConfig{
+		Addr:      "127.0.0.1",
+		Router:    resolver.NewRouter(resolver.RouterConfig{SystemResolver: &mockResolver{name: "system", response: resp}}),
+		Listeners: listeners,
+	})
+}
+
+func shutdownServer(server *Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = server.Shutdown(ctx)
+}
+
+func TestNewServer_Listeners(t *testing.T) {
+	server := newListenersTestServer(0)
+	assert.Len(t, server.listeners[0].udp, 1)
+	assert.Len(t, server.listeners[0].tcp, 1)
+	assert.False(t, server.listeners[0].udp[0].ReusePort)
+
+	server = newListenersTestServer(4)
+	if reusePortSupported {
+		assert.Len(t, server.listeners[0].udp, 4)
+		assert.Len(t, server.listeners[0].tcp, 4)
+		assert.True(t, server.listeners[0].udp[0].ReusePort)
+		assert.True(t, server.listeners[0].tcp[0].ReusePort)
+	} else {
+		assert.Len(t, server.listeners[0].udp, 1)
+		assert.Len(t, server.listeners[0].tcp, 1)
+	}
+}
+
+func TestNewServer_Listeners_Unsupported(t *testing.T) {
+	orig := reusePortSupported
+	reusePortSupported = false
+	defer func() { reusePortSupported = orig }()
+
+	server := newListenersTestServer(4)
+	assert.Len(t, server.listeners[0].udp, 1)
+	assert.Len(t, server.listeners[0].tcp, 1)
+	assert.False(t, server.listeners[0].udp[0].ReusePort)
+}
+
+func TestServer_Start_Listeners(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported on " + runtime.GOOS)
+	}
+
+	server := newListenersTestServer(4)
+	require.NoError(t, server.Start())
+	defer shutdownServer(server)
+
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			client := &dns.Client{Net: network}
+			// Queries from different source ports are spread over the sockets
+			for i := 0; i < 8; i++ {
+				req := &dns.Msg{}
+				req.SetQuestion("test.com.", dns.TypeA)
+				reply, _, err := client.Exchange(req, server.Addr())
+				require.NoError(t, err)
+				assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+				assert.Len(t, reply.Answer, 1)
+			}
+		})
+	}
+}
+
+// BenchmarkServer_UDPListeners measures UDP queries per second against servers with
+// an increasing number of SO_REUSEPORT sockets.
+func BenchmarkServer_UDPListeners(b *testing.B) {
+	counts := []int{1, 2, 4}
+	if procs := runtime.GOMAXPROCS(0); procs > 4 {
+		counts = append(counts, procs)
+	}
+
+	for _, listeners := range counts {
+		b.Run(fmt.Sprintf("listeners=%d", listeners), func(b *testing.B) {
+			if listeners > 1 && !reusePortSupported {
+				b.Skip("SO_REUSEPORT is not supported on " + runtime.GOOS)
+			}
+
+			server := newListenersTestServer(listeners)
+			require.NoError(b, server.Start())
+			defer shutdownServer(server)
+
+			req := &dns.Msg{}
+			req.SetQuestion("test.com.", dns.TypeA)
+			query, err := req.Pack()
+			require.NoError(b, err)
+
+			b.SetParallelism(4)
+			b.ResetTimer()
+			start := time.Now()
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := net.Dial("udp", server.Addr())
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer conn.Close()
+
+				buf := make([]byte, dns.MinMsgSize)
+				for pb.Next() {
+					_ = conn.SetDeadline(time.Now().Add(time.Second))
+					if _, err := conn.Write(query); err != nil {
+						b.Error(err)
+						return
+					}
+					if _, err := conn.Read(buf); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "qps")
+		})
+	}
+}
@@ -5,92 +5,288 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
+	"runtime"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 
+	"github.com/steigr/nameserver-switcher/internal/acl"
 	"github.com/steigr/nameserver-switcher/internal/config"
 	"github.com/steigr/nameserver-switcher/internal/logging"
 	"github.com/steigr/nameserver-switcher/internal/metrics"
+	"github.com/steigr/nameserver-switcher/internal/proxyproto"
 	"github.com/steigr/nameserver-switcher/internal/resolver"
+	"github.com/steigr/nameserver-switcher/internal/rrl"
 )
 
+// defaultRequestTimeout bounds the handling of a request when no timeout is configured.
+const defaultRequestTimeout = 10 * time.Second
+
+// reusePortSupported reports whether several sockets can share the DNS port with
+// SO_REUSEPORT, letting the kernel spread queries over them.
+var reusePortSupported = runtime.GOOS == "linux"
+
 // Server is a DNS server that routes requests through the resolver router.
 type Server struct {
-	udpServer *dns.Server
-	tcpServer *dns.Server
-	router    *resolver.Router
-	metrics   *metrics.Metrics
-	config    *config.Config
-	addr      string
-	port      int
+	listeners       []*listener
+	tlsServer       *dns.Server
+	dohServer       *http.Server
+	router          *resolver.Router
+	metrics         *metrics.Metrics
+	config          *config.Config
+	addr            string
+	port            int
+	maxUDPSize      int
+	tlsPort         int
+	tlsCertFile     string
+	tlsKeyFile      string
+	tlsClientCAFile string
+	dohCertFile     string
+	dohKeyFile      string
+	acl             *acl.List
+	tlsACL          *acl.List
+	dohACL          *acl.List
+	rateLimiter     *rrl.Limiter
+	proxyProtocol   *proxyproto.Policy
+	admission       *admission
+	shedRcode       int
+	requestTimeout  time.Duration
 }
 
 // ServerConfig holds configuration for the DNS server.
 type ServerConfig struct {
-	Addr    string
-	Port    int
-	Router  *resolver.Router
-	Metrics *metrics.Metrics
-	Config  *config.Config
+	Addr string
+	Port int
+	// Endpoints are the addresses serving plain DNS. When empty, Addr and Port serve
+	// UDP and TCP.
+	Endpoints []Endpoint
+	Router    *resolver.Router
+	Metrics   *metrics.Metrics
+	Config    *config.Config
+	// MaxUDPSize caps the size of UDP responses regardless of the buffer size clients
+	// advertise (0 leaves it to the client).
+	MaxUDPSize int
+	// Listeners is the number of UDP and of TCP sockets sharing each endpoint with
+	// SO_REUSEPORT, each served by its own goroutine. It is 1 when not positive or
+	// where SO_REUSEPORT is not supported.
+	Listeners int
+	// TLSPort is the DNS-over-TLS port, used when TLSCertFile is set.
+	TLSPort int
+	// TLSCertFile and TLSKeyFile enable the DNS-over-TLS listener. They are reloaded
+	// when they change.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile requires DNS-over-TLS clients to present a certificate signed by
+	// one of its CAs.
+	TLSClientCAFile string
+	// DoHPort is the port of the DNS-over-HTTPS listener, used when DoHCertFile is set.
+	DoHPort int
+	// DoHCertFile and DoHKeyFile enable a DNS-over-HTTPS listener serving DoHPath. They
+	// are reloaded when they change.
+	DoHCertFile string
+	DoHKeyFile  string
+	// ACL, TLSACL and DoHACL restrict which clients may query over UDP and TCP,
+	// DNS-over-TLS and DNS-over-HTTPS. Nil lists allow every client.
+	ACL    *acl.List
+	TLSACL *acl.List
+	DoHACL *acl.List
+	// RateLimiter limits the rate of UDP responses per client (nil disables it).
+	RateLimiter *rrl.Limiter
+	// ProxyProtocol reads PROXY protocol headers on TCP connections from trusted load
+	// balancers (nil disables it). Endpoints then have a single TCP socket.
+	ProxyProtocol *proxyproto.Policy
+	// MaxInFlight bounds the number of requests handled concurrently (0 disables the
+	// limit). Requests beyond it wait for a slot, up to MaxQueued of them for at most
+	// QueueTimeout, and are answered with ShedRcode (REFUSED when 0) otherwise.
+	MaxInFlight  int
+	MaxQueued    int
+	QueueTimeout time.Duration
+	ShedRcode    int
+	// RequestTimeout bounds the handling of a request (10 seconds when 0).
+	RequestTimeout time.Duration
 }
 
 // NewServer creates a new DNS server.
 func NewServer(cfg ServerConfig) *Server {
 	s := &Server{
-		router:  cfg.Router,
-		metrics: cfg.Metrics,
-		config:  cfg.Config,
-		addr:    cfg.Addr,
-		port:    cfg.Port,
+		router:          cfg.Router,
+		metrics:         cfg.Metrics,
+		config:          cfg.Config,
+		addr:            cfg.Addr,
+		port:            cfg.Port,
+		maxUDPSize:      cfg.MaxUDPSize,
+		tlsPort:         cfg.TLSPort,
+		tlsCertFile:     cfg.TLSCertFile,
+		tlsKeyFile:      cfg.TLSKeyFile,
+		tlsClientCAFile: cfg.TLSClientCAFile,
+		dohCertFile:     cfg.DoHCertFile,
+		dohKeyFile:      cfg.DoHKeyFile,
+		acl:             cfg.ACL,
+		tlsACL:          cfg.TLSACL,
+		dohACL:          cfg.DoHACL,
+		rateLimiter:     cfg.RateLimiter,
+		proxyProtocol:   cfg.ProxyProtocol,
+		admission:       newAdmission(cfg.MaxInFlight, cfg.MaxQueued, cfg.QueueTimeout, cfg.Metrics),
+		shedRcode:       cfg.ShedRcode,
+		requestTimeout:  cfg.RequestTimeout,
+	}
+	if s.shedRcode == dns.RcodeSuccess {
+		s.shedRcode = dns.RcodeRefused
+	}
+	if s.requestTimeout <= 0 {
+		s.requestTimeout = defaultRequestTimeout
+	}
+
+	endpoints := cfg.Endpoints
+	if len(endpoints) == 0 {
+		endpoints = []Endpoint{{Addr: cfg.Addr, Port: cfg.Port, UDP: true, TCP: true}}
 	}
 
-	handler := dns.HandlerFunc(s.handleRequest)
+	sockets := cfg.Listeners
+	if sockets < 1 {
+		sockets = 1
+	}
+	if sockets > 1 && !reusePortSupported {
+		logging.Warnf("SO_REUSEPORT is not supported on %s, using a single DNS socket", runtime.GOOS)
+		sockets = 1
+	}
 
-	listenAddr := fmt.Sprintf("%s:%d", cfg.Addr, cfg.Port)
+	for _, endpoint := range endpoints {
+		s.listeners = append(s.listeners, s.newListener(endpoint, sockets))
+	}
 
-	s.udpServer = &dns.Server{
-		Addr:    listenAddr,
-		Net:     "udp",
-		Handler: handler,
+	if cfg.TLSCertFile != "" {
+		s.tlsServer = &dns.Server{
+			Addr:    fmt.Sprintf("%s:%d", cfg.Addr, cfg.TLSPort),
+			Net:     "tcp-tls",
+			Handler: s.handler("dot"),
+		}
 	}
 
-	s.tcpServer = &dns.Server{
-		Addr:    listenAddr,
-		Net:     "tcp",
-		Handler: handler,
+	if cfg.DoHCertFile != "" {
+		mux := http.NewServeMux()
+		mux.Handle(DoHPath, s.DoHHandler())
+		s.dohServer = &http.Server{
+			Addr:              fmt.Sprintf("%s:%d", cfg.Addr, cfg.DoHPort),
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
 	}
 
 	return s
 }
 
-// Start starts the DNS server (UDP and TCP).
+// Start starts the DNS server (UDP, TCP and, when configured, DNS-over-TLS and
+// DNS-over-HTTPS). It returns once every listener is bound, or with an error naming
+// the first listener that could not bind, after stopping the ones already started.
 func (s *Server) Start() error {
-	errCh := make(chan error, 2)
+	var running []*dns.Server
+	fail := func(err error) error {
+		for _, server := range running {
+			_ = server.Shutdown()
+		}
+		return err
+	}
 
-	go func() {
-		logging.Infof("Starting DNS server (UDP) on %s:%d", s.addr, s.port)
-		if err := s.udpServer.ListenAndServe(); err != nil {
-			errCh <- fmt.Errorf("UDP server failed: %w", err)
+	for _, l := range s.listeners {
+		logging.Infof("Starting DNS listener %s (%s) on %s with %d UDP and %d TCP sockets",
+			l.endpoint.Name, l.endpoint.protocols(), l.endpoint, len(l.udp), len(l.tcp))
+		for _, server := range l.udp {
+			if err := startDNSServer(server); err != nil {
+				return fail(fmt.Errorf("DNS listener %s (UDP) failed: %w", l.endpoint.Name, err))
+			}
+			running = append(running, server)
+			l.bound(server)
 		}
-	}()
+		for _, server := range l.tcp {
+			if s.proxyProtocol != nil {
+				lis, err := net.Listen("tcp", server.Addr)
+				if err != nil {
+					return fail(fmt.Errorf("DNS listener %s (TCP) failed: %w", l.endpoint.Name, err))
+				}
+				server.Listener = s.proxyProtocol.Listen(lis)
+			}
+			if err := startDNSServer(server); err != nil {
+				return fail(fmt.Errorf("DNS listener %s (TCP) failed: %w", l.endpoint.Name, err))
+			}
+			running = append(running, server)
+			l.bound(server)
+		}
+	}
+
+	if s.tlsServer != nil {
+		tlsConfig, err := serverTLSConfig(s.tlsCertFile, s.tlsKeyFile, s.tlsClientCAFile)
+		if err != nil {
+			return fail(fmt.Errorf("TLS server failed: %w", err))
+		}
+		s.tlsServer.TLSConfig = tlsConfig
+
+		logging.Infof("Starting DNS server (TLS) on %s:%d", s.addr, s.tlsPort)
+		if err := startDNSServer(s.tlsServer); err != nil {
+			return fail(fmt.Errorf("TLS server failed: %w", err))
+		}
+		running = append(running, s.tlsServer)
+	}
+
+	if s.dohServer != nil {
+		tlsConfig, err := serverTLSConfig(s.dohCertFile, s.dohKeyFile, "")
+		if err != nil {
+			return fail(fmt.Errorf("DoH server failed: %w", err))
+		}
+		s.dohServer.TLSConfig = tlsConfig
+
+		lis, err := net.Listen("tcp", s.dohServer.Addr)
+		if err != nil {
+			return fail(fmt.Errorf("DoH server failed: %w", err))
+		}
+		// Port 0 binds a port picked by the system
+		s.dohServer.Addr = lis.Addr().String()
+
+		logging.Infof("Starting DNS server (DoH) on %s", s.dohServer.Addr)
+		go func() {
+			if err := s.dohServer.ServeTLS(lis, "", ""); err != nil && err != http.ErrServerClosed {
+				logging.Errorf("DoH server error: %v", err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// startDNSServer starts server, on its Listener when set, and waits until it is
+// listening. Errors after that are logged.
+func startDNSServer(server *dns.Server) error {
+	listening := make(chan struct{})
+	errCh := make(chan error, 1)
+	server.NotifyStartedFunc = func() { close(listening) }
 
 	go func() {
-		logging.Infof("Starting DNS server (TCP) on %s:%d", s.addr, s.port)
-		if err := s.tcpServer.ListenAndServe(); err != nil {
-			errCh <- fmt.Errorf("TCP server failed: %w", err)
+		var err error
+		if server.Listener != nil {
+			err = server.ActivateAndServe()
+		} else {
+			err = server.ListenAndServe()
+		}
+		select {
+		case <-listening:
+			if err != nil {
+				logging.Errorf("DNS server (%s) on %s error: %v", server.Net, server.Addr, err)
+			}
+		default:
+			errCh <- err
 		}
 	}()
 
-	// Give servers time to start
-	time.Sleep(100 * time.Millisecond)
-
-	// Check if either server failed immediately
 	select {
+	case <-listening:
+		return nil
 	case err := <-errCh:
+		if err == nil {
+			err = fmt.Errorf("stopped before listening on %s", server.Addr)
+		}
 		return err
-	default:
-		return nil
 	}
 }
 
@@ -98,12 +294,29 @@ func (s *Server) Start() error {
 func (s *Server) Shutdown(ctx context.Context) error {
 	var errs []error
 
-	if err := s.udpServer.ShutdownContext(ctx); err != nil {
-		errs = append(errs, fmt.Errorf("UDP shutdown failed: %w", err))
+	for _, l := range s.listeners {
+		for _, server := range l.udp {
+			if err := server.ShutdownContext(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("DNS listener %s UDP shutdown failed: %w", l.endpoint.Name, err))
+			}
+		}
+		for _, server := range l.tcp {
+			if err := server.ShutdownContext(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("DNS listener %s TCP shutdown failed: %w", l.endpoint.Name, err))
+			}
+		}
+	}
+
+	if s.tlsServer != nil {
+		if err := s.tlsServer.ShutdownContext(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("TLS shutdown failed: %w", err))
+		}
 	}
 
-	if err := s.tcpServer.ShutdownContext(ctx); err != nil {
-		errs = append(errs, fmt.Errorf("TCP shutdown failed: %w", err))
+	if s.dohServer != nil {
+		if err := s.dohServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("DoH shutdown failed: %w", err))
+		}
 	}
 
 	if len(errs) > 0 {
@@ -113,14 +326,41 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	return nil
 }
 
-// handleRequest handles incoming DNS requests.
-func (s *Server) handleRequest(w dns.ResponseWriter, req *dns.Msg) {
+// handler returns the handler of the named listener.
+func (s *Server) handler(listener string) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		s.handleRequest(w, req, listener)
+	})
+}
+
+// handleRequest handles incoming DNS requests received by the named listener.
+func (s *Server) handleRequest(w dns.ResponseWriter, req *dns.Msg, listener string) {
 	start := time.Now()
 
 	// Determine protocol
 	protocol := "udp"
-	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+	if _, ok := w.(*dohResponseWriter); ok {
+		protocol = "doh"
+	} else if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
 		protocol = "tcp"
+		if cs, ok := w.(dns.ConnectionStater); ok && cs.ConnectionState() != nil {
+			protocol = "tls"
+		}
+	}
+
+	// Apply the access control list of the listener
+	if list := s.listenerACL(protocol); !list.Allowed(w.RemoteAddr()) {
+		if list.Action() == acl.Drop {
+			_ = w.Close()
+			return
+		}
+		resp := &dns.Msg{}
+		resp.SetRcode(req, dns.RcodeRefused)
+		_ = s.writeResponse(w, req, resp, protocol)
+		if s.metrics != nil {
+			s.metrics.RecordResponseCode("REFUSED")
+		}
+		return
 	}
 
 	// Get query type and question
@@ -134,6 +374,7 @@ func (s *Server) handleRequest(w dns.ResponseWriter, req *dns.Msg) {
 	// Log request if enabled
 	if s.config != nil && s.config.LogRequests {
 		logging.LogDNSRequest(logging.DNSRequest{
+			Listener: listener,
 			Protocol: protocol,
 			Type:     qtype,
 			Name:     qname,
@@ -143,12 +384,29 @@ func (s *Server) handleRequest(w dns.ResponseWriter, req *dns.Msg) {
 
 	if s.metrics != nil {
 		s.metrics.RecordRequest(protocol, qtype)
+		s.metrics.RecordListenerRequest(listener, protocol)
+	}
+
+	// Wait for an in-flight slot, or shed the request when saturated
+	if reason := s.admission.acquire(); reason != "" {
+		resp := &dns.Msg{}
+		resp.SetRcode(req, s.shedRcode)
+		_ = s.writeResponse(w, req, resp, protocol)
+		if s.metrics != nil {
+			s.metrics.RecordShed(protocol, reason)
+			s.metrics.RecordResponseCode(dns.RcodeToString[s.shedRcode])
+		}
+		return
+	}
+	defer s.admission.release()
+
+	if s.metrics != nil {
 		s.metrics.IncActiveConnections()
 		defer s.metrics.DecActiveConnections()
 	}
 
 	// Create context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
 	defer cancel()
 
 	// Route the request
@@ -162,7 +420,7 @@ func (s *Server) handleRequest(w dns.ResponseWriter, req *dns.Msg) {
 		// Send SERVFAIL response
 		resp := &dns.Msg{}
 		resp.SetRcode(req, dns.RcodeServerFailure)
-		_ = w.WriteMsg(resp)
+		_ = s.writeResponse(w, req, resp, protocol)
 
 		if s.metrics != nil {
 			s.metrics.RecordResponseCode("SERVFAIL")
@@ -182,52 +440,22 @@ func (s *Server) handleRequest(w dns.ResponseWriter, req *dns.Msg) {
 		if result.CNAMEMatched {
 			s.metrics.RecordCNAMEMatch(result.CNAMEPattern)
 		}
+		if result.Fallback {
+			s.metrics.RecordFallback(result.ResolverUsed)
+		}
+		if result.Stale {
+			s.metrics.RecordStaleAnswer(result.ResolverUsed)
+		}
 
 		rcode := dns.RcodeToString[result.Response.Rcode]
 		s.metrics.RecordResponseCode(rcode)
 	}
 
 	// Log response if enabled
-	if s.config != nil && s.config.LogResponses {
-		rcode := dns.RcodeToString[result.Response.Rcode]
-		answerCount := len(result.Response.Answer)
-		logging.LogDNSResponse(logging.DNSResponse{
-			Name:           qname,
-			Rcode:          rcode,
-			AnswerCount:    answerCount,
-			Resolver:       result.ResolverUsed,
-			DurationMs:     duration * 1000,
-			RequestMatched: result.RequestMatched,
-			CNAMEMatched:   result.CNAMEMatched,
-		})
-	}
-
-	// Debug logging
-	if s.config != nil && s.config.Debug {
-		debug := logging.DNSDebug{
-			Resolver: result.ResolverUsed,
-		}
-		if result.RequestMatched {
-			debug.MatchedPattern = result.MatchedPattern
-			debug.Request = qname
-		}
-		if result.CNAMEMatched {
-			// Extract CNAME from response
-			cnames := resolver.ExtractCNAME(result.Response)
-			if len(cnames) > 0 {
-				debug.CNAMEPattern = result.CNAMEPattern
-				debug.CNAME = cnames[0]
-			}
-		}
-		debug.FullResponse = result.Response.String()
-		logging.LogDNSDebug(debug)
-	}
-
-	// Set response ID to match request
-	result.Response.Id = req.Id
+	result.Log(qname, time.Since(start), s.config)
 
 	// Write response
-	if err := w.WriteMsg(result.Response); err != nil {
+	if err := s.writeResponse(w, req, result.Response, protocol); err != nil {
 		logging.Errorf("Error writing response: %v", err)
 		if s.metrics != nil {
 			s.metrics.RecordError("write")
@@ -235,9 +463,49 @@ func (s *Server) handleRequest(w dns.ResponseWriter, req *dns.Msg) {
 	}
 }
 
-// Addr returns the listen address.
+// writeResponse writes resp sized for the client. UDP responses take a token from
+// the rate limiter: limited responses are dropped or slipped.
+func (s *Server) writeResponse(w dns.ResponseWriter, req, resp *dns.Msg, protocol string) error {
+	udp := protocol == "udp"
+	if udp {
+		switch s.rateLimiter.Check(w.RemoteAddr(), resp) {
+		case rrl.Drop:
+			return nil
+		case rrl.Slip:
+			resp = slipResponse(req, resp.Rcode)
+		}
+	}
+	return w.WriteMsg(fitResponse(req, resp, udp, s.maxUDPSize))
+}
+
+// slipResponse returns a truncated response without records, which genuine clients
+// retry over TCP.
+func slipResponse(req *dns.Msg, rcode int) *dns.Msg {
+	slip := &dns.Msg{}
+	slip.SetRcode(req, rcode)
+	slip.Truncated = true
+	return slip
+}
+
+// listenerACL returns the access control list of the listener serving protocol.
+func (s *Server) listenerACL(protocol string) *acl.List {
+	switch protocol {
+	case "tls":
+		return s.tlsACL
+	case "doh":
+		return s.dohACL
+	default:
+		return s.acl
+	}
+}
+
+// Addr returns the addresses of the DNS endpoints, comma-separated.
 func (s *Server) Addr() string {
-	return fmt.Sprintf("%s:%d", s.addr, s.port)
+	addrs := make([]string, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.endpoint.String())
+	}
+	return strings.Join(addrs, ", ")
 }
 
 // Query performs a DNS query through the router (for testing).
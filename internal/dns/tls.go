@@ -0,0 +1,111 @@
+package dns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/steigr/nameserver-switcher/internal/logging"
+)
+
+// certReloader serves a certificate and key from files and reloads them when either
+// file changes, so renewed certificates are picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// newCertReloader loads the certificate and key.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(r.latestModTime()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, reloading it if the files changed
+// since it was loaded. A certificate that fails to load is logged and the previous
+// one is kept.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	modTime := r.latestModTime()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if modTime.After(r.modTime) {
+		if err := r.reloadLocked(modTime); err != nil {
+			logging.Warnf("Failed to reload TLS certificate, keeping the previous one: %v", err)
+			// Retry only after the files change again
+			r.modTime = modTime
+		} else {
+			logging.Infof("Reloaded TLS certificate from %s", r.certFile)
+		}
+	}
+	return r.cert, nil
+}
+
+// reload loads the certificate and key and records modTime as their modification time.
+func (r *certReloader) reload(modTime time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reloadLocked(modTime)
+}
+
+// reloadLocked is reload with the lock held.
+func (r *certReloader) reloadLocked(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// latestModTime returns the later modification time of the certificate and key files.
+func (r *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// serverTLSConfig builds the TLS configuration of the DNS-over-TLS listener. With a
+// client CA file, clients must present a certificate signed by one of its CAs.
+func serverTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
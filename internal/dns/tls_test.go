@@ -0,0 +1,125 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+	"github.com/steigr/nameserver-switcher/internal/resolver"
+	"github.com/steigr/nameserver-switcher/internal/testhelper"
+)
+
+// startTLSServer starts a DNS server with a DNS-over-TLS listener and returns its address.
+func startTLSServer(t *testing.T, pki *testhelper.PKI, clientCAFile string, m *metrics.Metrics) string {
+	t.Helper()
+	resp := &dns.Msg{
+		Answer: []dns.RR{
+			&dns.A{
+				Hdr: dns.RR_Header{Name: "test.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("1.2.3.4").To4(),
+			},
+		},
+	}
+
+	server := NewServer(ServerConfig{
+		Addr:            "127.0.0.1",
+		Router:          resolver.NewRouter(resolver.RouterConfig{SystemResolver: &mockResolver{name: "system", response: resp}}),
+		Metrics:         m,
+		TLSCertFile:     pki.ServerCertFile,
+		TLSKeyFile:      pki.ServerKeyFile,
+		TLSClientCAFile: clientCAFile,
+	})
+	require.NoError(t, server.Start())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	})
+	return server.tlsServer.Listener.Addr().String()
+}
+
+// exchangeTLS sends an A query for test.com over DNS-over-TLS.
+func exchangeTLS(cfg *tls.Config, addr string) (*dns.Msg, error) {
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: cfg, Timeout: 2 * time.Second}
+	msg := &dns.Msg{}
+	msg.SetQuestion("test.com.", dns.TypeA)
+	reply, _, err := client.Exchange(msg, addr)
+	return reply, err
+}
+
+func TestServer_HandleRequest_TLS(t *testing.T) {
+	pki := testhelper.NewPKI(t)
+	m := metrics.NewMetrics("test_dns_tls")
+	addr := startTLSServer(t, pki, "", m)
+
+	reply, err := exchangeTLS(&tls.Config{RootCAs: pki.CAPool, ServerName: "dns.test"}, addr)
+	require.NoError(t, err)
+	require.Len(t, reply.Answer, 1)
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.RequestsTotal.WithLabelValues("tls", "A")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.RequestsTotal.WithLabelValues("tcp", "A")))
+}
+
+func TestServer_HandleRequest_TLSClientCertificate(t *testing.T) {
+	pki := testhelper.NewPKI(t)
+	addr := startTLSServer(t, pki, pki.CAFile, nil)
+
+	_, err := exchangeTLS(&tls.Config{RootCAs: pki.CAPool, ServerName: "dns.test"}, addr)
+	assert.Error(t, err, "clients without a certificate are rejected")
+
+	reply, err := exchangeTLS(&tls.Config{
+		RootCAs:      pki.CAPool,
+		ServerName:   "dns.test",
+		Certificates: []tls.Certificate{pki.ClientCert},
+	}, addr)
+	require.NoError(t, err)
+	assert.Len(t, reply.Answer, 1)
+}
+
+func TestServer_Start_TLSCertificateError(t *testing.T) {
+	server := NewServer(ServerConfig{
+		Addr:        "127.0.0.1",
+		Router:      resolver.NewRouter(resolver.RouterConfig{}),
+		TLSCertFile: filepath.Join(t.TempDir(), "missing.pem"),
+		TLSKeyFile:  filepath.Join(t.TempDir(), "missing-key.pem"),
+	})
+	assert.Error(t, server.Start())
+}
+
+func TestCertReloader_ReloadsChangedCertificate(t *testing.T) {
+	pki := testhelper.NewPKI(t)
+	reloader, err := newCertReloader(pki.ServerCertFile, pki.ServerKeyFile)
+	require.NoError(t, err)
+
+	commonName := func() string {
+		cert, err := reloader.GetCertificate(nil)
+		require.NoError(t, err)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return parsed.Subject.CommonName
+	}
+	assert.Equal(t, "dns.test", commonName())
+
+	// A renewed certificate is served once the files change
+	pki.WriteServerCert(t, "renewed.dns.test")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(pki.ServerCertFile, later, later))
+	require.NoError(t, os.Chtimes(pki.ServerKeyFile, later, later))
+	assert.Equal(t, "renewed.dns.test", commonName())
+
+	// A broken renewal keeps the previous certificate
+	require.NoError(t, os.WriteFile(pki.ServerCertFile, []byte("garbage"), 0o600))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(pki.ServerCertFile, later, later))
+	assert.Equal(t, "renewed.dns.test", commonName())
+}
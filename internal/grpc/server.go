@@ -5,18 +5,25 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"regexp"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 
+	"github.com/steigr/nameserver-switcher/internal/acl"
 	"github.com/steigr/nameserver-switcher/internal/config"
 	"github.com/steigr/nameserver-switcher/internal/logging"
 	"github.com/steigr/nameserver-switcher/internal/matcher"
 	"github.com/steigr/nameserver-switcher/internal/metrics"
+	"github.com/steigr/nameserver-switcher/internal/proxyproto"
 	"github.com/steigr/nameserver-switcher/internal/resolver"
 	coredns "github.com/steigr/nameserver-switcher/pkg/api/coredns"
 	pb "github.com/steigr/nameserver-switcher/pkg/api/v1"
@@ -32,12 +39,15 @@ type Server struct {
 	requestMatcher   *matcher.RegexMatcher
 	cnameMatcher     *matcher.RegexMatcher
 	grpcServer       *grpc.Server
+	listener         net.Listener
 	startTime        time.Time
 	totalRequests    uint64
 	requestResolver  string
 	explicitResolver string
 	addr             string
 	port             int
+	queryACL         *acl.List
+	proxyProtocol    *proxyproto.Policy
 }
 
 // ServerConfig holds configuration for the gRPC server.
@@ -51,6 +61,11 @@ type ServerConfig struct {
 	CNAMEMatcher     *matcher.RegexMatcher
 	RequestResolver  string
 	ExplicitResolver string
+	// QueryACL restricts which peers may use the CoreDNS Query RPC (nil allows every peer).
+	QueryACL *acl.List
+	// ProxyProtocol reads PROXY protocol headers on connections from trusted load
+	// balancers, so peers are identified by their real address (nil disables it).
+	ProxyProtocol *proxyproto.Policy
 }
 
 // NewServer creates a new gRPC server.
@@ -66,6 +81,8 @@ func NewServer(cfg ServerConfig) *Server {
 		explicitResolver: cfg.ExplicitResolver,
 		addr:             cfg.Addr,
 		port:             cfg.Port,
+		queryACL:         cfg.QueryACL,
+		proxyProtocol:    cfg.ProxyProtocol,
 	}
 
 	s.grpcServer = grpc.NewServer()
@@ -84,6 +101,8 @@ func (s *Server) Start() error {
 		return fmt.Errorf("failed to listen: %w", err)
 	}
 
+	lis = s.proxyProtocol.Listen(lis)
+	s.listener = lis
 	logging.Infof("Starting gRPC server on %s", listenAddr)
 
 	go func() {
@@ -100,6 +119,10 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	stopped := make(chan struct{})
 	go func() {
 		s.grpcServer.GracefulStop()
+		// GracefulStop only closes the listener once Serve has picked it up
+		if s.listener != nil {
+			_ = s.listener.Close()
+		}
 		close(stopped)
 	}()
 
@@ -150,34 +173,7 @@ func (s *Server) Resolve(ctx context.Context, req *pb.ResolveRequest) (*pb.Resol
 	}
 
 	// Convert DNS records
-	for _, rr := range result.Response.Answer {
-		record := &pb.DNSRecord{
-			Name: rr.Header().Name,
-			Type: dns.TypeToString[rr.Header().Rrtype],
-			Ttl:  rr.Header().Ttl,
-		}
-
-		switch r := rr.(type) {
-		case *dns.A:
-			record.Value = r.A.String()
-		case *dns.AAAA:
-			record.Value = r.AAAA.String()
-		case *dns.CNAME:
-			record.Value = r.Target
-		case *dns.MX:
-			record.Value = fmt.Sprintf("%d %s", r.Preference, r.Mx)
-		case *dns.TXT:
-			record.Value = strings.Join(r.Txt, " ")
-		case *dns.NS:
-			record.Value = r.Ns
-		case *dns.PTR:
-			record.Value = r.Ptr
-		default:
-			record.Value = rr.String()
-		}
-
-		resp.Records = append(resp.Records, record)
-	}
+	resp.Records = toRecords(result.Response.Answer)
 
 	// Record metrics
 	if s.metrics != nil {
@@ -271,6 +267,164 @@ func (s *Server) GetStats(ctx context.Context, req *pb.GetStatsRequest) (*pb.Get
 	}, nil
 }
 
+// GetCacheEntry implements the GetCacheEntry RPC method.
+func (s *Server) GetCacheEntry(ctx context.Context, req *pb.GetCacheEntryRequest) (*pb.GetCacheEntryResponse, error) {
+	var qtype uint16
+	if req.Type != "" {
+		t, ok := dns.StringToType[strings.ToUpper(req.Type)]
+		if !ok {
+			return nil, fmt.Errorf("unknown type %q", req.Type)
+		}
+		qtype = t
+	}
+
+	entries := toCacheEntries(s.router.CachedAnswers(req.Name, qtype))
+	return &pb.GetCacheEntryResponse{
+		Found:   len(entries) > 0,
+		Entries: entries,
+	}, nil
+}
+
+// ListCacheEntries implements the ListCacheEntries RPC method.
+func (s *Server) ListCacheEntries(ctx context.Context, req *pb.ListCacheEntriesRequest) (*pb.ListCacheEntriesResponse, error) {
+	var pattern *regexp.Regexp
+	if req.Pattern != "" {
+		re, err := regexp.Compile(req.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+		pattern = re
+	}
+
+	entries := toCacheEntries(s.router.ListCachedAnswers(pattern))
+	resp := &pb.ListCacheEntriesResponse{Total: uint64(len(entries))}
+	if req.Limit > 0 && len(entries) > int(req.Limit) {
+		entries = entries[:req.Limit]
+	}
+	resp.Entries = entries
+	return resp, nil
+}
+
+// FlushCacheName implements the FlushCacheName RPC method.
+func (s *Server) FlushCacheName(ctx context.Context, req *pb.FlushCacheNameRequest) (*pb.FlushCacheResponse, error) {
+	if req.Name == "" {
+		return &pb.FlushCacheResponse{
+			Success: false,
+			Error:   "name is required",
+		}, nil
+	}
+
+	flushed := s.router.FlushCacheName(req.Name)
+	logging.Infof("Flushed %d cached answers for %s", flushed, req.Name)
+	return &pb.FlushCacheResponse{
+		Success: true,
+		Flushed: uint64(flushed),
+	}, nil
+}
+
+// FlushCache implements the FlushCache RPC method.
+func (s *Server) FlushCache(ctx context.Context, req *pb.FlushCacheRequest) (*pb.FlushCacheResponse, error) {
+	if req.Pattern == "" && req.Resolver == "" {
+		return &pb.FlushCacheResponse{
+			Success: false,
+			Error:   "pattern or resolver is required",
+		}, nil
+	}
+
+	var pattern *regexp.Regexp
+	if req.Pattern != "" {
+		re, err := regexp.Compile(req.Pattern)
+		if err != nil {
+			return &pb.FlushCacheResponse{
+				Success: false,
+				Error:   err.Error(),
+			}, nil
+		}
+		pattern = re
+	}
+
+	flushed := s.router.FlushCache(pattern, req.Resolver)
+	logging.Infof("Flushed %d cached answers (pattern %q, resolver %q)", flushed, req.Pattern, req.Resolver)
+	return &pb.FlushCacheResponse{
+		Success: true,
+		Flushed: uint64(flushed),
+	}, nil
+}
+
+// GetCacheStats implements the GetCacheStats RPC method.
+func (s *Server) GetCacheStats(ctx context.Context, req *pb.GetCacheStatsRequest) (*pb.GetCacheStatsResponse, error) {
+	stats := s.router.CacheStats()
+	return &pb.GetCacheStatsResponse{
+		Enabled:   stats.Capacity > 0,
+		Entries:   uint64(stats.Entries),
+		Capacity:  uint64(stats.Capacity),
+		Hits:      stats.Hits,
+		Misses:    stats.Misses,
+		Evictions: stats.Evictions,
+	}, nil
+}
+
+// toCacheEntries converts cached answers, sorted by name and type.
+func toCacheEntries(answers []resolver.CachedAnswer) []*pb.CacheEntry {
+	sort.Slice(answers, func(i, j int) bool {
+		if answers[i].Name != answers[j].Name {
+			return answers[i].Name < answers[j].Name
+		}
+		return answers[i].Qtype < answers[j].Qtype
+	})
+
+	now := time.Now()
+	entries := make([]*pb.CacheEntry, 0, len(answers))
+	for _, a := range answers {
+		entries = append(entries, &pb.CacheEntry{
+			Name:             a.Name,
+			Type:             dns.TypeToString[a.Qtype],
+			DnssecOk:         a.DO,
+			Rule:             a.Result.Rule,
+			ResolverUsed:     a.Result.ResolverUsed,
+			Rcode:            dns.RcodeToString[a.Result.Response.Rcode],
+			Records:          toRecords(a.Result.Response.Answer),
+			AgeSeconds:       uint64(now.Sub(a.Stored).Seconds()),
+			ExpiresInSeconds: uint64(a.Expires.Sub(now).Seconds()),
+		})
+	}
+	return entries
+}
+
+// toRecords converts DNS records.
+func toRecords(rrs []dns.RR) []*pb.DNSRecord {
+	var records []*pb.DNSRecord
+	for _, rr := range rrs {
+		record := &pb.DNSRecord{
+			Name: rr.Header().Name,
+			Type: dns.TypeToString[rr.Header().Rrtype],
+			Ttl:  rr.Header().Ttl,
+		}
+
+		switch r := rr.(type) {
+		case *dns.A:
+			record.Value = r.A.String()
+		case *dns.AAAA:
+			record.Value = r.AAAA.String()
+		case *dns.CNAME:
+			record.Value = r.Target
+		case *dns.MX:
+			record.Value = fmt.Sprintf("%d %s", r.Preference, r.Mx)
+		case *dns.TXT:
+			record.Value = strings.Join(r.Txt, " ")
+		case *dns.NS:
+			record.Value = r.Ns
+		case *dns.PTR:
+			record.Value = r.Ptr
+		default:
+			record.Value = rr.String()
+		}
+
+		records = append(records, record)
+	}
+	return records
+}
+
 // Addr returns the listen address.
 func (s *Server) Addr() string {
 	return fmt.Sprintf("%s:%d", s.addr, s.port)
@@ -287,6 +441,21 @@ func (s *Server) Query(ctx context.Context, req *coredns.DnsPacket) (*coredns.Dn
 		return nil, fmt.Errorf("failed to unpack DNS message: %w", err)
 	}
 
+	// Apply the access control list to the calling peer
+	var from net.Addr
+	if p, ok := peer.FromContext(ctx); ok {
+		from = p.Addr
+	}
+	if !s.queryACL.Allowed(from) {
+		if s.queryACL.Action() == acl.Drop {
+			return nil, status.Error(codes.PermissionDenied, "client not allowed")
+		}
+		reply := new(dns.Msg)
+		reply.SetRcode(msg, dns.RcodeRefused)
+		packed, _ := reply.Pack()
+		return &coredns.DnsPacket{Msg: packed}, nil
+	}
+
 	// Increment request counter
 	atomic.AddUint64(&s.totalRequests, 1)
 
@@ -300,11 +469,15 @@ func (s *Server) Query(ctx context.Context, req *coredns.DnsPacket) (*coredns.Dn
 
 	// Log request if enabled
 	if s.cfg != nil && s.cfg.LogRequests {
+		fromAddr := "grpc-client"
+		if from != nil {
+			fromAddr = from.String()
+		}
 		logging.LogDNSRequest(logging.DNSRequest{
 			Protocol: "grpc",
 			Type:     qtype,
 			Name:     qname,
-			From:     "grpc-client",
+			From:     fromAddr,
 		})
 	}
 
@@ -326,43 +499,8 @@ func (s *Server) Query(ctx context.Context, req *coredns.DnsPacket) (*coredns.Dn
 
 		// Pack and return the response
 		if result.Response != nil {
-			duration := time.Since(start).Seconds()
-
 			// Log response if enabled
-			if s.cfg != nil && s.cfg.LogResponses {
-				rcode := dns.RcodeToString[result.Response.Rcode]
-				answerCount := len(result.Response.Answer)
-				logging.LogDNSResponse(logging.DNSResponse{
-					Name:           qname,
-					Rcode:          rcode,
-					AnswerCount:    answerCount,
-					Resolver:       result.ResolverUsed,
-					DurationMs:     duration * 1000,
-					RequestMatched: result.RequestMatched,
-					CNAMEMatched:   result.CNAMEMatched,
-				})
-			}
-
-			// Debug logging
-			if s.cfg != nil && s.cfg.Debug {
-				debug := logging.DNSDebug{
-					Resolver: result.ResolverUsed,
-				}
-				if result.RequestMatched {
-					debug.MatchedPattern = result.MatchedPattern
-					debug.Request = qname
-				}
-				if result.CNAMEMatched {
-					// Extract CNAME from response
-					cnames := resolver.ExtractCNAME(result.Response)
-					if len(cnames) > 0 {
-						debug.CNAMEPattern = result.CNAMEPattern
-						debug.CNAME = cnames[0]
-					}
-				}
-				debug.FullResponse = result.Response.String()
-				logging.LogDNSDebug(debug)
-			}
+			result.Log(qname, time.Since(start), s.cfg)
 
 			// Ensure the response has the same ID as the request
 			result.Response.Id = msg.Id
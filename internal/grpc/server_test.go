@@ -1,17 +1,32 @@
 package grpc
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/steigr/nameserver-switcher/internal/acl"
+	"github.com/steigr/nameserver-switcher/internal/cache"
 	"github.com/steigr/nameserver-switcher/internal/config"
+	"github.com/steigr/nameserver-switcher/internal/logging"
 	"github.com/steigr/nameserver-switcher/internal/matcher"
 	"github.com/steigr/nameserver-switcher/internal/metrics"
+	"github.com/steigr/nameserver-switcher/internal/proxyproto"
 	"github.com/steigr/nameserver-switcher/internal/resolver"
 	coredns "github.com/steigr/nameserver-switcher/pkg/api/coredns"
 	pb "github.com/steigr/nameserver-switcher/pkg/api/v1"
@@ -165,6 +180,199 @@ func TestServer_GetStats(t *testing.T) {
 	assert.Equal(t, uint64(0), result.TotalRequests)
 }
 
+func TestServer_GetStats_ExcludesPrefetch(t *testing.T) {
+	upstream := &mockResolver{name: "passthrough", response: &dns.Msg{
+		Answer: []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "test.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   []byte{1, 2, 3, 4},
+		}},
+	}}
+	m := metrics.NewMetrics("test_grpc_stats_prefetch")
+	router := resolver.NewRouter(resolver.RouterConfig{
+		PassthroughResolver: upstream,
+		Cache:               cache.New(cache.Config{MaxEntries: 10, PrefetchHits: 1, PrefetchPercentage: 100}),
+		PrefetchWorkers:     1,
+		Metrics:             m,
+	})
+	router.StartPrefetching()
+	defer router.StopPrefetching()
+
+	server := NewServer(ServerConfig{
+		Addr:   "127.0.0.1",
+		Port:   25397,
+		Router: router,
+	})
+
+	for i := 0; i < 2; i++ {
+		_, err := server.Resolve(context.Background(), &pb.ResolveRequest{Name: "test.com", Type: "A"})
+		require.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(m.Prefetches.WithLabelValues("refreshed")) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	result, err := server.GetStats(context.Background(), &pb.GetStatsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), result.TotalRequests)
+}
+
+// newCacheServer returns a server whose cache holds answers for test.com from
+// "passthrough" and for other.org from "system".
+func newCacheServer(t *testing.T) *Server {
+	t.Helper()
+	answer := func(name string) *dns.Msg {
+		return &dns.Msg{Answer: []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   []byte{1, 2, 3, 4},
+		}}}
+	}
+	orgMatcher, err := matcher.NewRegexMatcher([]string{`\.org$`})
+	require.NoError(t, err)
+	router := resolver.NewRouter(resolver.RouterConfig{
+		Rules: []resolver.Rule{{
+			Name:           "org",
+			RequestMatcher: orgMatcher,
+			TargetResolver: &mockResolver{name: "system", response: answer("other.org.")},
+		}},
+		PassthroughResolver: &mockResolver{name: "passthrough", response: answer("test.com.")},
+		Cache:               cache.New(cache.Config{MaxEntries: 10}),
+	})
+	server := NewServer(ServerConfig{
+		Addr:   "127.0.0.1",
+		Port:   25398,
+		Router: router,
+	})
+
+	for _, name := range []string{"test.com", "other.org"} {
+		_, err := server.Resolve(context.Background(), &pb.ResolveRequest{Name: name, Type: "A"})
+		require.NoError(t, err)
+	}
+	return server
+}
+
+func TestServer_GetCacheEntry(t *testing.T) {
+	server := newCacheServer(t)
+
+	result, err := server.GetCacheEntry(context.Background(), &pb.GetCacheEntryRequest{Name: "test.com", Type: "a"})
+	require.NoError(t, err)
+	assert.True(t, result.Found)
+	require.Len(t, result.Entries, 1)
+	entry := result.Entries[0]
+	assert.Equal(t, "test.com.", entry.Name)
+	assert.Equal(t, "A", entry.Type)
+	assert.Equal(t, "passthrough", entry.ResolverUsed)
+	assert.Equal(t, "NOERROR", entry.Rcode)
+	require.Len(t, entry.Records, 1)
+	assert.Equal(t, "1.2.3.4", entry.Records[0].Value)
+	assert.LessOrEqual(t, entry.Records[0].Ttl, uint32(300))
+	assert.LessOrEqual(t, entry.ExpiresInSeconds, uint64(300))
+
+	result, err = server.GetCacheEntry(context.Background(), &pb.GetCacheEntryRequest{Name: "test.com"})
+	require.NoError(t, err)
+	assert.Len(t, result.Entries, 1)
+
+	result, err = server.GetCacheEntry(context.Background(), &pb.GetCacheEntryRequest{Name: "test.com", Type: "AAAA"})
+	require.NoError(t, err)
+	assert.False(t, result.Found)
+
+	_, err = server.GetCacheEntry(context.Background(), &pb.GetCacheEntryRequest{Name: "test.com", Type: "BOGUS"})
+	assert.Error(t, err)
+}
+
+func TestServer_ListCacheEntries(t *testing.T) {
+	server := newCacheServer(t)
+
+	result, err := server.ListCacheEntries(context.Background(), &pb.ListCacheEntriesRequest{})
+	require.NoError(t, err)
+	require.Len(t, result.Entries, 2)
+	assert.Equal(t, uint64(2), result.Total)
+	assert.Equal(t, "other.org.", result.Entries[0].Name)
+	assert.Equal(t, "org", result.Entries[0].Rule)
+	assert.Equal(t, "test.com.", result.Entries[1].Name)
+
+	result, err = server.ListCacheEntries(context.Background(), &pb.ListCacheEntriesRequest{Pattern: `\.com$`})
+	require.NoError(t, err)
+	require.Len(t, result.Entries, 1)
+	assert.Equal(t, "test.com.", result.Entries[0].Name)
+
+	result, err = server.ListCacheEntries(context.Background(), &pb.ListCacheEntriesRequest{Limit: 1})
+	require.NoError(t, err)
+	assert.Len(t, result.Entries, 1)
+	assert.Equal(t, uint64(2), result.Total)
+
+	_, err = server.ListCacheEntries(context.Background(), &pb.ListCacheEntriesRequest{Pattern: "[invalid"})
+	assert.Error(t, err)
+}
+
+func TestServer_FlushCacheName(t *testing.T) {
+	server := newCacheServer(t)
+
+	result, err := server.FlushCacheName(context.Background(), &pb.FlushCacheNameRequest{Name: "TEST.com"})
+	require.NoError(t, err)
+	assert.True(t, result.Success)
+	assert.Equal(t, uint64(1), result.Flushed)
+
+	entry, err := server.GetCacheEntry(context.Background(), &pb.GetCacheEntryRequest{Name: "test.com"})
+	require.NoError(t, err)
+	assert.False(t, entry.Found)
+
+	result, err = server.FlushCacheName(context.Background(), &pb.FlushCacheNameRequest{})
+	require.NoError(t, err)
+	assert.False(t, result.Success)
+	assert.NotEmpty(t, result.Error)
+}
+
+func TestServer_FlushCache(t *testing.T) {
+	server := newCacheServer(t)
+
+	result, err := server.FlushCache(context.Background(), &pb.FlushCacheRequest{})
+	require.NoError(t, err)
+	assert.False(t, result.Success)
+
+	result, err = server.FlushCache(context.Background(), &pb.FlushCacheRequest{Pattern: "[invalid"})
+	require.NoError(t, err)
+	assert.False(t, result.Success)
+	assert.NotEmpty(t, result.Error)
+
+	result, err = server.FlushCache(context.Background(), &pb.FlushCacheRequest{Resolver: "system"})
+	require.NoError(t, err)
+	assert.True(t, result.Success)
+	assert.Equal(t, uint64(1), result.Flushed)
+
+	result, err = server.FlushCache(context.Background(), &pb.FlushCacheRequest{Pattern: `^test\.`})
+	require.NoError(t, err)
+	assert.True(t, result.Success)
+	assert.Equal(t, uint64(1), result.Flushed)
+
+	stats, err := server.GetCacheStats(context.Background(), &pb.GetCacheStatsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), stats.Entries)
+}
+
+func TestServer_GetCacheStats(t *testing.T) {
+	server := newCacheServer(t)
+
+	_, err := server.Resolve(context.Background(), &pb.ResolveRequest{Name: "test.com", Type: "A"})
+	require.NoError(t, err)
+
+	stats, err := server.GetCacheStats(context.Background(), &pb.GetCacheStatsRequest{})
+	require.NoError(t, err)
+	assert.True(t, stats.Enabled)
+	assert.Equal(t, uint64(2), stats.Entries)
+	assert.Equal(t, uint64(10), stats.Capacity)
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+
+	disabled := NewServer(ServerConfig{
+		Addr:   "127.0.0.1",
+		Port:   25399,
+		Router: resolver.NewRouter(resolver.RouterConfig{}),
+	})
+	stats, err = disabled.GetCacheStats(context.Background(), &pb.GetCacheStatsRequest{})
+	require.NoError(t, err)
+	assert.False(t, stats.Enabled)
+}
+
 func TestServer_Addr(t *testing.T) {
 	server := NewServer(ServerConfig{
 		Addr:   "127.0.0.1",
@@ -609,6 +817,59 @@ func TestServer_Query_InvalidPacket(t *testing.T) {
 	assert.Contains(t, err.Error(), "failed to unpack")
 }
 
+func TestServer_Query_ACL(t *testing.T) {
+	resp := &dns.Msg{
+		Answer: []dns.RR{
+			&dns.A{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   []byte{1, 2, 3, 4},
+			},
+		},
+	}
+	router := resolver.NewRouter(resolver.RouterConfig{
+		SystemResolver: &mockResolver{name: "system", response: resp},
+	})
+
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	packed, err := msg.Pack()
+	require.NoError(t, err)
+
+	fromPeer := func(ip string) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}})
+	}
+
+	m := metrics.NewMetrics("test_grpc_query_acl")
+	list, err := acl.New(acl.Config{Listener: "grpc", Allow: "10.0.0.0/8", Metrics: m})
+	require.NoError(t, err)
+	server := NewServer(ServerConfig{Router: router, QueryACL: list})
+
+	// Allowed peers are answered
+	result, err := server.Query(fromPeer("10.1.2.3"), &coredns.DnsPacket{Msg: packed})
+	require.NoError(t, err)
+	reply := &dns.Msg{}
+	require.NoError(t, reply.Unpack(result.Msg))
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.NotEmpty(t, reply.Answer)
+
+	// Other peers are refused
+	result, err = server.Query(fromPeer("192.0.2.1"), &coredns.DnsPacket{Msg: packed})
+	require.NoError(t, err)
+	require.NoError(t, reply.Unpack(result.Msg))
+	assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+	assert.Equal(t, msg.Id, reply.Id)
+	assert.Empty(t, reply.Answer)
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.ACLDenied.WithLabelValues("grpc", "refuse")))
+
+	// With the drop action, the RPC fails without an answer
+	list, err = acl.New(acl.Config{Listener: "grpc", Deny: "192.0.2.0/24", Action: acl.Drop})
+	require.NoError(t, err)
+	server = NewServer(ServerConfig{Router: router, QueryACL: list})
+	result, err = server.Query(fromPeer("192.0.2.1"), &coredns.DnsPacket{Msg: packed})
+	assert.Nil(t, result)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
 func TestServer_Query_WithConfig_LogRequests(t *testing.T) {
 	resp := &dns.Msg{
 		Answer: []dns.RR{
@@ -768,6 +1029,42 @@ func TestServer_Query_WithConfig_AllEnabled(t *testing.T) {
 	require.NotNil(t, result)
 }
 
+func TestServer_Query_LogResponses_Stale(t *testing.T) {
+	system := &mockResolver{name: "system", response: &dns.Msg{
+		Answer: []dns.RR{
+			&dns.A{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   []byte{1, 2, 3, 4},
+			},
+		},
+	}}
+	router := resolver.NewRouter(resolver.RouterConfig{
+		SystemResolver: system,
+		ServeStale:     true,
+	})
+	server := NewServer(ServerConfig{
+		Router: router,
+		Config: &config.Config{LogResponses: true},
+	})
+	logs := captureLogs(t)
+
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	packed, err := msg.Pack()
+	require.NoError(t, err)
+
+	_, err = server.Query(context.Background(), &coredns.DnsPacket{Msg: packed})
+	require.NoError(t, err)
+	system.err = errors.New("i/o timeout")
+	_, err = server.Query(context.Background(), &coredns.DnsPacket{Msg: packed})
+	require.NoError(t, err)
+
+	// Responses are logged like those of the DNS listeners
+	assert.Contains(t, logs.String(), `"rule":"passthrough"`)
+	assert.Contains(t, logs.String(), `"stale":true`)
+	assert.Contains(t, logs.String(), `"fallback":"passthrough resolver failed: i/o timeout"`)
+}
+
 func TestServer_Query_WithPatternMatch(t *testing.T) {
 	// Response with CNAME that matches the CNAME pattern
 	explicitResp := &dns.Msg{
@@ -1088,3 +1385,99 @@ func (m *mockRouterWithCNAMEMatch) Route(ctx context.Context, req *dns.Msg) (*re
 	}
 	return m.response, nil
 }
+
+func TestServer_Query_ProxyProtocol(t *testing.T) {
+	router := resolver.NewRouter(resolver.RouterConfig{
+		SystemResolver: &mockResolver{name: "system", response: &dns.Msg{Answer: []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   []byte{1, 2, 3, 4},
+		}}}},
+	})
+	list, err := acl.New(acl.Config{Listener: "grpc", Deny: "192.0.2.0/24"})
+	require.NoError(t, err)
+	policy, err := proxyproto.New(proxyproto.Config{Listener: "grpc", Trusted: "127.0.0.0/8"})
+	require.NoError(t, err)
+
+	server := NewServer(ServerConfig{
+		Addr:          "127.0.0.1",
+		Router:        router,
+		Config:        &config.Config{LogRequests: true},
+		QueryACL:      list,
+		ProxyProtocol: policy,
+	})
+	logs := captureLogs(t)
+	require.NoError(t, server.Start())
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	packed, err := msg.Pack()
+	require.NoError(t, err)
+
+	// query connects as if through a load balancer forwarding the client at source
+	query := func(source string) *dns.Msg {
+		conn, err := grpc.NewClient(server.listener.Addr().String(),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+				c, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+				if err != nil {
+					return nil, err
+				}
+				_, err = fmt.Fprintf(c, "PROXY TCP4 %s 127.0.0.1 40000 53\r\n", source)
+				return c, err
+			}))
+		require.NoError(t, err)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		result, err := coredns.NewDnsServiceClient(conn).Query(ctx, &coredns.DnsPacket{Msg: packed})
+		require.NoError(t, err)
+		reply := &dns.Msg{}
+		require.NoError(t, reply.Unpack(result.Msg))
+		return reply
+	}
+
+	// The access control list sees the client, not the load balancer
+	assert.Equal(t, dns.RcodeRefused, query("192.0.2.1").Rcode)
+	assert.Equal(t, dns.RcodeSuccess, query("198.51.100.1").Rcode)
+
+	// and so do the request logs
+	assert.Contains(t, logs.String(), `"from":"198.51.100.1:40000"`)
+}
+
+// logBuffer collects log output; it is safe for concurrent use.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) Sync() error {
+	return nil
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs sends the output of the default logger, as JSON, to the returned buffer
+// until the test ends.
+func captureLogs(t *testing.T) *logBuffer {
+	logs := &logBuffer{}
+	previous := logging.Default()
+	logging.SetDefault(logging.NewLogger(logging.Config{Output: logs, Format: logging.FormatJSON}))
+	t.Cleanup(func() { logging.SetDefault(previous) })
+	return logs
+}
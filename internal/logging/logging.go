@@ -3,6 +3,7 @@ package logging
 
 import (
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -471,6 +472,7 @@ func Errorf(format string, args ...interface{}) {
 
 // DNSRequest represents a DNS request log entry.
 type DNSRequest struct {
+	Listener string `json:"listener,omitempty"`
 	Protocol string `json:"protocol"`
 	Type     string `json:"type"`
 	Name     string `json:"name"`
@@ -483,19 +485,24 @@ type DNSResponse struct {
 	Rcode          string  `json:"rcode"`
 	AnswerCount    int     `json:"answer_count"`
 	Resolver       string  `json:"resolver"`
+	Rule           string  `json:"rule,omitempty"`
 	DurationMs     float64 `json:"duration_ms"`
 	RequestMatched bool    `json:"request_matched,omitempty"`
 	CNAMEMatched   bool    `json:"cname_matched,omitempty"`
+	Cached         bool    `json:"cached,omitempty"`
+	Stale          bool    `json:"stale,omitempty"`
+	Fallback       string  `json:"fallback,omitempty"`
 }
 
 // DNSDebug represents debug information for DNS routing.
 type DNSDebug struct {
-	MatchedPattern string `json:"matched_pattern,omitempty"`
-	Request        string `json:"request,omitempty"`
-	CNAMEPattern   string `json:"cname_pattern,omitempty"`
-	CNAME          string `json:"cname,omitempty"`
-	Resolver       string `json:"resolver,omitempty"`
-	FullResponse   string `json:"full_response,omitempty"`
+	MatchedPattern string   `json:"matched_pattern,omitempty"`
+	Request        string   `json:"request,omitempty"`
+	CNAMEPattern   string   `json:"cname_pattern,omitempty"`
+	CNAME          string   `json:"cname,omitempty"`
+	CNAMEChain     []string `json:"cname_chain,omitempty"`
+	Resolver       string   `json:"resolver,omitempty"`
+	FullResponse   string   `json:"full_response,omitempty"`
 }
 
 // LogDNSRequest logs a DNS request.
@@ -506,6 +513,9 @@ func (l *Logger) LogDNSRequest(req DNSRequest) {
 		"name":     req.Name,
 		"from":     req.From,
 	}
+	if req.Listener != "" {
+		fields["listener"] = req.Listener
+	}
 	l.Info("DNS request received", fields)
 }
 
@@ -518,12 +528,24 @@ func (l *Logger) LogDNSResponse(resp DNSResponse) {
 		"resolver":     resp.Resolver,
 		"duration_ms":  resp.DurationMs,
 	}
+	if resp.Rule != "" {
+		fields["rule"] = resp.Rule
+	}
 	if resp.RequestMatched {
 		fields["request_matched"] = true
 	}
 	if resp.CNAMEMatched {
 		fields["cname_matched"] = true
 	}
+	if resp.Cached {
+		fields["cached"] = true
+	}
+	if resp.Stale {
+		fields["stale"] = true
+	}
+	if resp.Fallback != "" {
+		fields["fallback"] = resp.Fallback
+	}
 	l.Info("DNS response sent", fields)
 }
 
@@ -544,6 +566,13 @@ func (l *Logger) LogDNSDebug(debug DNSDebug) {
 		})
 	}
 
+	if len(debug.CNAMEChain) > 0 {
+		l.Debug("CNAME chain followed", map[string]interface{}{
+			"request": debug.Request,
+			"chain":   strings.Join(debug.CNAMEChain, " -> "),
+		})
+	}
+
 	if debug.CNAMEPattern != "" {
 		l.Debug("CNAME_PATTERN matched", map[string]interface{}{
 			"pattern": debug.CNAMEPattern,
@@ -215,6 +215,7 @@ func TestLogger_DNSRequest(t *testing.T) {
 	logger := NewLogger(Config{Output: buf, Format: FormatJSON})
 
 	logger.LogDNSRequest(DNSRequest{
+		Listener: "node-local",
 		Protocol: "udp",
 		Type:     "A",
 		Name:     "example.com.",
@@ -226,6 +227,7 @@ func TestLogger_DNSRequest(t *testing.T) {
 	require.NoError(t, err)
 
 	assert.Equal(t, "DNS request received", entry["message"])
+	assert.Equal(t, "node-local", entry["listener"])
 	assert.Equal(t, "udp", entry["protocol"])
 	assert.Equal(t, "A", entry["type"])
 	assert.Equal(t, "example.com.", entry["name"])
@@ -258,6 +260,66 @@ func TestLogger_DNSResponse(t *testing.T) {
 	assert.Equal(t, 12.345, entry["duration_ms"])
 	assert.Equal(t, true, entry["request_matched"])
 	assert.Equal(t, true, entry["cname_matched"])
+	assert.NotContains(t, entry, "fallback")
+}
+
+func TestLogger_DNSResponse_Fallback(t *testing.T) {
+	buf := newTestBuffer()
+	logger := NewLogger(Config{Output: buf, Format: FormatJSON})
+
+	logger.LogDNSResponse(DNSResponse{
+		Name:     "example.com.",
+		Rcode:    "NOERROR",
+		Resolver: "backup",
+		Rule:     "corp",
+		Fallback: "explicit resolver failed: i/o timeout",
+	})
+
+	var entry map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	require.NoError(t, err)
+
+	assert.Equal(t, "backup", entry["resolver"])
+	assert.Equal(t, "corp", entry["rule"])
+	assert.Equal(t, "explicit resolver failed: i/o timeout", entry["fallback"])
+}
+
+func TestLogger_DNSResponse_Cached(t *testing.T) {
+	buf := newTestBuffer()
+	logger := NewLogger(Config{Output: buf, Format: FormatJSON})
+
+	logger.LogDNSResponse(DNSResponse{
+		Name:     "example.com.",
+		Rcode:    "NOERROR",
+		Resolver: "explicit",
+		Cached:   true,
+	})
+
+	var entry map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	require.NoError(t, err)
+
+	assert.Equal(t, true, entry["cached"])
+}
+
+func TestLogger_DNSResponse_Stale(t *testing.T) {
+	buf := newTestBuffer()
+	logger := NewLogger(Config{Output: buf, Format: FormatJSON})
+
+	logger.LogDNSResponse(DNSResponse{
+		Name:     "example.com.",
+		Rcode:    "NOERROR",
+		Resolver: "explicit",
+		Stale:    true,
+		Fallback: "explicit resolver failed: i/o timeout",
+	})
+
+	var entry map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	require.NoError(t, err)
+
+	assert.Equal(t, true, entry["stale"])
+	assert.Equal(t, "explicit resolver failed: i/o timeout", entry["fallback"])
 }
 
 func TestLogger_DNSDebug(t *testing.T) {
@@ -289,6 +351,23 @@ func TestLogger_DNSDebug(t *testing.T) {
 		// Verify pattern is present
 		assert.Contains(t, output, "pattern")
 	})
+
+	t.Run("cname chain", func(t *testing.T) {
+		buf := newTestBuffer()
+		logger := NewLogger(Config{Output: buf, Format: FormatJSON, Debug: true})
+
+		logger.LogDNSDebug(DNSDebug{
+			Request:      "a.example.com",
+			CNAMEChain:   []string{"b.example.com", "c.cdn.net"},
+			CNAMEPattern: ".*\\.cdn\\.net$",
+			CNAME:        "c.cdn.net",
+		})
+
+		output := buf.String()
+		assert.Contains(t, output, "CNAME chain followed")
+		assert.Contains(t, output, "b.example.com -> c.cdn.net")
+		assert.Contains(t, output, "CNAME_PATTERN matched")
+	})
 }
 
 func TestDefaultLogger(t *testing.T) {
@@ -6,6 +6,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // Matcher defines the interface for pattern matching.
@@ -18,11 +19,27 @@ type Matcher interface {
 	Patterns() []string
 }
 
+// Versioned is implemented by matchers whose patterns can change at runtime.
+type Versioned interface {
+	// Generation returns a counter that increases whenever the patterns change.
+	Generation() uint64
+}
+
+// Generation returns the generation of m, or 0 if m is nil or not Versioned.
+func Generation(m Matcher) uint64 {
+	if v, ok := m.(Versioned); ok {
+		return v.Generation()
+	}
+	return 0
+}
+
 // RegexMatcher implements Matcher using compiled regular expressions.
 type RegexMatcher struct {
 	patterns []*regexp.Regexp
 	raw      []string
 	mu       sync.RWMutex
+	// generation counts pattern updates
+	generation atomic.Uint64
 }
 
 // NewRegexMatcher creates a new RegexMatcher from a slice of regex pattern strings.
@@ -118,10 +135,16 @@ func (m *RegexMatcher) UpdatePatterns(patterns []string) error {
 	m.patterns = newPatterns
 	m.raw = newRaw
 	m.mu.Unlock()
+	m.generation.Add(1)
 
 	return nil
 }
 
+// Generation returns the number of pattern updates.
+func (m *RegexMatcher) Generation() uint64 {
+	return m.generation.Load()
+}
+
 // NoOpMatcher is a matcher that never matches anything.
 type NoOpMatcher struct{}
 
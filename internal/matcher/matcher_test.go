@@ -156,6 +156,22 @@ func TestRegexMatcher_UpdatePatterns_WithEmptyPatterns(t *testing.T) {
 	assert.False(t, m.Match("www.example.com"))
 }
 
+func TestRegexMatcher_Generation(t *testing.T) {
+	m, err := NewRegexMatcher([]string{`.*\.example\.com$`})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), m.Generation())
+
+	require.NoError(t, m.UpdatePatterns([]string{`.*\.test\.org$`}))
+	assert.Equal(t, uint64(1), m.Generation())
+
+	// Rejected updates leave the generation unchanged
+	assert.Error(t, m.UpdatePatterns([]string{"[invalid"}))
+	assert.Equal(t, uint64(1), Generation(m))
+
+	assert.Equal(t, uint64(0), Generation(NewNoOpMatcher()))
+	assert.Equal(t, uint64(0), Generation(nil))
+}
+
 func TestNoOpMatcher(t *testing.T) {
 	m := NewNoOpMatcher()
 
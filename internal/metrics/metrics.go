@@ -11,13 +11,28 @@ import (
 // Metrics holds all Prometheus metrics.
 type Metrics struct {
 	RequestsTotal     *prometheus.CounterVec
+	ListenerRequests  *prometheus.CounterVec
 	RequestDuration   *prometheus.HistogramVec
 	ResolverUsed      *prometheus.CounterVec
 	PatternMatches    *prometheus.CounterVec
 	CNAMEMatches      *prometheus.CounterVec
 	Errors            *prometheus.CounterVec
 	ActiveConnections prometheus.Gauge
+	QueuedRequests    prometheus.Gauge
 	DNSResponseCodes  *prometheus.CounterVec
+	TCPFallbacks      *prometheus.CounterVec
+	CoalescedRequests *prometheus.CounterVec
+	UpstreamDuration  *prometheus.HistogramVec
+	UpstreamErrors    *prometheus.CounterVec
+	Fallbacks         *prometheus.CounterVec
+	StaleAnswers      *prometheus.CounterVec
+	Prefetches        *prometheus.CounterVec
+	CacheHits         *prometheus.CounterVec
+	CacheMisses       *prometheus.CounterVec
+	CacheEvictions    *prometheus.CounterVec
+	ACLDenied         *prometheus.CounterVec
+	RateLimited       *prometheus.CounterVec
+	ShedRequests      *prometheus.CounterVec
 }
 
 var (
@@ -57,6 +72,14 @@ func createMetrics(namespace string) *Metrics {
 			},
 			[]string{"protocol", "type"},
 		),
+		ListenerRequests: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "listener_requests_total",
+				Help:      "Total number of DNS requests received per listener",
+			},
+			[]string{"listener", "protocol"},
+		),
 		RequestDuration: promauto.NewHistogramVec(
 			prometheus.HistogramOpts{
 				Namespace: namespace,
@@ -105,6 +128,13 @@ func createMetrics(namespace string) *Metrics {
 				Help:      "Number of active connections",
 			},
 		),
+		QueuedRequests: promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "queued_requests",
+				Help:      "Number of DNS requests waiting for an in-flight slot",
+			},
+		),
 		DNSResponseCodes: promauto.NewCounterVec(
 			prometheus.CounterOpts{
 				Namespace: namespace,
@@ -113,6 +143,111 @@ func createMetrics(namespace string) *Metrics {
 			},
 			[]string{"rcode"},
 		),
+		TCPFallbacks: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "upstream_tcp_fallbacks_total",
+				Help:      "Total number of truncated UDP upstream responses retried over TCP",
+			},
+			[]string{"resolver"},
+		),
+		CoalescedRequests: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "upstream_coalesced_requests_total",
+				Help:      "Total number of upstream queries answered by an identical query already in flight",
+			},
+			[]string{"resolver"},
+		),
+		UpstreamDuration: promauto.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "upstream_duration_seconds",
+				Help:      "Duration of exchanges with individual upstream servers",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"resolver", "upstream"},
+		),
+		UpstreamErrors: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "upstream_errors_total",
+				Help:      "Total number of failed exchanges with individual upstream servers",
+			},
+			[]string{"resolver", "upstream"},
+		),
+		Fallbacks: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "fallbacks_total",
+				Help:      "Total number of responses produced by a failure policy",
+			},
+			[]string{"resolver"},
+		),
+		StaleAnswers: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "stale_answers_total",
+				Help:      "Total number of last good answers served past their TTL",
+			},
+			[]string{"resolver"},
+		),
+		Prefetches: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "prefetches_total",
+				Help:      "Total number of background refreshes of popular cached answers",
+			},
+			[]string{"result"},
+		),
+		CacheHits: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "cache_hits_total",
+				Help:      "Total number of cache lookups answered from the cache",
+			},
+			[]string{"cache"},
+		),
+		CacheMisses: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "cache_misses_total",
+				Help:      "Total number of cache lookups not answered from the cache",
+			},
+			[]string{"cache"},
+		),
+		CacheEvictions: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "cache_evictions_total",
+				Help:      "Total number of cache entries evicted to stay within the size limit",
+			},
+			[]string{"cache"},
+		),
+		ACLDenied: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "acl_denied_total",
+				Help:      "Total number of queries from clients denied by an access control list",
+			},
+			[]string{"listener", "action"},
+		),
+		RateLimited: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "rrl_limited_total",
+				Help:      "Total number of UDP responses slipped or dropped by response rate limiting",
+			},
+			[]string{"class", "action"},
+		),
+		ShedRequests: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "requests_shed_total",
+				Help:      "Total number of DNS requests answered immediately because the server was saturated",
+			},
+			[]string{"protocol", "reason"},
+		),
 	}
 }
 
@@ -121,6 +256,11 @@ func (m *Metrics) RecordRequest(protocol, qtype string) {
 	m.RequestsTotal.WithLabelValues(protocol, qtype).Inc()
 }
 
+// RecordListenerRequest records a DNS request received by the named listener.
+func (m *Metrics) RecordListenerRequest(listener, protocol string) {
+	m.ListenerRequests.WithLabelValues(listener, protocol).Inc()
+}
+
 // RecordDuration records the duration of a request.
 func (m *Metrics) RecordDuration(resolver string, duration float64) {
 	m.RequestDuration.WithLabelValues(resolver).Observe(duration)
@@ -151,6 +291,72 @@ func (m *Metrics) RecordResponseCode(rcode string) {
 	m.DNSResponseCodes.WithLabelValues(rcode).Inc()
 }
 
+// RecordTCPFallback records a truncated UDP response that was retried over TCP.
+func (m *Metrics) RecordTCPFallback(resolver string) {
+	m.TCPFallbacks.WithLabelValues(resolver).Inc()
+}
+
+// RecordCoalesced records a query that shared the exchange of an identical query in flight.
+func (m *Metrics) RecordCoalesced(resolver string) {
+	m.CoalescedRequests.WithLabelValues(resolver).Inc()
+}
+
+// RecordUpstreamDuration records the duration of an exchange with an upstream server.
+func (m *Metrics) RecordUpstreamDuration(resolver, upstream string, duration float64) {
+	m.UpstreamDuration.WithLabelValues(resolver, upstream).Observe(duration)
+}
+
+// RecordUpstreamError records a failed exchange with an upstream server.
+func (m *Metrics) RecordUpstreamError(resolver, upstream string) {
+	m.UpstreamErrors.WithLabelValues(resolver, upstream).Inc()
+}
+
+// RecordFallback records a response produced by a failure policy.
+func (m *Metrics) RecordFallback(resolver string) {
+	m.Fallbacks.WithLabelValues(resolver).Inc()
+}
+
+// RecordPrefetch records a background refresh by result: refreshed, failed or dropped.
+func (m *Metrics) RecordPrefetch(result string) {
+	m.Prefetches.WithLabelValues(result).Inc()
+}
+
+// RecordStaleAnswer records a last good answer served past its TTL.
+func (m *Metrics) RecordStaleAnswer(resolver string) {
+	m.StaleAnswers.WithLabelValues(resolver).Inc()
+}
+
+// RecordCacheHit records a lookup answered from the given cache.
+func (m *Metrics) RecordCacheHit(cache string) {
+	m.CacheHits.WithLabelValues(cache).Inc()
+}
+
+// RecordCacheMiss records a lookup not answered from the given cache.
+func (m *Metrics) RecordCacheMiss(cache string) {
+	m.CacheMisses.WithLabelValues(cache).Inc()
+}
+
+// RecordCacheEviction records an entry evicted from the given cache.
+func (m *Metrics) RecordCacheEviction(cache string) {
+	m.CacheEvictions.WithLabelValues(cache).Inc()
+}
+
+// RecordACLDenied records a query denied by the access control list of a listener.
+func (m *Metrics) RecordACLDenied(listener, action string) {
+	m.ACLDenied.WithLabelValues(listener, action).Inc()
+}
+
+// RecordRateLimited records a response of the given class slipped or dropped by
+// response rate limiting.
+func (m *Metrics) RecordRateLimited(class, action string) {
+	m.RateLimited.WithLabelValues(class, action).Inc()
+}
+
+// RecordShed records a request shed by reason: queue_full or queue_timeout.
+func (m *Metrics) RecordShed(protocol, reason string) {
+	m.ShedRequests.WithLabelValues(protocol, reason).Inc()
+}
+
 // IncActiveConnections increments active connections.
 func (m *Metrics) IncActiveConnections() {
 	m.ActiveConnections.Inc()
@@ -160,3 +366,13 @@ func (m *Metrics) IncActiveConnections() {
 func (m *Metrics) DecActiveConnections() {
 	m.ActiveConnections.Dec()
 }
+
+// IncQueuedRequests increments the requests waiting for an in-flight slot.
+func (m *Metrics) IncQueuedRequests() {
+	m.QueuedRequests.Inc()
+}
+
+// DecQueuedRequests decrements the requests waiting for an in-flight slot.
+func (m *Metrics) DecQueuedRequests() {
+	m.QueuedRequests.Dec()
+}
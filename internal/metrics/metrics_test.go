@@ -3,6 +3,7 @@ package metrics
 import (
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -11,13 +12,28 @@ func TestNewMetrics(t *testing.T) {
 
 	assert.NotNil(t, m)
 	assert.NotNil(t, m.RequestsTotal)
+	assert.NotNil(t, m.ListenerRequests)
 	assert.NotNil(t, m.RequestDuration)
 	assert.NotNil(t, m.ResolverUsed)
 	assert.NotNil(t, m.PatternMatches)
 	assert.NotNil(t, m.CNAMEMatches)
 	assert.NotNil(t, m.Errors)
 	assert.NotNil(t, m.ActiveConnections)
+	assert.NotNil(t, m.QueuedRequests)
 	assert.NotNil(t, m.DNSResponseCodes)
+	assert.NotNil(t, m.TCPFallbacks)
+	assert.NotNil(t, m.CoalescedRequests)
+	assert.NotNil(t, m.UpstreamDuration)
+	assert.NotNil(t, m.UpstreamErrors)
+	assert.NotNil(t, m.Fallbacks)
+	assert.NotNil(t, m.StaleAnswers)
+	assert.NotNil(t, m.Prefetches)
+	assert.NotNil(t, m.CacheHits)
+	assert.NotNil(t, m.CacheMisses)
+	assert.NotNil(t, m.CacheEvictions)
+	assert.NotNil(t, m.ACLDenied)
+	assert.NotNil(t, m.RateLimited)
+	assert.NotNil(t, m.ShedRequests)
 }
 
 func TestNewMetrics_DefaultNamespace(t *testing.T) {
@@ -84,11 +100,102 @@ func TestMetrics_RecordResponseCode(t *testing.T) {
 	m.RecordResponseCode("SERVFAIL")
 }
 
+func TestMetrics_RecordTCPFallback(t *testing.T) {
+	m := NewMetrics("test_tcp_fallback")
+
+	// Should not panic
+	m.RecordTCPFallback("explicit")
+	m.RecordTCPFallback("passthrough")
+}
+
+func TestMetrics_RecordCache(t *testing.T) {
+	m := NewMetrics("test_cache")
+
+	// Should not panic
+	m.RecordCacheHit("response")
+	m.RecordCacheMiss("response")
+	m.RecordCacheEviction("response")
+}
+
+func TestMetrics_RecordACLDenied(t *testing.T) {
+	m := NewMetrics("test_acl_denied")
+
+	// Should not panic
+	m.RecordACLDenied("dns", "refuse")
+	m.RecordACLDenied("grpc", "drop")
+}
+
+func TestMetrics_RecordRateLimited(t *testing.T) {
+	m := NewMetrics("test_rate_limited")
+
+	// Should not panic
+	m.RecordRateLimited("response", "slip")
+	m.RecordRateLimited("nxdomain", "drop")
+}
+
+func TestMetrics_RecordUpstream(t *testing.T) {
+	m := NewMetrics("test_upstream_servers")
+
+	// Should not panic
+	m.RecordUpstreamDuration("explicit", "1.1.1.1:53", 0.012)
+	m.RecordUpstreamDuration("explicit", "8.8.8.8:53", 0.030)
+	m.RecordUpstreamError("explicit", "8.8.8.8:53")
+}
+
+func TestMetrics_RecordCoalesced(t *testing.T) {
+	m := NewMetrics("test_coalesced")
+
+	// Should not panic
+	m.RecordCoalesced("explicit")
+}
+
+func TestMetrics_RecordFallback(t *testing.T) {
+	m := NewMetrics("test_fallback")
+
+	// Should not panic
+	m.RecordFallback("backup")
+}
+
+func TestMetrics_RecordPrefetch(t *testing.T) {
+	m := NewMetrics("test_prefetch")
+
+	// Should not panic
+	m.RecordPrefetch("refreshed")
+	m.RecordPrefetch("dropped")
+}
+
+func TestMetrics_RecordStaleAnswer(t *testing.T) {
+	m := NewMetrics("test_stale")
+
+	// Should not panic
+	m.RecordStaleAnswer("explicit")
+}
+
 func TestMetrics_ActiveConnections(t *testing.T) {
 	m := NewMetrics("test_conn")
 
-	// Should not panic
 	m.IncActiveConnections()
 	m.IncActiveConnections()
 	m.DecActiveConnections()
+	m.IncQueuedRequests()
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.ActiveConnections))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.QueuedRequests))
+}
+
+func TestMetrics_RecordListenerRequest(t *testing.T) {
+	m := NewMetrics("test_listener_request")
+
+	// Should not panic
+	m.RecordListenerRequest("127.0.0.1:53", "udp")
+	m.RecordListenerRequest("node-local", "tcp")
+	m.RecordListenerRequest("dot", "tls")
+}
+
+func TestMetrics_RecordShed(t *testing.T) {
+	m := NewMetrics("test_shed")
+
+	// Should not panic
+	m.RecordShed("udp", "queue_full")
+	m.RecordShed("tcp", "queue_timeout")
 }
@@ -0,0 +1,257 @@
+// Package proxyproto reads PROXY protocol v1 and v2 headers sent by trusted load
+// balancers, so TCP frontends see the address of the real client.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/steigr/nameserver-switcher/internal/acl"
+	"github.com/steigr/nameserver-switcher/internal/logging"
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+)
+
+const (
+	// maxV1HeaderLen is the longest v1 header, including the trailing CRLF.
+	maxV1HeaderLen = 107
+	// v2HeaderLen is the length of the fixed part of a v2 header.
+	v2HeaderLen = 16
+)
+
+var (
+	// v1Signature starts a v1 header.
+	v1Signature = []byte("PROXY ")
+	// v2Signature starts a v2 header.
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Config holds configuration for a PROXY protocol policy.
+type Config struct {
+	// Listener names the frontend in logs (e.g. dns, grpc).
+	Listener string
+	// Trusted is a comma-separated list of CIDRs or addresses of the proxies whose
+	// connections must start with a PROXY protocol header.
+	Trusted string
+	// Metrics records rejected headers.
+	Metrics *metrics.Metrics
+}
+
+// Policy decides which connections carry a PROXY protocol header.
+type Policy struct {
+	listener string
+	trusted  []netip.Prefix
+	metrics  *metrics.Metrics
+}
+
+// New creates a PROXY protocol policy. It returns nil, which reads no headers, when
+// Trusted is empty.
+func New(cfg Config) (*Policy, error) {
+	trusted, err := acl.ParsePrefixes(cfg.Trusted)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s PROXY protocol trusted list: %w", cfg.Listener, err)
+	}
+	if len(trusted) == 0 {
+		return nil, nil
+	}
+	return &Policy{listener: cfg.Listener, trusted: trusted, metrics: cfg.Metrics}, nil
+}
+
+// Listen wraps l so connections from trusted proxies report the client address of
+// their PROXY protocol header as their remote address. Connections from other peers
+// are passed through unchanged. A nil Policy returns l.
+func (p *Policy) Listen(l net.Listener) net.Listener {
+	if p == nil {
+		return l
+	}
+	return &listener{Listener: l, policy: p}
+}
+
+// trusts reports whether the peer at addr is a trusted proxy.
+func (p *Policy) trusts(addr net.Addr) bool {
+	client, ok := acl.ClientAddr(addr)
+	if !ok {
+		return false
+	}
+	for _, prefix := range p.trusted {
+		if prefix.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// listener wraps the connections of trusted proxies.
+type listener struct {
+	net.Listener
+	policy *Policy
+}
+
+// Accept waits for the next connection. The header of a trusted proxy is read on
+// first use of the connection, so a slow proxy does not hold up other connections.
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.policy.trusts(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &conn{Conn: c, policy: l.policy}, nil
+}
+
+// conn is a connection from a trusted proxy that starts with a PROXY protocol header.
+type conn struct {
+	net.Conn
+	policy *Policy
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+// init reads the header, within the deadlines set on the connection.
+func (c *conn) init() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		c.remote = c.Conn.RemoteAddr()
+
+		remote, err := readHeader(c.reader)
+		if err != nil {
+			c.err = fmt.Errorf("invalid PROXY protocol header: %w", err)
+			logging.Warnf("Rejected %s connection from %s: %v", c.policy.listener, c.remote, c.err)
+			if c.policy.metrics != nil {
+				c.policy.metrics.RecordError("proxy_protocol")
+			}
+			return
+		}
+		if remote != nil {
+			c.remote = remote
+		}
+	})
+}
+
+// Read reads data following the header.
+func (c *conn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address of the header, or the address of the proxy
+// for headers without one, such as health checks.
+func (c *conn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// readHeader reads a v1 or v2 header and returns the source address it carries, or
+// nil when it carries none.
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	// The shortest header, "PROXY UNKNOWN\r\n", is 15 bytes: check the v1 signature
+	// first and peek the longer v2 signature only when it does not match
+	sig, err := r.Peek(len(v1Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, v1Signature) {
+		return readV1Header(r)
+	}
+	sig, err = r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, v2Signature) {
+		return readV2Header(r)
+	}
+	return nil, errors.New("missing header")
+}
+
+// readV1Header reads a text header such as "PROXY TCP4 192.0.2.1 192.0.2.2 4000 53\r\n".
+func readV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxV1HeaderLen {
+			return nil, errors.New("v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil || addr.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port %q", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readV2Header reads a binary header.
+func readV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, v2HeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if version := header[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0:
+		// LOCAL: a connection of the proxy itself, such as a health check
+		return nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", command)
+	}
+
+	switch family {
+	case 0x11:
+		// TCP over IPv4: source and destination address, then source and destination port
+		if len(payload) < 12 {
+			return nil, errors.New("short v2 IPv4 address block")
+		}
+		addr := netip.AddrFrom4([4]byte(payload[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(payload[8:10]))), nil
+	case 0x21:
+		// TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("short v2 IPv6 address block")
+		}
+		addr := netip.AddrFrom16([16]byte(payload[0:16]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(payload[32:34]))), nil
+	default:
+		// Unspecified, UDP or UNIX sockets carry no usable client address
+		return nil, nil
+	}
+}
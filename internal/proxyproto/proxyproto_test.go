@@ -0,0 +1,189 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+)
+
+// v2Header builds a v2 header for a TCP connection from src to dst.
+func v2Header(command byte, src, dst netip.AddrPort) []byte {
+	var family byte = 0x11
+	addrs := append(src.Addr().AsSlice(), dst.Addr().AsSlice()...)
+	if src.Addr().Is6() {
+		family = 0x21
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+	// A TLV the reader must skip
+	addrs = append(addrs, 0x04, 0x00, 0x01, 0xff)
+
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func parse(t *testing.T, data []byte) (net.Addr, string, error) {
+	t.Helper()
+	r := bufio.NewReader(bytes.NewReader(data))
+	addr, err := readHeader(r)
+	rest, _ := io.ReadAll(r)
+	return addr, string(rest), err
+}
+
+func TestNew(t *testing.T) {
+	p, err := New(Config{Listener: "dns"})
+	require.NoError(t, err)
+	assert.Nil(t, p, "no trusted proxies disables the PROXY protocol")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Same(t, l, p.Listen(l))
+
+	_, err = New(Config{Listener: "dns", Trusted: "10.0.0.0/33"})
+	assert.ErrorContains(t, err, "invalid dns PROXY protocol trusted list")
+}
+
+func TestReadHeader_V1(t *testing.T) {
+	addr, rest, err := parse(t, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 40000 53\r\nquery"))
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:40000", addr.String())
+	assert.IsType(t, &net.TCPAddr{}, addr)
+	assert.Equal(t, "query", rest)
+
+	addr, _, err = parse(t, []byte("PROXY TCP6 2001:db8::1 2001:db8::53 40000 53\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:40000", addr.String())
+
+	addr, rest, err = parse(t, []byte("PROXY UNKNOWN\r\nquery"))
+	require.NoError(t, err)
+	assert.Nil(t, addr)
+	assert.Equal(t, "query", rest)
+
+	// A bare UNKNOWN header, with nothing after it
+	addr, rest, err = parse(t, []byte("PROXY UNKNOWN\r\n"))
+	require.NoError(t, err)
+	assert.Nil(t, addr)
+	assert.Empty(t, rest)
+
+	for _, invalid := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 40000\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 40000 53\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 70000 53\r\n",
+		"PROXY UDP4 192.0.2.1 198.51.100.1 40000 53\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 40000 53" + string(make([]byte, 100)),
+	} {
+		_, _, err := parse(t, []byte(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestReadHeader_V2(t *testing.T) {
+	src := netip.MustParseAddrPort("192.0.2.1:40000")
+	dst := netip.MustParseAddrPort("198.51.100.1:53")
+
+	addr, rest, err := parse(t, append(v2Header(0x1, src, dst), "query"...))
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:40000", addr.String())
+	assert.IsType(t, &net.TCPAddr{}, addr)
+	assert.Equal(t, "query", rest)
+
+	addr, _, err = parse(t, v2Header(0x1, netip.MustParseAddrPort("[2001:db8::1]:40000"), netip.MustParseAddrPort("[2001:db8::53]:53")))
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:40000", addr.String())
+
+	// LOCAL connections, such as health checks, carry no client address
+	addr, rest, err = parse(t, append(v2Header(0x0, src, dst), "query"...))
+	require.NoError(t, err)
+	assert.Nil(t, addr)
+	assert.Equal(t, "query", rest)
+
+	_, _, err = parse(t, v2Header(0x2, src, dst))
+	assert.Error(t, err, "unknown command")
+
+	_, _, err = parse(t, v2Header(0x1, src, dst)[:20])
+	assert.Error(t, err, "truncated header")
+}
+
+func TestReadHeader_Missing(t *testing.T) {
+	_, _, err := parse(t, []byte("\x00\x1d\x12\x34 a DNS query"))
+	assert.ErrorContains(t, err, "missing header")
+}
+
+// accept connects to l, writes data and returns the accepted connection.
+func accept(t *testing.T, l net.Listener, data []byte) net.Conn {
+	t.Helper()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	_, err = client.Write(data)
+	require.NoError(t, err)
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	return conn
+}
+
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer inner.Close()
+
+	m := metrics.NewMetrics("test_proxyproto_listener")
+	p, err := New(Config{Listener: "dns", Trusted: "127.0.0.0/8", Metrics: m})
+	require.NoError(t, err)
+	l := p.Listen(inner)
+
+	t.Run("trusted proxy", func(t *testing.T) {
+		conn := accept(t, l, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 40000 53\r\nquery"))
+		assert.Equal(t, "192.0.2.1:40000", conn.RemoteAddr().String())
+
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "query", string(buf))
+	})
+
+	t.Run("invalid header", func(t *testing.T) {
+		conn := accept(t, l, []byte("not a PROXY protocol header"))
+		_, err := conn.Read(make([]byte, 5))
+		assert.ErrorContains(t, err, "invalid PROXY protocol header")
+		assert.Equal(t, inner.Addr().(*net.TCPAddr).IP.String(), conn.RemoteAddr().(*net.TCPAddr).IP.String())
+		assert.Equal(t, 1.0, testutil.ToFloat64(m.Errors.WithLabelValues("proxy_protocol")))
+	})
+}
+
+func TestListener_Untrusted(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer inner.Close()
+
+	p, err := New(Config{Listener: "grpc", Trusted: "10.0.0.0/8"})
+	require.NoError(t, err)
+	l := p.Listen(inner)
+
+	// Headers from untrusted peers are not interpreted
+	header := "PROXY TCP4 192.0.2.1 198.51.100.1 40000 53\r\n"
+	conn := accept(t, l, []byte(header))
+	assert.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+
+	buf := make([]byte, len(header))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, header, string(buf))
+}
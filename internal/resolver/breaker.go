@@ -0,0 +1,128 @@
+package resolver
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when every upstream of a pool is skipped because its circuit is open.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// BreakerConfig holds the circuit breaker settings for pool members.
+type BreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures that opens the circuit (0 disables).
+	FailureThreshold int
+	// OpenDuration is how long an open circuit rejects queries before a trial query is let through.
+	OpenDuration time.Duration
+}
+
+// circuitState is the state of a circuit breaker.
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// String returns the state name.
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker tracks consecutive failures of a single upstream.
+// A closed breaker passes all queries. After FailureThreshold consecutive
+// failures it opens and rejects queries for OpenDuration, then half-opens and
+// lets a single trial query through: success closes it, failure reopens it.
+type breaker struct {
+	cfg BreakerConfig
+	now func() time.Time
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// newBreaker creates a closed breaker.
+func newBreaker(cfg BreakerConfig) *breaker {
+	return &breaker{cfg: cfg, now: time.Now}
+}
+
+// allow reports whether a query may be sent to the upstream.
+func (b *breaker) allow() bool {
+	if b.cfg.FailureThreshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.cfg.OpenDuration {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.trial = true
+		return true
+	case circuitHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// success records a successful exchange and closes the circuit.
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = circuitClosed
+	b.failures = 0
+	b.trial = false
+}
+
+// failure records a failed exchange and opens the circuit once the threshold is reached.
+func (b *breaker) failure() {
+	if b.cfg.FailureThreshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.state != circuitClosed || b.failures >= b.cfg.FailureThreshold {
+		b.state = circuitOpen
+		b.openedAt = b.now()
+	}
+}
+
+// release gives back a trial slot without judging the upstream, e.g. when the client went away.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// current returns the current state.
+func (b *breaker) current() circuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
@@ -0,0 +1,92 @@
+package resolver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestBreaker returns a breaker whose clock is advanced by the returned function.
+func newTestBreaker(cfg BreakerConfig) (*breaker, func(time.Duration)) {
+	now := time.Unix(1700000000, 0)
+	b := newBreaker(cfg)
+	b.now = func() time.Time { return now }
+	return b, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestBreaker_Disabled(t *testing.T) {
+	b, _ := newTestBreaker(BreakerConfig{})
+
+	for i := 0; i < 10; i++ {
+		b.failure()
+	}
+	assert.True(t, b.allow())
+	assert.Equal(t, circuitClosed, b.current())
+}
+
+func TestBreaker_OpensAfterThreshold(t *testing.T) {
+	b, _ := newTestBreaker(BreakerConfig{FailureThreshold: 3, OpenDuration: 10 * time.Second})
+
+	b.failure()
+	b.failure()
+	assert.True(t, b.allow())
+	assert.Equal(t, circuitClosed, b.current())
+
+	b.failure()
+	assert.Equal(t, circuitOpen, b.current())
+	assert.False(t, b.allow())
+}
+
+func TestBreaker_SuccessResetsFailures(t *testing.T) {
+	b, _ := newTestBreaker(BreakerConfig{FailureThreshold: 2, OpenDuration: 10 * time.Second})
+
+	b.failure()
+	b.success()
+	b.failure()
+	assert.Equal(t, circuitClosed, b.current())
+}
+
+func TestBreaker_HalfOpen(t *testing.T) {
+	b, advance := newTestBreaker(BreakerConfig{FailureThreshold: 1, OpenDuration: 10 * time.Second})
+
+	b.failure()
+	assert.False(t, b.allow())
+
+	advance(10 * time.Second)
+	assert.True(t, b.allow(), "first query after the open duration is a trial")
+	assert.Equal(t, circuitHalfOpen, b.current())
+	assert.False(t, b.allow(), "only one trial at a time")
+
+	t.Run("trial failure reopens", func(t *testing.T) {
+		b.failure()
+		assert.Equal(t, circuitOpen, b.current())
+		assert.False(t, b.allow())
+	})
+
+	t.Run("trial success closes", func(t *testing.T) {
+		advance(10 * time.Second)
+		assert.True(t, b.allow())
+		b.success()
+		assert.Equal(t, circuitClosed, b.current())
+		assert.True(t, b.allow())
+		assert.True(t, b.allow())
+	})
+}
+
+func TestBreaker_Release(t *testing.T) {
+	b, advance := newTestBreaker(BreakerConfig{FailureThreshold: 1, OpenDuration: time.Second})
+
+	b.failure()
+	advance(time.Second)
+	assert.True(t, b.allow())
+	b.release()
+	assert.Equal(t, circuitHalfOpen, b.current())
+	assert.True(t, b.allow(), "released trial slot can be reused")
+}
+
+func TestCircuitState_String(t *testing.T) {
+	assert.Equal(t, "closed", circuitClosed.String())
+	assert.Equal(t, "open", circuitOpen.String())
+	assert.Equal(t, "half-open", circuitHalfOpen.String())
+}
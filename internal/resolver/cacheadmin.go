@@ -0,0 +1,116 @@
+package resolver
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/steigr/nameserver-switcher/internal/cache"
+)
+
+// CachedAnswer is a cached response and how it was routed.
+type CachedAnswer struct {
+	Name  string
+	Qtype uint16
+	// DO is the DNSSEC OK bit of the queries the answer is cached for.
+	DO bool
+	// Result holds the routing outcome; its Response carries the remaining TTLs.
+	Result  *RouteResult
+	Stored  time.Time
+	Expires time.Time
+}
+
+// CachedAnswers returns the cached answers for name, for all types when qtype is 0.
+func (r *Router) CachedAnswers(name string, qtype uint16) []CachedAnswer {
+	name = canonicalName(name)
+	return r.cachedAnswers(func(key cache.Key) bool {
+		return key.Name == name && (qtype == 0 || key.Qtype == qtype)
+	})
+}
+
+// ListCachedAnswers returns the cached answers whose name, without the trailing dot,
+// matches pattern, or all cached answers when pattern is nil.
+func (r *Router) ListCachedAnswers(pattern *regexp.Regexp) []CachedAnswer {
+	return r.cachedAnswers(func(key cache.Key) bool {
+		return pattern == nil || pattern.MatchString(strings.TrimSuffix(key.Name, "."))
+	})
+}
+
+// FlushCacheName removes the cached answers for name and forgets its routing
+// decision and last good answers, so the next query probes again. It returns the
+// number of answers removed.
+func (r *Router) FlushCacheName(name string) int {
+	name = canonicalName(name)
+	r.forget(func(n string) bool { return n == name })
+	return r.cache.Delete(func(e cache.Entry) bool {
+		return e.Key.Name == name
+	})
+}
+
+// FlushCache removes the cached answers whose name matches pattern and that were
+// answered by resolver, and forgets the routing decisions and last good answers of
+// their names. A nil pattern or an empty resolver matches any answer. It returns the
+// number of answers removed.
+func (r *Router) FlushCache(pattern *regexp.Regexp, resolver string) int {
+	flushed := make(map[string]bool)
+	n := r.cache.Delete(func(e cache.Entry) bool {
+		if pattern != nil && !pattern.MatchString(strings.TrimSuffix(e.Key.Name, ".")) {
+			return false
+		}
+		if resolver != "" {
+			outcome, ok := e.Meta.(*RouteResult)
+			if !ok || outcome.ResolverUsed != resolver {
+				return false
+			}
+		}
+		flushed[e.Key.Name] = true
+		return true
+	})
+	if len(flushed) > 0 {
+		r.forget(func(name string) bool { return flushed[name] })
+	}
+	return n
+}
+
+// forget drops the routing decisions and last good answers of the names match
+// reports true for.
+func (r *Router) forget(match func(name string) bool) {
+	r.decisions.forget(match)
+	r.stale.forget(match)
+}
+
+// CacheStats returns the response cache statistics.
+func (r *Router) CacheStats() cache.Stats {
+	return r.cache.Stats()
+}
+
+// cachedAnswers returns the unexpired cached answers whose key matches.
+func (r *Router) cachedAnswers(match func(cache.Key) bool) []CachedAnswer {
+	now := time.Now()
+	var answers []CachedAnswer
+	for _, e := range r.cache.Entries() {
+		outcome, ok := e.Meta.(*RouteResult)
+		if !ok || !match(e.Key) {
+			continue
+		}
+		result := *outcome
+		result.Response = e.Answer(now)
+		result.Cached = true
+		answers = append(answers, CachedAnswer{
+			Name:    e.Key.Name,
+			Qtype:   e.Key.Qtype,
+			DO:      e.Key.DO,
+			Result:  &result,
+			Stored:  e.Stored,
+			Expires: e.Expires,
+		})
+	}
+	return answers
+}
+
+// canonicalName returns name in the form used in cache keys.
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
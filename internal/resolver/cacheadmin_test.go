@@ -0,0 +1,104 @@
+package resolver
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCacheAdminRouter(t *testing.T) (*Router, *recordingResolver) {
+	t.Helper()
+	explicit := &recordingResolver{name: "explicit", answer: completeChain()}
+	system := &recordingResolver{name: "system", answer: newAResponse("other.example.org.", "192.0.2.2").Answer}
+	router := newTestRouter(explicit, system, withCaches, func(cfg *RouterConfig) {
+		cfg.ServeStale = true
+	})
+	routeProbe(t, router, "www.example.com.")
+	routeProbe(t, router, "other.example.org.")
+	require.Equal(t, 2, router.CacheStats().Entries)
+	return router, explicit
+}
+
+func TestRouter_CachedAnswers(t *testing.T) {
+	router, _ := newCacheAdminRouter(t)
+
+	answers := router.CachedAnswers("WWW.example.com", dns.TypeA)
+	require.Len(t, answers, 1)
+	assert.Equal(t, "www.example.com.", answers[0].Name)
+	assert.Equal(t, dns.TypeA, answers[0].Qtype)
+	assert.Equal(t, "explicit", answers[0].Result.ResolverUsed)
+	assert.True(t, answers[0].Result.CNAMEMatched)
+	assert.True(t, answers[0].Result.Cached)
+	assert.Len(t, answers[0].Result.Response.Answer, 2)
+	assert.True(t, answers[0].Expires.After(answers[0].Stored))
+
+	assert.Len(t, router.CachedAnswers("www.example.com.", 0), 1)
+	assert.Empty(t, router.CachedAnswers("www.example.com.", dns.TypeAAAA))
+	assert.Empty(t, router.CachedAnswers("missing.example.com.", 0))
+}
+
+func TestRouter_ListCachedAnswers(t *testing.T) {
+	router, _ := newCacheAdminRouter(t)
+
+	assert.Len(t, router.ListCachedAnswers(nil), 2)
+	answers := router.ListCachedAnswers(regexp.MustCompile(`\.org$`))
+	require.Len(t, answers, 1)
+	assert.Equal(t, "other.example.org.", answers[0].Name)
+	assert.Equal(t, "system", answers[0].Result.ResolverUsed)
+}
+
+func TestRouter_FlushCacheName(t *testing.T) {
+	router, explicit := newCacheAdminRouter(t)
+	require.Equal(t, 1, router.decisions.size())
+	require.Equal(t, 2, router.stale.size())
+
+	assert.Equal(t, 1, router.FlushCacheName("www.example.com"))
+	assert.Equal(t, 0, router.decisions.size())
+	assert.Equal(t, 1, router.stale.size(), "the last good answer of the name is forgotten")
+	assert.Equal(t, 0, router.FlushCacheName("www.example.com"))
+
+	// The flushed name is probed and resolved again
+	queries := explicit.queries.Load()
+	result := routeProbe(t, router, "www.example.com.")
+	assert.False(t, result.Cached)
+	assert.False(t, result.DecisionCached)
+	assert.Greater(t, explicit.queries.Load(), queries)
+}
+
+func TestRouter_FlushCache(t *testing.T) {
+	router, explicit := newCacheAdminRouter(t)
+	require.Equal(t, 1, router.decisions.size())
+	require.Equal(t, 2, router.stale.size())
+
+	assert.Equal(t, 0, router.FlushCache(regexp.MustCompile(`\.org$`), "explicit"))
+	assert.Equal(t, 1, router.decisions.size(), "names left in the cache keep their decision")
+	assert.Equal(t, 2, router.stale.size())
+
+	assert.Equal(t, 1, router.FlushCache(nil, "explicit"))
+	assert.Empty(t, router.CachedAnswers("www.example.com.", 0))
+	assert.Equal(t, 0, router.decisions.size())
+	assert.Equal(t, 1, router.stale.size())
+
+	assert.Equal(t, 1, router.FlushCache(regexp.MustCompile(`^other\.`), ""))
+	assert.Equal(t, 0, router.CacheStats().Entries)
+	assert.Equal(t, 0, router.stale.size())
+
+	// The flushed name is probed and resolved again
+	queries := explicit.queries.Load()
+	result := routeProbe(t, router, "www.example.com.")
+	assert.False(t, result.Cached)
+	assert.False(t, result.DecisionCached)
+	assert.Greater(t, explicit.queries.Load(), queries)
+}
+
+func TestRouter_CacheAdmin_NoCache(t *testing.T) {
+	router := NewRouter(RouterConfig{SystemResolver: &recordingResolver{name: "system"}})
+
+	assert.Empty(t, router.ListCachedAnswers(nil))
+	assert.Equal(t, 0, router.FlushCacheName("www.example.com."))
+	assert.Equal(t, 0, router.FlushCache(nil, ""))
+	assert.Equal(t, 0, router.CacheStats().Capacity)
+}
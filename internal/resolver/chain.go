@@ -0,0 +1,150 @@
+package resolver
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// defaultCNAMEMaxDepth bounds the CNAME/DNAME hops followed when no depth is configured.
+const defaultCNAMEMaxDepth = 8
+
+// followChain chases the alias chain of the requested name, evaluating the rule's
+// CNAME patterns at every hop. Targets the upstream did not resolve in its answer
+// are queried at the probe resolver. It stops at the first matching hop, at a loop
+// or after the maximum depth and returns the matching hop, if any. Every hop is
+// recorded in result.CNAMEChain and the lowest TTL of the followed aliases in
+// result.chainTTL.
+func (r *Router) followChain(ctx context.Context, rule *Rule, req, resp *dns.Msg, result *RouteResult) string {
+	name := req.Question[0].Name
+	seen := map[string]bool{strings.ToLower(name): true}
+	chased := ""
+
+	for len(result.CNAMEChain) < r.cnameMaxDepth {
+		next, ttl, ok := nextHop(resp, name)
+		if !ok {
+			// The upstream stopped early; ask the probe resolver for the rest of the chain
+			if len(result.CNAMEChain) == 0 || chased == name || answersName(resp, name) {
+				return ""
+			}
+			chased = name
+
+			var err error
+			resp, err = rule.ProbeResolver.Resolve(ctx, chaseRequest(req, name))
+			if err != nil || resp == nil || resp.Rcode != dns.RcodeSuccess {
+				return ""
+			}
+			continue
+		}
+
+		if seen[strings.ToLower(next)] {
+			// CNAME loop
+			return ""
+		}
+		seen[strings.ToLower(next)] = true
+
+		hop := strings.TrimSuffix(next, ".")
+		if len(result.CNAMEChain) == 0 || ttl < result.chainTTL {
+			result.chainTTL = ttl
+		}
+		result.CNAMEChain = append(result.CNAMEChain, hop)
+		if rule.CNAMEMatcher.Match(hop) {
+			return hop
+		}
+		name = next
+	}
+	return ""
+}
+
+// nextHop returns the alias target of name in the answer section, from a CNAME
+// owned by name or synthesized from a DNAME owned by one of its ancestors, and the
+// TTL of that record.
+func nextHop(resp *dns.Msg, name string) (string, uint32, bool) {
+	for _, rr := range resp.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+			return cname.Target, cname.Hdr.Ttl, true
+		}
+	}
+	for _, rr := range resp.Answer {
+		dname, ok := rr.(*dns.DNAME)
+		if !ok || strings.EqualFold(dname.Hdr.Name, name) || !dns.IsSubDomain(dname.Hdr.Name, name) {
+			continue
+		}
+		// RFC 6672: replace the DNAME owner suffix with its target
+		prefix := name[:len(name)-len(dname.Hdr.Name)]
+		return dns.Fqdn(prefix + dname.Target), dname.Hdr.Ttl, true
+	}
+	return "", 0, false
+}
+
+// answersName reports whether the answer section has non-alias records for name.
+func answersName(resp *dns.Msg, name string) bool {
+	for _, rr := range resp.Answer {
+		switch rr.(type) {
+		case *dns.CNAME, *dns.DNAME:
+			continue
+		}
+		if strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isFinalAnswer reports whether resp completely answers req: NXDOMAIN, or an alias
+// chain (possibly empty) ending in records or a NODATA response with an SOA.
+func isFinalAnswer(req, resp *dns.Msg) bool {
+	switch {
+	case resp == nil || resp.Truncated || len(req.Question) == 0:
+		return false
+	case resp.Rcode == dns.RcodeNameError:
+		return true
+	case resp.Rcode != dns.RcodeSuccess:
+		return false
+	}
+
+	name := req.Question[0].Name
+	seen := map[string]bool{strings.ToLower(name): true}
+	for {
+		next, _, ok := nextHop(resp, name)
+		if !ok {
+			break
+		}
+		if seen[strings.ToLower(next)] {
+			return false
+		}
+		seen[strings.ToLower(next)] = true
+		name = next
+	}
+
+	if answersName(resp, name) {
+		return true
+	}
+	for _, rr := range resp.Ns {
+		if _, ok := rr.(*dns.SOA); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAlias reports whether the response contains CNAME or DNAME records.
+func hasAlias(resp *dns.Msg) bool {
+	for _, rr := range resp.Answer {
+		switch rr.(type) {
+		case *dns.CNAME, *dns.DNAME:
+			return true
+		}
+	}
+	return false
+}
+
+// chaseRequest builds the query for the next name of an alias chain.
+func chaseRequest(req *dns.Msg, name string) *dns.Msg {
+	chase := new(dns.Msg)
+	chase.SetQuestion(name, req.Question[0].Qtype)
+	chase.Question[0].Qclass = req.Question[0].Qclass
+	chase.RecursionDesired = req.RecursionDesired
+	return chase
+}
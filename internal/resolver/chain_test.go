@@ -0,0 +1,167 @@
+package resolver
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// aliasResolver answers from a fixed set of alias records per query name.
+type aliasResolver struct {
+	records map[string][]dns.RR
+	queries atomic.Int32
+}
+
+func (a *aliasResolver) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	a.queries.Add(1)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = a.records[strings.ToLower(req.Question[0].Name)]
+	return resp, nil
+}
+
+func (a *aliasResolver) Name() string {
+	return "probe"
+}
+
+func cname(name, target string) dns.RR {
+	return &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: target}
+}
+
+func dname(name, target string) dns.RR {
+	return &dns.DNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeDNAME, Class: dns.ClassINET, Ttl: 300}, Target: target}
+}
+
+// chainRule routes through the target resolver when a CNAME of the probe answer
+// matches cnamePatterns, following at most maxDepth aliases.
+func chainRule(probe Resolver, cnamePatterns map[string]string, maxDepth int) func(*RouterConfig) {
+	return func(cfg *RouterConfig) {
+		cfg.Rules = []Rule{{
+			Name:                 "chain",
+			CNAMEMatcher:         &MockMatcher{matches: cnamePatterns},
+			ProbeResolver:        probe,
+			TargetResolver:       &MockResolver{name: "target", response: newAResponse("a.example.com.", "10.0.0.1")},
+			NoCnameMatchResolver: &MockResolver{name: "no-cname-match", response: newAResponse("a.example.com.", "10.0.0.2")},
+		}}
+		cfg.CNAMEMaxDepth = maxDepth
+	}
+}
+
+func routeChain(t *testing.T, router *Router) *RouteResult {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	result, err := router.Route(context.Background(), req)
+	require.NoError(t, err)
+	return result
+}
+
+func TestRouter_Route_CNAMEChainInResponse(t *testing.T) {
+	probe := &aliasResolver{records: map[string][]dns.RR{
+		"a.example.com.": {
+			cname("a.example.com.", "b.example.com."),
+			cname("b.example.com.", "c.cdn.net."),
+			newAResponse("c.cdn.net.", "192.0.2.1").Answer[0],
+		},
+	}}
+
+	result := routeChain(t, newTestRouter(nil, nil, chainRule(probe, map[string]string{"c.cdn.net": "cdn"}, 0)))
+	assert.Equal(t, "target", result.ResolverUsed)
+	assert.True(t, result.CNAMEMatched)
+	assert.Equal(t, "cdn", result.CNAMEPattern)
+	assert.Equal(t, []string{"b.example.com", "c.cdn.net"}, result.CNAMEChain)
+	assert.Equal(t, int32(1), probe.queries.Load())
+}
+
+func TestRouter_Route_CNAMEChainChased(t *testing.T) {
+	// The upstream stops after the first hop
+	probe := &aliasResolver{records: map[string][]dns.RR{
+		"a.example.com.": {cname("a.example.com.", "b.example.com.")},
+		"b.example.com.": {cname("b.example.com.", "c.cdn.net.")},
+	}}
+
+	result := routeChain(t, newTestRouter(nil, nil, chainRule(probe, map[string]string{"c.cdn.net": "cdn"}, 0)))
+	assert.Equal(t, "target", result.ResolverUsed)
+	assert.Equal(t, []string{"b.example.com", "c.cdn.net"}, result.CNAMEChain)
+	assert.Equal(t, int32(2), probe.queries.Load())
+}
+
+func TestRouter_Route_CNAMEChainStopsAtFirstMatch(t *testing.T) {
+	probe := &aliasResolver{records: map[string][]dns.RR{
+		"a.example.com.": {cname("a.example.com.", "b.cdn.net.")},
+		"b.cdn.net.":     {cname("b.cdn.net.", "c.other.net.")},
+	}}
+
+	result := routeChain(t, newTestRouter(nil, nil, chainRule(probe, map[string]string{"b.cdn.net": "cdn"}, 0)))
+	assert.Equal(t, "target", result.ResolverUsed)
+	assert.Equal(t, []string{"b.cdn.net"}, result.CNAMEChain)
+	assert.Equal(t, int32(1), probe.queries.Load())
+}
+
+func TestRouter_Route_DNAME(t *testing.T) {
+	probe := &aliasResolver{records: map[string][]dns.RR{
+		"a.example.com.": {dname("example.com.", "example.cdn.net.")},
+	}}
+
+	result := routeChain(t, newTestRouter(nil, nil, chainRule(probe, map[string]string{"a.example.cdn.net": "cdn"}, 0)))
+	assert.Equal(t, "target", result.ResolverUsed)
+	assert.Equal(t, []string{"a.example.cdn.net"}, result.CNAMEChain)
+}
+
+func TestRouter_Route_CNAMELoop(t *testing.T) {
+	probe := &aliasResolver{records: map[string][]dns.RR{
+		"a.example.com.": {cname("a.example.com.", "b.example.com."), cname("b.example.com.", "a.example.com.")},
+	}}
+
+	result := routeChain(t, newTestRouter(nil, nil, chainRule(probe, map[string]string{"c.cdn.net": "cdn"}, 0)))
+	assert.Equal(t, "no-cname-match", result.ResolverUsed)
+	assert.False(t, result.CNAMEMatched)
+	assert.Equal(t, []string{"b.example.com"}, result.CNAMEChain)
+}
+
+func TestRouter_Route_CNAMEMaxDepth(t *testing.T) {
+	probe := &aliasResolver{records: map[string][]dns.RR{
+		"a.example.com.": {cname("a.example.com.", "b.example.com.")},
+		"b.example.com.": {cname("b.example.com.", "c.example.com.")},
+		"c.example.com.": {cname("c.example.com.", "d.cdn.net.")},
+	}}
+
+	t.Run("Reached", func(t *testing.T) {
+		result := routeChain(t, newTestRouter(nil, nil, chainRule(probe, map[string]string{"d.cdn.net": "cdn"}, 2)))
+		assert.Equal(t, "no-cname-match", result.ResolverUsed)
+		assert.Equal(t, []string{"b.example.com", "c.example.com"}, result.CNAMEChain)
+	})
+
+	t.Run("Deep enough", func(t *testing.T) {
+		result := routeChain(t, newTestRouter(nil, nil, chainRule(probe, map[string]string{"d.cdn.net": "cdn"}, 3)))
+		assert.Equal(t, "target", result.ResolverUsed)
+		assert.Equal(t, []string{"b.example.com", "c.example.com", "d.cdn.net"}, result.CNAMEChain)
+	})
+}
+
+func TestNextHop(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.Answer = []dns.RR{
+		dname("example.com.", "example.net."),
+		cname("WWW.Example.com.", "cdn.example.org."),
+	}
+
+	// CNAME owned by the name wins over DNAME synthesis, compared case-insensitively
+	next, ttl, ok := nextHop(resp, "www.example.com.")
+	require.True(t, ok)
+	assert.Equal(t, "cdn.example.org.", next)
+	assert.Equal(t, uint32(300), ttl)
+
+	next, _, ok = nextHop(resp, "mail.example.com.")
+	require.True(t, ok)
+	assert.Equal(t, "mail.example.net.", next)
+
+	// A DNAME does not apply to its own owner
+	_, _, ok = nextHop(resp, "example.com.")
+	assert.False(t, ok)
+}
@@ -0,0 +1,107 @@
+package resolver
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// flight is an upstream exchange shared by identical concurrent queries.
+type flight struct {
+	done chan struct{}
+	resp *dns.Msg
+	err  error
+}
+
+// coalescer lets concurrent identical queries share one upstream exchange.
+type coalescer struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+	// onJoin is called when a query joins an exchange in flight.
+	onJoin func()
+}
+
+// coalesceKey identifies queries that can share an exchange: the question as sent,
+// the CD bit and the EDNS0 options. Requests without a question are not coalesced.
+func coalesceKey(req *dns.Msg) (string, bool) {
+	if len(req.Question) != 1 {
+		return "", false
+	}
+	q := req.Question[0]
+
+	var b strings.Builder
+	b.WriteString(q.Name)
+	b.WriteByte('|')
+	b.WriteString(strconv.Itoa(int(q.Qtype)))
+	b.WriteByte('|')
+	b.WriteString(strconv.Itoa(int(q.Qclass)))
+	if req.CheckingDisabled {
+		b.WriteString("|cd")
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		b.WriteByte('|')
+		b.WriteString(opt.String())
+	}
+	return b.String(), true
+}
+
+// do runs exchange for req unless an identical exchange is in flight, in which case it
+// waits for that one. Every caller receives its own copy of the response carrying the
+// ID of its request.
+//
+// A shared exchange runs detached from the context of the caller that started it,
+// bounded by timeout, so callers that give up do not fail the others. Such callers
+// get their context error.
+func (c *coalescer) do(ctx context.Context, req *dns.Msg, timeout time.Duration, exchange func(context.Context) (*dns.Msg, error)) (*dns.Msg, error) {
+	key, ok := coalesceKey(req)
+	if !ok {
+		return exchange(ctx)
+	}
+
+	c.mu.Lock()
+	if c.flights == nil {
+		c.flights = make(map[string]*flight)
+	}
+	f, shared := c.flights[key]
+	if !shared {
+		f = &flight{done: make(chan struct{})}
+		c.flights[key] = f
+		go c.run(context.WithoutCancel(ctx), key, f, timeout, exchange)
+	}
+	c.mu.Unlock()
+
+	if shared && c.onJoin != nil {
+		c.onJoin()
+	}
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	resp := f.resp.Copy()
+	resp.Id = req.Id
+	return resp, nil
+}
+
+// run performs the shared exchange of f and wakes its callers.
+func (c *coalescer) run(ctx context.Context, key string, f *flight, timeout time.Duration, exchange func(context.Context) (*dns.Msg, error)) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	f.resp, f.err = exchange(ctx)
+
+	c.mu.Lock()
+	delete(c.flights, key)
+	c.mu.Unlock()
+	close(f.done)
+}
@@ -0,0 +1,222 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+)
+
+// startBlockingServer starts a UDP DNS server that holds every answer until release is closed.
+func startBlockingServer(t *testing.T, release chan struct{}, queries *atomic.Int32) string {
+	t.Helper()
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Add(1)
+		<-release
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1").To4(),
+		}}
+		_ = w.WriteMsg(resp)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = srv.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	return pc.LocalAddr().String()
+}
+
+func TestDNSResolver_Resolve_CoalescesIdenticalQueries(t *testing.T) {
+	const clients = 10
+
+	release := make(chan struct{})
+	var queries atomic.Int32
+	addr := startBlockingServer(t, release, &queries)
+	m := metrics.NewMetrics("test_resolver_coalesce")
+
+	r, err := NewUpstreamResolver(addr, true, "explicit", UpstreamOptions{Metrics: m})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	responses := make([]*dns.Msg, clients)
+	requests := make([]*dns.Msg, clients)
+	for i := 0; i < clients; i++ {
+		requests[i] = new(dns.Msg)
+		requests[i].SetQuestion("example.com.", dns.TypeA)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := r.Resolve(context.Background(), requests[i])
+			assert.NoError(t, err)
+			responses[i] = resp
+		}(i)
+	}
+
+	// Release the upstream once every client waits for the first exchange
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(m.CoalescedRequests.WithLabelValues("explicit")) == clients-1
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), queries.Load())
+	assert.Equal(t, float64(clients-1), testutil.ToFloat64(m.CoalescedRequests.WithLabelValues("explicit")))
+	for i, resp := range responses {
+		require.NotNil(t, resp)
+		assert.Equal(t, requests[i].Id, resp.Id)
+		require.Len(t, resp.Answer, 1)
+	}
+
+	// Every client owns its response
+	responses[0].Answer = nil
+	assert.Len(t, responses[1].Answer, 1)
+}
+
+func TestDNSResolver_Resolve_DifferentQueriesNotCoalesced(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	var queries atomic.Int32
+	addr := startBlockingServer(t, release, &queries)
+
+	r, err := NewUpstreamResolver(addr, true, "explicit", UpstreamOptions{})
+	require.NoError(t, err)
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", qtype)
+		_, err := r.Resolve(context.Background(), req)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(2), queries.Load())
+}
+
+func TestCoalesceKey(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	plain, ok := coalesceKey(req)
+	require.True(t, ok)
+
+	do := req.Copy()
+	do.SetEdns0(1232, true)
+	withDO, _ := coalesceKey(do)
+	assert.NotEqual(t, plain, withDO)
+
+	cd := req.Copy()
+	cd.CheckingDisabled = true
+	withCD, _ := coalesceKey(cd)
+	assert.NotEqual(t, plain, withCD)
+
+	// The message ID does not matter
+	other := req.Copy()
+	other.Id++
+	otherKey, _ := coalesceKey(other)
+	assert.Equal(t, plain, otherKey)
+
+	_, ok = coalesceKey(new(dns.Msg))
+	assert.False(t, ok)
+}
+
+func TestCoalescer_WaiterCanceled(t *testing.T) {
+	var joined atomic.Int32
+	c := coalescer{onJoin: func() { joined.Add(1) }}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		_, _ = c.do(context.Background(), req, time.Second, func(context.Context) (*dns.Msg, error) {
+			close(started)
+			<-release
+			return new(dns.Msg), nil
+		})
+	}()
+	<-started
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.do(ctx, req, time.Second, func(context.Context) (*dns.Msg, error) {
+		t.Error("identical query must not start a second exchange")
+		return nil, nil
+	})
+	assert.Equal(t, int32(1), joined.Load())
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestPool_CoalescedLeaderCanceled(t *testing.T) {
+	const joiners = 3
+
+	release := make(chan struct{})
+	var queries atomic.Int32
+	addr := startBlockingServer(t, release, &queries)
+	m := metrics.NewMetrics("test_resolver_coalesce_leader_canceled")
+
+	pool, err := NewUpstreamPool(addr, true, "explicit", StrategySequential, UpstreamOptions{
+		Metrics: m,
+		Breaker: BreakerConfig{FailureThreshold: 1, OpenDuration: time.Minute},
+	})
+	require.NoError(t, err)
+
+	newRequest := func() *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		return req
+	}
+
+	// The leader starts the exchange and gives up while it is in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := pool.Resolve(ctx, newRequest())
+		leaderErr <- err
+	}()
+	require.Eventually(t, func() bool { return queries.Load() == 1 }, time.Second, time.Millisecond)
+
+	var wg sync.WaitGroup
+	responses := make([]*dns.Msg, joiners)
+	errs := make([]error, joiners)
+	for i := 0; i < joiners; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i], errs[i] = pool.Resolve(context.Background(), newRequest())
+		}(i)
+	}
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(m.CoalescedRequests.WithLabelValues("explicit")) == joiners
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(t, <-leaderErr, context.Canceled)
+	close(release)
+	wg.Wait()
+
+	// The joiners still get the answer of the shared exchange
+	assert.Equal(t, int32(1), queries.Load())
+	for i := range responses {
+		require.NoError(t, errs[i])
+		assert.Len(t, responses[i].Answer, 1)
+	}
+
+	// and the canceled leader did not count against the upstream
+	assert.NoError(t, pool.HealthCheck())
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.UpstreamErrors.WithLabelValues("explicit", addr)))
+}
@@ -0,0 +1,220 @@
+package resolver
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/steigr/nameserver-switcher/internal/matcher"
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+)
+
+// decisionMetricsLabel identifies the route decision cache in cache metrics.
+const decisionMetricsLabel = "route"
+
+// decisionKey identifies the name a routing decision applies to.
+type decisionKey struct {
+	name   string
+	qclass uint16
+}
+
+// decision is the outcome of a probe: the route that answered the request and the
+// CNAME match that led there. It is valid for all query types of the name.
+type decision struct {
+	key          decisionKey
+	rule         string
+	route        string
+	cnameMatched bool
+	cnamePattern string
+	cnameChain   []string
+	generation   uint64
+	expires      time.Time
+}
+
+// decisionCache remembers routing decisions per name for the TTL of the records that
+// led to them, evicting the least recently used.
+type decisionCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[decisionKey]*list.Element
+	lru        *list.List
+	metrics    *metrics.Metrics
+	now        func() time.Time
+}
+
+// newDecisionCache creates a cache holding up to maxEntries decisions, or nil when
+// maxEntries is not positive.
+func newDecisionCache(maxEntries int, m *metrics.Metrics) *decisionCache {
+	if maxEntries <= 0 {
+		return nil
+	}
+	return &decisionCache{
+		maxEntries: maxEntries,
+		entries:    make(map[decisionKey]*list.Element),
+		lru:        list.New(),
+		metrics:    m,
+		now:        time.Now,
+	}
+}
+
+// decisionKeyFor returns the decision key for a request.
+func decisionKeyFor(req *dns.Msg) decisionKey {
+	q := req.Question[0]
+	return decisionKey{name: strings.ToLower(q.Name), qclass: q.Qclass}
+}
+
+// get returns the decision for req if it is unexpired and was made with the current
+// pattern generation.
+func (c *decisionCache) get(req *dns.Msg, generation uint64) (*decision, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := decisionKeyFor(req)
+
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok {
+		d := el.Value.(*decision)
+		if d.generation != generation || !c.now().Before(d.expires) {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+			ok = false
+		}
+	}
+	var d *decision
+	if ok {
+		c.lru.MoveToFront(el)
+		d = el.Value.(*decision)
+	}
+	c.mu.Unlock()
+
+	if c.metrics != nil {
+		if ok {
+			c.metrics.RecordCacheHit(decisionMetricsLabel)
+		} else {
+			c.metrics.RecordCacheMiss(decisionMetricsLabel)
+		}
+	}
+	return d, ok
+}
+
+// put stores the decision made for req for ttl seconds.
+func (c *decisionCache) put(req *dns.Msg, d *decision, ttl uint32) {
+	if c == nil || ttl == 0 {
+		return
+	}
+	d.key = decisionKeyFor(req)
+	d.expires = c.now().Add(time.Duration(ttl) * time.Second)
+	c.insert(d)
+}
+
+// all returns copies of the unexpired decisions.
+func (c *decisionCache) all() []decision {
+	if c == nil {
+		return nil
+	}
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var decisions []decision
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		if d := el.Value.(*decision); now.Before(d.expires) {
+			decisions = append(decisions, *d)
+		}
+	}
+	return decisions
+}
+
+// restore stores a decision returned by all unless it has expired.
+func (c *decisionCache) restore(d *decision) {
+	if c == nil || !c.now().Before(d.expires) {
+		return
+	}
+	c.insert(d)
+}
+
+// forget drops the decisions, in any class, for the names match reports true for.
+func (c *decisionCache) forget(match func(name string) bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, el := range c.entries {
+		if match(key.name) {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// insert adds or replaces a decision and evicts the least recently used beyond the limit.
+func (c *decisionCache) insert(d *decision) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[d.key]; ok {
+		el.Value = d
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[d.key] = c.lru.PushFront(d)
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*decision).key)
+		if c.metrics != nil {
+			c.metrics.RecordCacheEviction(decisionMetricsLabel)
+		}
+	}
+}
+
+// size returns the number of cached decisions.
+func (c *decisionCache) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// patternGeneration returns a counter that increases whenever the patterns of any rule change.
+func patternGeneration(rules []Rule) uint64 {
+	var generation uint64
+	for i := range rules {
+		generation += matcher.Generation(rules[i].RequestMatcher) + matcher.Generation(rules[i].CNAMEMatcher)
+	}
+	return generation
+}
+
+// RecordTTL returns the lowest TTL of the answer records in resp or, for negative
+// answers, the SOA negative TTL. It returns 0 when resp has neither.
+func RecordTTL(resp *dns.Msg) uint32 {
+	var ttl uint32
+	found := false
+	lower := func(v uint32) {
+		if !found || v < ttl {
+			ttl = v
+			found = true
+		}
+	}
+
+	for _, rr := range resp.Answer {
+		lower(rr.Header().Ttl)
+	}
+	if !found {
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				lower(soa.Hdr.Ttl)
+				lower(soa.Minttl)
+				break
+			}
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,142 @@
+package resolver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/matcher"
+)
+
+// cachedDecisions routes names under example.com through cnameMatcher and caches
+// routing decisions for up to 10 names.
+func cachedDecisions(t *testing.T, cnameMatcher matcher.Matcher) func(*RouterConfig) {
+	t.Helper()
+	requestMatcher, err := matcher.NewRegexMatcher([]string{`.*\.example\.com$`})
+	require.NoError(t, err)
+	return func(cfg *RouterConfig) {
+		cfg.RequestMatcher = requestMatcher
+		cfg.CNAMEMatcher = cnameMatcher
+		cfg.DecisionCacheSize = 10
+	}
+}
+
+func TestRouter_Route_DecisionCacheSkipsProbe(t *testing.T) {
+	cnameMatcher, err := matcher.NewRegexMatcher([]string{`.*\.cdn\.net$`})
+	require.NoError(t, err)
+	explicit := &recordingResolver{name: "explicit", answer: []dns.RR{cname("www.example.com.", "www.cdn.net.")}}
+	system := &recordingResolver{name: "system"}
+	router := newTestRouter(explicit, system, cachedDecisions(t, cnameMatcher))
+
+	result := routeProbe(t, router, "www.example.com.")
+	assert.False(t, result.DecisionCached)
+	assert.Equal(t, "explicit", result.ResolverUsed)
+	assert.Equal(t, int32(2), explicit.queries.Load())
+
+	// The second lookup goes straight to the target resolver
+	result = routeProbe(t, router, "www.example.com.")
+	assert.True(t, result.DecisionCached)
+	assert.True(t, result.CNAMEMatched)
+	assert.Equal(t, `.*\.cdn\.net$`, result.CNAMEPattern)
+	assert.Equal(t, []string{"www.cdn.net"}, result.CNAMEChain)
+	assert.Equal(t, "explicit", result.ResolverUsed)
+	assert.Equal(t, int32(3), explicit.queries.Load())
+	assert.Equal(t, 1, router.decisions.size())
+}
+
+func TestRouter_Route_DecisionCacheNoCnameMatch(t *testing.T) {
+	cnameMatcher, err := matcher.NewRegexMatcher([]string{`.*\.cdn\.net$`})
+	require.NoError(t, err)
+	explicit := &recordingResolver{name: "explicit", answer: []dns.RR{cname("www.example.com.", "www.other.net.")}}
+	system := &recordingResolver{name: "system"}
+	router := newTestRouter(explicit, system, cachedDecisions(t, cnameMatcher))
+
+	routeProbe(t, router, "www.example.com.")
+	result := routeProbe(t, router, "www.example.com.")
+	assert.True(t, result.DecisionCached)
+	assert.False(t, result.CNAMEMatched)
+	assert.Equal(t, "system", result.ResolverUsed)
+	assert.Equal(t, int32(2), explicit.queries.Load())
+	assert.Equal(t, int32(2), system.queries.Load())
+}
+
+func TestRouter_Route_DecisionCacheExpires(t *testing.T) {
+	cnameMatcher, err := matcher.NewRegexMatcher([]string{`.*\.cdn\.net$`})
+	require.NoError(t, err)
+	explicit := &recordingResolver{name: "explicit", answer: []dns.RR{cname("www.example.com.", "www.cdn.net.")}}
+	router := newTestRouter(explicit, &recordingResolver{name: "system"}, cachedDecisions(t, cnameMatcher))
+
+	now := time.Now()
+	router.decisions.now = func() time.Time { return now }
+
+	routeProbe(t, router, "www.example.com.")
+	now = now.Add(299 * time.Second)
+	assert.True(t, routeProbe(t, router, "www.example.com.").DecisionCached)
+
+	// The decision lives for the TTL of the CNAME
+	now = now.Add(time.Second)
+	assert.False(t, routeProbe(t, router, "www.example.com.").DecisionCached)
+}
+
+func TestRouter_Route_DecisionCacheInvalidatedByPatternUpdate(t *testing.T) {
+	cnameMatcher, err := matcher.NewRegexMatcher([]string{`.*\.cdn\.net$`})
+	require.NoError(t, err)
+	explicit := &recordingResolver{name: "explicit", answer: []dns.RR{cname("www.example.com.", "www.cdn.net.")}}
+	system := &recordingResolver{name: "system"}
+	router := newTestRouter(explicit, system, cachedDecisions(t, cnameMatcher))
+
+	routeProbe(t, router, "www.example.com.")
+	require.NoError(t, cnameMatcher.UpdatePatterns([]string{`.*\.other\.net$`}))
+
+	result := routeProbe(t, router, "www.example.com.")
+	assert.False(t, result.DecisionCached)
+	assert.False(t, result.CNAMEMatched)
+	assert.Equal(t, "system", result.ResolverUsed)
+}
+
+func TestRouter_Route_DecisionCacheDisabled(t *testing.T) {
+	explicit := &recordingResolver{name: "explicit", answer: completeChain()}
+	router := newTestRouter(explicit, &recordingResolver{name: "system"})
+
+	routeProbe(t, router, "www.example.com.")
+	assert.False(t, routeProbe(t, router, "www.example.com.").DecisionCached)
+	assert.Nil(t, router.decisions)
+}
+
+func TestDecisionCache_Eviction(t *testing.T) {
+	c := newDecisionCache(1, nil)
+	first := new(dns.Msg)
+	first.SetQuestion("a.example.com.", dns.TypeA)
+	second := new(dns.Msg)
+	second.SetQuestion("b.example.com.", dns.TypeA)
+
+	c.put(first, &decision{route: RouteExplicit}, 60)
+	c.put(second, &decision{route: RouteExplicit}, 60)
+	_, ok := c.get(first, 0)
+	assert.False(t, ok)
+	_, ok = c.get(second, 0)
+	assert.True(t, ok)
+	assert.Equal(t, 1, c.size())
+
+	// Decisions hold for every query type and case of the name
+	other := new(dns.Msg)
+	other.SetQuestion("B.example.com.", dns.TypeAAAA)
+	_, ok = c.get(other, 0)
+	assert.True(t, ok)
+}
+
+func TestRecordTTL(t *testing.T) {
+	resp := newAResponse("www.example.com.", "192.0.2.1")
+	resp.Answer[0].Header().Ttl = 60
+	assert.Equal(t, uint32(60), RecordTTL(resp))
+
+	negative := new(dns.Msg)
+	negative.Ns = []dns.RR{soa("example.com.")}
+	negative.Ns[0].(*dns.SOA).Minttl = 30
+	assert.Equal(t, uint32(30), RecordTTL(negative))
+
+	assert.Equal(t, uint32(0), RecordTTL(new(dns.Msg)))
+}
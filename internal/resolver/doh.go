@@ -0,0 +1,143 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// dohMediaType is the RFC 8484 wire-format media type.
+	dohMediaType = "application/dns-message"
+	// dohMaxResponseSize bounds the response body to the largest DNS message.
+	dohMaxResponseSize = dns.MaxMsgSize
+)
+
+// DoHResolver performs DNS-over-HTTPS (RFC 8484) lookups.
+type DoHResolver struct {
+	url       string
+	method    string
+	client    *http.Client
+	recursive bool
+	name      string
+}
+
+// NewDoHResolver creates a DNS-over-HTTPS resolver for the given endpoint URL.
+// Method is either http.MethodPost (default) or http.MethodGet.
+func NewDoHResolver(endpoint string, recursive bool, name string, method string, client *http.Client) *DoHResolver {
+	if method != http.MethodGet {
+		method = http.MethodPost
+	}
+
+	return &DoHResolver{
+		url:       endpoint,
+		method:    method,
+		client:    client,
+		recursive: recursive,
+		name:      name,
+	}
+}
+
+// newDoHClient creates an HTTP client that keeps HTTP/2 connections to the upstream open.
+func newDoHClient(tlsConfig *tls.Config, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: timeout,
+		},
+	}
+}
+
+// Resolve performs a DNS lookup over HTTPS.
+func (r *DoHResolver) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	reqCopy := req.Copy()
+	reqCopy.RecursionDesired = r.recursive
+	// RFC 8484 4.1: use ID 0 so responses are cache friendly
+	reqCopy.Id = 0
+
+	packed, err := reqCopy.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack DNS request: %w", err)
+	}
+
+	httpReq, err := r.newRequest(ctx, packed)
+	if err != nil {
+		return nil, fmt.Errorf("DoH query failed: %w", err)
+	}
+
+	httpResp, err := r.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("DoH query failed: %w", err)
+	}
+	defer func() { _ = httpResp.Body.Close() }()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH query failed: unexpected HTTP status %d", httpResp.StatusCode)
+	}
+	// Media type parameters, such as a charset, and letter case do not matter
+	ct := httpResp.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(ct); err != nil || mediaType != dohMediaType {
+		return nil, fmt.Errorf("DoH query failed: unexpected content type %q", ct)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, dohMaxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("DoH query failed: %w", err)
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, fmt.Errorf("failed to unpack DoH response: %w", err)
+	}
+	resp.Id = req.Id
+
+	return resp, nil
+}
+
+// newRequest builds the HTTP request for a packed DNS message.
+func (r *DoHResolver) newRequest(ctx context.Context, packed []byte) (*http.Request, error) {
+	var httpReq *http.Request
+	var err error
+
+	if r.method == http.MethodGet {
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		q := httpReq.URL.Query()
+		q.Set("dns", base64.RawURLEncoding.EncodeToString(packed))
+		httpReq.URL.RawQuery = q.Encode()
+	} else {
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(packed))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", dohMediaType)
+	}
+
+	httpReq.Header.Set("Accept", dohMediaType)
+	return httpReq, nil
+}
+
+// Name returns the resolver name.
+func (r *DoHResolver) Name() string {
+	return r.name
+}
+
+// Server returns the endpoint URL.
+func (r *DoHResolver) Server() string {
+	return r.url
+}
@@ -0,0 +1,281 @@
+package resolver
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dohTestServer is an in-process RFC 8484 server backed by httptest.
+type dohTestServer struct {
+	server      *httptest.Server
+	caFile      string
+	connections int64
+	lastMethod  atomic.Value
+	lastProto   atomic.Value
+	lastID      atomic.Value
+	lastRD      atomic.Value
+}
+
+// newDoHTestServer starts an HTTP/2 DoH server that answers A queries with 192.0.2.2.
+func newDoHTestServer(t *testing.T, handler http.HandlerFunc) *dohTestServer {
+	t.Helper()
+
+	s := &dohTestServer{}
+	if handler == nil {
+		handler = s.serveDNS
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", handler)
+
+	s.server = httptest.NewUnstartedServer(mux)
+	s.server.EnableHTTP2 = true
+	s.server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&s.connections, 1)
+		}
+	}
+	s.server.StartTLS()
+	t.Cleanup(s.server.Close)
+
+	s.caFile = filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(s.caFile, certPEM, 0o600))
+
+	return s
+}
+
+func (s *dohTestServer) serveDNS(w http.ResponseWriter, r *http.Request) {
+	s.lastMethod.Store(r.Method)
+	s.lastProto.Store(r.Proto)
+
+	var packed []byte
+	var err error
+	if r.Method == http.MethodGet {
+		packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	} else {
+		if r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		packed, err = io.ReadAll(r.Body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(packed); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.lastID.Store(req.Id)
+	s.lastRD.Store(req.RecursionDesired)
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("192.0.2.2").To4(),
+	})
+	out, _ := resp.Pack()
+
+	w.Header().Set("Content-Type", dohMediaType)
+	_, _ = w.Write(out)
+}
+
+func (s *dohTestServer) url() string {
+	return s.server.URL + "/dns-query"
+}
+
+func TestDoHResolver_Resolve(t *testing.T) {
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		t.Run(method, func(t *testing.T) {
+			srv := newDoHTestServer(t, nil)
+
+			r, err := NewUpstreamResolver(srv.url(), true, "explicit", UpstreamOptions{
+				TLS:       TLSOptions{CAFile: srv.caFile},
+				DoHMethod: method,
+			})
+			require.NoError(t, err)
+			require.IsType(t, &DoHResolver{}, r)
+			assert.Equal(t, "explicit", r.Name())
+
+			for i := 0; i < 3; i++ {
+				req := new(dns.Msg)
+				req.SetQuestion("doh.example.com.", dns.TypeA)
+
+				resp, err := r.Resolve(context.Background(), req)
+				require.NoError(t, err)
+				assert.Equal(t, req.Id, resp.Id)
+				require.Len(t, resp.Answer, 1)
+				assert.Equal(t, "192.0.2.2", resp.Answer[0].(*dns.A).A.String())
+			}
+
+			assert.Equal(t, method, srv.lastMethod.Load())
+			assert.Equal(t, "HTTP/2.0", srv.lastProto.Load())
+			assert.Equal(t, uint16(0), srv.lastID.Load())
+			// All queries share a single HTTP/2 connection
+			assert.Equal(t, int64(1), atomic.LoadInt64(&srv.connections))
+		})
+	}
+}
+
+func TestDoHResolver_DefaultPath(t *testing.T) {
+	r, err := NewUpstreamResolver("https://dns.example", true, "explicit", UpstreamOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "https://dns.example/dns-query", r.(*DoHResolver).Server())
+
+	r, err = NewUpstreamResolver("https://dns.example:8443/resolve", true, "explicit", UpstreamOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "https://dns.example:8443/resolve", r.(*DoHResolver).Server())
+}
+
+func TestDoHResolver_RecursionDesired(t *testing.T) {
+	srv := newDoHTestServer(t, nil)
+
+	r, err := NewUpstreamResolver(srv.url(), false, "probe", UpstreamOptions{TLS: TLSOptions{CAFile: srv.caFile}})
+	require.NoError(t, err)
+
+	req := new(dns.Msg)
+	req.SetQuestion("doh.example.com.", dns.TypeA)
+	_, err = r.Resolve(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, false, srv.lastRD.Load())
+}
+
+func TestDoHResolver_Errors(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("doh.example.com.", dns.TypeA)
+
+	t.Run("HTTP error status", func(t *testing.T) {
+		srv := newDoHTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		})
+		r, err := NewUpstreamResolver(srv.url(), true, "explicit", UpstreamOptions{TLS: TLSOptions{CAFile: srv.caFile}})
+		require.NoError(t, err)
+
+		_, err = r.Resolve(context.Background(), req)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "unexpected HTTP status 503")
+	})
+
+	t.Run("wrong content type", func(t *testing.T) {
+		srv := newDoHTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte("<html></html>"))
+		})
+		r, err := NewUpstreamResolver(srv.url(), true, "explicit", UpstreamOptions{TLS: TLSOptions{CAFile: srv.caFile}})
+		require.NoError(t, err)
+
+		_, err = r.Resolve(context.Background(), req)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "unexpected content type")
+	})
+
+	t.Run("content type with parameters", func(t *testing.T) {
+		srv := newDoHTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			query := new(dns.Msg)
+			require.NoError(t, query.Unpack(body))
+			resp := new(dns.Msg)
+			resp.SetReply(query)
+			packed, err := resp.Pack()
+			require.NoError(t, err)
+			w.Header().Set("Content-Type", "Application/DNS-Message; charset=binary")
+			_, _ = w.Write(packed)
+		})
+		r, err := NewUpstreamResolver(srv.url(), true, "explicit", UpstreamOptions{TLS: TLSOptions{CAFile: srv.caFile}})
+		require.NoError(t, err)
+
+		_, err = r.Resolve(context.Background(), req)
+		assert.NoError(t, err)
+	})
+
+	t.Run("malformed body", func(t *testing.T) {
+		srv := newDoHTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", dohMediaType)
+			_, _ = w.Write([]byte{0x01})
+		})
+		r, err := NewUpstreamResolver(srv.url(), true, "explicit", UpstreamOptions{TLS: TLSOptions{CAFile: srv.caFile}})
+		require.NoError(t, err)
+
+		_, err = r.Resolve(context.Background(), req)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to unpack DoH response")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		srv := newDoHTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		})
+		r, err := NewUpstreamResolver(srv.url(), true, "explicit", UpstreamOptions{
+			TLS:     TLSOptions{CAFile: srv.caFile},
+			Timeout: 100 * time.Millisecond,
+		})
+		require.NoError(t, err)
+
+		start := time.Now()
+		_, err = r.Resolve(context.Background(), req)
+		assert.Error(t, err)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		srv := newDoHTestServer(t, nil)
+		r, err := NewUpstreamResolver(srv.url(), true, "explicit", UpstreamOptions{})
+		require.NoError(t, err)
+
+		_, err = r.Resolve(context.Background(), req)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "DoH query failed")
+	})
+}
+
+func TestNewDoHResolver_DefaultsToPost(t *testing.T) {
+	r := NewDoHResolver("https://dns.example/dns-query", true, "doh", "", http.DefaultClient)
+	assert.Equal(t, http.MethodPost, r.method)
+
+	r = NewDoHResolver("https://dns.example/dns-query", true, "doh", "GET", http.DefaultClient)
+	assert.Equal(t, http.MethodGet, r.method)
+}
+
+func TestRouter_Route_DoHResolver(t *testing.T) {
+	srv := newDoHTestServer(t, nil)
+
+	passthrough, err := NewUpstreamResolver(srv.url(), true, "passthrough", UpstreamOptions{TLS: TLSOptions{CAFile: srv.caFile}})
+	require.NoError(t, err)
+
+	router := NewRouter(RouterConfig{
+		RequestMatcher:      &MockMatcher{matches: map[string]string{}},
+		PassthroughResolver: passthrough,
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("doh.example.com.", dns.TypeA)
+
+	result, err := router.Route(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, "passthrough", result.ResolverUsed)
+	assert.False(t, result.RequestMatched)
+	require.Len(t, result.Response.Answer, 1)
+}
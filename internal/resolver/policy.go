@@ -0,0 +1,232 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Route names used to attach failure policies to the router's resolvers.
+const (
+	RouteExplicit        = "explicit"
+	RoutePassthrough     = "passthrough"
+	RouteNoCnameResponse = "no-cname-response"
+	RouteNoCnameMatch    = "no-cname-match"
+)
+
+// FailureAction is what the router does when a routed resolver fails.
+type FailureAction string
+
+const (
+	// FailureActionError returns the error, which clients see as SERVFAIL (default).
+	FailureActionError FailureAction = "error"
+	// FailureActionFallback answers from another resolver.
+	FailureActionFallback FailureAction = "fallback"
+	// FailureActionStale answers with the last good response for the question.
+	FailureActionStale FailureAction = "stale"
+	// FailureActionRcode answers with a fixed response code.
+	FailureActionRcode FailureAction = "rcode"
+	// FailureActionRetry retries the same resolver with exponential backoff.
+	FailureActionRetry FailureAction = "retry"
+)
+
+const (
+	// defaultRetries is the number of retries for "retry" without an explicit count.
+	defaultRetries = 2
+	// defaultRetryBackoff is the initial delay between retries.
+	defaultRetryBackoff = 100 * time.Millisecond
+)
+
+// FailurePolicy describes how a route reacts to resolver failures.
+type FailurePolicy struct {
+	Action FailureAction
+	// Fallback answers the query for FailureActionFallback.
+	Fallback Resolver
+	// Rcode is returned for FailureActionRcode.
+	Rcode int
+	// Retries and Backoff configure FailureActionRetry; the backoff doubles after every retry.
+	Retries int
+	Backoff time.Duration
+	// FailureRcodes are upstream response codes treated like errors (e.g. SERVFAIL, REFUSED).
+	FailureRcodes []int
+}
+
+// ParseFailurePolicy parses a policy spec of the form:
+//   - "error" (or empty) - return SERVFAIL
+//   - "fallback:<resolver>" - answer from the named resolver
+//   - "stale" - answer with the last good response
+//   - "rcode:<RCODE>" - answer with the given rcode, e.g. rcode:REFUSED
+//   - "retry[:<count>[:<backoff>]]" - retry with backoff, e.g. retry:3:50ms
+//
+// Named resolvers for fallback are looked up in resolvers.
+func ParseFailurePolicy(spec string, resolvers map[string]Resolver) (FailurePolicy, error) {
+	parts := strings.Split(strings.TrimSpace(spec), ":")
+	action := FailureAction(strings.ToLower(parts[0]))
+	args := parts[1:]
+
+	switch action {
+	case "", FailureActionError:
+		return FailurePolicy{Action: FailureActionError}, nil
+	case FailureActionStale:
+		return FailurePolicy{Action: FailureActionStale}, nil
+	case FailureActionFallback:
+		if len(args) != 1 || args[0] == "" {
+			return FailurePolicy{}, fmt.Errorf("failure policy %q: fallback needs a resolver name", spec)
+		}
+		fallback, ok := resolvers[args[0]]
+		if !ok || fallback == nil {
+			return FailurePolicy{}, fmt.Errorf("failure policy %q: unknown resolver %q", spec, args[0])
+		}
+		return FailurePolicy{Action: FailureActionFallback, Fallback: fallback}, nil
+	case FailureActionRcode:
+		if len(args) != 1 {
+			return FailurePolicy{}, fmt.Errorf("failure policy %q: rcode needs a response code", spec)
+		}
+		rcode, err := parseRcode(args[0])
+		if err != nil {
+			return FailurePolicy{}, fmt.Errorf("failure policy %q: %w", spec, err)
+		}
+		return FailurePolicy{Action: FailureActionRcode, Rcode: rcode}, nil
+	case FailureActionRetry:
+		policy := FailurePolicy{Action: FailureActionRetry, Retries: defaultRetries, Backoff: defaultRetryBackoff}
+		if len(args) > 2 {
+			return FailurePolicy{}, fmt.Errorf("failure policy %q: too many arguments", spec)
+		}
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 1 {
+				return FailurePolicy{}, fmt.Errorf("failure policy %q: invalid retry count %q", spec, args[0])
+			}
+			policy.Retries = n
+		}
+		if len(args) > 1 {
+			d, err := time.ParseDuration(args[1])
+			if err != nil || d < 0 {
+				return FailurePolicy{}, fmt.Errorf("failure policy %q: invalid backoff %q", spec, args[1])
+			}
+			policy.Backoff = d
+		}
+		return policy, nil
+	default:
+		return FailurePolicy{}, fmt.Errorf("unknown failure policy %q", spec)
+	}
+}
+
+// ParseRcodes parses a comma-separated list of response codes such as "SERVFAIL,REFUSED".
+func ParseRcodes(list string) ([]int, error) {
+	var rcodes []int
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		rcode, err := parseRcode(s)
+		if err != nil {
+			return nil, err
+		}
+		rcodes = append(rcodes, rcode)
+	}
+	return rcodes, nil
+}
+
+// parseRcode parses a response code name (case-insensitive) or number.
+func parseRcode(s string) (int, error) {
+	if rcode, ok := dns.StringToRcode[strings.ToUpper(s)]; ok {
+		return rcode, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n <= 0xFFF {
+		return n, nil
+	}
+	return 0, fmt.Errorf("unknown rcode %q", s)
+}
+
+// isFailureRcode reports whether rcode is treated as a failure.
+func (p FailurePolicy) isFailureRcode(rcode int) bool {
+	for _, rc := range p.FailureRcodes {
+		if rc == rcode {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveWithPolicy queries res for the given route of rule and applies the route's
+// failure policy when the query errors or returns a failure rcode. final reports whether
+// the response was produced by the policy and must be returned to the client as-is.
+func (r *Router) resolveWithPolicy(ctx context.Context, rule *Rule, route string, res Resolver, req *dns.Msg, result *RouteResult) (resp *dns.Msg, final bool, err error) {
+	policy := rule.FailurePolicies[route]
+
+	resp, err = query(ctx, res, req, policy)
+	if err == nil {
+		return resp, false, nil
+	}
+	failure := fmt.Errorf("%s resolver failed: %w", route, err)
+
+	switch policy.Action {
+	case FailureActionRetry:
+		backoff := policy.Backoff
+		for i := 0; i < policy.Retries; i++ {
+			select {
+			case <-ctx.Done():
+				return nil, false, failure
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+
+			// A successful retry is a regular answer of the same resolver, so it is cached
+			if resp, err = query(ctx, res, req, policy); err == nil {
+				return resp, false, nil
+			}
+		}
+		return nil, false, fmt.Errorf("%w (after %d retries: %v)", failure, policy.Retries, err)
+
+	case FailureActionFallback:
+		resp, err = policy.Fallback.Resolve(ctx, req)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w (fallback %s also failed: %v)", failure, policy.Fallback.Name(), err)
+		}
+		markFallback(result, failure)
+		result.ResolverUsed = policy.Fallback.Name()
+		return resp, true, nil
+
+	case FailureActionStale:
+		if stale, _, ok := r.stale.get(req); ok {
+			markFallback(result, failure)
+			result.ResolverUsed = res.Name()
+			result.Stale = true
+			return stale, true, nil
+		}
+		return nil, false, fmt.Errorf("%w (no stale answer available)", failure)
+
+	case FailureActionRcode:
+		resp = new(dns.Msg)
+		resp.SetRcode(req, policy.Rcode)
+		markFallback(result, failure)
+		result.ResolverUsed = res.Name()
+		return resp, true, nil
+	}
+
+	return nil, false, failure
+}
+
+// query resolves req and turns failure rcodes into errors.
+func query(ctx context.Context, res Resolver, req *dns.Msg, policy FailurePolicy) (*dns.Msg, error) {
+	resp, err := res.Resolve(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if policy.isFailureRcode(resp.Rcode) {
+		return nil, fmt.Errorf("upstream returned %s", dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// markFallback records on result that the failure policy produced the answer.
+func markFallback(result *RouteResult, failure error) {
+	result.Fallback = true
+	result.FallbackReason = failure.Error()
+}
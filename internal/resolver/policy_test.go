@@ -0,0 +1,304 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/cache"
+)
+
+func newAResponse(name, ip string) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetQuestion(name, dns.TypeA)
+	resp.Response = true
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP(ip).To4(),
+	}}
+	return resp
+}
+
+func newRcodeResponse(name string, rcode int) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetRcode(req, rcode)
+	return resp
+}
+
+func TestParseFailurePolicy(t *testing.T) {
+	backup := &MockResolver{name: "backup"}
+	resolvers := map[string]Resolver{"backup": backup}
+
+	tests := []struct {
+		spec     string
+		expected FailurePolicy
+	}{
+		{"", FailurePolicy{Action: FailureActionError}},
+		{"error", FailurePolicy{Action: FailureActionError}},
+		{"stale", FailurePolicy{Action: FailureActionStale}},
+		{"fallback:backup", FailurePolicy{Action: FailureActionFallback, Fallback: backup}},
+		{"rcode:REFUSED", FailurePolicy{Action: FailureActionRcode, Rcode: dns.RcodeRefused}},
+		{"rcode:nxdomain", FailurePolicy{Action: FailureActionRcode, Rcode: dns.RcodeNameError}},
+		{"retry", FailurePolicy{Action: FailureActionRetry, Retries: 2, Backoff: 100 * time.Millisecond}},
+		{"retry:3", FailurePolicy{Action: FailureActionRetry, Retries: 3, Backoff: 100 * time.Millisecond}},
+		{"retry:1:20ms", FailurePolicy{Action: FailureActionRetry, Retries: 1, Backoff: 20 * time.Millisecond}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			policy, err := ParseFailurePolicy(tt.spec, resolvers)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, policy)
+		})
+	}
+}
+
+func TestParseFailurePolicy_Errors(t *testing.T) {
+	resolvers := map[string]Resolver{"backup": &MockResolver{name: "backup"}}
+
+	for _, spec := range []string{
+		"ignore",
+		"fallback",
+		"fallback:unknown",
+		"rcode",
+		"rcode:BOGUS",
+		"retry:0",
+		"retry:two",
+		"retry:1:soon",
+		"retry:1:1s:extra",
+	} {
+		t.Run(spec, func(t *testing.T) {
+			_, err := ParseFailurePolicy(spec, resolvers)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseRcodes(t *testing.T) {
+	rcodes, err := ParseRcodes("SERVFAIL, refused,3")
+	require.NoError(t, err)
+	assert.Equal(t, []int{dns.RcodeServerFailure, dns.RcodeRefused, dns.RcodeNameError}, rcodes)
+
+	rcodes, err = ParseRcodes("")
+	require.NoError(t, err)
+	assert.Empty(t, rcodes)
+
+	_, err = ParseRcodes("SERVFAIL,NOPE")
+	assert.Error(t, err)
+}
+
+func TestRouter_FailurePolicy_Default(t *testing.T) {
+	router := NewRouter(RouterConfig{
+		PassthroughResolver: &MockResolver{name: "passthrough", err: errors.New("i/o timeout")},
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	_, err := router.Route(context.Background(), req)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "passthrough resolver failed")
+}
+
+func TestRouter_FailurePolicy_Fallback(t *testing.T) {
+	router := NewRouter(RouterConfig{
+		RequestMatcher:   &MockMatcher{matches: map[string]string{"internal.example.com": `.*\.example\.com`}},
+		ExplicitResolver: &MockResolver{name: "explicit", err: errors.New("i/o timeout")},
+		FailurePolicies: map[string]FailurePolicy{
+			RouteExplicit: {Action: FailureActionFallback, Fallback: &MockResolver{name: "backup", response: newAResponse("internal.example.com.", "192.0.2.9")}},
+		},
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("internal.example.com.", dns.TypeA)
+
+	result, err := router.Route(context.Background(), req)
+	require.NoError(t, err)
+	assert.True(t, result.RequestMatched)
+	assert.True(t, result.Fallback)
+	assert.Contains(t, result.FallbackReason, "explicit resolver failed: i/o timeout")
+	assert.Equal(t, "backup", result.ResolverUsed)
+	require.Len(t, result.Response.Answer, 1)
+}
+
+func TestRouter_FailurePolicy_FallbackAlsoFails(t *testing.T) {
+	router := NewRouter(RouterConfig{
+		PassthroughResolver: &MockResolver{name: "passthrough", err: errors.New("i/o timeout")},
+		FailurePolicies: map[string]FailurePolicy{
+			RoutePassthrough: {Action: FailureActionFallback, Fallback: &MockResolver{name: "backup", err: errors.New("refused")}},
+		},
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	_, err := router.Route(context.Background(), req)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "passthrough resolver failed")
+	assert.Contains(t, err.Error(), "fallback backup also failed")
+}
+
+func TestRouter_FailurePolicy_FailureRcodes(t *testing.T) {
+	servfail := newRcodeResponse("example.com.", dns.RcodeServerFailure)
+
+	t.Run("rcode triggers fallback", func(t *testing.T) {
+		router := NewRouter(RouterConfig{
+			PassthroughResolver: &MockResolver{name: "passthrough", response: servfail},
+			FailurePolicies: map[string]FailurePolicy{
+				RoutePassthrough: {
+					Action:        FailureActionFallback,
+					Fallback:      &MockResolver{name: "backup", response: newAResponse("example.com.", "192.0.2.9")},
+					FailureRcodes: []int{dns.RcodeServerFailure, dns.RcodeRefused},
+				},
+			},
+		})
+
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+
+		result, err := router.Route(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, "backup", result.ResolverUsed)
+		assert.Contains(t, result.FallbackReason, "upstream returned SERVFAIL")
+	})
+
+	t.Run("rcode passes through without policy", func(t *testing.T) {
+		router := NewRouter(RouterConfig{
+			PassthroughResolver: &MockResolver{name: "passthrough", response: servfail},
+		})
+
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+
+		result, err := router.Route(context.Background(), req)
+		require.NoError(t, err)
+		assert.False(t, result.Fallback)
+		assert.Equal(t, dns.RcodeServerFailure, result.Response.Rcode)
+	})
+}
+
+func TestRouter_FailurePolicy_Rcode(t *testing.T) {
+	router := NewRouter(RouterConfig{
+		RequestMatcher:          &MockMatcher{matches: map[string]string{"internal.example.com": `.*\.example\.com`}},
+		ExplicitResolver:        &MockResolver{name: "explicit", err: errors.New("i/o timeout")},
+		NoCnameResponseResolver: &MockResolver{name: "no-cname-response", response: newAResponse("internal.example.com.", "192.0.2.1")},
+		FailurePolicies: map[string]FailurePolicy{
+			RouteExplicit: {Action: FailureActionRcode, Rcode: dns.RcodeRefused},
+		},
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("internal.example.com.", dns.TypeA)
+
+	// The synthesized answer is final; it is not treated as a probe response
+	result, err := router.Route(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeRefused, result.Response.Rcode)
+	assert.Equal(t, "explicit", result.ResolverUsed)
+	assert.True(t, result.Fallback)
+}
+
+func TestRouter_FailurePolicy_Stale(t *testing.T) {
+	upstream := &MockResolver{name: "passthrough", response: newAResponse("example.com.", "192.0.2.1")}
+	router := NewRouter(RouterConfig{
+		PassthroughResolver: upstream,
+		FailurePolicies: map[string]FailurePolicy{
+			RoutePassthrough: {Action: FailureActionStale},
+		},
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	t.Run("no stale answer yet", func(t *testing.T) {
+		upstream.err = errors.New("i/o timeout")
+		_, err := router.Route(context.Background(), req)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "no stale answer available")
+	})
+
+	t.Run("serves last good answer", func(t *testing.T) {
+		upstream.err = nil
+		result, err := router.Route(context.Background(), req)
+		require.NoError(t, err)
+		assert.False(t, result.Fallback)
+
+		upstream.err = errors.New("i/o timeout")
+		result, err = router.Route(context.Background(), req)
+		require.NoError(t, err)
+		assert.True(t, result.Fallback)
+		assert.Equal(t, "passthrough", result.ResolverUsed)
+		require.Len(t, result.Response.Answer, 1)
+		assert.Equal(t, uint32(staleTTL), result.Response.Answer[0].Header().Ttl)
+	})
+}
+
+func TestRouter_FailurePolicy_Retry(t *testing.T) {
+	calls := 0
+	flaky := &MockResolverWithCallback{
+		name: "passthrough",
+		callback: func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+			calls++
+			if calls < 3 {
+				return nil, errors.New("i/o timeout")
+			}
+			return newAResponse("example.com.", "192.0.2.1"), nil
+		},
+	}
+
+	router := NewRouter(RouterConfig{
+		PassthroughResolver: flaky,
+		FailurePolicies: map[string]FailurePolicy{
+			RoutePassthrough: {Action: FailureActionRetry, Retries: 2, Backoff: time.Millisecond},
+		},
+		Cache: cache.New(cache.Config{MaxEntries: 10}),
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	result, err := router.Route(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.False(t, result.Fallback, "the same resolver answered")
+	assert.Equal(t, "passthrough", result.ResolverUsed)
+
+	// so the answer is cached like any other
+	result, err = router.Route(context.Background(), req)
+	require.NoError(t, err)
+	assert.True(t, result.Cached)
+	assert.Equal(t, 3, calls)
+	router.cache.Delete(func(cache.Entry) bool { return true })
+
+	t.Run("exhausted", func(t *testing.T) {
+		calls = -10
+		_, err := router.Route(context.Background(), req)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "after 2 retries")
+	})
+
+	t.Run("stops on context cancel", func(t *testing.T) {
+		calls = -10
+		slow := NewRouter(RouterConfig{
+			PassthroughResolver: flaky,
+			FailurePolicies: map[string]FailurePolicy{
+				RoutePassthrough: {Action: FailureActionRetry, Retries: 5, Backoff: time.Second},
+			},
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := slow.Route(ctx, req)
+		assert.Error(t, err)
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+	})
+}
@@ -0,0 +1,363 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+)
+
+// Strategy selects the order in which a Pool tries its upstreams.
+type Strategy string
+
+const (
+	// StrategySequential always tries upstreams in configured order.
+	StrategySequential Strategy = "sequential"
+	// StrategyRoundRobin rotates the first upstream on every query.
+	StrategyRoundRobin Strategy = "round_robin"
+	// StrategyRandom tries upstreams in random order.
+	StrategyRandom Strategy = "random"
+	// StrategyLowestLatency prefers the upstream with the lowest EWMA latency.
+	StrategyLowestLatency Strategy = "lowest_latency"
+)
+
+const (
+	// ewmaWeight is the weight of a new latency sample in the moving average.
+	ewmaWeight = 0.3
+	// failureLatency is the minimum latency recorded for a failed exchange.
+	failureLatency = time.Second
+)
+
+// ParseStrategy parses a strategy name. An empty string selects sequential failover.
+func ParseStrategy(s string) (Strategy, error) {
+	switch Strategy(strings.ToLower(strings.TrimSpace(s))) {
+	case "", StrategySequential:
+		return StrategySequential, nil
+	case StrategyRoundRobin:
+		return StrategyRoundRobin, nil
+	case StrategyRandom:
+		return StrategyRandom, nil
+	case StrategyLowestLatency:
+		return StrategyLowestLatency, nil
+	default:
+		return "", fmt.Errorf("unknown upstream strategy %q", s)
+	}
+}
+
+// PoolConfig holds configuration for a Pool.
+type PoolConfig struct {
+	// Name is the resolver name used for logging/metrics.
+	Name      string
+	Upstreams []Resolver
+	Strategy  Strategy
+	Metrics   *metrics.Metrics
+	// Breaker configures per-upstream circuit breaking (disabled when FailureThreshold is 0).
+	Breaker BreakerConfig
+	// ProbeInterval is how often upstreams are probed in the background (0 disables probing).
+	ProbeInterval time.Duration
+}
+
+// Pool is a Resolver that spreads queries over several upstreams and fails
+// over to the next upstream when one returns an error.
+type Pool struct {
+	name          string
+	members       []*poolMember
+	strategy      Strategy
+	metrics       *metrics.Metrics
+	probeInterval time.Duration
+	next          uint64
+
+	stopMu sync.Mutex
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// poolMember tracks latency and circuit state for a single upstream.
+type poolMember struct {
+	resolver Resolver
+	address  string
+	breaker  *breaker
+
+	mu      sync.Mutex
+	latency time.Duration
+	sampled bool
+}
+
+// NewPool creates a new Pool with the given configuration.
+func NewPool(cfg PoolConfig) *Pool {
+	strategy := cfg.Strategy
+	if strategy == "" {
+		strategy = StrategySequential
+	}
+
+	members := make([]*poolMember, len(cfg.Upstreams))
+	for i, r := range cfg.Upstreams {
+		members[i] = &poolMember{resolver: r, address: upstreamAddress(r), breaker: newBreaker(cfg.Breaker)}
+	}
+
+	return &Pool{
+		name:          cfg.Name,
+		members:       members,
+		strategy:      strategy,
+		metrics:       cfg.Metrics,
+		probeInterval: cfg.ProbeInterval,
+	}
+}
+
+// NewUpstreamPool creates a Pool from a comma-separated list of upstream
+// addresses in any form accepted by NewUpstreamResolver.
+func NewUpstreamPool(addresses string, recursive bool, name string, strategy Strategy, opts UpstreamOptions) (*Pool, error) {
+	var upstreams []Resolver
+	for _, addr := range strings.Split(addresses, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		r, err := NewUpstreamResolver(addr, recursive, name, opts)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, r)
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream addresses in %q", addresses)
+	}
+
+	return NewPool(PoolConfig{
+		Name:          name,
+		Upstreams:     upstreams,
+		Strategy:      strategy,
+		Metrics:       opts.Metrics,
+		Breaker:       opts.Breaker,
+		ProbeInterval: opts.ProbeInterval,
+	}), nil
+}
+
+// Resolve sends the request to upstreams in strategy order until one succeeds.
+// Upstreams with an open circuit are skipped; if all are open it fails fast with ErrCircuitOpen.
+func (p *Pool) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if len(p.members) == 0 {
+		return nil, fmt.Errorf("no upstreams configured for %s", p.name)
+	}
+
+	var lastErr error
+	tried := 0
+	for _, m := range p.order() {
+		if !m.breaker.allow() {
+			continue
+		}
+		tried++
+
+		start := time.Now()
+		resp, err := m.resolver.Resolve(ctx, req)
+		p.observe(ctx, m, time.Since(start), err)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if tried == 0 {
+		return nil, fmt.Errorf("all upstreams of %s are unavailable: %w", p.name, ErrCircuitOpen)
+	}
+	if len(p.members) == 1 {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("all upstreams of %s failed: %w", p.name, lastErr)
+}
+
+// order returns the members in the order they should be tried.
+func (p *Pool) order() []*poolMember {
+	if len(p.members) == 1 || p.strategy == StrategySequential {
+		return p.members
+	}
+
+	ordered := make([]*poolMember, len(p.members))
+	switch p.strategy {
+	case StrategyRoundRobin:
+		start := int((atomic.AddUint64(&p.next, 1) - 1) % uint64(len(p.members)))
+		for i := range p.members {
+			ordered[i] = p.members[(start+i)%len(p.members)]
+		}
+	case StrategyRandom:
+		copy(ordered, p.members)
+		rand.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+	case StrategyLowestLatency:
+		copy(ordered, p.members)
+		latencies := make(map[*poolMember]time.Duration, len(ordered))
+		for _, m := range ordered {
+			latencies[m] = m.score()
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return latencies[ordered[i]] < latencies[ordered[j]]
+		})
+	default:
+		copy(ordered, p.members)
+	}
+	return ordered
+}
+
+// observe records the outcome of an exchange with a member.
+func (p *Pool) observe(ctx context.Context, m *poolMember, elapsed time.Duration, err error) {
+	if err != nil && ctx.Err() != nil {
+		// The caller gave up; this says nothing about the upstream
+		m.breaker.release()
+		return
+	}
+
+	if p.metrics != nil {
+		p.metrics.RecordUpstreamDuration(p.name, m.address, elapsed.Seconds())
+		if err != nil {
+			p.metrics.RecordUpstreamError(p.name, m.address)
+		}
+	}
+
+	if err != nil {
+		m.breaker.failure()
+		if elapsed < failureLatency {
+			elapsed = failureLatency
+		}
+	} else {
+		m.breaker.success()
+	}
+	m.record(elapsed)
+}
+
+// StartProbing starts probing all upstreams in the background every ProbeInterval.
+// Probe results feed the circuit breakers so open upstreams close again without client traffic.
+func (p *Pool) StartProbing() {
+	if p.probeInterval <= 0 {
+		return
+	}
+
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	if p.stop != nil {
+		return
+	}
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(p.probeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				p.probe()
+			}
+		}
+	}(p.stop, p.done)
+}
+
+// StopProbing stops background probing and waits for the prober to exit.
+func (p *Pool) StopProbing() {
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop = nil
+	p.done = nil
+}
+
+// probe sends a root NS query to every upstream and records the outcome.
+func (p *Pool) probe() {
+	var wg sync.WaitGroup
+	for _, m := range p.members {
+		wg.Add(1)
+		go func(m *poolMember) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), p.probeInterval)
+			defer cancel()
+
+			req := new(dns.Msg)
+			req.SetQuestion(".", dns.TypeNS)
+			if _, err := m.resolver.Resolve(ctx, req); err != nil {
+				m.breaker.failure()
+				return
+			}
+			m.breaker.success()
+		}(m)
+	}
+	wg.Wait()
+}
+
+// HealthCheck reports an error naming every upstream whose circuit is not closed.
+func (p *Pool) HealthCheck() error {
+	var down []string
+	for _, m := range p.members {
+		if state := m.breaker.current(); state != circuitClosed {
+			down = append(down, fmt.Sprintf("%s (%s)", m.address, state))
+		}
+	}
+	if len(down) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d/%d upstreams unavailable: %s", len(down), len(p.members), strings.Join(down, ", "))
+}
+
+// record folds a latency sample into the moving average.
+func (m *poolMember) record(sample time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.sampled {
+		m.latency = sample
+		m.sampled = true
+		return
+	}
+	m.latency = time.Duration(ewmaWeight*float64(sample) + (1-ewmaWeight)*float64(m.latency))
+}
+
+// score returns the moving average latency. Unsampled members score zero so they are tried first.
+func (m *poolMember) score() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.latency
+}
+
+// Name returns the resolver name.
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// Strategy returns the selection strategy.
+func (p *Pool) Strategy() Strategy {
+	return p.strategy
+}
+
+// Upstreams returns the upstream addresses in configured order.
+func (p *Pool) Upstreams() []string {
+	addrs := make([]string, len(p.members))
+	for i, m := range p.members {
+		addrs[i] = m.address
+	}
+	return addrs
+}
+
+// upstreamAddress returns the address used to label an upstream in metrics.
+func upstreamAddress(r Resolver) string {
+	if s, ok := r.(interface{ Server() string }); ok {
+		return s.Server()
+	}
+	return r.Name()
+}
@@ -0,0 +1,379 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+)
+
+// countingUpstream is a pool member that records how often it was queried.
+type countingUpstream struct {
+	server string
+	delay  time.Duration
+	err    error
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (u *countingUpstream) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	u.mu.Lock()
+	u.calls++
+	err := u.err
+	u.mu.Unlock()
+
+	if u.delay > 0 {
+		time.Sleep(u.delay)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	return resp, nil
+}
+
+func (u *countingUpstream) Name() string {
+	return "test"
+}
+
+func (u *countingUpstream) Server() string {
+	return u.server
+}
+
+func (u *countingUpstream) count() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.calls
+}
+
+func newPoolRequest() *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("pool.example.com.", dns.TypeA)
+	return req
+}
+
+func TestParseStrategy(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Strategy
+	}{
+		{"", StrategySequential},
+		{"sequential", StrategySequential},
+		{"round_robin", StrategyRoundRobin},
+		{"Random", StrategyRandom},
+		{" lowest_latency ", StrategyLowestLatency},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			s, err := ParseStrategy(tt.input)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, s)
+		})
+	}
+
+	_, err := ParseStrategy("fastest")
+	assert.Error(t, err)
+}
+
+func TestPool_Sequential(t *testing.T) {
+	first := &countingUpstream{server: "a:53"}
+	second := &countingUpstream{server: "b:53"}
+	pool := NewPool(PoolConfig{Name: "explicit", Upstreams: []Resolver{first, second}})
+
+	for i := 0; i < 4; i++ {
+		_, err := pool.Resolve(context.Background(), newPoolRequest())
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, StrategySequential, pool.Strategy())
+	assert.Equal(t, 4, first.count())
+	assert.Equal(t, 0, second.count())
+}
+
+func TestPool_SequentialFailover(t *testing.T) {
+	first := &countingUpstream{server: "a:53", err: errors.New("connection refused")}
+	second := &countingUpstream{server: "b:53"}
+	m := metrics.NewMetrics("test_pool_failover")
+	pool := NewPool(PoolConfig{Name: "explicit", Upstreams: []Resolver{first, second}, Metrics: m})
+
+	resp, err := pool.Resolve(context.Background(), newPoolRequest())
+	require.NoError(t, err)
+	assert.NotNil(t, resp)
+	assert.Equal(t, 1, first.count())
+	assert.Equal(t, 1, second.count())
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.UpstreamErrors.WithLabelValues("explicit", "a:53")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.UpstreamErrors.WithLabelValues("explicit", "b:53")))
+}
+
+func TestPool_AllFail(t *testing.T) {
+	pool := NewPool(PoolConfig{Name: "explicit", Upstreams: []Resolver{
+		&countingUpstream{server: "a:53", err: errors.New("timeout")},
+		&countingUpstream{server: "b:53", err: errors.New("refused")},
+	}})
+
+	_, err := pool.Resolve(context.Background(), newPoolRequest())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "all upstreams of explicit failed")
+	assert.Contains(t, err.Error(), "refused")
+}
+
+func TestPool_SingleUpstreamErrorUnwrapped(t *testing.T) {
+	pool := NewPool(PoolConfig{Name: "explicit", Upstreams: []Resolver{
+		&countingUpstream{server: "a:53", err: errors.New("timeout")},
+	}})
+
+	_, err := pool.Resolve(context.Background(), newPoolRequest())
+	assert.EqualError(t, err, "timeout")
+}
+
+func TestPool_NoUpstreams(t *testing.T) {
+	pool := NewPool(PoolConfig{Name: "explicit"})
+
+	_, err := pool.Resolve(context.Background(), newPoolRequest())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no upstreams configured")
+}
+
+func TestPool_RoundRobin(t *testing.T) {
+	upstreams := []*countingUpstream{{server: "a:53"}, {server: "b:53"}, {server: "c:53"}}
+	pool := NewPool(PoolConfig{
+		Name:      "passthrough",
+		Upstreams: []Resolver{upstreams[0], upstreams[1], upstreams[2]},
+		Strategy:  StrategyRoundRobin,
+	})
+
+	for i := 0; i < 9; i++ {
+		_, err := pool.Resolve(context.Background(), newPoolRequest())
+		require.NoError(t, err)
+	}
+
+	for _, u := range upstreams {
+		assert.Equal(t, 3, u.count(), u.server)
+	}
+}
+
+func TestPool_Random(t *testing.T) {
+	upstreams := []*countingUpstream{{server: "a:53"}, {server: "b:53"}}
+	pool := NewPool(PoolConfig{
+		Name:      "passthrough",
+		Upstreams: []Resolver{upstreams[0], upstreams[1]},
+		Strategy:  StrategyRandom,
+	})
+
+	for i := 0; i < 200; i++ {
+		_, err := pool.Resolve(context.Background(), newPoolRequest())
+		require.NoError(t, err)
+	}
+
+	// Each upstream should see a meaningful share of 200 queries
+	for _, u := range upstreams {
+		assert.Greater(t, u.count(), 40, u.server)
+	}
+	assert.Equal(t, 200, upstreams[0].count()+upstreams[1].count())
+}
+
+func TestPool_LowestLatency(t *testing.T) {
+	slow := &countingUpstream{server: "slow:53", delay: 20 * time.Millisecond}
+	fast := &countingUpstream{server: "fast:53"}
+	pool := NewPool(PoolConfig{
+		Name:      "explicit",
+		Upstreams: []Resolver{slow, fast},
+		Strategy:  StrategyLowestLatency,
+	})
+
+	for i := 0; i < 10; i++ {
+		_, err := pool.Resolve(context.Background(), newPoolRequest())
+		require.NoError(t, err)
+	}
+
+	// The slow upstream is tried once while unsampled; afterwards the fast one wins
+	assert.Equal(t, 1, slow.count())
+	assert.Equal(t, 9, fast.count())
+}
+
+func TestPool_LowestLatencyPenalizesErrors(t *testing.T) {
+	failing := &countingUpstream{server: "failing:53", err: errors.New("refused")}
+	healthy := &countingUpstream{server: "healthy:53", delay: 5 * time.Millisecond}
+	pool := NewPool(PoolConfig{
+		Name:      "explicit",
+		Upstreams: []Resolver{failing, healthy},
+		Strategy:  StrategyLowestLatency,
+	})
+
+	for i := 0; i < 5; i++ {
+		_, err := pool.Resolve(context.Background(), newPoolRequest())
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 1, failing.count())
+	assert.Equal(t, 5, healthy.count())
+}
+
+func TestPool_StopsOnContextCancel(t *testing.T) {
+	first := &countingUpstream{server: "a:53", err: context.Canceled}
+	second := &countingUpstream{server: "b:53"}
+	pool := NewPool(PoolConfig{Name: "explicit", Upstreams: []Resolver{first, second}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := pool.Resolve(ctx, newPoolRequest())
+	assert.Error(t, err)
+	assert.Equal(t, 0, second.count())
+}
+
+func TestPool_RecordsUpstreamDuration(t *testing.T) {
+	m := metrics.NewMetrics("test_pool_duration")
+	pool := NewPool(PoolConfig{
+		Name:      "explicit",
+		Upstreams: []Resolver{&countingUpstream{server: "a:53"}},
+		Metrics:   m,
+	})
+
+	_, err := pool.Resolve(context.Background(), newPoolRequest())
+	require.NoError(t, err)
+	assert.Equal(t, 1, testutil.CollectAndCount(m.UpstreamDuration))
+}
+
+func TestNewUpstreamPool(t *testing.T) {
+	pool, err := NewUpstreamPool("1.1.1.1, tls://9.9.9.9,https://dns.google/dns-query", true, "explicit", StrategyRoundRobin, UpstreamOptions{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "explicit", pool.Name())
+	assert.Equal(t, StrategyRoundRobin, pool.Strategy())
+	assert.Equal(t, []string{"1.1.1.1:53", "9.9.9.9:853", "https://dns.google/dns-query"}, pool.Upstreams())
+
+	_, err = NewUpstreamPool("1.1.1.1,quic://9.9.9.9", true, "explicit", StrategySequential, UpstreamOptions{})
+	assert.Error(t, err)
+
+	_, err = NewUpstreamPool(" , ", true, "explicit", StrategySequential, UpstreamOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no upstream addresses")
+}
+
+func TestPool_CircuitBreaker_SkipsOpenUpstream(t *testing.T) {
+	failing := &countingUpstream{server: "a:53", err: errors.New("timeout")}
+	healthy := &countingUpstream{server: "b:53"}
+	pool := NewPool(PoolConfig{
+		Name:      "explicit",
+		Upstreams: []Resolver{failing, healthy},
+		Breaker:   BreakerConfig{FailureThreshold: 2, OpenDuration: time.Minute},
+	})
+
+	for i := 0; i < 5; i++ {
+		_, err := pool.Resolve(context.Background(), newPoolRequest())
+		require.NoError(t, err)
+	}
+
+	// Two failures open the circuit; later queries go straight to the healthy upstream
+	assert.Equal(t, 2, failing.count())
+	assert.Equal(t, 5, healthy.count())
+
+	err := pool.HealthCheck()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "a:53 (open)")
+	assert.NotContains(t, err.Error(), "b:53")
+}
+
+func TestPool_CircuitBreaker_FailsFast(t *testing.T) {
+	slow := &countingUpstream{server: "a:53", delay: 50 * time.Millisecond, err: errors.New("i/o timeout")}
+	pool := NewPool(PoolConfig{
+		Name:      "explicit",
+		Upstreams: []Resolver{slow},
+		Breaker:   BreakerConfig{FailureThreshold: 1, OpenDuration: time.Minute},
+	})
+
+	_, err := pool.Resolve(context.Background(), newPoolRequest())
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrCircuitOpen)
+
+	start := time.Now()
+	_, err = pool.Resolve(context.Background(), newPoolRequest())
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Less(t, time.Since(start), 10*time.Millisecond)
+	assert.Equal(t, 1, slow.count())
+}
+
+func TestPool_CircuitBreaker_HalfOpenRecovers(t *testing.T) {
+	upstream := &countingUpstream{server: "a:53", err: errors.New("refused")}
+	pool := NewPool(PoolConfig{
+		Name:      "explicit",
+		Upstreams: []Resolver{upstream},
+		Breaker:   BreakerConfig{FailureThreshold: 1, OpenDuration: 20 * time.Millisecond},
+	})
+
+	_, err := pool.Resolve(context.Background(), newPoolRequest())
+	require.Error(t, err)
+	_, err = pool.Resolve(context.Background(), newPoolRequest())
+	require.ErrorIs(t, err, ErrCircuitOpen)
+
+	upstream.mu.Lock()
+	upstream.err = nil
+	upstream.mu.Unlock()
+	time.Sleep(30 * time.Millisecond)
+
+	_, err = pool.Resolve(context.Background(), newPoolRequest())
+	require.NoError(t, err)
+	assert.NoError(t, pool.HealthCheck())
+}
+
+func TestPool_CanceledQueryDoesNotOpenCircuit(t *testing.T) {
+	upstream := &countingUpstream{server: "a:53", err: context.Canceled}
+	pool := NewPool(PoolConfig{
+		Name:      "explicit",
+		Upstreams: []Resolver{upstream},
+		Breaker:   BreakerConfig{FailureThreshold: 1, OpenDuration: time.Minute},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := pool.Resolve(ctx, newPoolRequest())
+	require.Error(t, err)
+	assert.NoError(t, pool.HealthCheck())
+}
+
+func TestPool_Probing(t *testing.T) {
+	upstream := &countingUpstream{server: "a:53", err: errors.New("refused")}
+	pool := NewPool(PoolConfig{
+		Name:          "explicit",
+		Upstreams:     []Resolver{upstream},
+		Breaker:       BreakerConfig{FailureThreshold: 1, OpenDuration: time.Hour},
+		ProbeInterval: 10 * time.Millisecond,
+	})
+
+	pool.StartProbing()
+	defer pool.StopProbing()
+
+	// Failing probes open the circuit without client traffic
+	require.Eventually(t, func() bool { return pool.HealthCheck() != nil }, time.Second, 5*time.Millisecond)
+
+	// Successful probes close it again even though the open duration has not elapsed
+	upstream.mu.Lock()
+	upstream.err = nil
+	upstream.mu.Unlock()
+	require.Eventually(t, func() bool { return pool.HealthCheck() == nil }, time.Second, 5*time.Millisecond)
+
+	pool.StopProbing()
+	calls := upstream.count()
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, calls, upstream.count(), "no probes after StopProbing")
+}
+
+func TestPool_ProbingDisabled(t *testing.T) {
+	pool := NewPool(PoolConfig{Name: "explicit", Upstreams: []Resolver{&countingUpstream{server: "a:53"}}})
+
+	// Must not block or panic
+	pool.StartProbing()
+	pool.StopProbing()
+}
@@ -0,0 +1,144 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/steigr/nameserver-switcher/internal/logging"
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+)
+
+const (
+	// prefetchQueueSize bounds the refreshes waiting for a worker; more are dropped.
+	prefetchQueueSize = 1024
+	// prefetchTimeout bounds a single background refresh.
+	prefetchTimeout = 10 * time.Second
+)
+
+// Results recorded in the prefetch metrics.
+const (
+	prefetchRefreshed = "refreshed"
+	prefetchFailed    = "failed"
+	prefetchDropped   = "dropped"
+)
+
+// prefetchKey marks contexts of background refreshes.
+type prefetchKey struct{}
+
+// withPrefetch marks ctx as a background refresh, which bypasses the response cache.
+func withPrefetch(ctx context.Context) context.Context {
+	return context.WithValue(ctx, prefetchKey{}, true)
+}
+
+// isPrefetch reports whether ctx belongs to a background refresh.
+func isPrefetch(ctx context.Context) bool {
+	prefetch, _ := ctx.Value(prefetchKey{}).(bool)
+	return prefetch
+}
+
+// prefetcher re-resolves popular cached answers through the router before they
+// expire, so clients are answered from the cache.
+type prefetcher struct {
+	router  *Router
+	workers int
+	queue   chan *dns.Msg
+	metrics *metrics.Metrics
+
+	stopMu sync.Mutex
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newPrefetcher creates a prefetcher with the given number of workers, or nil when
+// workers is not positive.
+func newPrefetcher(router *Router, workers int, m *metrics.Metrics) *prefetcher {
+	if workers <= 0 {
+		return nil
+	}
+	return &prefetcher{
+		router:  router,
+		workers: workers,
+		queue:   make(chan *dns.Msg, prefetchQueueSize),
+		metrics: m,
+	}
+}
+
+// start starts the workers.
+func (p *prefetcher) start() {
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	if p.stop != nil {
+		return
+	}
+	p.stop = make(chan struct{})
+
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go p.run(p.stop)
+	}
+}
+
+// shutdown stops the workers and waits for running refreshes to finish.
+func (p *prefetcher) shutdown() {
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+	p.stop = nil
+}
+
+// enqueue schedules a refresh of req without blocking. Refreshes are dropped
+// while the prefetcher is stopped or its queue is full.
+func (p *prefetcher) enqueue(req *dns.Msg) {
+	p.stopMu.Lock()
+	running := p.stop != nil
+	p.stopMu.Unlock()
+
+	if running {
+		select {
+		case p.queue <- req.Copy():
+			return
+		default:
+		}
+	}
+	p.record(prefetchDropped)
+}
+
+// run refreshes queued requests until stop is closed.
+func (p *prefetcher) run(stop chan struct{}) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-stop:
+			return
+		case req := <-p.queue:
+			p.refresh(req)
+		}
+	}
+}
+
+// refresh re-resolves req, which replaces its cache entry.
+func (p *prefetcher) refresh(req *dns.Msg) {
+	ctx, cancel := context.WithTimeout(withPrefetch(context.Background()), prefetchTimeout)
+	defer cancel()
+
+	if _, err := p.router.Route(ctx, req); err != nil {
+		logging.Debugf("Prefetch of %s failed: %v", req.Question[0].Name, err)
+		p.record(prefetchFailed)
+		return
+	}
+	p.record(prefetchRefreshed)
+}
+
+// record counts a prefetch result.
+func (p *prefetcher) record(result string) {
+	if p.metrics != nil {
+		p.metrics.RecordPrefetch(result)
+	}
+}
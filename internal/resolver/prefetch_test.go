@@ -0,0 +1,92 @@
+package resolver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/cache"
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+)
+
+// prefetching caches answers and refreshes each one in the background as soon as
+// it has been hit twice.
+func prefetching(m *metrics.Metrics) func(*RouterConfig) {
+	return func(cfg *RouterConfig) {
+		cfg.Cache = cache.New(cache.Config{MaxEntries: 10, PrefetchHits: 2, PrefetchPercentage: 100})
+		cfg.PrefetchWorkers = 1
+		cfg.Metrics = m
+	}
+}
+
+func TestRouter_Prefetch(t *testing.T) {
+	m := metrics.NewMetrics("test_router_prefetch")
+	upstream := &recordingResolver{name: "passthrough", answer: newAResponse("example.com.", "192.0.2.1").Answer}
+	router := newTestRouter(nil, upstream, prefetching(m))
+	router.StartPrefetching()
+	defer router.StopPrefetching()
+
+	for i := 0; i < 3; i++ {
+		result := routeProbe(t, router, "example.com.")
+		assert.Equal(t, i > 0, result.Cached)
+	}
+
+	// The second hit makes the entry popular, which refreshes it in the background
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(m.Prefetches.WithLabelValues(prefetchRefreshed)) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(2), upstream.queries.Load())
+
+	// The refreshed entry is served from the cache
+	assert.True(t, routeProbe(t, router, "example.com.").Cached)
+	assert.Equal(t, int32(2), upstream.queries.Load())
+}
+
+func TestRouter_PrefetchStopped(t *testing.T) {
+	m := metrics.NewMetrics("test_router_prefetch_stopped")
+	upstream := &recordingResolver{name: "passthrough", answer: newAResponse("example.com.", "192.0.2.1").Answer}
+	router := newTestRouter(nil, upstream, prefetching(m))
+
+	for i := 0; i < 3; i++ {
+		routeProbe(t, router, "example.com.")
+	}
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.Prefetches.WithLabelValues(prefetchDropped)))
+	assert.Equal(t, int32(1), upstream.queries.Load())
+}
+
+func TestRouter_PrefetchBypassesCache(t *testing.T) {
+	upstream := &recordingResolver{name: "passthrough", answer: newAResponse("example.com.", "192.0.2.1").Answer}
+	router := newTestRouter(nil, upstream, prefetching(nil))
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	_, err := router.Route(context.Background(), req)
+	require.NoError(t, err)
+
+	result, err := router.Route(withPrefetch(context.Background()), req)
+	require.NoError(t, err)
+	assert.False(t, result.Cached)
+	assert.Equal(t, int32(2), upstream.queries.Load())
+}
+
+func TestNewPrefetcher_Disabled(t *testing.T) {
+	router := NewRouter(RouterConfig{
+		PassthroughResolver: &MockResolver{name: "passthrough"},
+		Cache:               cache.New(cache.Config{MaxEntries: 10}),
+	})
+	assert.Nil(t, router.prefetch)
+
+	// Refresh-ahead needs the response cache
+	router = NewRouter(RouterConfig{
+		PassthroughResolver: &MockResolver{name: "passthrough"},
+		PrefetchWorkers:     1,
+	})
+	assert.Nil(t, router.prefetch)
+	router.StartPrefetching()
+	router.StopPrefetching()
+}
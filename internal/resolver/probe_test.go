@@ -0,0 +1,183 @@
+package resolver
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingResolver answers with a fixed set of answer records and counts queries.
+type recordingResolver struct {
+	name    string
+	answer  []dns.RR
+	ns      []dns.RR
+	rcode   int
+	queries atomic.Int32
+}
+
+func (r *recordingResolver) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	r.queries.Add(1)
+	resp := new(dns.Msg)
+	resp.SetRcode(req, r.rcode)
+	resp.Answer = r.answer
+	resp.Ns = r.ns
+	return resp, nil
+}
+
+func (r *recordingResolver) Name() string {
+	return r.name
+}
+
+func soa(zone string) dns.RR {
+	return &dns.SOA{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300}, Ns: "ns." + zone, Mbox: "hostmaster." + zone}
+}
+
+// completeChain is a probe answer that resolves www.example.com through a matching CNAME.
+func completeChain() []dns.RR {
+	return []dns.RR{
+		cname("www.example.com.", "www.cdn.net."),
+		newAResponse("www.cdn.net.", "192.0.2.1").Answer[0],
+	}
+}
+
+func routeProbe(tb testing.TB, router *Router, qname string) *RouteResult {
+	tb.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(qname, dns.TypeA)
+	result, err := router.Route(context.Background(), req)
+	require.NoError(tb, err)
+	return result
+}
+
+func TestRouter_Route_ReusesFinalProbeAnswer(t *testing.T) {
+	explicit := &recordingResolver{name: "explicit", answer: completeChain()}
+	system := &recordingResolver{name: "system"}
+
+	result := routeProbe(t, newTestRouter(explicit, system), "www.example.com.")
+	assert.Equal(t, "explicit", result.ResolverUsed)
+	assert.True(t, result.CNAMEMatched)
+	assert.True(t, result.ProbeReused)
+	assert.Len(t, result.Response.Answer, 2)
+	assert.Equal(t, int32(1), explicit.queries.Load())
+	assert.Equal(t, int32(0), system.queries.Load())
+}
+
+func TestRouter_Route_RequeriesIncompleteProbeAnswer(t *testing.T) {
+	// A non-recursive probe typically stops at the first CNAME
+	explicit := &recordingResolver{name: "explicit", answer: []dns.RR{cname("www.example.com.", "www.cdn.net.")}}
+
+	result := routeProbe(t, newTestRouter(explicit, &recordingResolver{name: "system"}), "www.example.com.")
+	assert.Equal(t, "explicit", result.ResolverUsed)
+	assert.True(t, result.CNAMEMatched)
+	assert.False(t, result.ProbeReused)
+	// Probe and recursive lookup; the first hop matches so nothing is chased
+	assert.Equal(t, int32(2), explicit.queries.Load())
+}
+
+func TestRouter_Route_SeparateProbeResolver(t *testing.T) {
+	probe := &recordingResolver{name: "probe", answer: completeChain()}
+	explicit := &recordingResolver{name: "explicit", answer: completeChain()}
+
+	result := routeProbe(t, newTestRouter(explicit, &recordingResolver{name: "system"}, withProbe(probe)), "www.example.com.")
+	assert.Equal(t, "explicit", result.ResolverUsed)
+	assert.True(t, result.CNAMEMatched)
+	assert.False(t, result.ProbeReused)
+	assert.Equal(t, int32(1), probe.queries.Load())
+	assert.Equal(t, int32(1), explicit.queries.Load())
+}
+
+func TestRouter_Route_ProbeResolverWithoutExplicit(t *testing.T) {
+	probe := &recordingResolver{name: "probe", answer: completeChain()}
+	system := &recordingResolver{name: "system"}
+
+	// Without an explicit resolver the probe resolver is unused, as before
+	result := routeProbe(t, newTestRouter(nil, system, withProbe(probe)), "www.example.com.")
+	assert.Equal(t, "system", result.ResolverUsed)
+	assert.Equal(t, int32(0), probe.queries.Load())
+}
+
+func TestIsFinalAnswer(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+
+	reply := func(rcode int, answer, ns []dns.RR) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, rcode)
+		resp.Answer = answer
+		resp.Ns = ns
+		return resp
+	}
+	truncated := reply(dns.RcodeSuccess, newAResponse("www.example.com.", "192.0.2.1").Answer, nil)
+	truncated.Truncated = true
+
+	tests := []struct {
+		name     string
+		resp     *dns.Msg
+		expected bool
+	}{
+		{"Answer", reply(dns.RcodeSuccess, newAResponse("www.example.com.", "192.0.2.1").Answer, nil), true},
+		{"CompleteChain", reply(dns.RcodeSuccess, completeChain(), nil), true},
+		{"IncompleteChain", reply(dns.RcodeSuccess, []dns.RR{cname("www.example.com.", "www.cdn.net.")}, nil), false},
+		{"NXDOMAIN", reply(dns.RcodeNameError, nil, []dns.RR{soa("example.com.")}), true},
+		{"NODATA", reply(dns.RcodeSuccess, nil, []dns.RR{soa("example.com.")}), true},
+		{"Referral", reply(dns.RcodeSuccess, nil, []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET}, Ns: "ns.example.com."}}), false},
+		{"SERVFAIL", reply(dns.RcodeServerFailure, nil, nil), false},
+		{"Truncated", truncated, false},
+		{"Loop", reply(dns.RcodeSuccess, []dns.RR{cname("www.example.com.", "a.example.com."), cname("a.example.com.", "www.example.com.")}, nil), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isFinalAnswer(req, tt.resp))
+		})
+	}
+}
+
+// BenchmarkRouter_Route reports the upstream queries per request for each routing path.
+func BenchmarkRouter_Route(b *testing.B) {
+	paths := []struct {
+		name   string
+		qname  string
+		probe  bool
+		answer []dns.RR
+	}{
+		{"Passthrough", "other.example.org.", false, nil},
+		{"NoCNAMEResponse", "www.example.com.", false, newAResponse("www.example.com.", "192.0.2.1").Answer},
+		{"CNAMENoMatch", "www.example.com.", false, []dns.RR{cname("www.example.com.", "www.other.net."), newAResponse("www.other.net.", "192.0.2.1").Answer[0]}},
+		{"CNAMEMatchReused", "www.example.com.", false, completeChain()},
+		{"CNAMEMatchIncomplete", "www.example.com.", false, []dns.RR{cname("www.example.com.", "www.cdn.net.")}},
+		{"CNAMEMatchProbeResolver", "www.example.com.", true, completeChain()},
+	}
+
+	for _, path := range paths {
+		b.Run(path.name, func(b *testing.B) {
+			explicit := &recordingResolver{name: "explicit", answer: path.answer}
+			system := &recordingResolver{name: "system"}
+			upstreams := []*recordingResolver{explicit, system}
+
+			var probe Resolver
+			if path.probe {
+				p := &recordingResolver{name: "probe", answer: path.answer}
+				upstreams = append(upstreams, p)
+				probe = p
+			}
+			router := newTestRouter(explicit, system, withProbe(probe))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				routeProbe(b, router, path.qname)
+			}
+			b.StopTimer()
+
+			var queries int32
+			for _, u := range upstreams {
+				queries += u.queries.Load()
+			}
+			b.ReportMetric(float64(queries)/float64(b.N), "queries/op")
+		})
+	}
+}
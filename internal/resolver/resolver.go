@@ -3,12 +3,15 @@ package resolver
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"strings"
 	"time"
 
 	"github.com/miekg/dns"
+
+	"github.com/steigr/nameserver-switcher/internal/metrics"
 )
 
 // Resolver defines the interface for DNS resolution.
@@ -25,6 +28,9 @@ type DNSResolver struct {
 	client    *dns.Client
 	recursive bool
 	name      string
+	udpSize   uint16
+	metrics   *metrics.Metrics
+	inflight  coalescer
 }
 
 // NewDNSResolver creates a new DNS resolver.
@@ -33,7 +39,7 @@ func NewDNSResolver(server string, recursive bool, name string) *DNSResolver {
 		server = server + ":53"
 	}
 
-	return &DNSResolver{
+	r := &DNSResolver{
 		server: server,
 		client: &dns.Client{
 			Net:     "udp",
@@ -42,10 +48,59 @@ func NewDNSResolver(server string, recursive bool, name string) *DNSResolver {
 		recursive: recursive,
 		name:      name,
 	}
+	r.inflight.onJoin = r.recordCoalesced
+	return r
+}
+
+// NewDNSOverTLSResolver creates a DNS resolver that talks DNS-over-TLS (RFC 7858).
+// The TLS config should carry a ClientSessionCache so sessions are resumed across queries.
+func NewDNSOverTLSResolver(server string, recursive bool, name string, tlsConfig *tls.Config) *DNSResolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), "853")
+	}
+
+	r := &DNSResolver{
+		server: server,
+		client: &dns.Client{
+			Net:       "tcp-tls",
+			Timeout:   5 * time.Second,
+			TLSConfig: tlsConfig,
+		},
+		recursive: recursive,
+		name:      name,
+	}
+	r.inflight.onJoin = r.recordCoalesced
+	return r
+}
+
+// SetUDPSize sets the EDNS0 UDP buffer size advertised upstream. Zero leaves requests unchanged.
+func (r *DNSResolver) SetUDPSize(size uint16) {
+	r.udpSize = size
+}
+
+// SetMetrics sets the metrics used to count TCP fallbacks.
+func (r *DNSResolver) SetMetrics(m *metrics.Metrics) {
+	r.metrics = m
 }
 
 // Resolve performs a DNS lookup.
+// Truncated UDP responses are retried over TCP. Concurrent identical queries share
+// one exchange, bounded by the client timeout for the query and its TCP retry.
 func (r *DNSResolver) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	return r.inflight.do(ctx, req, 2*r.client.Timeout, func(ctx context.Context) (*dns.Msg, error) {
+		return r.exchange(ctx, req)
+	})
+}
+
+// recordCoalesced counts a query that joined an identical exchange in flight.
+func (r *DNSResolver) recordCoalesced() {
+	if r.metrics != nil {
+		r.metrics.RecordCoalesced(r.name)
+	}
+}
+
+// exchange sends req to the server.
+func (r *DNSResolver) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
 	reqCopy := req.Copy()
 
 	if r.recursive {
@@ -54,10 +109,18 @@ func (r *DNSResolver) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, erro
 		reqCopy.RecursionDesired = false
 	}
 
-	resp, _, err := r.client.ExchangeContext(ctx, reqCopy, r.server)
+	addedOPT := setUDPSize(reqCopy, r.udpSize)
+
+	resp, fellBack, err := exchange(ctx, r.client, reqCopy, r.server)
 	if err != nil {
 		return nil, fmt.Errorf("DNS query failed: %w", err)
 	}
+	if fellBack && r.metrics != nil {
+		r.metrics.RecordTCPFallback(r.name)
+	}
+	if addedOPT {
+		removeOPT(resp)
+	}
 
 	return resp, nil
 }
@@ -131,7 +194,7 @@ func (r *SystemResolver) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, e
 
 	var lastErr error
 	for _, server := range r.servers {
-		resp, _, err := r.client.ExchangeContext(ctx, reqCopy, server)
+		resp, _, err := exchange(ctx, r.client, reqCopy, server)
 		if err != nil {
 			lastErr = err
 			continue
@@ -155,6 +218,54 @@ func (r *SystemResolver) Servers() []string {
 	return r.servers
 }
 
+// exchange sends req to server and retries over TCP when a UDP response is truncated.
+// It reports whether the TCP retry was used.
+func exchange(ctx context.Context, client *dns.Client, req *dns.Msg, server string) (*dns.Msg, bool, error) {
+	resp, _, err := client.ExchangeContext(ctx, req, server)
+	if err != nil {
+		return nil, false, err
+	}
+	if !resp.Truncated || (client.Net != "" && client.Net != "udp") {
+		return resp, false, nil
+	}
+
+	tcpClient := &dns.Client{
+		Net:     "tcp",
+		Timeout: client.Timeout,
+		Dialer:  client.Dialer,
+	}
+	resp, _, err = tcpClient.ExchangeContext(ctx, req, server)
+	if err != nil {
+		return nil, true, fmt.Errorf("TCP retry after truncated response failed: %w", err)
+	}
+	return resp, true, nil
+}
+
+// setUDPSize advertises size as the EDNS0 UDP buffer size on req.
+// It reports whether an OPT record had to be added.
+func setUDPSize(req *dns.Msg, size uint16) bool {
+	if size == 0 {
+		return false
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		opt.SetUDPSize(size)
+		return false
+	}
+	req.SetEdns0(size, false)
+	return true
+}
+
+// removeOPT strips the OPT record from a response to a request that carried none.
+func removeOPT(resp *dns.Msg) {
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	resp.Extra = extra
+}
+
 // ExtractCNAME extracts CNAME targets from a DNS response.
 func ExtractCNAME(resp *dns.Msg) []string {
 	var cnames []string
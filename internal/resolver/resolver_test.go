@@ -2,12 +2,19 @@ package resolver
 
 import (
 	"context"
+	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/cache"
+	"github.com/steigr/nameserver-switcher/internal/metrics"
 )
 
 func TestNewDNSResolver(t *testing.T) {
@@ -208,6 +215,35 @@ func (m *MockResolverWithCallback) Name() string {
 	return m.name
 }
 
+// newTestRouter creates a router that probes www.example.com through explicit and
+// answers through explicit when its CNAME matches www.cdn.net, and through system
+// otherwise. Options adjust the configuration before the router is created.
+func newTestRouter(explicit, system Resolver, options ...func(*RouterConfig)) *Router {
+	cfg := RouterConfig{
+		RequestMatcher:   &MockMatcher{matches: map[string]string{"www.example.com": "example"}},
+		CNAMEMatcher:     &MockMatcher{matches: map[string]string{"www.cdn.net": "cdn"}},
+		ExplicitResolver: explicit,
+		SystemResolver:   system,
+	}
+	for _, option := range options {
+		option(&cfg)
+	}
+	return NewRouter(cfg)
+}
+
+// withProbe probes through probe instead of the explicit resolver.
+func withProbe(probe Resolver) func(*RouterConfig) {
+	return func(cfg *RouterConfig) {
+		cfg.ProbeResolver = probe
+	}
+}
+
+// withCaches caches answers and routing decisions for up to 10 names.
+func withCaches(cfg *RouterConfig) {
+	cfg.Cache = cache.New(cache.Config{MaxEntries: 10})
+	cfg.DecisionCacheSize = 10
+}
+
 func TestRouter_Route_NoPatternMatch(t *testing.T) {
 	systemResp := &dns.Msg{
 		Answer: []dns.RR{
@@ -727,6 +763,46 @@ func TestRouter_Route_NoResolverForMatchedPattern(t *testing.T) {
 	assert.Contains(t, err.Error(), "no resolver available for matched pattern")
 }
 
+func TestRouter_Route_Cache(t *testing.T) {
+	explicit := &recordingResolver{name: "explicit", answer: completeChain()}
+	router := NewRouter(RouterConfig{
+		RequestMatcher:   &MockMatcher{matches: map[string]string{"www.example.com": "example"}},
+		CNAMEMatcher:     &MockMatcher{matches: map[string]string{"www.cdn.net": "cdn"}},
+		ExplicitResolver: explicit,
+		Cache:            cache.New(cache.Config{MaxEntries: 10}),
+	})
+
+	first := routeProbe(t, router, "www.example.com.")
+	assert.False(t, first.Cached)
+
+	second := routeProbe(t, router, "www.example.com.")
+	assert.True(t, second.Cached)
+	assert.Equal(t, "explicit", second.ResolverUsed)
+	assert.Equal(t, RuleDefault, second.Rule)
+	assert.True(t, second.RequestMatched)
+	assert.True(t, second.CNAMEMatched)
+	assert.Equal(t, "cdn", second.CNAMEPattern)
+	assert.Equal(t, []string{"www.cdn.net"}, second.CNAMEChain)
+	assert.Len(t, second.Response.Answer, 2)
+	assert.Equal(t, int32(1), explicit.queries.Load())
+}
+
+func TestRouter_Route_CacheSkipsFallback(t *testing.T) {
+	router := NewRouter(RouterConfig{
+		PassthroughResolver: &MockResolver{name: "passthrough", err: assert.AnError},
+		FailurePolicies: map[string]FailurePolicy{
+			RoutePassthrough: {Action: FailureActionRcode, Rcode: dns.RcodeRefused},
+		},
+		Cache: cache.New(cache.Config{MaxEntries: 10}),
+	})
+
+	for i := 0; i < 2; i++ {
+		result := routeProbe(t, router, "example.org.")
+		assert.True(t, result.Fallback)
+		assert.False(t, result.Cached)
+	}
+}
+
 func TestDNSResolver_Resolve(t *testing.T) {
 	// This test requires a real DNS server
 	// Skip if running in a restricted environment
@@ -1048,3 +1124,146 @@ func TestDNSResolver_Name(t *testing.T) {
 	r := NewDNSResolver("8.8.8.8:53", true, "test-resolver")
 	assert.Equal(t, "test-resolver", r.Name())
 }
+
+// truncatingServer answers over UDP with TC set and no records, and over TCP with the full answer.
+type truncatingServer struct {
+	addr       string
+	udpQueries int64
+	tcpQueries int64
+	udpSize    atomic.Value
+}
+
+// startTruncatingServer starts UDP and TCP DNS listeners on the same local port.
+func startTruncatingServer(t *testing.T) *truncatingServer {
+	t.Helper()
+
+	s := &truncatingServer{}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+
+		if w.RemoteAddr().Network() == "udp" {
+			atomic.AddInt64(&s.udpQueries, 1)
+			if opt := req.IsEdns0(); opt != nil {
+				s.udpSize.Store(opt.UDPSize())
+				resp.SetEdns0(opt.UDPSize(), false)
+			}
+			resp.Truncated = true
+			_ = w.WriteMsg(resp)
+			return
+		}
+
+		atomic.AddInt64(&s.tcpQueries, 1)
+		for i := 0; i < 20; i++ {
+			resp.Answer = append(resp.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{strings.Repeat("x", 200)},
+			})
+		}
+		_ = w.WriteMsg(resp)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s.addr = pc.LocalAddr().String()
+	ln, err := net.Listen("tcp", s.addr)
+	require.NoError(t, err)
+
+	for _, srv := range []*dns.Server{
+		{PacketConn: pc, Handler: handler},
+		{Listener: ln, Handler: handler},
+	} {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go func() { _ = srv.ActivateAndServe() }()
+		<-started
+		t.Cleanup(func() { _ = srv.Shutdown() })
+	}
+
+	return s
+}
+
+func TestDNSResolver_Resolve_TruncatedRetriesOverTCP(t *testing.T) {
+	srv := startTruncatingServer(t)
+	m := metrics.NewMetrics("test_resolver_tcp_fallback")
+
+	r, err := NewUpstreamResolver(srv.addr, true, "explicit", UpstreamOptions{Metrics: m})
+	require.NoError(t, err)
+
+	req := new(dns.Msg)
+	req.SetQuestion("large.example.com.", dns.TypeTXT)
+
+	resp, err := r.Resolve(context.Background(), req)
+	require.NoError(t, err)
+	assert.False(t, resp.Truncated)
+	assert.Len(t, resp.Answer, 20)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&srv.udpQueries))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&srv.tcpQueries))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.TCPFallbacks.WithLabelValues("explicit")))
+}
+
+func TestDNSResolver_Resolve_UDPSize(t *testing.T) {
+	srv := startTruncatingServer(t)
+
+	r, err := NewUpstreamResolver(srv.addr, true, "explicit", UpstreamOptions{UDPSize: 1232})
+	require.NoError(t, err)
+
+	t.Run("adds OPT and strips it from the response", func(t *testing.T) {
+		req := new(dns.Msg)
+		req.SetQuestion("large.example.com.", dns.TypeTXT)
+
+		resp, err := r.Resolve(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, uint16(1232), srv.udpSize.Load())
+		assert.Nil(t, resp.IsEdns0())
+		assert.Nil(t, req.IsEdns0(), "caller's request must not be modified")
+	})
+
+	t.Run("overrides client buffer size", func(t *testing.T) {
+		req := new(dns.Msg)
+		req.SetQuestion("large.example.com.", dns.TypeTXT)
+		req.SetEdns0(512, true)
+
+		_, err := r.Resolve(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, uint16(1232), srv.udpSize.Load())
+		assert.Equal(t, uint16(512), req.IsEdns0().UDPSize())
+	})
+}
+
+func TestDNSResolver_Resolve_TCPOnly(t *testing.T) {
+	srv := startTruncatingServer(t)
+
+	r, err := NewUpstreamResolver("tcp://"+srv.addr, true, "explicit", UpstreamOptions{})
+	require.NoError(t, err)
+
+	req := new(dns.Msg)
+	req.SetQuestion("large.example.com.", dns.TypeTXT)
+
+	resp, err := r.Resolve(context.Background(), req)
+	require.NoError(t, err)
+	assert.Len(t, resp.Answer, 20)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&srv.udpQueries))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&srv.tcpQueries))
+}
+
+func TestSystemResolver_Resolve_TruncatedRetriesOverTCP(t *testing.T) {
+	srv := startTruncatingServer(t)
+
+	r := &SystemResolver{
+		servers: []string{srv.addr},
+		client: &dns.Client{
+			Net:     "udp",
+			Timeout: time.Second,
+		},
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("large.example.com.", dns.TypeTXT)
+
+	resp, err := r.Resolve(context.Background(), req)
+	require.NoError(t, err)
+	assert.False(t, resp.Truncated)
+	assert.Len(t, resp.Answer, 20)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&srv.tcpQueries))
+}
@@ -4,59 +4,108 @@ package resolver
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 
+	"github.com/steigr/nameserver-switcher/internal/cache"
+	"github.com/steigr/nameserver-switcher/internal/config"
+	"github.com/steigr/nameserver-switcher/internal/logging"
 	"github.com/steigr/nameserver-switcher/internal/matcher"
+	"github.com/steigr/nameserver-switcher/internal/metrics"
 )
 
-// Router routes DNS requests to appropriate resolvers based on pattern matching.
+// Router routes DNS requests to appropriate resolvers based on an ordered list of rules.
 type Router struct {
-	requestMatcher          matcher.Matcher
-	cnameMatcher            matcher.Matcher
-	explicitResolver        Resolver
-	passthroughResolver     Resolver
-	noCnameResponseResolver Resolver
-	noCnameMatchResolver    Resolver
+	requestMatcher matcher.Matcher
+	cnameMatcher   matcher.Matcher
+	rules          []Rule
+	stale          *staleStore
+	cache          *cache.Cache
+	decisions      *decisionCache
+	cnameMaxDepth  int
+	serveStale     bool
+	staleTimeout   time.Duration
+	staleFlights   *staleFlights
+	prefetch       *prefetcher
 }
 
 // RouterConfig holds configuration for the router.
 type RouterConfig struct {
+	// Rules are evaluated in order before the rules built from the legacy fields below.
+	Rules []Rule
+
 	RequestMatcher          matcher.Matcher
 	CNAMEMatcher            matcher.Matcher
 	ExplicitResolver        Resolver
+	ProbeResolver           Resolver // Used for the probe lookup instead of ExplicitResolver
 	PassthroughResolver     Resolver // Used when request doesn't match any pattern
 	NoCnameResponseResolver Resolver // Used when response has no CNAME
 	NoCnameMatchResolver    Resolver // Used when CNAME doesn't match pattern
 	// Deprecated: Use PassthroughResolver, NoCnameResponseResolver, or NoCnameMatchResolver instead
 	SystemResolver Resolver
+	// FailurePolicies maps route names (RouteExplicit, RoutePassthrough, ...) to failure policies
+	// for the legacy rules. Routes without a policy return an error, which clients see as SERVFAIL.
+	FailurePolicies map[string]FailurePolicy
+	// StaleEntries bounds the answers kept for serving stale (default 10000).
+	StaleEntries int
+	// ServeStale answers with the last good answer when a rule fails (RFC 8767).
+	ServeStale bool
+	// StaleMaxAge bounds how long past its TTL an answer is served stale (0 disables the limit).
+	StaleMaxAge time.Duration
+	// StaleAnswerTimeout is how long ServeStale waits for upstreams before answering
+	// stale while resolution continues (0 waits until resolution fails).
+	StaleAnswerTimeout time.Duration
+	// CNAMEMaxDepth bounds the CNAME/DNAME hops followed when matching CNAME patterns (default 8).
+	CNAMEMaxDepth int
+	// Cache caches routed responses per rule (nil disables caching).
+	Cache *cache.Cache
+	// DecisionCacheSize bounds the names whose probe outcome is remembered (0 disables).
+	DecisionCacheSize int
+	// PrefetchWorkers is the number of workers refreshing popular cached answers
+	// ahead of expiry (0 disables refresh-ahead).
+	PrefetchWorkers int
+	// Metrics records route decision cache and prefetch activity.
+	Metrics *metrics.Metrics
 }
 
 // NewRouter creates a new Router with the given configuration.
 func NewRouter(cfg RouterConfig) *Router {
-	// Support backward compatibility: if new resolvers are not set, use SystemResolver
-	passthroughResolver := cfg.PassthroughResolver
-	if passthroughResolver == nil {
-		passthroughResolver = cfg.SystemResolver
+	rules := make([]Rule, 0, len(cfg.Rules)+2)
+	rules = append(rules, cfg.Rules...)
+	rules = append(rules, DefaultRules(cfg)...)
+
+	cnameMaxDepth := cfg.CNAMEMaxDepth
+	if cnameMaxDepth <= 0 {
+		cnameMaxDepth = defaultCNAMEMaxDepth
 	}
-	noCnameResponseResolver := cfg.NoCnameResponseResolver
-	if noCnameResponseResolver == nil {
-		noCnameResponseResolver = cfg.SystemResolver
+
+	router := &Router{
+		requestMatcher: cfg.RequestMatcher,
+		cnameMatcher:   cfg.CNAMEMatcher,
+		rules:          rules,
+		cache:          cfg.Cache,
+		decisions:      newDecisionCache(cfg.DecisionCacheSize, cfg.Metrics),
+		cnameMaxDepth:  cnameMaxDepth,
+		serveStale:     cfg.ServeStale,
+		staleTimeout:   cfg.StaleAnswerTimeout,
+		staleFlights:   newStaleFlights(maxStaleResolutions),
 	}
-	noCnameMatchResolver := cfg.NoCnameMatchResolver
-	if noCnameMatchResolver == nil {
-		noCnameMatchResolver = cfg.SystemResolver
+	if cfg.Cache != nil {
+		router.prefetch = newPrefetcher(router, cfg.PrefetchWorkers, cfg.Metrics)
 	}
 
-	return &Router{
-		requestMatcher:          cfg.RequestMatcher,
-		cnameMatcher:            cfg.CNAMEMatcher,
-		explicitResolver:        cfg.ExplicitResolver,
-		passthroughResolver:     passthroughResolver,
-		noCnameResponseResolver: noCnameResponseResolver,
-		noCnameMatchResolver:    noCnameMatchResolver,
+	// Only keep last good answers when they can be served
+	for _, rule := range rules {
+		if cfg.ServeStale || rule.usesStale() {
+			router.stale = newStaleStore(cfg.StaleEntries, cfg.StaleMaxAge)
+			break
+		}
 	}
+
+	return router
 }
 
 // RouteResult contains information about how a request was routed.
@@ -67,152 +116,318 @@ type RouteResult struct {
 	CNAMEMatched   bool
 	MatchedPattern string
 	CNAMEPattern   string
+	// CNAMEChain lists the CNAME/DNAME targets followed from the requested name, in order.
+	CNAMEChain []string
+	// Rule is the name of the rule that handled the request.
+	Rule string
+	// Cached is set when the response was served from the cache.
+	Cached bool
+	// DecisionCached is set when the probe was skipped because the routing decision was cached.
+	DecisionCached bool
+	// ProbeReused is set when the final probe answer was returned without a second query.
+	ProbeReused bool
+	// Stale is set when the response is a last good answer served past its TTL.
+	Stale bool
+	// Fallback is set when a failure policy produced the response.
+	Fallback bool
+	// FallbackReason describes the failure that triggered the policy or the stale answer.
+	FallbackReason string
+
+	// probe is the final probe answer, which later stages reuse instead of querying
+	// the probe resolver again.
+	probe *dns.Msg
+	// route is the route chosen after the probe and decisionTTL how long that choice
+	// holds; chainTTL is the lowest TTL of the followed aliases.
+	route       string
+	decisionTTL uint32
+	chainTTL    uint32
 }
 
-// Route processes a DNS request according to the routing rules:
-// 1. If request matches request patterns, do non-recursive lookup to explicit resolver
-// 2. If response is CNAME and matches CNAME patterns, recursive lookup to explicit resolver
-// 3. If CNAME doesn't match, use noCnameMatchResolver
-// 4. If no CNAME in response, use noCnameResponseResolver
-// 5. If no request pattern match, use passthroughResolver
+// Route processes a DNS request with the first rule whose request matcher matches:
+// 1. Without a probe resolver, answer from the target resolver
+// 2. Otherwise do a lookup to the probe resolver
+// 3. If a CNAME or DNAME in the alias chain matches the rule's CNAME patterns, use the target resolver
+// 4. If CNAME doesn't match, use the rule's no-CNAME-match resolver
+// 5. If no CNAME in response, use the rule's no-CNAME-response resolver
 func (r *Router) Route(ctx context.Context, req *dns.Msg) (*RouteResult, error) {
 	if len(req.Question) == 0 {
 		return nil, fmt.Errorf("no question in request")
 	}
 
 	qname := strings.TrimSuffix(req.Question[0].Name, ".")
-	result := &RouteResult{}
+	generation := patternGeneration(r.rules)
+
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if !rule.matches(qname) {
+			continue
+		}
 
-	// Check if request matches any request pattern
-	if r.shouldUseRequestMatcher(qname) {
-		return r.routeMatchedRequest(ctx, req, qname, result)
+		// Responses cached before a pattern update are not reused
+		key, _ := cache.KeyFor(req, rule.Name+"@"+strconv.FormatUint(generation, 10))
+		prefetch := isPrefetch(ctx)
+		if !prefetch {
+			if resp, meta, ok := r.cache.Get(key, req); ok {
+				if r.prefetch != nil && r.cache.Due(key) {
+					r.prefetch.enqueue(req)
+				}
+				cached := *meta.(*RouteResult)
+				cached.Response = resp
+				cached.Cached = true
+				return &cached, nil
+			}
+		}
+
+		result := &RouteResult{Rule: rule.Name}
+		if rule.RequestMatcher != nil {
+			result.RequestMatched = true
+			result.MatchedPattern = rule.RequestMatcher.MatchingPattern(qname)
+		}
+		if r.serveStale && !prefetch {
+			return r.routeStale(ctx, req, *result, func(ctx context.Context) (*RouteResult, error) {
+				return r.resolve(ctx, rule, req, key, generation, result)
+			})
+		}
+		return r.resolve(ctx, rule, req, key, generation, result)
 	}
 
-	// No pattern match, use passthroughResolver
-	return r.routePassthrough(ctx, req, result)
+	return nil, fmt.Errorf("no resolver available")
 }
 
-// shouldUseRequestMatcher checks if the request matches any pattern
-func (r *Router) shouldUseRequestMatcher(qname string) bool {
-	return r.requestMatcher != nil && r.requestMatcher.Match(qname)
+// resolve routes req with rule and remembers the outcome in the caches.
+func (r *Router) resolve(ctx context.Context, rule *Rule, req *dns.Msg, key cache.Key, generation uint64, result *RouteResult) (*RouteResult, error) {
+	var err error
+	if d, ok := r.cachedDecision(rule, req, generation); ok {
+		result, err = r.routeDecision(ctx, rule, d, req, result)
+	} else {
+		result, err = r.routeRule(ctx, rule, req, result)
+		if err == nil && result.route != "" && !result.Fallback {
+			r.decisions.put(req, result.decision(rule, generation), result.decisionTTL)
+		}
+	}
+	if err == nil && !result.Fallback {
+		// Answers produced by a failure policy are neither cached nor kept as last good answer
+		r.cache.Set(key, result.Response, result.outcome())
+		r.stale.put(req, result.Response, result.ResolverUsed)
+	}
+	return result, err
 }
 
-// routeMatchedRequest handles requests that match the request pattern
-func (r *Router) routeMatchedRequest(ctx context.Context, req *dns.Msg, qname string, result *RouteResult) (*RouteResult, error) {
-	result.RequestMatched = true
-	result.MatchedPattern = r.requestMatcher.MatchingPattern(qname)
-
-	// If no explicit resolver, use fallback
-	if r.explicitResolver == nil {
-		return r.useFallbackResolver(ctx, req, result)
+// routeRule handles a request with the given rule
+func (r *Router) routeRule(ctx context.Context, rule *Rule, req *dns.Msg, result *RouteResult) (*RouteResult, error) {
+	if rule.ProbeResolver == nil {
+		if rule.TargetResolver != nil {
+			return r.useResolver(ctx, rule, RoutePassthrough, rule.TargetResolver, req, result)
+		}
+		// No probe or target, answer like a probe without CNAME
+		return r.useNoCnameResponseResolver(ctx, rule, req, result)
 	}
 
-	// Query explicit resolver
-	resp, err := r.explicitResolver.Resolve(ctx, req)
+	// Query probe resolver
+	resp, final, err := r.resolveWithPolicy(ctx, rule, RouteExplicit, rule.ProbeResolver, req, result)
 	if err != nil {
-		return nil, fmt.Errorf("explicit resolver failed: %w", err)
+		return nil, err
+	}
+	if final {
+		result.Response = resp
+		return result, nil
+	}
+	if isFinalAnswer(req, resp) {
+		result.probe = resp
 	}
 
 	// Process response based on CNAME presence
-	return r.processExplicitResponse(ctx, req, resp, result)
+	return r.processProbeResponse(ctx, rule, req, resp, result)
 }
 
-// processExplicitResponse handles the response from explicit resolver
-func (r *Router) processExplicitResponse(ctx context.Context, req *dns.Msg, resp *dns.Msg, result *RouteResult) (*RouteResult, error) {
-	if !HasCNAME(resp) {
-		return r.useNoCnameResponseResolver(ctx, req, result)
-	}
-
-	if r.cnameMatcher == nil {
-		return r.useNoCnameResponseResolver(ctx, req, result)
+// processProbeResponse handles the response from the probe resolver
+func (r *Router) processProbeResponse(ctx context.Context, rule *Rule, req *dns.Msg, resp *dns.Msg, result *RouteResult) (*RouteResult, error) {
+	if !hasAlias(resp) || rule.CNAMEMatcher == nil {
+		result.decide(RouteNoCnameResponse, RecordTTL(resp))
+		return r.useNoCnameResponseResolver(ctx, rule, req, result)
 	}
 
-	// Check if any CNAME matches the pattern
-	return r.processCNAMEMatch(ctx, req, resp, result)
+	// Check if any CNAME in the chain matches the pattern
+	return r.processCNAMEMatch(ctx, rule, req, resp, result)
 }
 
-// processCNAMEMatch checks CNAME records and routes accordingly
-func (r *Router) processCNAMEMatch(ctx context.Context, req *dns.Msg, resp *dns.Msg, result *RouteResult) (*RouteResult, error) {
-	cnames := ExtractCNAME(resp)
-
-	for _, cname := range cnames {
-		cname = strings.TrimSuffix(cname, ".")
-		if r.cnameMatcher.Match(cname) {
-			return r.handleMatchedCNAME(ctx, req, cname, result)
-		}
+// processCNAMEMatch follows the alias chain and routes accordingly
+func (r *Router) processCNAMEMatch(ctx context.Context, rule *Rule, req *dns.Msg, resp *dns.Msg, result *RouteResult) (*RouteResult, error) {
+	if cname := r.followChain(ctx, rule, req, resp, result); cname != "" {
+		result.decide(RouteExplicit, result.chainTTL)
+		return r.handleMatchedCNAME(ctx, rule, req, cname, result)
 	}
 
 	// CNAME exists but doesn't match pattern
-	return r.useNoCnameMatchResolver(ctx, req, result)
+	result.decide(RouteNoCnameMatch, result.chainTTL)
+	return r.useNoCnameMatchResolver(ctx, rule, req, result)
 }
 
 // handleMatchedCNAME handles a CNAME that matches the pattern
-func (r *Router) handleMatchedCNAME(ctx context.Context, req *dns.Msg, cname string, result *RouteResult) (*RouteResult, error) {
+func (r *Router) handleMatchedCNAME(ctx context.Context, rule *Rule, req *dns.Msg, cname string, result *RouteResult) (*RouteResult, error) {
 	result.CNAMEMatched = true
-	result.CNAMEPattern = r.cnameMatcher.MatchingPattern(cname)
+	result.CNAMEPattern = rule.CNAMEMatcher.MatchingPattern(cname)
 
-	// Do recursive lookup to explicit resolver
-	explicitResp, err := r.explicitResolver.Resolve(ctx, req)
-	if err != nil {
-		return nil, fmt.Errorf("explicit resolver failed: %w", err)
+	// Do recursive lookup to target resolver
+	return r.useResolver(ctx, rule, RouteExplicit, rule.target(), req, result)
+}
+
+// cachedDecision returns the remembered probe outcome for req if rule probes.
+func (r *Router) cachedDecision(rule *Rule, req *dns.Msg, generation uint64) (*decision, bool) {
+	if rule.ProbeResolver == nil {
+		return nil, false
 	}
+	d, ok := r.decisions.get(req, generation)
+	if !ok || d.rule != rule.Name {
+		return nil, false
+	}
+	return d, true
+}
 
-	result.Response = explicitResp
-	result.ResolverUsed = r.explicitResolver.Name()
-	return result, nil
+// routeDecision skips the probe and answers from the route of a cached decision
+func (r *Router) routeDecision(ctx context.Context, rule *Rule, d *decision, req *dns.Msg, result *RouteResult) (*RouteResult, error) {
+	result.DecisionCached = true
+	result.CNAMEMatched = d.cnameMatched
+	result.CNAMEPattern = d.cnamePattern
+	result.CNAMEChain = d.cnameChain
+
+	switch d.route {
+	case RouteExplicit:
+		return r.useResolver(ctx, rule, RouteExplicit, rule.target(), req, result)
+	case RouteNoCnameMatch:
+		return r.useNoCnameMatchResolver(ctx, rule, req, result)
+	default:
+		return r.useNoCnameResponseResolver(ctx, rule, req, result)
+	}
 }
 
 // useNoCnameMatchResolver uses the resolver for unmatched CNAMEs
-func (r *Router) useNoCnameMatchResolver(ctx context.Context, req *dns.Msg, result *RouteResult) (*RouteResult, error) {
-	if r.noCnameMatchResolver == nil {
+func (r *Router) useNoCnameMatchResolver(ctx context.Context, rule *Rule, req *dns.Msg, result *RouteResult) (*RouteResult, error) {
+	if rule.NoCnameMatchResolver == nil {
 		return nil, fmt.Errorf("no resolver available for matched pattern")
 	}
 
-	resp, err := r.noCnameMatchResolver.Resolve(ctx, req)
-	if err != nil {
-		return nil, fmt.Errorf("no-cname-match resolver failed: %w", err)
-	}
-
-	result.Response = resp
-	result.ResolverUsed = r.noCnameMatchResolver.Name()
-	return result, nil
+	return r.useResolver(ctx, rule, RouteNoCnameMatch, rule.NoCnameMatchResolver, req, result)
 }
 
 // useNoCnameResponseResolver uses the resolver for responses without CNAME
-func (r *Router) useNoCnameResponseResolver(ctx context.Context, req *dns.Msg, result *RouteResult) (*RouteResult, error) {
-	if r.noCnameResponseResolver == nil {
+func (r *Router) useNoCnameResponseResolver(ctx context.Context, rule *Rule, req *dns.Msg, result *RouteResult) (*RouteResult, error) {
+	if rule.NoCnameResponseResolver == nil {
 		return nil, fmt.Errorf("no resolver available for matched pattern")
 	}
 
-	resp, err := r.noCnameResponseResolver.Resolve(ctx, req)
+	return r.useResolver(ctx, rule, RouteNoCnameResponse, rule.NoCnameResponseResolver, req, result)
+}
+
+// useResolver answers the request from res, applying the route's failure policy.
+// A final probe answer is reused when res is the probe resolver.
+func (r *Router) useResolver(ctx context.Context, rule *Rule, route string, res Resolver, req *dns.Msg, result *RouteResult) (*RouteResult, error) {
+	if result.probe != nil && res == rule.ProbeResolver {
+		result.Response = result.probe
+		result.ResolverUsed = res.Name()
+		result.ProbeReused = true
+		return result, nil
+	}
+
+	resp, final, err := r.resolveWithPolicy(ctx, rule, route, res, req, result)
 	if err != nil {
-		return nil, fmt.Errorf("no-cname-response resolver failed: %w", err)
+		return nil, err
 	}
 
 	result.Response = resp
-	result.ResolverUsed = r.noCnameResponseResolver.Name()
+	if !final {
+		result.ResolverUsed = res.Name()
+	}
 	return result, nil
 }
 
-// useFallbackResolver uses noCnameResponseResolver when no explicit resolver is configured
-func (r *Router) useFallbackResolver(ctx context.Context, req *dns.Msg, result *RouteResult) (*RouteResult, error) {
-	return r.useNoCnameResponseResolver(ctx, req, result)
+// decide records the route chosen after the probe and how long the choice holds.
+func (r *RouteResult) decide(route string, ttl uint32) {
+	r.route = route
+	r.decisionTTL = ttl
 }
 
-// routePassthrough handles requests that don't match any pattern
-func (r *Router) routePassthrough(ctx context.Context, req *dns.Msg, result *RouteResult) (*RouteResult, error) {
-	if r.passthroughResolver == nil {
-		return nil, fmt.Errorf("no resolver available")
+// decision returns the routing decision recorded in r.
+func (r *RouteResult) decision(rule *Rule, generation uint64) *decision {
+	return &decision{
+		rule:         rule.Name,
+		route:        r.route,
+		cnameMatched: r.CNAMEMatched,
+		cnamePattern: r.CNAMEPattern,
+		cnameChain:   r.CNAMEChain,
+		generation:   generation,
 	}
+}
 
-	resp, err := r.passthroughResolver.Resolve(ctx, req)
-	if err != nil {
-		return nil, fmt.Errorf("passthrough resolver failed: %w", err)
+// outcome returns a copy of the routing metadata of r without the response.
+func (r *RouteResult) outcome() *RouteResult {
+	outcome := *r
+	outcome.Response = nil
+	outcome.probe = nil
+	return &outcome
+}
+
+// Log logs the response of r to a query for name that took duration, when cfg enables
+// response logging, and how it was routed, when cfg enables debug logging.
+func (r *RouteResult) Log(name string, duration time.Duration, cfg *config.Config) {
+	if cfg == nil {
+		return
 	}
 
-	result.Response = resp
-	result.ResolverUsed = r.passthroughResolver.Name()
-	return result, nil
+	if cfg.LogResponses {
+		logging.LogDNSResponse(logging.DNSResponse{
+			Name:           name,
+			Rcode:          dns.RcodeToString[r.Response.Rcode],
+			AnswerCount:    len(r.Response.Answer),
+			Resolver:       r.ResolverUsed,
+			Rule:           r.Rule,
+			DurationMs:     duration.Seconds() * 1000,
+			RequestMatched: r.RequestMatched,
+			CNAMEMatched:   r.CNAMEMatched,
+			Cached:         r.Cached,
+			Stale:          r.Stale,
+			Fallback:       r.FallbackReason,
+		})
+	}
+
+	if cfg.Debug {
+		debug := logging.DNSDebug{
+			Resolver:   r.ResolverUsed,
+			CNAMEChain: r.CNAMEChain,
+		}
+		if r.RequestMatched {
+			debug.MatchedPattern = r.MatchedPattern
+			debug.Request = name
+		}
+		if r.CNAMEMatched && len(r.CNAMEChain) > 0 {
+			// The chain stops at the matching hop
+			debug.CNAMEPattern = r.CNAMEPattern
+			debug.CNAME = r.CNAMEChain[len(r.CNAMEChain)-1]
+		}
+		debug.FullResponse = r.Response.String()
+		logging.LogDNSDebug(debug)
+	}
+}
+
+// StartPrefetching starts refreshing popular cached answers in the background.
+func (r *Router) StartPrefetching() {
+	if r.prefetch != nil {
+		r.prefetch.start()
+	}
+}
+
+// StopPrefetching stops background refreshes and waits for running ones to finish.
+func (r *Router) StopPrefetching() {
+	if r.prefetch != nil {
+		r.prefetch.shutdown()
+	}
+}
+
+// Rules returns the rules in evaluation order.
+func (r *Router) Rules() []Rule {
+	rules := make([]Rule, len(r.rules))
+	copy(rules, r.rules)
+	return rules
 }
 
 // GetRequestMatcher returns the request matcher.
@@ -0,0 +1,105 @@
+package resolver
+
+import (
+	"github.com/steigr/nameserver-switcher/internal/matcher"
+)
+
+// Names of the rules built from the legacy router settings.
+const (
+	RuleDefault     = "default"
+	RulePassthrough = "passthrough"
+)
+
+// Rule routes the requests whose name matches RequestMatcher.
+//
+// Without a ProbeResolver the request is answered by TargetResolver. Otherwise the
+// request is first sent to ProbeResolver: if the answer has a CNAME matching
+// CNAMEMatcher the request is answered by TargetResolver (the probe resolver when
+// unset), if it has a non-matching CNAME by NoCnameMatchResolver, and if it has no
+// CNAME (or CNAMEMatcher is nil) by NoCnameResponseResolver. When that resolver is
+// the probe resolver and the probe answer is final, the probe answer is returned.
+type Rule struct {
+	// Name identifies the rule in results and logs.
+	Name string
+	// RequestMatcher selects the requests handled by the rule; nil matches every request.
+	RequestMatcher matcher.Matcher
+	// CNAMEMatcher selects the probed CNAMEs that are sent to TargetResolver.
+	CNAMEMatcher            matcher.Matcher
+	ProbeResolver           Resolver
+	TargetResolver          Resolver
+	NoCnameResponseResolver Resolver
+	NoCnameMatchResolver    Resolver
+	// FailurePolicies maps route names (RouteExplicit, RoutePassthrough, ...) to failure policies.
+	// RouteExplicit covers the probe and the target after a CNAME match, RoutePassthrough
+	// the target of a rule without probe.
+	FailurePolicies map[string]FailurePolicy
+}
+
+// DefaultRules builds the rules equivalent to the legacy resolver fields of cfg:
+// requests matching RequestMatcher are probed at ProbeResolver (ExplicitResolver
+// when unset), all other requests go to PassthroughResolver.
+func DefaultRules(cfg RouterConfig) []Rule {
+	// Support backward compatibility: if new resolvers are not set, use SystemResolver
+	passthroughResolver := cfg.PassthroughResolver
+	if passthroughResolver == nil {
+		passthroughResolver = cfg.SystemResolver
+	}
+	noCnameResponseResolver := cfg.NoCnameResponseResolver
+	if noCnameResponseResolver == nil {
+		noCnameResponseResolver = cfg.SystemResolver
+	}
+	noCnameMatchResolver := cfg.NoCnameMatchResolver
+	if noCnameMatchResolver == nil {
+		noCnameMatchResolver = cfg.SystemResolver
+	}
+
+	probeResolver := cfg.ProbeResolver
+	if probeResolver == nil || cfg.ExplicitResolver == nil {
+		probeResolver = cfg.ExplicitResolver
+	}
+
+	var rules []Rule
+	if cfg.RequestMatcher != nil {
+		rules = append(rules, Rule{
+			Name:                    RuleDefault,
+			RequestMatcher:          cfg.RequestMatcher,
+			CNAMEMatcher:            cfg.CNAMEMatcher,
+			ProbeResolver:           probeResolver,
+			TargetResolver:          cfg.ExplicitResolver,
+			NoCnameResponseResolver: noCnameResponseResolver,
+			NoCnameMatchResolver:    noCnameMatchResolver,
+			FailurePolicies:         cfg.FailurePolicies,
+		})
+	}
+	if passthroughResolver != nil {
+		rules = append(rules, Rule{
+			Name:            RulePassthrough,
+			TargetResolver:  passthroughResolver,
+			FailurePolicies: cfg.FailurePolicies,
+		})
+	}
+	return rules
+}
+
+// matches reports whether the rule handles requests for qname.
+func (r *Rule) matches(qname string) bool {
+	return r.RequestMatcher == nil || r.RequestMatcher.Match(qname)
+}
+
+// target returns the resolver answering requests whose CNAME matched.
+func (r *Rule) target() Resolver {
+	if r.TargetResolver != nil {
+		return r.TargetResolver
+	}
+	return r.ProbeResolver
+}
+
+// usesStale reports whether any route of the rule serves stale answers.
+func (r *Rule) usesStale() bool {
+	for _, policy := range r.FailurePolicies {
+		if policy.Action == FailureActionStale {
+			return true
+		}
+	}
+	return false
+}
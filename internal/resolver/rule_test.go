@@ -0,0 +1,221 @@
+package resolver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCNAMEResponse(name, target string) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetQuestion(name, dns.TypeA)
+	resp.Response = true
+	resp.Answer = []dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+		Target: target,
+	}}
+	return resp
+}
+
+func TestRouter_Route_Rules(t *testing.T) {
+	corp := &MockResolver{name: "corp", response: newAResponse("www.corp.example.", "10.0.0.1")}
+	partner := &MockResolver{name: "partner", response: newAResponse("www.partner.example.", "10.1.0.1")}
+	passthrough := &MockResolver{name: "passthrough", response: newAResponse("example.org.", "192.0.2.1")}
+
+	router := NewRouter(RouterConfig{
+		Rules: []Rule{
+			{
+				Name:           "corp",
+				RequestMatcher: &MockMatcher{matches: map[string]string{"www.corp.example": `.*\.corp\.example$`}},
+				TargetResolver: corp,
+			},
+			{
+				Name:           "partner",
+				RequestMatcher: &MockMatcher{matches: map[string]string{"www.partner.example": `.*\.partner\.example$`}},
+				TargetResolver: partner,
+			},
+		},
+		PassthroughResolver: passthrough,
+	})
+
+	tests := []struct {
+		qname          string
+		rule           string
+		resolver       string
+		requestMatched bool
+		pattern        string
+	}{
+		{"www.corp.example.", "corp", "corp", true, `.*\.corp\.example$`},
+		{"www.partner.example.", "partner", "partner", true, `.*\.partner\.example$`},
+		{"example.org.", RulePassthrough, "passthrough", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.qname, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tt.qname, dns.TypeA)
+
+			result, err := router.Route(context.Background(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.rule, result.Rule)
+			assert.Equal(t, tt.resolver, result.ResolverUsed)
+			assert.Equal(t, tt.requestMatched, result.RequestMatched)
+			assert.Equal(t, tt.pattern, result.MatchedPattern)
+		})
+	}
+}
+
+func TestRouter_Route_RulesFirstMatchWins(t *testing.T) {
+	matcher := &MockMatcher{matches: map[string]string{"www.corp.example": "corp"}}
+	router := NewRouter(RouterConfig{
+		Rules: []Rule{
+			{Name: "first", RequestMatcher: matcher, TargetResolver: &MockResolver{name: "first", response: newAResponse("www.corp.example.", "10.0.0.1")}},
+			{Name: "second", RequestMatcher: matcher, TargetResolver: &MockResolver{name: "second", response: newAResponse("www.corp.example.", "10.0.0.2")}},
+		},
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.corp.example.", dns.TypeA)
+
+	result, err := router.Route(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, "first", result.Rule)
+	assert.Equal(t, "first", result.ResolverUsed)
+}
+
+func TestRouter_Route_RuleProbe(t *testing.T) {
+	probeResp := newCNAMEResponse("www.corp.example.", "www.corp.cdn.")
+	rule := Rule{
+		Name:                    "corp",
+		RequestMatcher:          &MockMatcher{matches: map[string]string{"www.corp.example": "corp"}},
+		CNAMEMatcher:            &MockMatcher{matches: map[string]string{"www.corp.cdn": "cdn"}},
+		ProbeResolver:           &MockResolver{name: "probe", response: probeResp},
+		TargetResolver:          &MockResolver{name: "target", response: newAResponse("www.corp.example.", "10.0.0.1")},
+		NoCnameResponseResolver: &MockResolver{name: "no-cname-response", response: newAResponse("www.corp.example.", "10.0.0.2")},
+		NoCnameMatchResolver:    &MockResolver{name: "no-cname-match", response: newAResponse("www.corp.example.", "10.0.0.3")},
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.corp.example.", dns.TypeA)
+
+	t.Run("CNAMEMatch", func(t *testing.T) {
+		router := NewRouter(RouterConfig{Rules: []Rule{rule}})
+
+		result, err := router.Route(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, "target", result.ResolverUsed)
+		assert.True(t, result.CNAMEMatched)
+		assert.Equal(t, "cdn", result.CNAMEPattern)
+	})
+
+	t.Run("CNAMEMatchWithoutTarget", func(t *testing.T) {
+		noTarget := rule
+		noTarget.TargetResolver = nil
+		router := NewRouter(RouterConfig{Rules: []Rule{noTarget}})
+
+		result, err := router.Route(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, "probe", result.ResolverUsed)
+		assert.True(t, result.CNAMEMatched)
+	})
+
+	t.Run("CNAMENoMatch", func(t *testing.T) {
+		noMatch := rule
+		noMatch.CNAMEMatcher = &MockMatcher{matches: map[string]string{}}
+		router := NewRouter(RouterConfig{Rules: []Rule{noMatch}})
+
+		result, err := router.Route(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, "no-cname-match", result.ResolverUsed)
+		assert.False(t, result.CNAMEMatched)
+	})
+
+	t.Run("NoCNAME", func(t *testing.T) {
+		noCNAME := rule
+		noCNAME.ProbeResolver = &MockResolver{name: "probe", response: newAResponse("www.corp.example.", "10.0.0.9")}
+		router := NewRouter(RouterConfig{Rules: []Rule{noCNAME}})
+
+		result, err := router.Route(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, "no-cname-response", result.ResolverUsed)
+	})
+}
+
+func TestRouter_Route_RuleFailurePolicy(t *testing.T) {
+	backup := &MockResolver{name: "backup", response: newAResponse("www.corp.example.", "10.0.0.2")}
+	router := NewRouter(RouterConfig{
+		Rules: []Rule{{
+			Name:           "corp",
+			RequestMatcher: &MockMatcher{matches: map[string]string{"www.corp.example": "corp"}},
+			TargetResolver: &MockResolver{name: "corp", err: assert.AnError},
+			FailurePolicies: map[string]FailurePolicy{
+				RoutePassthrough: {Action: FailureActionFallback, Fallback: backup},
+			},
+		}},
+		// The legacy policies do not apply to custom rules
+		PassthroughResolver: &MockResolver{name: "passthrough", err: assert.AnError},
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.corp.example.", dns.TypeA)
+
+	result, err := router.Route(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, "backup", result.ResolverUsed)
+	assert.True(t, result.Fallback)
+
+	req.SetQuestion("example.org.", dns.TypeA)
+	_, err = router.Route(context.Background(), req)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "passthrough resolver failed")
+}
+
+func TestDefaultRules(t *testing.T) {
+	requestMatcher := &MockMatcher{matches: map[string]string{"example.com": "pattern"}}
+	explicit := &MockResolver{name: "explicit"}
+	system := &MockResolver{name: "system"}
+
+	t.Run("Legacy", func(t *testing.T) {
+		rules := DefaultRules(RouterConfig{
+			RequestMatcher:   requestMatcher,
+			ExplicitResolver: explicit,
+			SystemResolver:   system,
+		})
+
+		require.Len(t, rules, 2)
+		assert.Equal(t, RuleDefault, rules[0].Name)
+		assert.Equal(t, explicit, rules[0].ProbeResolver)
+		assert.Equal(t, explicit, rules[0].TargetResolver)
+		assert.Equal(t, system, rules[0].NoCnameResponseResolver)
+		assert.Equal(t, system, rules[0].NoCnameMatchResolver)
+		assert.Equal(t, RulePassthrough, rules[1].Name)
+		assert.Nil(t, rules[1].RequestMatcher)
+		assert.Equal(t, system, rules[1].TargetResolver)
+	})
+
+	t.Run("NoRequestMatcher", func(t *testing.T) {
+		rules := DefaultRules(RouterConfig{ExplicitResolver: explicit, PassthroughResolver: system})
+
+		require.Len(t, rules, 1)
+		assert.Equal(t, RulePassthrough, rules[0].Name)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.Empty(t, DefaultRules(RouterConfig{}))
+	})
+}
+
+func TestRouter_Rules(t *testing.T) {
+	router := NewRouter(RouterConfig{
+		Rules:               []Rule{{Name: "corp", TargetResolver: &MockResolver{name: "corp"}}},
+		PassthroughResolver: &MockResolver{name: "passthrough"},
+	})
+
+	rules := router.Rules()
+	require.Len(t, rules, 2)
+	assert.Equal(t, "corp", rules[0].Name)
+	assert.Equal(t, RulePassthrough, rules[1].Name)
+}
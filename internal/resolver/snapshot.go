@@ -0,0 +1,236 @@
+package resolver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/steigr/nameserver-switcher/internal/cache"
+	"github.com/steigr/nameserver-switcher/internal/matcher"
+)
+
+// snapshotVersion is the version of the snapshot format. Snapshots of other versions are ignored.
+const snapshotVersion = 1
+
+// snapshot holds cached answers and routing decisions across restarts. Fingerprint
+// identifies the rules the routing outcomes were computed with.
+type snapshot struct {
+	Version     int                `json:"version"`
+	Fingerprint string             `json:"fingerprint"`
+	Saved       time.Time          `json:"saved"`
+	Answers     []snapshotAnswer   `json:"answers"`
+	Decisions   []snapshotDecision `json:"decisions"`
+}
+
+// snapshotAnswer is a cached response in wire format and how it was routed.
+type snapshotAnswer struct {
+	Name           string    `json:"name"`
+	Qtype          uint16    `json:"qtype"`
+	Qclass         uint16    `json:"qclass"`
+	DO             bool      `json:"do,omitempty"`
+	Rule           string    `json:"rule"`
+	Msg            []byte    `json:"msg"`
+	Stored         time.Time `json:"stored"`
+	Expires        time.Time `json:"expires"`
+	Resolver       string    `json:"resolver"`
+	RequestMatched bool      `json:"request_matched,omitempty"`
+	MatchedPattern string    `json:"matched_pattern,omitempty"`
+	CNAMEMatched   bool      `json:"cname_matched,omitempty"`
+	CNAMEPattern   string    `json:"cname_pattern,omitempty"`
+	CNAMEChain     []string  `json:"cname_chain,omitempty"`
+}
+
+// snapshotDecision is a cached routing decision.
+type snapshotDecision struct {
+	Name         string    `json:"name"`
+	Qclass       uint16    `json:"qclass"`
+	Rule         string    `json:"rule"`
+	Route        string    `json:"route"`
+	CNAMEMatched bool      `json:"cname_matched,omitempty"`
+	CNAMEPattern string    `json:"cname_pattern,omitempty"`
+	CNAMEChain   []string  `json:"cname_chain,omitempty"`
+	Expires      time.Time `json:"expires"`
+}
+
+// SaveSnapshot writes the cached answers and routing decisions to path. The file is
+// replaced atomically so a crash never leaves a partial snapshot behind.
+func (r *Router) SaveSnapshot(path string) error {
+	snap := snapshot{
+		Version:     snapshotVersion,
+		Fingerprint: r.fingerprint(),
+		Saved:       time.Now(),
+	}
+
+	for _, e := range r.cache.Entries() {
+		msg, err := e.Msg.Pack()
+		if err != nil {
+			continue
+		}
+		outcome, ok := e.Meta.(*RouteResult)
+		if !ok {
+			continue
+		}
+		snap.Answers = append(snap.Answers, snapshotAnswer{
+			Name:           e.Key.Name,
+			Qtype:          e.Key.Qtype,
+			Qclass:         e.Key.Qclass,
+			DO:             e.Key.DO,
+			Rule:           outcome.Rule,
+			Msg:            msg,
+			Stored:         e.Stored,
+			Expires:        e.Expires,
+			Resolver:       outcome.ResolverUsed,
+			RequestMatched: outcome.RequestMatched,
+			MatchedPattern: outcome.MatchedPattern,
+			CNAMEMatched:   outcome.CNAMEMatched,
+			CNAMEPattern:   outcome.CNAMEPattern,
+			CNAMEChain:     outcome.CNAMEChain,
+		})
+	}
+
+	for _, d := range r.decisions.all() {
+		snap.Decisions = append(snap.Decisions, snapshotDecision{
+			Name:         d.key.name,
+			Qclass:       d.key.qclass,
+			Rule:         d.rule,
+			Route:        d.route,
+			CNAMEMatched: d.cnameMatched,
+			CNAMEPattern: d.cnamePattern,
+			CNAMEChain:   d.cnameChain,
+			Expires:      d.expires,
+		})
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if err := json.NewEncoder(tmp).Encode(snap); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// LoadSnapshot restores the cached answers and routing decisions saved to path and
+// returns the number of answers restored. Expired entries are skipped and the TTLs
+// of the others account for the time since they were cached. A missing snapshot is
+// not an error; a corrupt snapshot, one of another version or one taken with other
+// rules is rejected as a whole.
+func (r *Router) LoadSnapshot(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	return r.loadSnapshot(f)
+}
+
+// loadSnapshot restores a snapshot read from rd.
+func (r *Router) loadSnapshot(rd io.Reader) (int, error) {
+	var snap snapshot
+	if err := json.NewDecoder(rd).Decode(&snap); err != nil {
+		return 0, fmt.Errorf("corrupt snapshot: %w", err)
+	}
+	if snap.Version != snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+	if snap.Fingerprint != r.fingerprint() {
+		return 0, fmt.Errorf("snapshot was taken with different routing rules")
+	}
+
+	// Decode everything before restoring anything
+	generation := patternGeneration(r.rules)
+	entries := make([]cache.Entry, 0, len(snap.Answers))
+	for _, a := range snap.Answers {
+		msg := new(dns.Msg)
+		if err := msg.Unpack(a.Msg); err != nil {
+			return 0, fmt.Errorf("corrupt snapshot answer for %s: %w", a.Name, err)
+		}
+		entries = append(entries, cache.Entry{
+			Key: cache.Key{
+				Name:   a.Name,
+				Qtype:  a.Qtype,
+				Qclass: a.Qclass,
+				DO:     a.DO,
+				Route:  a.Rule + "@" + strconv.FormatUint(generation, 10),
+			},
+			Msg: msg,
+			Meta: &RouteResult{
+				Rule:           a.Rule,
+				ResolverUsed:   a.Resolver,
+				RequestMatched: a.RequestMatched,
+				MatchedPattern: a.MatchedPattern,
+				CNAMEMatched:   a.CNAMEMatched,
+				CNAMEPattern:   a.CNAMEPattern,
+				CNAMEChain:     a.CNAMEChain,
+			},
+			Stored:  a.Stored,
+			Expires: a.Expires,
+		})
+	}
+
+	for _, e := range entries {
+		r.cache.Restore(e)
+	}
+	for _, d := range snap.Decisions {
+		r.decisions.restore(&decision{
+			key:          decisionKey{name: d.Name, qclass: d.Qclass},
+			rule:         d.Rule,
+			route:        d.Route,
+			cnameMatched: d.CNAMEMatched,
+			cnamePattern: d.CNAMEPattern,
+			cnameChain:   d.CNAMEChain,
+			generation:   generation,
+			expires:      d.Expires,
+		})
+	}
+	return len(entries), nil
+}
+
+// fingerprint identifies the rules by their names, patterns and resolvers.
+func (r *Router) fingerprint() string {
+	patterns := func(m matcher.Matcher) string {
+		if m == nil {
+			return ""
+		}
+		return strings.Join(m.Patterns(), "\x00")
+	}
+	name := func(res Resolver) string {
+		if res == nil {
+			return ""
+		}
+		return res.Name()
+	}
+
+	h := sha256.New()
+	for _, rule := range r.rules {
+		fmt.Fprintf(h, "%s\n%s\n%s\n%s\n%s\n%s\n%s\n", rule.Name,
+			patterns(rule.RequestMatcher), patterns(rule.CNAMEMatcher),
+			name(rule.ProbeResolver), name(rule.TargetResolver),
+			name(rule.NoCnameResponseResolver), name(rule.NoCnameMatchResolver))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,149 @@
+package resolver
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouter_Snapshot_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+
+	explicit := &recordingResolver{name: "explicit", answer: completeChain()}
+	router := newTestRouter(explicit, &recordingResolver{name: "system"}, withCaches)
+	routeProbe(t, router, "www.example.com.")
+	require.NoError(t, router.SaveSnapshot(path))
+
+	// A restarted router answers from the snapshot without querying upstreams
+	restartedExplicit := &recordingResolver{name: "explicit", answer: completeChain()}
+	restarted := newTestRouter(restartedExplicit, &recordingResolver{name: "system"}, withCaches)
+	n, err := restarted.LoadSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 1, restarted.decisions.size())
+
+	result := routeProbe(t, restarted, "www.example.com.")
+	assert.True(t, result.Cached)
+	assert.Equal(t, "explicit", result.ResolverUsed)
+	assert.Equal(t, "default", result.Rule)
+	assert.True(t, result.CNAMEMatched)
+	assert.Equal(t, "cdn", result.CNAMEPattern)
+	assert.Equal(t, []string{"www.cdn.net"}, result.CNAMEChain)
+	assert.Len(t, result.Response.Answer, 2)
+	assert.Equal(t, int32(0), restartedExplicit.queries.Load())
+}
+
+func TestRouter_Snapshot_Missing(t *testing.T) {
+	router := newTestRouter(&recordingResolver{name: "explicit"}, &recordingResolver{name: "system"}, withCaches)
+	n, err := router.LoadSnapshot(filepath.Join(t.TempDir(), "missing.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestRouter_Snapshot_Rejected(t *testing.T) {
+	explicit := &recordingResolver{name: "explicit", answer: completeChain()}
+	router := newTestRouter(explicit, &recordingResolver{name: "system"}, withCaches)
+	routeProbe(t, router, "www.example.com.")
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	require.NoError(t, router.SaveSnapshot(path))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	rewrite := func(t *testing.T, change func(snap *snapshot)) string {
+		var snap snapshot
+		require.NoError(t, json.Unmarshal(data, &snap))
+		change(&snap)
+		out, err := json.Marshal(snap)
+		require.NoError(t, err)
+		p := filepath.Join(t.TempDir(), "snapshot.json")
+		require.NoError(t, os.WriteFile(p, out, 0o600))
+		return p
+	}
+
+	tests := []struct {
+		name string
+		path func(t *testing.T) string
+		err  string
+	}{
+		{
+			name: "truncated",
+			path: func(t *testing.T) string {
+				p := filepath.Join(t.TempDir(), "snapshot.json")
+				require.NoError(t, os.WriteFile(p, data[:len(data)/2], 0o600))
+				return p
+			},
+			err: "corrupt snapshot",
+		},
+		{
+			name: "other version",
+			path: func(t *testing.T) string {
+				return rewrite(t, func(snap *snapshot) { snap.Version = snapshotVersion + 1 })
+			},
+			err: "unsupported snapshot version",
+		},
+		{
+			name: "other rules",
+			path: func(t *testing.T) string {
+				return rewrite(t, func(snap *snapshot) { snap.Fingerprint = "other" })
+			},
+			err: "different routing rules",
+		},
+		{
+			name: "corrupt answer",
+			path: func(t *testing.T) string {
+				return rewrite(t, func(snap *snapshot) { snap.Answers[0].Msg = []byte{1, 2, 3} })
+			},
+			err: "corrupt snapshot answer",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restarted := newTestRouter(&recordingResolver{name: "explicit"}, &recordingResolver{name: "system"}, withCaches)
+			_, err := restarted.LoadSnapshot(tt.path(t))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+			assert.Equal(t, 0, restarted.cache.Len())
+			assert.Equal(t, 0, restarted.decisions.size())
+		})
+	}
+}
+
+func TestRouter_Snapshot_SkipsExpired(t *testing.T) {
+	router := newTestRouter(&recordingResolver{name: "explicit"}, &recordingResolver{name: "system"}, withCaches)
+	msg, err := newAResponse("www.example.com.", "192.0.2.1").Pack()
+	require.NoError(t, err)
+
+	snap := snapshot{
+		Version:     snapshotVersion,
+		Fingerprint: router.fingerprint(),
+		Answers: []snapshotAnswer{{
+			Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET, Rule: RuleDefault, Msg: msg,
+			Stored: time.Now().Add(-time.Hour), Expires: time.Now().Add(-time.Minute),
+		}},
+	}
+	data, err := json.Marshal(snap)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	_, err = router.LoadSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, 0, router.cache.Len())
+}
+
+func TestRouter_Fingerprint(t *testing.T) {
+	a := newTestRouter(&recordingResolver{name: "explicit"}, &recordingResolver{name: "system"}, withCaches)
+	b := newTestRouter(&recordingResolver{name: "explicit"}, &recordingResolver{name: "system"}, withCaches)
+	assert.Equal(t, a.fingerprint(), b.fingerprint())
+
+	c := newTestRouter(&recordingResolver{name: "other"}, &recordingResolver{name: "system"}, withCaches)
+	assert.NotEqual(t, a.fingerprint(), c.fingerprint())
+}
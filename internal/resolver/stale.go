@@ -0,0 +1,301 @@
+package resolver
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultStaleEntries bounds the number of questions kept for serving stale answers.
+	defaultStaleEntries = 10000
+	// staleTTL is the TTL of records in a stale answer (RFC 8767 section 4).
+	staleTTL = 30
+	// maxStaleResolutions bounds the resolutions continuing in the background after a
+	// stale answer.
+	maxStaleResolutions = 256
+	// staleResolveTimeout bounds a resolution continuing in the background.
+	staleResolveTimeout = 10 * time.Second
+)
+
+// staleKey identifies a question.
+type staleKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+// staleEntry is the last good answer for a question, the resolver that gave it and
+// when its TTL runs out.
+type staleEntry struct {
+	key      staleKey
+	msg      *dns.Msg
+	resolver string
+	expires  time.Time
+}
+
+// staleStore keeps the last good answer per question, evicting the least recently used.
+// Answers are dropped once they are more than maxStale past their TTL.
+type staleStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxStale   time.Duration
+	entries    map[staleKey]*list.Element
+	lru        *list.List
+	now        func() time.Time
+}
+
+// newStaleStore creates a store holding up to maxEntries answers for at most maxStale
+// past their TTL (0 keeps them until evicted).
+func newStaleStore(maxEntries int, maxStale time.Duration) *staleStore {
+	if maxEntries <= 0 {
+		maxEntries = defaultStaleEntries
+	}
+	return &staleStore{
+		maxEntries: maxEntries,
+		maxStale:   maxStale,
+		entries:    make(map[staleKey]*list.Element),
+		lru:        list.New(),
+		now:        time.Now,
+	}
+}
+
+// keyFor returns the store key for a request.
+func keyFor(req *dns.Msg) (staleKey, bool) {
+	if len(req.Question) == 0 {
+		return staleKey{}, false
+	}
+	q := req.Question[0]
+	return staleKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}, true
+}
+
+// put stores resp from resolver as the last good answer for req. Only NOERROR and
+// NXDOMAIN answers are kept.
+func (s *staleStore) put(req, resp *dns.Msg, resolver string) {
+	if s == nil || resp == nil {
+		return
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return
+	}
+	key, ok := keyFor(req)
+	if !ok {
+		return
+	}
+
+	entry := &staleEntry{
+		key:      key,
+		msg:      resp.Copy(),
+		resolver: resolver,
+		expires:  s.now().Add(time.Duration(RecordTTL(resp)) * time.Second),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.entries[key]; ok {
+		el.Value = entry
+		s.lru.MoveToFront(el)
+		return
+	}
+
+	s.entries[key] = s.lru.PushFront(entry)
+	for s.lru.Len() > s.maxEntries {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*staleEntry).key)
+	}
+}
+
+// get returns a copy of the last good answer for req with TTLs lowered to staleTTL and
+// the name of the resolver that gave it.
+func (s *staleStore) get(req *dns.Msg) (*dns.Msg, string, bool) {
+	if s == nil {
+		return nil, "", false
+	}
+	key, ok := keyFor(req)
+	if !ok {
+		return nil, "", false
+	}
+
+	s.mu.Lock()
+	el, ok := s.entries[key]
+	if !ok {
+		s.mu.Unlock()
+		return nil, "", false
+	}
+	entry := el.Value.(*staleEntry)
+	if s.maxStale > 0 && s.now().After(entry.expires.Add(s.maxStale)) {
+		s.lru.Remove(el)
+		delete(s.entries, key)
+		s.mu.Unlock()
+		return nil, "", false
+	}
+	s.lru.MoveToFront(el)
+	msg := entry.msg.Copy()
+	s.mu.Unlock()
+
+	msg.Id = req.Id
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > staleTTL {
+				rr.Header().Ttl = staleTTL
+			}
+		}
+	}
+	return msg, entry.resolver, true
+}
+
+// forget drops the answers, for any type and class, for the names match reports
+// true for.
+func (s *staleStore) forget(match func(name string) bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, el := range s.entries {
+		if match(key.name) {
+			s.lru.Remove(el)
+			delete(s.entries, key)
+		}
+	}
+}
+
+// size returns the number of stored answers.
+func (s *staleStore) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// staleFlight is a resolution that may continue in the background after a stale
+// answer, shared by identical queries.
+type staleFlight struct {
+	done   chan struct{}
+	result *RouteResult
+	err    error
+}
+
+// answer returns the result of the flight for req, with a response of its own.
+func (f *staleFlight) answer(req *dns.Msg) *RouteResult {
+	result := *f.result
+	result.Response = f.result.Response.Copy()
+	result.Response.Id = req.Id
+	return &result
+}
+
+// staleFlights bounds and deduplicates the resolutions that may continue in the
+// background after a stale answer.
+type staleFlights struct {
+	slots   chan struct{}
+	mu      sync.Mutex
+	flights map[string]*staleFlight
+}
+
+// newStaleFlights creates room for up to max resolutions.
+func newStaleFlights(max int) *staleFlights {
+	return &staleFlights{
+		slots:   make(chan struct{}, max),
+		flights: make(map[string]*staleFlight),
+	}
+}
+
+// start resolves req in the background, detached from ctx and bounded by
+// staleResolveTimeout, unless an identical resolution is running, and returns the
+// flight to wait for. It returns false when every slot is taken.
+func (s *staleFlights) start(ctx context.Context, req *dns.Msg, resolve func(context.Context) (*RouteResult, error)) (*staleFlight, bool) {
+	key, ok := coalesceKey(req)
+	if !ok {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.flights[key]; ok {
+		return f, true
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		return nil, false
+	}
+
+	f := &staleFlight{done: make(chan struct{})}
+	s.flights[key] = f
+	resolveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), staleResolveTimeout)
+	go func() {
+		defer cancel()
+		f.result, f.err = resolve(resolveCtx)
+
+		s.mu.Lock()
+		delete(s.flights, key)
+		s.mu.Unlock()
+		<-s.slots
+		close(f.done)
+	}()
+	return f, true
+}
+
+// routeStale resolves req and answers with the last good answer for it (RFC 8767) when
+// resolution fails or, with an answer timeout, does not finish in time. Resolution then
+// continues in the background so its answer refreshes the caches; identical queries
+// share it, and when too many are running req is resolved inline for up to the answer
+// timeout instead. base describes the matching rule for stale answers.
+func (r *Router) routeStale(ctx context.Context, req *dns.Msg, base RouteResult, resolve func(context.Context) (*RouteResult, error)) (*RouteResult, error) {
+	msg, resolver, ok := r.stale.get(req)
+	if !ok {
+		return resolve(ctx)
+	}
+	stale := func(reason error) *RouteResult {
+		base.Response = msg
+		base.ResolverUsed = resolver
+		base.Stale = true
+		base.FallbackReason = reason.Error()
+		return &base
+	}
+
+	if r.staleTimeout <= 0 {
+		result, err := resolve(ctx)
+		if err != nil {
+			return stale(err), nil
+		}
+		return result, nil
+	}
+
+	timeout := fmt.Errorf("no answer within %s", r.staleTimeout)
+	f, ok := r.staleFlights.start(ctx, req, resolve)
+	if !ok {
+		inlineCtx, cancel := context.WithTimeout(ctx, r.staleTimeout)
+		defer cancel()
+		result, err := resolve(inlineCtx)
+		if err == nil {
+			return result, nil
+		}
+		if ctx.Err() == nil && inlineCtx.Err() != nil {
+			err = timeout
+		}
+		return stale(err), nil
+	}
+
+	timer := time.NewTimer(r.staleTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+		if f.err != nil {
+			return stale(f.err), nil
+		}
+		return f.answer(req), nil
+	case <-timer.C:
+		return stale(timeout), nil
+	case <-ctx.Done():
+		return stale(ctx.Err()), nil
+	}
+}
@@ -0,0 +1,256 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaleStore_PutGet(t *testing.T) {
+	s := newStaleStore(10, 0)
+
+	req := new(dns.Msg)
+	req.SetQuestion("Example.COM.", dns.TypeA)
+	s.put(req, newAResponse("example.com.", "192.0.2.1"), "upstream")
+
+	lookup := new(dns.Msg)
+	lookup.SetQuestion("example.com.", dns.TypeA)
+	msg, resolver, ok := s.get(lookup)
+	require.True(t, ok)
+	assert.Equal(t, "upstream", resolver)
+	assert.Equal(t, lookup.Id, msg.Id)
+	assert.Equal(t, uint32(staleTTL), msg.Answer[0].Header().Ttl)
+
+	// The stored copy is not affected by changes to returned answers
+	msg.Answer = nil
+	msg, _, ok = s.get(lookup)
+	require.True(t, ok)
+	assert.Len(t, msg.Answer, 1)
+
+	other := new(dns.Msg)
+	other.SetQuestion("example.com.", dns.TypeAAAA)
+	_, _, ok = s.get(other)
+	assert.False(t, ok)
+}
+
+func TestStaleStore_OnlyKeepsGoodAnswers(t *testing.T) {
+	s := newStaleStore(10, 0)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	s.put(req, newRcodeResponse("example.com.", dns.RcodeServerFailure), "upstream")
+	assert.Equal(t, 0, s.size())
+
+	s.put(req, newRcodeResponse("example.com.", dns.RcodeNameError), "upstream")
+	assert.Equal(t, 1, s.size())
+}
+
+func TestStaleStore_EvictsLeastRecentlyUsed(t *testing.T) {
+	s := newStaleStore(2, 0)
+
+	reqFor := func(name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		return req
+	}
+
+	s.put(reqFor("a.example."), newAResponse("a.example.", "192.0.2.1"), "upstream")
+	s.put(reqFor("b.example."), newAResponse("b.example.", "192.0.2.2"), "upstream")
+	_, _, _ = s.get(reqFor("a.example."))
+	s.put(reqFor("c.example."), newAResponse("c.example.", "192.0.2.3"), "upstream")
+
+	assert.Equal(t, 2, s.size())
+	_, _, ok := s.get(reqFor("a.example."))
+	assert.True(t, ok)
+	_, _, ok = s.get(reqFor("b.example."))
+	assert.False(t, ok)
+}
+
+func TestStaleStore_Nil(t *testing.T) {
+	var s *staleStore
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	s.put(req, newAResponse("example.com.", "192.0.2.1"), "upstream")
+	_, _, ok := s.get(req)
+	assert.False(t, ok)
+}
+
+func TestStaleStore_MaxStale(t *testing.T) {
+	s := newStaleStore(10, time.Hour)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp := newAResponse("example.com.", "192.0.2.1")
+	resp.Answer[0].Header().Ttl = 60
+	s.put(req, resp, "upstream")
+
+	// Answers are served up to the max-stale duration past their TTL
+	now = now.Add(time.Hour + 60*time.Second)
+	_, _, ok := s.get(req)
+	assert.True(t, ok)
+
+	now = now.Add(time.Second)
+	_, _, ok = s.get(req)
+	assert.False(t, ok)
+	assert.Equal(t, 0, s.size())
+}
+
+func TestRouter_ServeStale(t *testing.T) {
+	upstream := &MockResolver{name: "passthrough", response: newAResponse("example.com.", "192.0.2.1")}
+	router := NewRouter(RouterConfig{
+		PassthroughResolver: upstream,
+		ServeStale:          true,
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	upstream.err = errors.New("i/o timeout")
+	_, err := router.Route(context.Background(), req)
+	assert.Error(t, err)
+
+	upstream.err = nil
+	result, err := router.Route(context.Background(), req)
+	require.NoError(t, err)
+	assert.False(t, result.Stale)
+
+	upstream.err = errors.New("i/o timeout")
+	result, err = router.Route(context.Background(), req)
+	require.NoError(t, err)
+	assert.True(t, result.Stale)
+	assert.False(t, result.Fallback)
+	assert.Equal(t, RulePassthrough, result.Rule)
+	assert.Equal(t, "passthrough", result.ResolverUsed)
+	assert.Contains(t, result.FallbackReason, "i/o timeout")
+	require.Len(t, result.Response.Answer, 1)
+	assert.Equal(t, uint32(staleTTL), result.Response.Answer[0].Header().Ttl)
+}
+
+func TestRouter_ServeStale_AnswerTimeout(t *testing.T) {
+	release := make(chan struct{})
+	var slow atomic.Bool
+	upstream := &MockResolverWithCallback{
+		name: "passthrough",
+		callback: func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+			if slow.Load() {
+				<-release
+				return newAResponse("example.com.", "192.0.2.2"), nil
+			}
+			return newAResponse("example.com.", "192.0.2.1"), nil
+		},
+	}
+	router := NewRouter(RouterConfig{
+		PassthroughResolver: upstream,
+		ServeStale:          true,
+		StaleAnswerTimeout:  10 * time.Millisecond,
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	_, err := router.Route(context.Background(), req)
+	require.NoError(t, err)
+
+	// A slow upstream is answered stale and refreshes the store in the background
+	slow.Store(true)
+	result, err := router.Route(context.Background(), req)
+	require.NoError(t, err)
+	assert.True(t, result.Stale)
+	assert.Contains(t, result.FallbackReason, "no answer within 10ms")
+	assert.Equal(t, "192.0.2.1", result.Response.Answer[0].(*dns.A).A.String())
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		msg, _, ok := router.stale.get(req)
+		return ok && msg.Answer[0].(*dns.A).A.String() == "192.0.2.2"
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestRouter_ServeStale_BackgroundResolutions(t *testing.T) {
+	release := make(chan struct{})
+	var slow atomic.Bool
+	var calls atomic.Int32
+	upstream := &MockResolverWithCallback{
+		name: "passthrough",
+		callback: func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+			calls.Add(1)
+			if slow.Load() && req.Question[0].Name != "c.example.com." {
+				select {
+				case <-release:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			return newAResponse(req.Question[0].Name, "192.0.2.1"), nil
+		},
+	}
+	router := NewRouter(RouterConfig{
+		PassthroughResolver: upstream,
+		ServeStale:          true,
+		StaleAnswerTimeout:  10 * time.Millisecond,
+	})
+	router.staleFlights = newStaleFlights(1)
+	defer close(release)
+
+	route := func(qname string) *RouteResult {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+		result, err := router.Route(context.Background(), req)
+		require.NoError(t, err)
+		return result
+	}
+	route("a.example.com.")
+	route("b.example.com.")
+	route("c.example.com.")
+	require.Equal(t, int32(3), calls.Load())
+
+	// Identical queries share the resolution continuing in the background
+	slow.Store(true)
+	for i := 0; i < 3; i++ {
+		result := route("a.example.com.")
+		assert.True(t, result.Stale)
+		assert.Contains(t, result.FallbackReason, "no answer within")
+	}
+	assert.Equal(t, int32(4), calls.Load())
+
+	// and once every slot is taken, other queries are resolved inline: answered stale
+	// only when the upstream does not answer in time
+	result := route("b.example.com.")
+	assert.True(t, result.Stale)
+	assert.Contains(t, result.FallbackReason, "no answer within")
+	assert.Equal(t, int32(5), calls.Load())
+
+	result = route("c.example.com.")
+	assert.False(t, result.Stale)
+	assert.Equal(t, int32(6), calls.Load())
+}
+
+func TestRouter_ServeStale_MaxAge(t *testing.T) {
+	upstream := &MockResolver{name: "passthrough", response: newAResponse("example.com.", "192.0.2.1")}
+	router := NewRouter(RouterConfig{
+		PassthroughResolver: upstream,
+		ServeStale:          true,
+		StaleMaxAge:         time.Minute,
+	})
+	now := time.Now()
+	router.stale.now = func() time.Time { return now }
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	_, err := router.Route(context.Background(), req)
+	require.NoError(t, err)
+
+	upstream.err = errors.New("i/o timeout")
+	now = now.Add(time.Hour)
+	_, err = router.Route(context.Background(), req)
+	assert.Error(t, err)
+}
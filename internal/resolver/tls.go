@@ -0,0 +1,59 @@
+package resolver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSOptions configures TLS for encrypted upstream transports.
+type TLSOptions struct {
+	// ServerName overrides the name used for SNI and certificate verification of
+	// upstreams given by IP address. Defaults to the host part of the upstream address.
+	ServerName string
+	// CAFile is a PEM bundle used instead of the system roots.
+	CAFile string
+	// CertFile is an optional client certificate presented to the upstream.
+	CertFile string
+	// KeyFile is the private key for CertFile.
+	KeyFile string
+}
+
+// sessionCacheSize is the number of TLS sessions kept per upstream for resumption.
+const sessionCacheSize = 64
+
+// ClientConfig builds a tls.Config for connecting to the given upstream host.
+func (o TLSOptions) ClientConfig(host string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         o.ServerName,
+		ClientSessionCache: tls.NewLRUClientSessionCache(sessionCacheSize),
+	}
+
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", o.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
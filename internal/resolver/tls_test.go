@@ -0,0 +1,199 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/testhelper"
+)
+
+// startTLSDNSServer starts an in-process DNS-over-TLS server answering A queries with 192.0.2.1.
+// It returns the listen address and a counter of resumed TLS sessions.
+func startTLSDNSServer(t *testing.T, cfg *tls.Config) (string, *int64) {
+	t.Helper()
+
+	var resumed int64
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if cs.DidResume {
+			atomic.AddInt64(&resumed, 1)
+		}
+		return nil
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	require.NoError(t, err)
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:          ln,
+		Net:               "tcp-tls",
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.1").To4(),
+			})
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	return ln.Addr().String(), &resumed
+}
+
+func TestTLSOptions_ClientConfig(t *testing.T) {
+	pki := testhelper.NewPKI(t)
+
+	t.Run("defaults server name to host", func(t *testing.T) {
+		cfg, err := TLSOptions{}.ClientConfig("dns.example")
+		require.NoError(t, err)
+		assert.Equal(t, "dns.example", cfg.ServerName)
+		assert.NotNil(t, cfg.ClientSessionCache)
+		assert.Nil(t, cfg.RootCAs)
+	})
+
+	t.Run("server name override", func(t *testing.T) {
+		cfg, err := TLSOptions{ServerName: "dns.test"}.ClientConfig("127.0.0.1")
+		require.NoError(t, err)
+		assert.Equal(t, "dns.test", cfg.ServerName)
+	})
+
+	t.Run("CA bundle and client certificate", func(t *testing.T) {
+		cfg, err := TLSOptions{CAFile: pki.CAFile, CertFile: pki.ClientCertFile, KeyFile: pki.ClientKeyFile}.ClientConfig("dns.test")
+		require.NoError(t, err)
+		assert.NotNil(t, cfg.RootCAs)
+		assert.Len(t, cfg.Certificates, 1)
+	})
+
+	t.Run("missing CA file", func(t *testing.T) {
+		_, err := TLSOptions{CAFile: "/nonexistent/ca.pem"}.ClientConfig("dns.test")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to read CA file")
+	})
+
+	t.Run("CA file without certificates", func(t *testing.T) {
+		empty := filepath.Join(t.TempDir(), "empty.pem")
+		require.NoError(t, os.WriteFile(empty, []byte("not a certificate"), 0o600))
+		_, err := TLSOptions{CAFile: empty}.ClientConfig("dns.test")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "no certificates found")
+	})
+
+	t.Run("invalid client certificate", func(t *testing.T) {
+		_, err := TLSOptions{CertFile: pki.CAFile, KeyFile: "/nonexistent/key.pem"}.ClientConfig("dns.test")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to load client certificate")
+	})
+}
+
+func TestDNSOverTLSResolver_Resolve(t *testing.T) {
+	pki := testhelper.NewPKI(t)
+	addr, resumed := startTLSDNSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{pki.ServerCert},
+		MinVersion:   tls.VersionTLS12,
+	})
+
+	r, err := NewUpstreamResolver("tls://"+addr+"?servername=dns.test", true, "explicit", UpstreamOptions{
+		TLS: TLSOptions{CAFile: pki.CAFile},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "explicit", r.Name())
+
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("secure.example.com.", dns.TypeA)
+
+		resp, err := r.Resolve(context.Background(), req)
+		require.NoError(t, err)
+		require.Len(t, resp.Answer, 1)
+		assert.Equal(t, "192.0.2.1", resp.Answer[0].(*dns.A).A.String())
+	}
+
+	// The first handshake is full; later queries should resume the cached session
+	assert.Positive(t, atomic.LoadInt64(resumed))
+}
+
+func TestDNSOverTLSResolver_UntrustedCertificate(t *testing.T) {
+	pki := testhelper.NewPKI(t)
+	addr, _ := startTLSDNSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{pki.ServerCert},
+		MinVersion:   tls.VersionTLS12,
+	})
+
+	// No CA bundle configured, so the test CA is not trusted
+	r, err := NewUpstreamResolver("tls://"+addr, true, "explicit", UpstreamOptions{})
+	require.NoError(t, err)
+
+	req := new(dns.Msg)
+	req.SetQuestion("secure.example.com.", dns.TypeA)
+
+	_, err = r.Resolve(context.Background(), req)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "DNS query failed")
+}
+
+func TestDNSOverTLSResolver_ServerNameMismatch(t *testing.T) {
+	pki := testhelper.NewPKI(t)
+	addr, _ := startTLSDNSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{pki.ServerCert},
+		MinVersion:   tls.VersionTLS12,
+	})
+
+	r, err := NewUpstreamResolver("tls://"+addr, true, "explicit", UpstreamOptions{
+		TLS: TLSOptions{CAFile: pki.CAFile, ServerName: "other.test"},
+	})
+	require.NoError(t, err)
+
+	req := new(dns.Msg)
+	req.SetQuestion("secure.example.com.", dns.TypeA)
+
+	_, err = r.Resolve(context.Background(), req)
+	assert.Error(t, err)
+}
+
+func TestDNSOverTLSResolver_ClientCertificate(t *testing.T) {
+	pki := testhelper.NewPKI(t)
+	addr, _ := startTLSDNSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{pki.ServerCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pki.CAPool,
+		MinVersion:   tls.VersionTLS12,
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("secure.example.com.", dns.TypeA)
+
+	t.Run("with client certificate", func(t *testing.T) {
+		r, err := NewUpstreamResolver("tls://"+addr, true, "explicit", UpstreamOptions{
+			TLS: TLSOptions{ServerName: "dns.test", CAFile: pki.CAFile, CertFile: pki.ClientCertFile, KeyFile: pki.ClientKeyFile},
+		})
+		require.NoError(t, err)
+
+		resp, err := r.Resolve(context.Background(), req)
+		require.NoError(t, err)
+		assert.Len(t, resp.Answer, 1)
+	})
+
+	t.Run("without client certificate", func(t *testing.T) {
+		r, err := NewUpstreamResolver("tls://"+addr, true, "explicit", UpstreamOptions{
+			TLS: TLSOptions{ServerName: "dns.test", CAFile: pki.CAFile},
+		})
+		require.NoError(t, err)
+
+		_, err = r.Resolve(context.Background(), req)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,108 @@
+package resolver
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+)
+
+// defaultUpstreamTimeout is used when UpstreamOptions.Timeout is not set.
+const defaultUpstreamTimeout = 5 * time.Second
+
+// UpstreamOptions holds transport settings shared by all upstream resolvers.
+type UpstreamOptions struct {
+	// TLS configures encrypted transports (tls:// and https://).
+	TLS TLSOptions
+	// Timeout bounds a single upstream exchange (default 5s).
+	Timeout time.Duration
+	// DoHMethod selects the HTTP method for https:// resolvers: "POST" (default) or "GET".
+	DoHMethod string
+	// UDPSize is the EDNS0 UDP buffer size advertised to plain DNS upstreams (0 disables EDNS0).
+	UDPSize uint16
+	// Metrics, when set, counts truncated UDP responses retried over TCP.
+	Metrics *metrics.Metrics
+	// Breaker configures circuit breaking for pools built by NewUpstreamPool.
+	Breaker BreakerConfig
+	// ProbeInterval enables background health probes for pools built by NewUpstreamPool.
+	ProbeInterval time.Duration
+}
+
+// NewUpstreamResolver creates a resolver for an upstream address.
+// Supported forms:
+//   - host[:port] or udp://host[:port] - plain DNS (port 53), retried over TCP when truncated
+//   - tcp://host[:port] - plain DNS over TCP only (port 53)
+//   - tls://host[:port][?servername=name] - DNS-over-TLS (port 853)
+//   - https://host[:port]/path - DNS-over-HTTPS (RFC 8484)
+func NewUpstreamResolver(address string, recursive bool, name string, opts UpstreamOptions) (Resolver, error) {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultUpstreamTimeout
+	}
+
+	if !strings.Contains(address, "://") {
+		return newPlainResolver(address, "udp", recursive, name, timeout, opts), nil
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resolver address %q: %w", address, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid resolver address %q: missing host", address)
+	}
+
+	switch u.Scheme {
+	case "udp", "dns":
+		return newPlainResolver(u.Host, "udp", recursive, name, timeout, opts), nil
+	case "tcp":
+		return newPlainResolver(u.Host, "tcp", recursive, name, timeout, opts), nil
+	case "tls":
+		tlsOpts := upstreamTLSOptions(u, opts.TLS)
+		if serverName := u.Query().Get("servername"); serverName != "" {
+			tlsOpts.ServerName = serverName
+		}
+		tlsConfig, err := tlsOpts.ClientConfig(u.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS settings for %q: %w", address, err)
+		}
+		r := NewDNSOverTLSResolver(u.Host, recursive, name, tlsConfig)
+		r.client.Timeout = timeout
+		return r, nil
+	case "https":
+		tlsConfig, err := upstreamTLSOptions(u, opts.TLS).ClientConfig(u.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS settings for %q: %w", address, err)
+		}
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		method := strings.ToUpper(opts.DoHMethod)
+		return NewDoHResolver(u.String(), recursive, name, method, newDoHClient(tlsConfig, timeout)), nil
+	default:
+		return nil, fmt.Errorf("unsupported resolver scheme %q in %q", u.Scheme, address)
+	}
+}
+
+// upstreamTLSOptions returns the TLS options for the upstream at u. The shared server
+// name only applies to upstreams given by IP address; named upstreams are verified
+// against their own host name.
+func upstreamTLSOptions(u *url.URL, opts TLSOptions) TLSOptions {
+	if _, err := netip.ParseAddr(u.Hostname()); err != nil {
+		opts.ServerName = ""
+	}
+	return opts
+}
+
+// newPlainResolver creates an unencrypted DNS resolver on the given network.
+func newPlainResolver(server, network string, recursive bool, name string, timeout time.Duration, opts UpstreamOptions) *DNSResolver {
+	r := NewDNSResolver(server, recursive, name)
+	r.client.Net = network
+	r.client.Timeout = timeout
+	r.SetUDPSize(opts.UDPSize)
+	r.SetMetrics(opts.Metrics)
+	return r
+}
@@ -0,0 +1,177 @@
+package resolver
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewUpstreamResolver(t *testing.T) {
+	tests := []struct {
+		name           string
+		address        string
+		expectedServer string
+		expectedNet    string
+	}{
+		{
+			name:           "bare host",
+			address:        "8.8.8.8",
+			expectedServer: "8.8.8.8:53",
+			expectedNet:    "udp",
+		},
+		{
+			name:           "host with port",
+			address:        "8.8.8.8:5353",
+			expectedServer: "8.8.8.8:5353",
+			expectedNet:    "udp",
+		},
+		{
+			name:           "udp scheme",
+			address:        "udp://1.1.1.1",
+			expectedServer: "1.1.1.1:53",
+			expectedNet:    "udp",
+		},
+		{
+			name:           "dns scheme",
+			address:        "dns://1.1.1.1:53",
+			expectedServer: "1.1.1.1:53",
+			expectedNet:    "udp",
+		},
+		{
+			name:           "tls default port",
+			address:        "tls://1.1.1.1",
+			expectedServer: "1.1.1.1:853",
+			expectedNet:    "tcp-tls",
+		},
+		{
+			name:           "tls with port and server name",
+			address:        "tls://1.1.1.1:8853?servername=cloudflare-dns.com",
+			expectedServer: "1.1.1.1:8853",
+			expectedNet:    "tcp-tls",
+		},
+		{
+			name:           "tls IPv6 default port",
+			address:        "tls://[2606:4700:4700::1111]",
+			expectedServer: "[2606:4700:4700::1111]:853",
+			expectedNet:    "tcp-tls",
+		},
+		{
+			name:           "tls IPv6 with port",
+			address:        "tls://[2606:4700:4700::1111]:8853",
+			expectedServer: "[2606:4700:4700::1111]:8853",
+			expectedNet:    "tcp-tls",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewUpstreamResolver(tt.address, true, "test", UpstreamOptions{})
+			require.NoError(t, err)
+
+			dnsResolver, ok := r.(*DNSResolver)
+			require.True(t, ok)
+			assert.Equal(t, tt.expectedServer, dnsResolver.Server())
+			assert.Equal(t, tt.expectedNet, dnsResolver.client.Net)
+			assert.Equal(t, "test", dnsResolver.Name())
+		})
+	}
+}
+
+func TestNewUpstreamResolver_TLSServerName(t *testing.T) {
+	r, err := NewUpstreamResolver("tls://1.1.1.1?servername=cloudflare-dns.com", true, "test", UpstreamOptions{
+		TLS: TLSOptions{ServerName: "ignored.example"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "cloudflare-dns.com", r.(*DNSResolver).client.TLSConfig.ServerName)
+
+	r, err = NewUpstreamResolver("tls://1.1.1.1", true, "test", UpstreamOptions{
+		TLS: TLSOptions{ServerName: "one.one.one.one"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "one.one.one.one", r.(*DNSResolver).client.TLSConfig.ServerName)
+
+	r, err = NewUpstreamResolver("tls://dns.example:853", true, "test", UpstreamOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "dns.example", r.(*DNSResolver).client.TLSConfig.ServerName)
+
+	// The shared server name does not override the host name of named upstreams
+	r, err = NewUpstreamResolver("tls://dns.example:853", true, "test", UpstreamOptions{
+		TLS: TLSOptions{ServerName: "one.one.one.one"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "dns.example", r.(*DNSResolver).client.TLSConfig.ServerName)
+
+	r, err = NewUpstreamResolver("https://dns.example/dns-query", true, "test", UpstreamOptions{
+		TLS: TLSOptions{ServerName: "one.one.one.one"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "dns.example", r.(*DoHResolver).client.Transport.(*http.Transport).TLSClientConfig.ServerName)
+
+	r, err = NewUpstreamResolver("https://[2606:4700:4700::1111]/dns-query", true, "test", UpstreamOptions{
+		TLS: TLSOptions{ServerName: "one.one.one.one"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "one.one.one.one", r.(*DoHResolver).client.Transport.(*http.Transport).TLSClientConfig.ServerName)
+}
+
+func TestNewUpstreamResolver_Errors(t *testing.T) {
+	tests := []struct {
+		name        string
+		address     string
+		opts        UpstreamOptions
+		errContains string
+	}{
+		{
+			name:        "unsupported scheme",
+			address:     "quic://1.1.1.1",
+			errContains: "unsupported resolver scheme",
+		},
+		{
+			name:        "bad CA file for DoH",
+			address:     "https://dns.example/dns-query",
+			opts:        UpstreamOptions{TLS: TLSOptions{CAFile: "/nonexistent/ca.pem"}},
+			errContains: "invalid TLS settings",
+		},
+		{
+			name:        "missing host",
+			address:     "tls://",
+			errContains: "missing host",
+		},
+		{
+			name:        "malformed URL",
+			address:     "tls://[::1",
+			errContains: "invalid resolver address",
+		},
+		{
+			name:        "bad CA file",
+			address:     "tls://1.1.1.1",
+			opts:        UpstreamOptions{TLS: TLSOptions{CAFile: "/nonexistent/ca.pem"}},
+			errContains: "invalid TLS settings",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewUpstreamResolver(tt.address, true, "test", tt.opts)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errContains)
+		})
+	}
+}
+
+func TestNewUpstreamResolver_Timeout(t *testing.T) {
+	r, err := NewUpstreamResolver("8.8.8.8", true, "test", UpstreamOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, r.(*DNSResolver).client.Timeout)
+
+	r, err = NewUpstreamResolver("tls://8.8.8.8", true, "test", UpstreamOptions{Timeout: 2 * time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Second, r.(*DNSResolver).client.Timeout)
+
+	r, err = NewUpstreamResolver("https://dns.google/dns-query", true, "test", UpstreamOptions{Timeout: 3 * time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, 3*time.Second, r.(*DoHResolver).client.Timeout)
+}
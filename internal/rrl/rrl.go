@@ -0,0 +1,281 @@
+// Package rrl provides response rate limiting (RRL) for the UDP DNS listener.
+package rrl
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/steigr/nameserver-switcher/internal/acl"
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+)
+
+const (
+	// defaultIPv4PrefixLen groups IPv4 clients into /24 networks.
+	defaultIPv4PrefixLen = 24
+	// defaultIPv6PrefixLen groups IPv6 clients into /56 networks.
+	defaultIPv6PrefixLen = 56
+	// defaultMaxBuckets bounds the number of tracked client prefixes and classes.
+	defaultMaxBuckets = 100000
+)
+
+// Class is the kind of a response; each class has its own bucket per client prefix.
+type Class string
+
+const (
+	// ClassResponse is a response with answers.
+	ClassResponse Class = "response"
+	// ClassNoData is a NOERROR response without answers.
+	ClassNoData Class = "nodata"
+	// ClassNXDomain is an NXDOMAIN response.
+	ClassNXDomain Class = "nxdomain"
+	// ClassError is any other response code, such as SERVFAIL or REFUSED.
+	ClassError Class = "error"
+)
+
+// Classify returns the class of a response.
+func Classify(resp *dns.Msg) Class {
+	switch {
+	case resp.Rcode == dns.RcodeNameError:
+		return ClassNXDomain
+	case resp.Rcode != dns.RcodeSuccess:
+		return ClassError
+	case len(resp.Answer) == 0:
+		return ClassNoData
+	default:
+		return ClassResponse
+	}
+}
+
+// Action is what to do with a response.
+type Action int
+
+const (
+	// Send sends the response.
+	Send Action = iota
+	// Slip sends a truncated empty response instead, so genuine clients retry over TCP.
+	Slip
+	// Drop sends nothing.
+	Drop
+)
+
+// String returns the name of the action.
+func (a Action) String() string {
+	switch a {
+	case Slip:
+		return "slip"
+	case Drop:
+		return "drop"
+	default:
+		return "send"
+	}
+}
+
+// Config holds configuration for a Limiter.
+type Config struct {
+	// ResponsesPerSecond is the rate of responses with answers per client prefix
+	// (0 disables rate limiting).
+	ResponsesPerSecond int
+	// NoDataPerSecond, NXDomainsPerSecond and ErrorsPerSecond are the rates of the other
+	// response classes (0 uses ResponsesPerSecond).
+	NoDataPerSecond    int
+	NXDomainsPerSecond int
+	ErrorsPerSecond    int
+	// IPv4PrefixLen and IPv6PrefixLen group clients into networks sharing a bucket
+	// (default 24 and 56).
+	IPv4PrefixLen int
+	IPv6PrefixLen int
+	// Slip sends every Slip-th limited response truncated instead of dropping it
+	// (0 drops all, 1 slips all).
+	Slip int
+	// Exempt is a comma-separated list of client CIDRs that are never limited.
+	Exempt string
+	// MaxBuckets bounds the number of tracked buckets, evicting the least recently
+	// used (default 100000).
+	MaxBuckets int
+	// Metrics records limited responses.
+	Metrics *metrics.Metrics
+}
+
+// bucketKey identifies the bucket of a client prefix and response class.
+type bucketKey struct {
+	prefix netip.Prefix
+	class  Class
+}
+
+// bucket is a token bucket holding up to one second worth of responses.
+type bucket struct {
+	key     bucketKey
+	tokens  float64
+	last    time.Time
+	limited int
+}
+
+// Limiter limits the rate of responses per client prefix and response class with
+// token buckets.
+type Limiter struct {
+	rates      map[Class]float64
+	ipv4Prefix int
+	ipv6Prefix int
+	slip       int
+	exempt     []netip.Prefix
+	maxBuckets int
+	metrics    *metrics.Metrics
+	now        func() time.Time
+
+	mu      sync.Mutex
+	buckets map[bucketKey]*list.Element
+	lru     *list.List
+}
+
+// New creates a Limiter. It returns nil, which sends every response, when
+// ResponsesPerSecond is not positive.
+func New(cfg Config) (*Limiter, error) {
+	if cfg.ResponsesPerSecond <= 0 {
+		return nil, nil
+	}
+
+	exempt, err := acl.ParsePrefixes(cfg.Exempt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RRL exempt list: %w", err)
+	}
+
+	ipv4Prefix := cfg.IPv4PrefixLen
+	if ipv4Prefix <= 0 {
+		ipv4Prefix = defaultIPv4PrefixLen
+	}
+	ipv6Prefix := cfg.IPv6PrefixLen
+	if ipv6Prefix <= 0 {
+		ipv6Prefix = defaultIPv6PrefixLen
+	}
+	if ipv4Prefix > 32 || ipv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid RRL prefix lengths /%d and /%d", ipv4Prefix, ipv6Prefix)
+	}
+
+	maxBuckets := cfg.MaxBuckets
+	if maxBuckets <= 0 {
+		maxBuckets = defaultMaxBuckets
+	}
+
+	rate := func(perSecond int) float64 {
+		if perSecond <= 0 {
+			return float64(cfg.ResponsesPerSecond)
+		}
+		return float64(perSecond)
+	}
+
+	return &Limiter{
+		rates: map[Class]float64{
+			ClassResponse: float64(cfg.ResponsesPerSecond),
+			ClassNoData:   rate(cfg.NoDataPerSecond),
+			ClassNXDomain: rate(cfg.NXDomainsPerSecond),
+			ClassError:    rate(cfg.ErrorsPerSecond),
+		},
+		ipv4Prefix: ipv4Prefix,
+		ipv6Prefix: ipv6Prefix,
+		slip:       cfg.Slip,
+		exempt:     exempt,
+		maxBuckets: maxBuckets,
+		metrics:    cfg.Metrics,
+		now:        time.Now,
+		buckets:    make(map[bucketKey]*list.Element),
+		lru:        list.New(),
+	}, nil
+}
+
+// Check takes a token for resp from the bucket of the client at addr and returns
+// whether to send, slip or drop the response. A nil Limiter sends every response.
+func (l *Limiter) Check(addr net.Addr, resp *dns.Msg) Action {
+	if l == nil {
+		return Send
+	}
+	prefix, ok := l.clientPrefix(addr)
+	if !ok {
+		return Send
+	}
+	class := Classify(resp)
+	key := bucketKey{prefix: prefix, class: class}
+	now := l.now()
+
+	l.mu.Lock()
+	var b *bucket
+	if el, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(el)
+		b = el.Value.(*bucket)
+	} else {
+		// The least recently used bucket is the one most likely to have refilled
+		if l.lru.Len() >= l.maxBuckets {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*bucket).key)
+		}
+		b = &bucket{key: key, tokens: l.rates[class], last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+	l.refillLocked(b, class, now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = 0
+		l.mu.Unlock()
+		return Send
+	}
+
+	action := l.limitLocked(b)
+	l.mu.Unlock()
+	l.record(class, action)
+	return action
+}
+
+// clientPrefix returns the network grouping the client at addr, or false for
+// exempt clients and clients without an address.
+func (l *Limiter) clientPrefix(addr net.Addr) (netip.Prefix, bool) {
+	client, ok := acl.ClientAddr(addr)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	for _, prefix := range l.exempt {
+		if prefix.Contains(client) {
+			return netip.Prefix{}, false
+		}
+	}
+
+	bits := l.ipv4Prefix
+	if client.Is6() {
+		bits = l.ipv6Prefix
+	}
+	prefix, _ := client.Prefix(bits)
+	return prefix, true
+}
+
+// refillLocked adds tokens for the time since the last response, up to one second
+// worth.
+func (l *Limiter) refillLocked(b *bucket, class Class, now time.Time) {
+	rate := l.rates[class]
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+}
+
+// limitLocked counts a limited response of b and returns whether to drop or slip it.
+func (l *Limiter) limitLocked(b *bucket) Action {
+	b.limited++
+	if l.slip > 0 && b.limited%l.slip == 0 {
+		return Slip
+	}
+	return Drop
+}
+
+// record counts a limited response.
+func (l *Limiter) record(class Class, action Action) {
+	if l.metrics != nil {
+		l.metrics.RecordRateLimited(string(class), action.String())
+	}
+}
@@ -0,0 +1,179 @@
+package rrl
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/steigr/nameserver-switcher/internal/metrics"
+	"github.com/steigr/nameserver-switcher/internal/testhelper"
+)
+
+func newTestLimiter(t *testing.T, cfg Config) (*Limiter, *testhelper.Clock) {
+	t.Helper()
+	l, err := New(cfg)
+	require.NoError(t, err)
+	require.NotNil(t, l)
+	clock := testhelper.NewClock()
+	l.now = clock.Now
+	return l, clock
+}
+
+func client(ip string) net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func answer() *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.com.", dns.TypeA)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("192.0.2.1").To4(),
+	}}
+	return resp
+}
+
+func rcode(code int) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.com.", dns.TypeA)
+	resp.Rcode = code
+	return resp
+}
+
+// sent counts how many of n responses the limiter lets through.
+func sent(l *Limiter, addr net.Addr, resp *dns.Msg, n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if l.Check(addr, resp) == Send {
+			count++
+		}
+	}
+	return count
+}
+
+func TestClassify(t *testing.T) {
+	assert.Equal(t, ClassResponse, Classify(answer()))
+	assert.Equal(t, ClassNoData, Classify(rcode(dns.RcodeSuccess)))
+	assert.Equal(t, ClassNXDomain, Classify(rcode(dns.RcodeNameError)))
+	assert.Equal(t, ClassError, Classify(rcode(dns.RcodeServerFailure)))
+	assert.Equal(t, ClassError, Classify(rcode(dns.RcodeRefused)))
+}
+
+func TestNew(t *testing.T) {
+	l, err := New(Config{})
+	require.NoError(t, err)
+	assert.Nil(t, l, "no rate disables limiting")
+	assert.Equal(t, Send, l.Check(client("192.0.2.1"), answer()))
+
+	_, err = New(Config{ResponsesPerSecond: 5, Exempt: "10.0.0.0/99"})
+	assert.Error(t, err)
+	_, err = New(Config{ResponsesPerSecond: 5, IPv4PrefixLen: 33})
+	assert.Error(t, err)
+}
+
+func TestLimiter_TokenBucket(t *testing.T) {
+	l, clock := newTestLimiter(t, Config{ResponsesPerSecond: 5})
+	addr := client("192.0.2.1")
+
+	// A full bucket holds one second worth of responses
+	assert.Equal(t, 5, sent(l, addr, answer(), 10))
+
+	// Tokens refill at the configured rate
+	clock.Advance(200 * time.Millisecond)
+	assert.Equal(t, 1, sent(l, addr, answer(), 10))
+
+	// but never beyond one second worth
+	clock.Advance(time.Minute)
+	assert.Equal(t, 5, sent(l, addr, answer(), 10))
+}
+
+func TestLimiter_ClientPrefixes(t *testing.T) {
+	l, _ := newTestLimiter(t, Config{ResponsesPerSecond: 2, IPv4PrefixLen: 24, IPv6PrefixLen: 48})
+
+	// Clients in the same network share a bucket
+	assert.Equal(t, 2, sent(l, client("192.0.2.1"), answer(), 5))
+	assert.Equal(t, 0, sent(l, client("192.0.2.200"), answer(), 5))
+	assert.Equal(t, 2, sent(l, client("192.0.3.1"), answer(), 5))
+
+	assert.Equal(t, 2, sent(l, client("2001:db8:1:1::1"), answer(), 5))
+	assert.Equal(t, 0, sent(l, client("2001:db8:1:2::1"), answer(), 5))
+	assert.Equal(t, 2, sent(l, client("2001:db8:2::1"), answer(), 5))
+
+	// IPv4-mapped clients share the bucket of their IPv4 network
+	assert.Equal(t, 0, sent(l, client("::ffff:192.0.2.7"), answer(), 5))
+}
+
+func TestLimiter_ResponseClasses(t *testing.T) {
+	l, _ := newTestLimiter(t, Config{ResponsesPerSecond: 3, NXDomainsPerSecond: 1, ErrorsPerSecond: 2})
+	addr := client("192.0.2.1")
+
+	assert.Equal(t, 3, sent(l, addr, answer(), 5))
+	assert.Equal(t, 1, sent(l, addr, rcode(dns.RcodeNameError), 5))
+	assert.Equal(t, 2, sent(l, addr, rcode(dns.RcodeServerFailure), 5))
+	assert.Equal(t, 3, sent(l, addr, rcode(dns.RcodeSuccess), 5), "nodata uses the responses rate")
+}
+
+func TestLimiter_Slip(t *testing.T) {
+	m := metrics.NewMetrics("test_rrl_slip")
+	l, _ := newTestLimiter(t, Config{ResponsesPerSecond: 1, Slip: 2, Metrics: m})
+	addr := client("192.0.2.1")
+
+	require.Equal(t, Send, l.Check(addr, answer()))
+	assert.Equal(t, Drop, l.Check(addr, answer()))
+	assert.Equal(t, Slip, l.Check(addr, answer()))
+	assert.Equal(t, Drop, l.Check(addr, answer()))
+	assert.Equal(t, Slip, l.Check(addr, answer()))
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.RateLimited.WithLabelValues("response", "slip")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.RateLimited.WithLabelValues("response", "drop")))
+
+	// Slip 1 slips every limited response, slip 0 drops them
+	l, _ = newTestLimiter(t, Config{ResponsesPerSecond: 1, Slip: 1})
+	l.Check(addr, answer())
+	assert.Equal(t, Slip, l.Check(addr, answer()))
+	assert.Equal(t, Slip, l.Check(addr, answer()))
+
+	l, _ = newTestLimiter(t, Config{ResponsesPerSecond: 1})
+	l.Check(addr, answer())
+	assert.Equal(t, Drop, l.Check(addr, answer()))
+	assert.Equal(t, Drop, l.Check(addr, answer()))
+}
+
+func TestLimiter_Exempt(t *testing.T) {
+	l, _ := newTestLimiter(t, Config{ResponsesPerSecond: 1, Exempt: "10.0.0.0/8, 2001:db8::/32"})
+
+	assert.Equal(t, 5, sent(l, client("10.1.2.3"), answer(), 5))
+	assert.Equal(t, 5, sent(l, client("2001:db8::1"), answer(), 5))
+	assert.Equal(t, 1, sent(l, client("192.0.2.1"), answer(), 5))
+	assert.Equal(t, Send, l.Check(nil, answer()), "clients without an address are not limited")
+}
+
+func TestLimiter_MaxBuckets(t *testing.T) {
+	l, _ := newTestLimiter(t, Config{ResponsesPerSecond: 1, IPv4PrefixLen: 32, MaxBuckets: 2})
+	key := func(ip string) bucketKey {
+		return bucketKey{prefix: netip.MustParsePrefix(ip + "/32"), class: ClassResponse}
+	}
+
+	l.Check(client("192.0.2.1"), answer())
+	l.Check(client("192.0.2.2"), answer())
+	require.Len(t, l.buckets, 2)
+
+	// The least recently used bucket makes room for a new client
+	l.Check(client("192.0.2.1"), answer())
+	l.Check(client("192.0.2.3"), answer())
+	assert.Len(t, l.buckets, 2)
+	assert.Equal(t, 2, l.lru.Len())
+	assert.Contains(t, l.buckets, key("192.0.2.1"))
+	assert.Contains(t, l.buckets, key("192.0.2.3"))
+	assert.NotContains(t, l.buckets, key("192.0.2.2"))
+
+	// An evicted client starts over with a full bucket
+	assert.Equal(t, Send, l.Check(client("192.0.2.2"), answer()))
+	assert.NotContains(t, l.buckets, key("192.0.2.1"))
+}
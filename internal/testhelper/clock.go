@@ -0,0 +1,28 @@
+package testhelper
+
+import "time"
+
+// Clock is a manually advanced time source.
+type Clock struct {
+	now time.Time
+}
+
+// NewClock returns a clock stopped at a fixed point in time.
+func NewClock() *Clock {
+	return &Clock{now: time.Unix(1700000000, 0)}
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to t.
+func (c *Clock) Set(t time.Time) {
+	c.now = t
+}
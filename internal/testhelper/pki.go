@@ -0,0 +1,116 @@
+// Package testhelper provides helpers shared by the tests of several packages.
+package testhelper
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// PKI is a throwaway CA with a server and a client certificate for dns.test and
+// 127.0.0.1, written to files in a temporary directory.
+type PKI struct {
+	// CAFile holds the CA certificate, which CAPool contains.
+	CAFile string
+	CAPool *x509.CertPool
+	// ServerCertFile and ServerKeyFile hold the server certificate loaded in ServerCert.
+	ServerCertFile string
+	ServerKeyFile  string
+	ServerCert     tls.Certificate
+	// ClientCertFile and ClientKeyFile hold the client certificate loaded in ClientCert.
+	ClientCertFile string
+	ClientKeyFile  string
+	ClientCert     tls.Certificate
+
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	serial int64
+}
+
+// NewPKI creates a CA and issues a server and a client certificate.
+func NewPKI(t testing.TB) *PKI {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	p := &PKI{
+		CAFile:         filepath.Join(dir, "ca.pem"),
+		CAPool:         pool,
+		ServerCertFile: filepath.Join(dir, "server.pem"),
+		ServerKeyFile:  filepath.Join(dir, "server-key.pem"),
+		ClientCertFile: filepath.Join(dir, "client.pem"),
+		ClientKeyFile:  filepath.Join(dir, "client-key.pem"),
+		caCert:         caCert,
+		caKey:          caKey,
+		serial:         1,
+	}
+	require.NoError(t, os.WriteFile(p.CAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0o600))
+	p.WriteServerCert(t, "dns.test")
+	p.ClientCert = p.issue(t, "client", x509.ExtKeyUsageClientAuth, p.ClientCertFile, p.ClientKeyFile)
+	return p
+}
+
+// WriteServerCert issues a new server certificate with the given common name and
+// writes it over the server certificate files, as a renewal would.
+func (p *PKI) WriteServerCert(t testing.TB, commonName string) {
+	t.Helper()
+	p.ServerCert = p.issue(t, commonName, x509.ExtKeyUsageServerAuth, p.ServerCertFile, p.ServerKeyFile)
+}
+
+// issue signs a certificate for dns.test and 127.0.0.1 and writes it and its key to
+// certFile and keyFile.
+func (p *PKI) issue(t testing.TB, commonName string, usage x509.ExtKeyUsage, certFile, keyFile string) tls.Certificate {
+	t.Helper()
+	p.serial++
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"dns.test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.caCert, &key.PublicKey, p.caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
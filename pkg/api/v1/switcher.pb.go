@@ -588,6 +588,638 @@ func (x *GetStatsResponse) GetUptimeSeconds() uint64 {
 	return 0
 }
 
+// CacheEntry is a cached answer.
+type CacheEntry struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The query name.
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// The query type.
+	Type string `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	// Whether the answer is cached for queries with the DNSSEC OK bit.
+	DnssecOk bool `protobuf:"varint,3,opt,name=dnssec_ok,json=dnssecOk,proto3" json:"dnssec_ok,omitempty"`
+	// The rule that handled the query.
+	Rule string `protobuf:"bytes,4,opt,name=rule,proto3" json:"rule,omitempty"`
+	// Which resolver answered.
+	ResolverUsed string `protobuf:"bytes,5,opt,name=resolver_used,json=resolverUsed,proto3" json:"resolver_used,omitempty"`
+	// The DNS response code.
+	Rcode string `protobuf:"bytes,6,opt,name=rcode,proto3" json:"rcode,omitempty"`
+	// The cached records with their remaining TTLs.
+	Records []*DNSRecord `protobuf:"bytes,7,rep,name=records,proto3" json:"records,omitempty"`
+	// Seconds since the answer was cached.
+	AgeSeconds uint64 `protobuf:"varint,8,opt,name=age_seconds,json=ageSeconds,proto3" json:"age_seconds,omitempty"`
+	// Seconds until the answer expires.
+	ExpiresInSeconds uint64 `protobuf:"varint,9,opt,name=expires_in_seconds,json=expiresInSeconds,proto3" json:"expires_in_seconds,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *CacheEntry) Reset() {
+	*x = CacheEntry{}
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CacheEntry) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CacheEntry) ProtoMessage() {}
+
+func (x *CacheEntry) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CacheEntry.ProtoReflect.Descriptor instead.
+func (*CacheEntry) Descriptor() ([]byte, []int) {
+	return file_pkg_api_v1_switcher_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *CacheEntry) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *CacheEntry) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *CacheEntry) GetDnssecOk() bool {
+	if x != nil {
+		return x.DnssecOk
+	}
+	return false
+}
+
+func (x *CacheEntry) GetRule() string {
+	if x != nil {
+		return x.Rule
+	}
+	return ""
+}
+
+func (x *CacheEntry) GetResolverUsed() string {
+	if x != nil {
+		return x.ResolverUsed
+	}
+	return ""
+}
+
+func (x *CacheEntry) GetRcode() string {
+	if x != nil {
+		return x.Rcode
+	}
+	return ""
+}
+
+func (x *CacheEntry) GetRecords() []*DNSRecord {
+	if x != nil {
+		return x.Records
+	}
+	return nil
+}
+
+func (x *CacheEntry) GetAgeSeconds() uint64 {
+	if x != nil {
+		return x.AgeSeconds
+	}
+	return 0
+}
+
+func (x *CacheEntry) GetExpiresInSeconds() uint64 {
+	if x != nil {
+		return x.ExpiresInSeconds
+	}
+	return 0
+}
+
+// GetCacheEntryRequest identifies the cached answers to return.
+type GetCacheEntryRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The query name.
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// The query type (all types if empty).
+	Type          string `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetCacheEntryRequest) Reset() {
+	*x = GetCacheEntryRequest{}
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetCacheEntryRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetCacheEntryRequest) ProtoMessage() {}
+
+func (x *GetCacheEntryRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetCacheEntryRequest.ProtoReflect.Descriptor instead.
+func (*GetCacheEntryRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_api_v1_switcher_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *GetCacheEntryRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *GetCacheEntryRequest) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+// GetCacheEntryResponse contains the cached answers for the name.
+type GetCacheEntryResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Whether any answer is cached.
+	Found bool `protobuf:"varint,1,opt,name=found,proto3" json:"found,omitempty"`
+	// The cached answers, one per type, DNSSEC OK bit and rule.
+	Entries       []*CacheEntry `protobuf:"bytes,2,rep,name=entries,proto3" json:"entries,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetCacheEntryResponse) Reset() {
+	*x = GetCacheEntryResponse{}
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetCacheEntryResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetCacheEntryResponse) ProtoMessage() {}
+
+func (x *GetCacheEntryResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetCacheEntryResponse.ProtoReflect.Descriptor instead.
+func (*GetCacheEntryResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_api_v1_switcher_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *GetCacheEntryResponse) GetFound() bool {
+	if x != nil {
+		return x.Found
+	}
+	return false
+}
+
+func (x *GetCacheEntryResponse) GetEntries() []*CacheEntry {
+	if x != nil {
+		return x.Entries
+	}
+	return nil
+}
+
+// ListCacheEntriesRequest selects the cached answers to return.
+type ListCacheEntriesRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Regex matched against the name without the trailing dot (all names if empty).
+	Pattern string `protobuf:"bytes,1,opt,name=pattern,proto3" json:"pattern,omitempty"`
+	// Maximum number of entries to return (all if 0).
+	Limit         uint32 `protobuf:"varint,2,opt,name=limit,proto3" json:"limit,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListCacheEntriesRequest) Reset() {
+	*x = ListCacheEntriesRequest{}
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListCacheEntriesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListCacheEntriesRequest) ProtoMessage() {}
+
+func (x *ListCacheEntriesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListCacheEntriesRequest.ProtoReflect.Descriptor instead.
+func (*ListCacheEntriesRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_api_v1_switcher_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *ListCacheEntriesRequest) GetPattern() string {
+	if x != nil {
+		return x.Pattern
+	}
+	return ""
+}
+
+func (x *ListCacheEntriesRequest) GetLimit() uint32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+// ListCacheEntriesResponse contains the matching cached answers.
+type ListCacheEntriesResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The matching cached answers.
+	Entries []*CacheEntry `protobuf:"bytes,1,rep,name=entries,proto3" json:"entries,omitempty"`
+	// Number of matching answers, which exceeds the entries returned when limited.
+	Total         uint64 `protobuf:"varint,2,opt,name=total,proto3" json:"total,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListCacheEntriesResponse) Reset() {
+	*x = ListCacheEntriesResponse{}
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListCacheEntriesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListCacheEntriesResponse) ProtoMessage() {}
+
+func (x *ListCacheEntriesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListCacheEntriesResponse.ProtoReflect.Descriptor instead.
+func (*ListCacheEntriesResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_api_v1_switcher_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *ListCacheEntriesResponse) GetEntries() []*CacheEntry {
+	if x != nil {
+		return x.Entries
+	}
+	return nil
+}
+
+func (x *ListCacheEntriesResponse) GetTotal() uint64 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+// FlushCacheNameRequest identifies the name to flush.
+type FlushCacheNameRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The query name.
+	Name          string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FlushCacheNameRequest) Reset() {
+	*x = FlushCacheNameRequest{}
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FlushCacheNameRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FlushCacheNameRequest) ProtoMessage() {}
+
+func (x *FlushCacheNameRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FlushCacheNameRequest.ProtoReflect.Descriptor instead.
+func (*FlushCacheNameRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_api_v1_switcher_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *FlushCacheNameRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+// FlushCacheRequest selects the cached answers to flush. At least one field must be set;
+// when both are, answers must match both.
+type FlushCacheRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Regex matched against the name without the trailing dot.
+	Pattern string `protobuf:"bytes,1,opt,name=pattern,proto3" json:"pattern,omitempty"`
+	// Name of the resolver that answered.
+	Resolver      string `protobuf:"bytes,2,opt,name=resolver,proto3" json:"resolver,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FlushCacheRequest) Reset() {
+	*x = FlushCacheRequest{}
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FlushCacheRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FlushCacheRequest) ProtoMessage() {}
+
+func (x *FlushCacheRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FlushCacheRequest.ProtoReflect.Descriptor instead.
+func (*FlushCacheRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_api_v1_switcher_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *FlushCacheRequest) GetPattern() string {
+	if x != nil {
+		return x.Pattern
+	}
+	return ""
+}
+
+func (x *FlushCacheRequest) GetResolver() string {
+	if x != nil {
+		return x.Resolver
+	}
+	return ""
+}
+
+// FlushCacheResponse indicates the result of a flush.
+type FlushCacheResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Whether the flush was successful.
+	Success bool `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
+	// Error message if unsuccessful.
+	Error string `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+	// Number of cached answers removed.
+	Flushed       uint64 `protobuf:"varint,3,opt,name=flushed,proto3" json:"flushed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FlushCacheResponse) Reset() {
+	*x = FlushCacheResponse{}
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FlushCacheResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FlushCacheResponse) ProtoMessage() {}
+
+func (x *FlushCacheResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FlushCacheResponse.ProtoReflect.Descriptor instead.
+func (*FlushCacheResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_api_v1_switcher_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *FlushCacheResponse) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *FlushCacheResponse) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *FlushCacheResponse) GetFlushed() uint64 {
+	if x != nil {
+		return x.Flushed
+	}
+	return 0
+}
+
+// GetCacheStatsRequest is empty - no parameters needed.
+type GetCacheStatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetCacheStatsRequest) Reset() {
+	*x = GetCacheStatsRequest{}
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetCacheStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetCacheStatsRequest) ProtoMessage() {}
+
+func (x *GetCacheStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetCacheStatsRequest.ProtoReflect.Descriptor instead.
+func (*GetCacheStatsRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_api_v1_switcher_proto_rawDescGZIP(), []int{17}
+}
+
+// GetCacheStatsResponse contains response cache statistics.
+type GetCacheStatsResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Whether the response cache is enabled.
+	Enabled bool `protobuf:"varint,1,opt,name=enabled,proto3" json:"enabled,omitempty"`
+	// Number of cached answers.
+	Entries uint64 `protobuf:"varint,2,opt,name=entries,proto3" json:"entries,omitempty"`
+	// Maximum number of cached answers.
+	Capacity uint64 `protobuf:"varint,3,opt,name=capacity,proto3" json:"capacity,omitempty"`
+	// Queries answered from the cache.
+	Hits uint64 `protobuf:"varint,4,opt,name=hits,proto3" json:"hits,omitempty"`
+	// Cache lookups without a usable entry.
+	Misses uint64 `protobuf:"varint,5,opt,name=misses,proto3" json:"misses,omitempty"`
+	// Entries evicted to stay within the capacity.
+	Evictions     uint64 `protobuf:"varint,6,opt,name=evictions,proto3" json:"evictions,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetCacheStatsResponse) Reset() {
+	*x = GetCacheStatsResponse{}
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetCacheStatsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetCacheStatsResponse) ProtoMessage() {}
+
+func (x *GetCacheStatsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_v1_switcher_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetCacheStatsResponse.ProtoReflect.Descriptor instead.
+func (*GetCacheStatsResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_api_v1_switcher_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *GetCacheStatsResponse) GetEnabled() bool {
+	if x != nil {
+		return x.Enabled
+	}
+	return false
+}
+
+func (x *GetCacheStatsResponse) GetEntries() uint64 {
+	if x != nil {
+		return x.Entries
+	}
+	return 0
+}
+
+func (x *GetCacheStatsResponse) GetCapacity() uint64 {
+	if x != nil {
+		return x.Capacity
+	}
+	return 0
+}
+
+func (x *GetCacheStatsResponse) GetHits() uint64 {
+	if x != nil {
+		return x.Hits
+	}
+	return 0
+}
+
+func (x *GetCacheStatsResponse) GetMisses() uint64 {
+	if x != nil {
+		return x.Misses
+	}
+	return 0
+}
+
+func (x *GetCacheStatsResponse) GetEvictions() uint64 {
+	if x != nil {
+		return x.Evictions
+	}
+	return 0
+}
+
 var File_pkg_api_v1_switcher_proto protoreflect.FileDescriptor
 
 const file_pkg_api_v1_switcher_proto_rawDesc = "" +
@@ -636,13 +1268,60 @@ const file_pkg_api_v1_switcher_proto_rawDesc = "" +
 	"\x05value\x18\x02 \x01(\x04R\x05value:\x028\x01\x1a?\n" +
 	"\x11CnameMatchesEntry\x12\x10\n" +
 	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
-	"\x05value\x18\x02 \x01(\x04R\x05value:\x028\x012\x86\x03\n" +
+	"\x05value\x18\x02 \x01(\x04R\x05value:\x028\x01\"\x9c\x02\n" +
+	"\n" +
+	"CacheEntry\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04type\x12\x1b\n" +
+	"\tdnssec_ok\x18\x03 \x01(\bR\bdnssecOk\x12\x12\n" +
+	"\x04rule\x18\x04 \x01(\tR\x04rule\x12#\n" +
+	"\rresolver_used\x18\x05 \x01(\tR\fresolverUsed\x12\x14\n" +
+	"\x05rcode\x18\x06 \x01(\tR\x05rcode\x12+\n" +
+	"\arecords\x18\a \x03(\v2\x11.api.v1.DNSRecordR\arecords\x12\x1f\n" +
+	"\vage_seconds\x18\b \x01(\x04R\n" +
+	"ageSeconds\x12,\n" +
+	"\x12expires_in_seconds\x18\t \x01(\x04R\x10expiresInSeconds\">\n" +
+	"\x14GetCacheEntryRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04type\"[\n" +
+	"\x15GetCacheEntryResponse\x12\x14\n" +
+	"\x05found\x18\x01 \x01(\bR\x05found\x12,\n" +
+	"\aentries\x18\x02 \x03(\v2\x12.api.v1.CacheEntryR\aentries\"I\n" +
+	"\x17ListCacheEntriesRequest\x12\x18\n" +
+	"\apattern\x18\x01 \x01(\tR\apattern\x12\x14\n" +
+	"\x05limit\x18\x02 \x01(\rR\x05limit\"^\n" +
+	"\x18ListCacheEntriesResponse\x12,\n" +
+	"\aentries\x18\x01 \x03(\v2\x12.api.v1.CacheEntryR\aentries\x12\x14\n" +
+	"\x05total\x18\x02 \x01(\x04R\x05total\"+\n" +
+	"\x15FlushCacheNameRequest\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\"I\n" +
+	"\x11FlushCacheRequest\x12\x18\n" +
+	"\apattern\x18\x01 \x01(\tR\apattern\x12\x1a\n" +
+	"\bresolver\x18\x02 \x01(\tR\bresolver\"^\n" +
+	"\x12FlushCacheResponse\x12\x18\n" +
+	"\asuccess\x18\x01 \x01(\bR\asuccess\x12\x14\n" +
+	"\x05error\x18\x02 \x01(\tR\x05error\x12\x18\n" +
+	"\aflushed\x18\x03 \x01(\x04R\aflushed\"\x16\n" +
+	"\x14GetCacheStatsRequest\"\xb1\x01\n" +
+	"\x15GetCacheStatsResponse\x12\x18\n" +
+	"\aenabled\x18\x01 \x01(\bR\aenabled\x12\x18\n" +
+	"\aentries\x18\x02 \x01(\x04R\aentries\x12\x1a\n" +
+	"\bcapacity\x18\x03 \x01(\x04R\bcapacity\x12\x12\n" +
+	"\x04hits\x18\x04 \x01(\x04R\x04hits\x12\x16\n" +
+	"\x06misses\x18\x05 \x01(\x04R\x06misses\x12\x1c\n" +
+	"\tevictions\x18\x06 \x01(\x04R\tevictions2\x8b\x06\n" +
 	"\x19NameserverSwitcherService\x12:\n" +
 	"\aResolve\x12\x16.api.v1.ResolveRequest\x1a\x17.api.v1.ResolveResponse\x12@\n" +
 	"\tGetConfig\x12\x18.api.v1.GetConfigRequest\x1a\x19.api.v1.GetConfigResponse\x12V\n" +
 	"\x15UpdateRequestPatterns\x12\x1d.api.v1.UpdatePatternsRequest\x1a\x1e.api.v1.UpdatePatternsResponse\x12T\n" +
 	"\x13UpdateCNAMEPatterns\x12\x1d.api.v1.UpdatePatternsRequest\x1a\x1e.api.v1.UpdatePatternsResponse\x12=\n" +
-	"\bGetStats\x12\x17.api.v1.GetStatsRequest\x1a\x18.api.v1.GetStatsResponseB2Z0github.com/steigr/nameserver-switcher/pkg/api/v1b\x06proto3"
+	"\bGetStats\x12\x17.api.v1.GetStatsRequest\x1a\x18.api.v1.GetStatsResponse\x12L\n" +
+	"\rGetCacheEntry\x12\x1c.api.v1.GetCacheEntryRequest\x1a\x1d.api.v1.GetCacheEntryResponse\x12U\n" +
+	"\x10ListCacheEntries\x12\x1f.api.v1.ListCacheEntriesRequest\x1a .api.v1.ListCacheEntriesResponse\x12K\n" +
+	"\x0eFlushCacheName\x12\x1d.api.v1.FlushCacheNameRequest\x1a\x1a.api.v1.FlushCacheResponse\x12C\n" +
+	"\n" +
+	"FlushCache\x12\x19.api.v1.FlushCacheRequest\x1a\x1a.api.v1.FlushCacheResponse\x12L\n" +
+	"\rGetCacheStats\x12\x1c.api.v1.GetCacheStatsRequest\x1a\x1d.api.v1.GetCacheStatsResponseB2Z0github.com/steigr/nameserver-switcher/pkg/api/v1b\x06proto3"
 
 var (
 	file_pkg_api_v1_switcher_proto_rawDescOnce sync.Once
@@ -656,41 +1335,64 @@ func file_pkg_api_v1_switcher_proto_rawDescGZIP() []byte {
 	return file_pkg_api_v1_switcher_proto_rawDescData
 }
 
-var file_pkg_api_v1_switcher_proto_msgTypes = make([]protoimpl.MessageInfo, 12)
+var file_pkg_api_v1_switcher_proto_msgTypes = make([]protoimpl.MessageInfo, 22)
 var file_pkg_api_v1_switcher_proto_goTypes = []any{
-	(*ResolveRequest)(nil),         // 0: api.v1.ResolveRequest
-	(*ResolveResponse)(nil),        // 1: api.v1.ResolveResponse
-	(*DNSRecord)(nil),              // 2: api.v1.DNSRecord
-	(*GetConfigRequest)(nil),       // 3: api.v1.GetConfigRequest
-	(*GetConfigResponse)(nil),      // 4: api.v1.GetConfigResponse
-	(*UpdatePatternsRequest)(nil),  // 5: api.v1.UpdatePatternsRequest
-	(*UpdatePatternsResponse)(nil), // 6: api.v1.UpdatePatternsResponse
-	(*GetStatsRequest)(nil),        // 7: api.v1.GetStatsRequest
-	(*GetStatsResponse)(nil),       // 8: api.v1.GetStatsResponse
-	nil,                            // 9: api.v1.GetStatsResponse.RequestsByResolverEntry
-	nil,                            // 10: api.v1.GetStatsResponse.PatternMatchesEntry
-	nil,                            // 11: api.v1.GetStatsResponse.CnameMatchesEntry
+	(*ResolveRequest)(nil),           // 0: api.v1.ResolveRequest
+	(*ResolveResponse)(nil),          // 1: api.v1.ResolveResponse
+	(*DNSRecord)(nil),                // 2: api.v1.DNSRecord
+	(*GetConfigRequest)(nil),         // 3: api.v1.GetConfigRequest
+	(*GetConfigResponse)(nil),        // 4: api.v1.GetConfigResponse
+	(*UpdatePatternsRequest)(nil),    // 5: api.v1.UpdatePatternsRequest
+	(*UpdatePatternsResponse)(nil),   // 6: api.v1.UpdatePatternsResponse
+	(*GetStatsRequest)(nil),          // 7: api.v1.GetStatsRequest
+	(*GetStatsResponse)(nil),         // 8: api.v1.GetStatsResponse
+	(*CacheEntry)(nil),               // 9: api.v1.CacheEntry
+	(*GetCacheEntryRequest)(nil),     // 10: api.v1.GetCacheEntryRequest
+	(*GetCacheEntryResponse)(nil),    // 11: api.v1.GetCacheEntryResponse
+	(*ListCacheEntriesRequest)(nil),  // 12: api.v1.ListCacheEntriesRequest
+	(*ListCacheEntriesResponse)(nil), // 13: api.v1.ListCacheEntriesResponse
+	(*FlushCacheNameRequest)(nil),    // 14: api.v1.FlushCacheNameRequest
+	(*FlushCacheRequest)(nil),        // 15: api.v1.FlushCacheRequest
+	(*FlushCacheResponse)(nil),       // 16: api.v1.FlushCacheResponse
+	(*GetCacheStatsRequest)(nil),     // 17: api.v1.GetCacheStatsRequest
+	(*GetCacheStatsResponse)(nil),    // 18: api.v1.GetCacheStatsResponse
+	nil,                              // 19: api.v1.GetStatsResponse.RequestsByResolverEntry
+	nil,                              // 20: api.v1.GetStatsResponse.PatternMatchesEntry
+	nil,                              // 21: api.v1.GetStatsResponse.CnameMatchesEntry
 }
 var file_pkg_api_v1_switcher_proto_depIdxs = []int32{
 	2,  // 0: api.v1.ResolveResponse.records:type_name -> api.v1.DNSRecord
-	9,  // 1: api.v1.GetStatsResponse.requests_by_resolver:type_name -> api.v1.GetStatsResponse.RequestsByResolverEntry
-	10, // 2: api.v1.GetStatsResponse.pattern_matches:type_name -> api.v1.GetStatsResponse.PatternMatchesEntry
-	11, // 3: api.v1.GetStatsResponse.cname_matches:type_name -> api.v1.GetStatsResponse.CnameMatchesEntry
-	0,  // 4: api.v1.NameserverSwitcherService.Resolve:input_type -> api.v1.ResolveRequest
-	3,  // 5: api.v1.NameserverSwitcherService.GetConfig:input_type -> api.v1.GetConfigRequest
-	5,  // 6: api.v1.NameserverSwitcherService.UpdateRequestPatterns:input_type -> api.v1.UpdatePatternsRequest
-	5,  // 7: api.v1.NameserverSwitcherService.UpdateCNAMEPatterns:input_type -> api.v1.UpdatePatternsRequest
-	7,  // 8: api.v1.NameserverSwitcherService.GetStats:input_type -> api.v1.GetStatsRequest
-	1,  // 9: api.v1.NameserverSwitcherService.Resolve:output_type -> api.v1.ResolveResponse
-	4,  // 10: api.v1.NameserverSwitcherService.GetConfig:output_type -> api.v1.GetConfigResponse
-	6,  // 11: api.v1.NameserverSwitcherService.UpdateRequestPatterns:output_type -> api.v1.UpdatePatternsResponse
-	6,  // 12: api.v1.NameserverSwitcherService.UpdateCNAMEPatterns:output_type -> api.v1.UpdatePatternsResponse
-	8,  // 13: api.v1.NameserverSwitcherService.GetStats:output_type -> api.v1.GetStatsResponse
-	9,  // [9:14] is the sub-list for method output_type
-	4,  // [4:9] is the sub-list for method input_type
-	4,  // [4:4] is the sub-list for extension type_name
-	4,  // [4:4] is the sub-list for extension extendee
-	0,  // [0:4] is the sub-list for field type_name
+	19, // 1: api.v1.GetStatsResponse.requests_by_resolver:type_name -> api.v1.GetStatsResponse.RequestsByResolverEntry
+	20, // 2: api.v1.GetStatsResponse.pattern_matches:type_name -> api.v1.GetStatsResponse.PatternMatchesEntry
+	21, // 3: api.v1.GetStatsResponse.cname_matches:type_name -> api.v1.GetStatsResponse.CnameMatchesEntry
+	2,  // 4: api.v1.CacheEntry.records:type_name -> api.v1.DNSRecord
+	9,  // 5: api.v1.GetCacheEntryResponse.entries:type_name -> api.v1.CacheEntry
+	9,  // 6: api.v1.ListCacheEntriesResponse.entries:type_name -> api.v1.CacheEntry
+	0,  // 7: api.v1.NameserverSwitcherService.Resolve:input_type -> api.v1.ResolveRequest
+	3,  // 8: api.v1.NameserverSwitcherService.GetConfig:input_type -> api.v1.GetConfigRequest
+	5,  // 9: api.v1.NameserverSwitcherService.UpdateRequestPatterns:input_type -> api.v1.UpdatePatternsRequest
+	5,  // 10: api.v1.NameserverSwitcherService.UpdateCNAMEPatterns:input_type -> api.v1.UpdatePatternsRequest
+	7,  // 11: api.v1.NameserverSwitcherService.GetStats:input_type -> api.v1.GetStatsRequest
+	10, // 12: api.v1.NameserverSwitcherService.GetCacheEntry:input_type -> api.v1.GetCacheEntryRequest
+	12, // 13: api.v1.NameserverSwitcherService.ListCacheEntries:input_type -> api.v1.ListCacheEntriesRequest
+	14, // 14: api.v1.NameserverSwitcherService.FlushCacheName:input_type -> api.v1.FlushCacheNameRequest
+	15, // 15: api.v1.NameserverSwitcherService.FlushCache:input_type -> api.v1.FlushCacheRequest
+	17, // 16: api.v1.NameserverSwitcherService.GetCacheStats:input_type -> api.v1.GetCacheStatsRequest
+	1,  // 17: api.v1.NameserverSwitcherService.Resolve:output_type -> api.v1.ResolveResponse
+	4,  // 18: api.v1.NameserverSwitcherService.GetConfig:output_type -> api.v1.GetConfigResponse
+	6,  // 19: api.v1.NameserverSwitcherService.UpdateRequestPatterns:output_type -> api.v1.UpdatePatternsResponse
+	6,  // 20: api.v1.NameserverSwitcherService.UpdateCNAMEPatterns:output_type -> api.v1.UpdatePatternsResponse
+	8,  // 21: api.v1.NameserverSwitcherService.GetStats:output_type -> api.v1.GetStatsResponse
+	11, // 22: api.v1.NameserverSwitcherService.GetCacheEntry:output_type -> api.v1.GetCacheEntryResponse
+	13, // 23: api.v1.NameserverSwitcherService.ListCacheEntries:output_type -> api.v1.ListCacheEntriesResponse
+	16, // 24: api.v1.NameserverSwitcherService.FlushCacheName:output_type -> api.v1.FlushCacheResponse
+	16, // 25: api.v1.NameserverSwitcherService.FlushCache:output_type -> api.v1.FlushCacheResponse
+	18, // 26: api.v1.NameserverSwitcherService.GetCacheStats:output_type -> api.v1.GetCacheStatsResponse
+	17, // [17:27] is the sub-list for method output_type
+	7,  // [7:17] is the sub-list for method input_type
+	7,  // [7:7] is the sub-list for extension type_name
+	7,  // [7:7] is the sub-list for extension extendee
+	0,  // [0:7] is the sub-list for field type_name
 }
 
 func init() { file_pkg_api_v1_switcher_proto_init() }
@@ -704,7 +1406,7 @@ func file_pkg_api_v1_switcher_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_pkg_api_v1_switcher_proto_rawDesc), len(file_pkg_api_v1_switcher_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   12,
+			NumMessages:   22,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -24,6 +24,11 @@ const (
 	NameserverSwitcherService_UpdateRequestPatterns_FullMethodName = "/api.v1.NameserverSwitcherService/UpdateRequestPatterns"
 	NameserverSwitcherService_UpdateCNAMEPatterns_FullMethodName   = "/api.v1.NameserverSwitcherService/UpdateCNAMEPatterns"
 	NameserverSwitcherService_GetStats_FullMethodName              = "/api.v1.NameserverSwitcherService/GetStats"
+	NameserverSwitcherService_GetCacheEntry_FullMethodName         = "/api.v1.NameserverSwitcherService/GetCacheEntry"
+	NameserverSwitcherService_ListCacheEntries_FullMethodName      = "/api.v1.NameserverSwitcherService/ListCacheEntries"
+	NameserverSwitcherService_FlushCacheName_FullMethodName        = "/api.v1.NameserverSwitcherService/FlushCacheName"
+	NameserverSwitcherService_FlushCache_FullMethodName            = "/api.v1.NameserverSwitcherService/FlushCache"
+	NameserverSwitcherService_GetCacheStats_FullMethodName         = "/api.v1.NameserverSwitcherService/GetCacheStats"
 )
 
 // NameserverSwitcherServiceClient is the client API for NameserverSwitcherService service.
@@ -42,6 +47,16 @@ type NameserverSwitcherServiceClient interface {
 	UpdateCNAMEPatterns(ctx context.Context, in *UpdatePatternsRequest, opts ...grpc.CallOption) (*UpdatePatternsResponse, error)
 	// GetStats returns current statistics.
 	GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*GetStatsResponse, error)
+	// GetCacheEntry returns the cached answers for a name.
+	GetCacheEntry(ctx context.Context, in *GetCacheEntryRequest, opts ...grpc.CallOption) (*GetCacheEntryResponse, error)
+	// ListCacheEntries returns the cached answers whose name matches a pattern.
+	ListCacheEntries(ctx context.Context, in *ListCacheEntriesRequest, opts ...grpc.CallOption) (*ListCacheEntriesResponse, error)
+	// FlushCacheName removes the cached answers for a name.
+	FlushCacheName(ctx context.Context, in *FlushCacheNameRequest, opts ...grpc.CallOption) (*FlushCacheResponse, error)
+	// FlushCache removes the cached answers matching a pattern or answered by a resolver.
+	FlushCache(ctx context.Context, in *FlushCacheRequest, opts ...grpc.CallOption) (*FlushCacheResponse, error)
+	// GetCacheStats returns the response cache statistics.
+	GetCacheStats(ctx context.Context, in *GetCacheStatsRequest, opts ...grpc.CallOption) (*GetCacheStatsResponse, error)
 }
 
 type nameserverSwitcherServiceClient struct {
@@ -102,6 +117,56 @@ func (c *nameserverSwitcherServiceClient) GetStats(ctx context.Context, in *GetS
 	return out, nil
 }
 
+func (c *nameserverSwitcherServiceClient) GetCacheEntry(ctx context.Context, in *GetCacheEntryRequest, opts ...grpc.CallOption) (*GetCacheEntryResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetCacheEntryResponse)
+	err := c.cc.Invoke(ctx, NameserverSwitcherService_GetCacheEntry_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nameserverSwitcherServiceClient) ListCacheEntries(ctx context.Context, in *ListCacheEntriesRequest, opts ...grpc.CallOption) (*ListCacheEntriesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListCacheEntriesResponse)
+	err := c.cc.Invoke(ctx, NameserverSwitcherService_ListCacheEntries_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nameserverSwitcherServiceClient) FlushCacheName(ctx context.Context, in *FlushCacheNameRequest, opts ...grpc.CallOption) (*FlushCacheResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FlushCacheResponse)
+	err := c.cc.Invoke(ctx, NameserverSwitcherService_FlushCacheName_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nameserverSwitcherServiceClient) FlushCache(ctx context.Context, in *FlushCacheRequest, opts ...grpc.CallOption) (*FlushCacheResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FlushCacheResponse)
+	err := c.cc.Invoke(ctx, NameserverSwitcherService_FlushCache_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nameserverSwitcherServiceClient) GetCacheStats(ctx context.Context, in *GetCacheStatsRequest, opts ...grpc.CallOption) (*GetCacheStatsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetCacheStatsResponse)
+	err := c.cc.Invoke(ctx, NameserverSwitcherService_GetCacheStats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // NameserverSwitcherServiceServer is the server API for NameserverSwitcherService service.
 // All implementations must embed UnimplementedNameserverSwitcherServiceServer
 // for forward compatibility.
@@ -118,6 +183,16 @@ type NameserverSwitcherServiceServer interface {
 	UpdateCNAMEPatterns(context.Context, *UpdatePatternsRequest) (*UpdatePatternsResponse, error)
 	// GetStats returns current statistics.
 	GetStats(context.Context, *GetStatsRequest) (*GetStatsResponse, error)
+	// GetCacheEntry returns the cached answers for a name.
+	GetCacheEntry(context.Context, *GetCacheEntryRequest) (*GetCacheEntryResponse, error)
+	// ListCacheEntries returns the cached answers whose name matches a pattern.
+	ListCacheEntries(context.Context, *ListCacheEntriesRequest) (*ListCacheEntriesResponse, error)
+	// FlushCacheName removes the cached answers for a name.
+	FlushCacheName(context.Context, *FlushCacheNameRequest) (*FlushCacheResponse, error)
+	// FlushCache removes the cached answers matching a pattern or answered by a resolver.
+	FlushCache(context.Context, *FlushCacheRequest) (*FlushCacheResponse, error)
+	// GetCacheStats returns the response cache statistics.
+	GetCacheStats(context.Context, *GetCacheStatsRequest) (*GetCacheStatsResponse, error)
 	mustEmbedUnimplementedNameserverSwitcherServiceServer()
 }
 
@@ -143,6 +218,21 @@ func (UnimplementedNameserverSwitcherServiceServer) UpdateCNAMEPatterns(context.
 func (UnimplementedNameserverSwitcherServiceServer) GetStats(context.Context, *GetStatsRequest) (*GetStatsResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "method GetStats not implemented")
 }
+func (UnimplementedNameserverSwitcherServiceServer) GetCacheEntry(context.Context, *GetCacheEntryRequest) (*GetCacheEntryResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetCacheEntry not implemented")
+}
+func (UnimplementedNameserverSwitcherServiceServer) ListCacheEntries(context.Context, *ListCacheEntriesRequest) (*ListCacheEntriesResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ListCacheEntries not implemented")
+}
+func (UnimplementedNameserverSwitcherServiceServer) FlushCacheName(context.Context, *FlushCacheNameRequest) (*FlushCacheResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method FlushCacheName not implemented")
+}
+func (UnimplementedNameserverSwitcherServiceServer) FlushCache(context.Context, *FlushCacheRequest) (*FlushCacheResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method FlushCache not implemented")
+}
+func (UnimplementedNameserverSwitcherServiceServer) GetCacheStats(context.Context, *GetCacheStatsRequest) (*GetCacheStatsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetCacheStats not implemented")
+}
 func (UnimplementedNameserverSwitcherServiceServer) mustEmbedUnimplementedNameserverSwitcherServiceServer() {
 }
 func (UnimplementedNameserverSwitcherServiceServer) testEmbeddedByValue() {}
@@ -255,6 +345,96 @@ func _NameserverSwitcherService_GetStats_Handler(srv interface{}, ctx context.Co
 	return interceptor(ctx, in, info, handler)
 }
 
+func _NameserverSwitcherService_GetCacheEntry_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCacheEntryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NameserverSwitcherServiceServer).GetCacheEntry(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NameserverSwitcherService_GetCacheEntry_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NameserverSwitcherServiceServer).GetCacheEntry(ctx, req.(*GetCacheEntryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NameserverSwitcherService_ListCacheEntries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListCacheEntriesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NameserverSwitcherServiceServer).ListCacheEntries(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NameserverSwitcherService_ListCacheEntries_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NameserverSwitcherServiceServer).ListCacheEntries(ctx, req.(*ListCacheEntriesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NameserverSwitcherService_FlushCacheName_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FlushCacheNameRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NameserverSwitcherServiceServer).FlushCacheName(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NameserverSwitcherService_FlushCacheName_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NameserverSwitcherServiceServer).FlushCacheName(ctx, req.(*FlushCacheNameRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NameserverSwitcherService_FlushCache_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FlushCacheRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NameserverSwitcherServiceServer).FlushCache(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NameserverSwitcherService_FlushCache_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NameserverSwitcherServiceServer).FlushCache(ctx, req.(*FlushCacheRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NameserverSwitcherService_GetCacheStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCacheStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NameserverSwitcherServiceServer).GetCacheStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NameserverSwitcherService_GetCacheStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NameserverSwitcherServiceServer).GetCacheStats(ctx, req.(*GetCacheStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // NameserverSwitcherService_ServiceDesc is the grpc.ServiceDesc for NameserverSwitcherService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -282,6 +462,26 @@ var NameserverSwitcherService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetStats",
 			Handler:    _NameserverSwitcherService_GetStats_Handler,
 		},
+		{
+			MethodName: "GetCacheEntry",
+			Handler:    _NameserverSwitcherService_GetCacheEntry_Handler,
+		},
+		{
+			MethodName: "ListCacheEntries",
+			Handler:    _NameserverSwitcherService_ListCacheEntries_Handler,
+		},
+		{
+			MethodName: "FlushCacheName",
+			Handler:    _NameserverSwitcherService_FlushCacheName_Handler,
+		},
+		{
+			MethodName: "FlushCache",
+			Handler:    _NameserverSwitcherService_FlushCache_Handler,
+		},
+		{
+			MethodName: "GetCacheStats",
+			Handler:    _NameserverSwitcherService_GetCacheStats_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/api/v1/switcher.proto",